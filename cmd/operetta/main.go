@@ -1,52 +1,190 @@
 package main
 
 import (
-    "flag"
-    "log"
-    "net"
-    "net/http"
-    "os"
-    "time"
-
-    "operetta/internal/proxy"
-    "operetta/oms"
+	"context"
+	"errors"
+	"flag"
+	"log"
+	"log/slog"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"operetta/internal/proxy"
+	"operetta/oms"
 )
 
 func main() {
+	configPath := flag.String("config", os.Getenv("OMS_CONFIG"), "JSON config file; OMS_* env vars override its values (env OMS_CONFIG)")
 	addrFlag := flag.String("addr", ":8081", "listen address, e.g. :81 or 0.0.0.0:8081")
+	tlsCertFlag := flag.String("tls-cert", "", "PEM certificate file(s), comma-separated for SNI (env OMS_TLS_CERT)")
+	tlsKeyFlag := flag.String("tls-key", "", "PEM key file(s) matching -tls-cert (env OMS_TLS_KEY)")
+	tlsAddrFlag := flag.String("tls-addr", "", "HTTPS listen address for the admin, metrics and debug routes; when empty and a certificate is set, -addr serves HTTPS (env OMS_TLS_ADDR)")
+	drainFlag := flag.Duration("shutdown-timeout", 30*time.Second, "how long SIGTERM waits for in-flight requests before closing connections")
 	flag.Parse()
-	
-	oms.ProxyCookieJarStore = proxy.CookieJarStoreInstance
-    oms.ProxyDeriveClientKey = proxy.DeriveUpstreamClientKey
+
+	fc := &proxy.FileConfig{}
+	if *configPath != "" {
+		var err error
+		if fc, err = proxy.ReadConfigFile(*configPath); err != nil {
+			log.Fatalf("Config: %v", err)
+		}
+	}
+	explicit := map[string]bool{}
+	flag.Visit(func(f *flag.Flag) { explicit[f.Name] = true })
+	// Precedence: explicit flag, then environment, then config file.
+	setting := func(name, flagVal, env, fileVal string) string {
+		if explicit[name] {
+			return flagVal
+		}
+		if v := os.Getenv(env); v != "" {
+			return v
+		}
+		return fileVal
+	}
 
 	addr := *addrFlag
+	if !explicit["addr"] && fc.Addr != "" {
+		addr = fc.Addr
+	}
 	if env := os.Getenv("PORT"); env != "" {
 		addr = ":" + env
 	}
+	tlsCert := setting("tls-cert", *tlsCertFlag, "OMS_TLS_CERT", fc.TLSCert)
+	tlsKey := setting("tls-key", *tlsKeyFlag, "OMS_TLS_KEY", fc.TLSKey)
+	tlsAddr := setting("tls-addr", *tlsAddrFlag, "OMS_TLS_ADDR", fc.TLSAddr)
+	drainTimeout := *drainFlag
+	if !explicit["shutdown-timeout"] {
+		drainTimeout = fc.ShutdownDuration(drainTimeout)
+	}
 
-	log.SetFlags(log.LstdFlags | log.Lmicroseconds)
-	log.SetOutput(os.Stdout)
-
-	handler := proxy.NewServer()
-    srv := &http.Server{
-        Addr:         addr,
-        Handler:      handler,
-        // Conservative timeouts to avoid slowloris and leaked connections blocking the server
-        ReadHeaderTimeout: 5 * time.Second,
-        ReadTimeout:       30 * time.Second,
-        WriteTimeout:      2 * time.Minute,
-        IdleTimeout:       60 * time.Second,
-        ErrorLog:     log.New(os.Stdout, "HTTPERR ", log.LstdFlags|log.Lmicroseconds),
-        ConnState: func(c net.Conn, s http.ConnState) {
-            log.Printf("CONN %s %s", s.String(), c.RemoteAddr())
-        },
-    }
+	var certs *proxy.CertReloader
+	if tlsCert != "" || tlsKey != "" {
+		var err error
+		certs, err = proxy.NewCertReloader(tlsCert, tlsKey)
+		if err != nil {
+			log.Fatalf("TLS setup: %v", err)
+		}
+	} else if tlsAddr != "" {
+		log.Fatalf("-tls-addr %s requires -tls-cert and -tls-key", tlsAddr)
+	}
 
+	cfg := fc.Config()
+	// Route the standard log package and oms through the structured logger.
+	slog.SetDefault(cfg.Logger)
+	oms.SetDefaultOptions(cfg.Render)
+	handler := proxy.New(cfg)
+	var servers []*http.Server
+	errc := make(chan error, 2)
+	start := func(addr string, h http.Handler, certs *proxy.CertReloader) {
+		srv := newHTTPServer(addr, h)
+		servers = append(servers, srv)
+		go serve(srv, addr, certs, errc)
+	}
+	if certs != nil && tlsAddr == "" {
+		start(addr, handler, certs)
+	} else {
+		start(addr, handler, nil)
+		if certs != nil {
+			// The extra listener is the admin/debug port, not a second handset port.
+			start(tlsAddr, handler.AdminHandler(), certs)
+		}
+	}
+
+	sigc := make(chan os.Signal, 1)
+	signal.Notify(sigc, syscall.SIGHUP, syscall.SIGTERM, os.Interrupt)
+	exitCode := 0
+	for running := true; running; {
+		select {
+		case err := <-errc:
+			slog.Error("server error", "err", err)
+			exitCode = 1
+			running = false
+		case sig := <-sigc:
+			if sig == syscall.SIGHUP {
+				if certs != nil {
+					if err := certs.Reload(); err != nil {
+						slog.Error("TLS reload failed, keeping previous certificates", "err", err)
+					} else {
+						slog.Info("TLS certificates reloaded")
+					}
+				}
+				if *configPath != "" {
+					next, err := proxy.ReadConfigFile(*configPath)
+					if err != nil {
+						slog.Error("config reload failed, keeping previous settings", "err", err)
+						continue
+					}
+					fc = next
+				}
+				cfg := fc.Config()
+				oms.SetDefaultOptions(cfg.Render)
+				handler.Reload(cfg)
+				continue
+			}
+			slog.Info("draining connections", "signal", sig.String(), "timeout", drainTimeout.String())
+			running = false
+		}
+	}
+	signal.Stop(sigc)
+	shutdown(servers, drainTimeout)
+	if err := handler.Close(); err != nil {
+		slog.Error("session flush failed", "err", err)
+		exitCode = 1
+	}
+	slog.Info("stopped")
+	os.Exit(exitCode)
+}
+
+func newHTTPServer(addr string, handler http.Handler) *http.Server {
+	return &http.Server{
+		Addr:    addr,
+		Handler: handler,
+		// Conservative timeouts to avoid slowloris and leaked connections blocking the server
+		ReadHeaderTimeout: 5 * time.Second,
+		ReadTimeout:       30 * time.Second,
+		WriteTimeout:      2 * time.Minute,
+		IdleTimeout:       60 * time.Second,
+		ErrorLog:          slog.NewLogLogger(slog.Default().Handler(), slog.LevelWarn),
+		ConnState: func(c net.Conn, s http.ConnState) {
+			slog.Debug("conn", "state", s.String(), "remote", c.RemoteAddr().String())
+		},
+	}
+}
+
+// serve listens on addr and reports a listener failure on errc. A non-nil
+// certs switches the listener to HTTPS.
+func serve(srv *http.Server, addr string, certs *proxy.CertReloader, errc chan<- error) {
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
-		log.Fatalf("Listen error on %s: %v", addr, err)
+		errc <- err
+		return
+	}
+	if certs == nil {
+		slog.Info("listening", "addr", addr)
+		err = srv.Serve(ln)
+	} else {
+		srv.TLSConfig = certs.TLSConfig()
+		slog.Info("listening", "addr", addr, "tls", true)
+		err = srv.ServeTLS(ln, "", "")
+	}
+	if !errors.Is(err, http.ErrServerClosed) {
+		errc <- err
 	}
+}
 
-	log.Println("Listening on", addr)
-	log.Fatal(srv.Serve(ln))
+// shutdown stops accepting connections and waits up to timeout for in-flight
+// requests before forcibly closing what remains.
+func shutdown(servers []*http.Server, timeout time.Duration) {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	for _, srv := range servers {
+		if err := srv.Shutdown(ctx); err != nil {
+			slog.Warn("shutdown incomplete", "addr", srv.Addr, "err", err)
+			_ = srv.Close()
+		}
+	}
 }
@@ -12,6 +12,7 @@ require (
 	github.com/chromedp/cdproto v0.0.0-20250803210736-d308e07a266d
 	github.com/chromedp/chromedp v0.14.2
 	golang.org/x/image v0.31.0
+	golang.org/x/text v0.29.0
 )
 
 require (
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// adminCookie carries the admin token for the browser console once it has
+// been presented, so that it does not stay in URLs, logs and Referer headers.
+const adminCookie = "operetta_admin"
+
+// authorizeAdmin guards operator endpoints. When Config.AdminToken is set the
+// request must present it as a bearer token, an X-Admin-Token header, the
+// console cookie or a `token` query parameter. Without a token the endpoints
+// are disabled unless Config.AdminLoopback trusts loopback clients, which is
+// unsafe behind a local reverse proxy.
+func (s *Server) authorizeAdmin(w http.ResponseWriter, r *http.Request) bool {
+	cfg := s.config()
+	if cfg.AdminToken != "" {
+		if subtle.ConstantTimeCompare([]byte(adminTokenFrom(r)), []byte(cfg.AdminToken)) == 1 {
+			return true
+		}
+		w.Header().Set("WWW-Authenticate", `Bearer realm="operetta-admin"`)
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	if cfg.AdminLoopback {
+		host, _, err := net.SplitHostPort(r.RemoteAddr)
+		if err != nil {
+			host = r.RemoteAddr
+		}
+		if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+			return true
+		}
+	}
+	http.Error(w, "forbidden", http.StatusForbidden)
+	return false
+}
+
+// adminTokenFrom returns the admin credential presented by r, preferring
+// headers over the query string.
+func adminTokenFrom(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		if tok := strings.TrimSpace(strings.TrimPrefix(auth, "Bearer ")); tok != "" {
+			return tok
+		}
+	}
+	if tok := strings.TrimSpace(r.Header.Get("X-Admin-Token")); tok != "" {
+		return tok
+	}
+	if c, err := r.Cookie(adminCookie); err == nil && c.Value != "" {
+		return c.Value
+	}
+	return r.URL.Query().Get("token")
+}
+
+// handleCachePurge drops rendered pages from the page cache by exact URL or host.
+func (s *Server) handleCachePurge(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	if r.Method != http.MethodPost && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", "POST, DELETE")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	_ = r.ParseForm()
+	target := strings.TrimSpace(r.FormValue("url"))
+	host := strings.TrimSpace(r.FormValue("host"))
+	if target == "" && host == "" {
+		http.Error(w, "missing url or host", http.StatusBadRequest)
+		return
+	}
+	if target != "" {
+		target = normalizeObmlURL(target)
+	}
+	purged := s.cache.Purge(target, host)
+	s.requestLogger(r).Info("cache purge", "url", target, "host", host, "removed", purged)
+	w.Header().Set("Content-Type", "application/json; charset=utf-8")
+	_ = json.NewEncoder(w).Encode(map[string]int{"purged": purged})
+}
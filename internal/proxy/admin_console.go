@@ -0,0 +1,518 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html/template"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+
+	"operetta/oms"
+)
+
+const (
+	consoleImageLimit  = 100
+	consoleSourceLimit = 2 << 20
+)
+
+type consoleSession struct {
+	ClientKey string
+	Prefix    string
+	Code      string
+	Expires   time.Time
+	Domains   []string
+	Prefs     []consolePref
+}
+
+type consolePref struct {
+	Target string
+	Pref   renderPref
+}
+
+type consoleSite struct {
+	Host  string
+	Mode  string
+	Bytes int64
+	Error string
+}
+
+type consoleData struct {
+	Token   string
+	Message string
+	Error   string
+	Now     time.Time
+
+	Sessions  []consoleSession
+	Stats     SessionStats
+	Pages     []pageCacheEntry
+	PageBytes int64
+	Images    []oms.ImageCacheEntry
+	ImageUse  oms.ImageCacheUsage
+	ImageHits oms.ImageCacheCounters
+
+	SitesDir string
+	Sites    []consoleSite
+	EditHost string
+	EditBody string
+}
+
+// handleAdminConsole serves the operator dashboard listing sessions, caches
+// and site overrides.
+func (s *Server) handleAdminConsole(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	q := r.URL.Query()
+	if tok := q.Get("token"); tok != "" && s.config().AdminToken != "" {
+		// Trade the query token for a cookie so that it drops out of the
+		// address bar, access logs and Referer headers.
+		http.SetCookie(w, &http.Cookie{
+			Name:     adminCookie,
+			Value:    tok,
+			Path:     "/",
+			HttpOnly: true,
+			Secure:   r.TLS != nil,
+			SameSite: http.SameSiteStrictMode,
+		})
+		q.Del("token")
+		target := "/admin"
+		if len(q) > 0 {
+			target += "?" + q.Encode()
+		}
+		http.Redirect(w, r, target, http.StatusSeeOther)
+		return
+	}
+	data := s.consoleData(r)
+	data.Message = q.Get("msg")
+	if host := strings.TrimSpace(q.Get("site")); host != "" {
+		data.EditHost = host
+		if !validSiteHost(host) {
+			data.Error = fmt.Sprintf("invalid host %q", host)
+		} else if raw, err := os.ReadFile(filepath.Join(data.SitesDir, host+".json")); err == nil {
+			data.EditBody = string(raw)
+		} else if !errors.Is(err, os.ErrNotExist) {
+			data.Error = err.Error()
+		}
+		if data.EditBody == "" {
+			data.EditBody = "{\n  \"mode\": \"full\"\n}\n"
+		}
+	}
+	s.writeConsole(w, http.StatusOK, data)
+}
+
+func (s *Server) consoleData(r *http.Request) consoleData {
+	data := consoleData{
+		Token:     r.URL.Query().Get("token"),
+		Now:       s.clock(),
+		Stats:     s.SessionStats(),
+		Pages:     s.cache.Entries(),
+		Images:    oms.ImageCacheEntries(consoleImageLimit),
+		ImageUse:  oms.ImageCacheSummary(),
+		ImageHits: oms.ImageCacheStats(),
+		SitesDir:  s.config().SitesDir,
+	}
+	for _, p := range data.Pages {
+		data.PageBytes += p.Bytes
+	}
+	for key, tok := range s.auth.snapshot() {
+		jarKey := "AUTH|" + tok.Prefix + "|" + tok.Code
+		sess := consoleSession{
+			ClientKey: key,
+			Prefix:    tok.Prefix,
+			Code:      shortSecret(tok.Code),
+			Expires:   tok.ExpiresAt,
+			Domains:   s.cookieJars.Domains(jarKey),
+		}
+		for target, pref := range s.renderPrefs.WithPrefix(jarKey + "|") {
+			sess.Prefs = append(sess.Prefs, consolePref{Target: target, Pref: pref})
+		}
+		sort.Slice(sess.Prefs, func(i, j int) bool { return sess.Prefs[i].Target < sess.Prefs[j].Target })
+		data.Sessions = append(data.Sessions, sess)
+	}
+	sort.Slice(data.Sessions, func(i, j int) bool { return data.Sessions[i].ClientKey < data.Sessions[j].ClientKey })
+	data.Sites = listSiteConfigs(data.SitesDir)
+	return data
+}
+
+func (s *Server) writeConsole(w http.ResponseWriter, status int, data consoleData) {
+	var buf bytes.Buffer
+	if err := consoleTemplate.ExecuteTemplate(&buf, "console", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	w.WriteHeader(status)
+	_, _ = buf.WriteTo(w)
+}
+
+// handleConsolePagePurge removes page cache entries by key, URL, host or all.
+func (s *Server) handleConsolePagePurge(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeConsolePost(w, r) {
+		return
+	}
+	removed := 0
+	switch {
+	case r.FormValue("all") != "":
+		removed = s.cache.Clear()
+	case r.FormValue("key") != "":
+		if s.cache.Remove(r.FormValue("key")) {
+			removed = 1
+		}
+	default:
+		target := strings.TrimSpace(r.FormValue("url"))
+		if target != "" {
+			target = normalizeObmlURL(target)
+		}
+		removed = s.cache.Purge(target, strings.TrimSpace(r.FormValue("host")))
+	}
+	s.requestLogger(r).Info("console page cache purge", "removed", removed)
+	consoleRedirect(w, r, fmt.Sprintf("Removed %d cached page(s).", removed))
+}
+
+// handleConsoleImagePurge removes an image URL, or everything, from the memory
+// and disk image caches.
+func (s *Server) handleConsoleImagePurge(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeConsolePost(w, r) {
+		return
+	}
+	target := strings.TrimSpace(r.FormValue("url"))
+	if target == "" && r.FormValue("all") == "" {
+		consoleRedirect(w, r, "Enter an image URL or use purge all.")
+		return
+	}
+	mem, disk := oms.PurgeImageCache(target)
+	s.requestLogger(r).Info("console image cache purge", "url", target, "memory", mem, "disk", disk)
+	consoleRedirect(w, r, fmt.Sprintf("Removed %d memory and %d disk image(s).", mem, disk))
+}
+
+// handleConsoleSiteSave validates and writes a per-host SiteConfig file.
+func (s *Server) handleConsoleSiteSave(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeConsolePost(w, r) {
+		return
+	}
+	host := strings.ToLower(strings.TrimSpace(r.FormValue("host")))
+	body := r.FormValue("config")
+	dir := s.config().SitesDir
+	err := saveSiteConfig(dir, host, []byte(body))
+	if err != nil {
+		data := s.consoleData(r)
+		data.Error = err.Error()
+		data.EditHost, data.EditBody = host, body
+		s.writeConsole(w, http.StatusBadRequest, data)
+		return
+	}
+	s.sites.Reset(dir)
+	s.requestLogger(r).Info("console site config saved", "host", host)
+	consoleRedirect(w, r, "Saved "+host+".json.")
+}
+
+// handleConsoleRender shows the origin page next to the decoded OBML it renders to.
+func (s *Server) handleConsoleRender(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	target := strings.TrimSpace(r.URL.Query().Get("url"))
+	u, err := url.Parse(target)
+	if target == "" || err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		http.Error(w, "url must be an absolute http(s) URL", http.StatusBadRequest)
+		return
+	}
+	data := struct {
+		Token, URL, Source, SourceErr, RenderErr string
+		Bytes, Part, Parts                       int
+		Tokens                                   []omsToken
+	}{Token: r.URL.Query().Get("token"), URL: target}
+
+	source, err := fetchConsoleSource(r, target)
+	if err != nil {
+		data.SourceErr = err.Error()
+	} else {
+		data.Source = source
+	}
+
+	opt := defaultRenderOptions()
+	opt.Engine = s.renderEngine()
+	opt.Logger = s.requestLogger(r)
+	page, err := s.loadPage(r.Context(), target, http.Header{}, opt)
+	if err == nil {
+		page.Normalize()
+		data.Bytes = len(page.Data)
+		data.Part, data.Parts = page.Parts()
+		data.Tokens, err = decodeOMSTokens(page.Data)
+	}
+	if err != nil {
+		data.RenderErr = err.Error()
+	}
+	var buf bytes.Buffer
+	if err := consoleTemplate.ExecuteTemplate(&buf, "render", data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Header().Set("Referrer-Policy", "no-referrer")
+	_, _ = buf.WriteTo(w)
+}
+
+// authorizeConsolePost admits console form posts: admin credentials, POST
+// only, and no cross-site origin so that loopback-only mode is not open to CSRF.
+func (s *Server) authorizeConsolePost(w http.ResponseWriter, r *http.Request) bool {
+	if !s.authorizeAdmin(w, r) {
+		return false
+	}
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return false
+	}
+	if origin := r.Header.Get("Origin"); origin != "" {
+		if u, err := url.Parse(origin); err != nil || !strings.EqualFold(u.Host, r.Host) {
+			http.Error(w, "cross-origin request rejected", http.StatusForbidden)
+			return false
+		}
+	} else if site := r.Header.Get("Sec-Fetch-Site"); site != "" && site != "same-origin" && site != "none" {
+		http.Error(w, "cross-site request rejected", http.StatusForbidden)
+		return false
+	}
+	_ = r.ParseForm()
+	return true
+}
+
+func consoleRedirect(w http.ResponseWriter, r *http.Request, msg string) {
+	q := url.Values{}
+	if tok := r.URL.Query().Get("token"); tok != "" {
+		q.Set("token", tok)
+	}
+	q.Set("msg", msg)
+	http.Redirect(w, r, "/admin?"+q.Encode(), http.StatusSeeOther)
+}
+
+func fetchConsoleSource(r *http.Request, target string) (string, error) {
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, target, nil)
+	if err != nil {
+		return "", err
+	}
+	client := &http.Client{Timeout: 15 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(io.LimitReader(resp.Body, consoleSourceLimit))
+	if err != nil {
+		return "", err
+	}
+	// The frame is sandboxed without scripts; <base> keeps relative assets working.
+	return `<base href="` + template.HTMLEscapeString(target) + `">` + string(body), nil
+}
+
+func listSiteConfigs(dir string) []consoleSite {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil
+	}
+	var out []consoleSite
+	for _, e := range entries {
+		name := e.Name()
+		if e.IsDir() || !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		site := consoleSite{Host: strings.TrimSuffix(name, ".json")}
+		if info, err := e.Info(); err == nil {
+			site.Bytes = info.Size()
+		}
+		raw, err := os.ReadFile(filepath.Join(dir, name))
+		if err == nil {
+			var cfg *SiteConfig
+			if cfg, err = validateSiteConfig(raw); err == nil {
+				site.Mode = cfg.Mode
+			}
+		}
+		if err != nil {
+			site.Error = err.Error()
+		}
+		out = append(out, site)
+	}
+	return out
+}
+
+// validateSiteConfig parses a SiteConfig strictly: unknown keys, unknown
+// modes and malformed headers are rejected.
+func validateSiteConfig(raw []byte) (*SiteConfig, error) {
+	var cfg SiteConfig
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&cfg); err != nil {
+		return nil, err
+	}
+	if dec.More() {
+		return nil, errors.New("trailing data after JSON object")
+	}
+	cfg.Mode = strings.TrimSpace(strings.ToLower(cfg.Mode))
+	switch cfg.Mode {
+	case "", "full", "compact", "reader":
+	default:
+		return nil, fmt.Errorf("mode %q must be full, compact or reader", cfg.Mode)
+	}
+	cfg.LayoutTables = strings.TrimSpace(strings.ToLower(cfg.LayoutTables))
+	switch cfg.LayoutTables {
+	case "", "linearize", "source":
+	default:
+		return nil, fmt.Errorf("layoutTables %q must be linearize or source", cfg.LayoutTables)
+	}
+	for name, value := range cfg.Headers {
+		if !validHeaderName(name) {
+			return nil, fmt.Errorf("invalid header name %q", name)
+		}
+		if strings.ContainsAny(value, "\r\n") {
+			return nil, fmt.Errorf("header %s contains a line break", name)
+		}
+	}
+	if b := cfg.Bake; b != nil {
+		if _, ok := parseJSModeString(b.Mode); !ok {
+			return nil, fmt.Errorf("bake.mode %q must be auto, off, on or required", b.Mode)
+		}
+		if b.WaitAfterLoadMS < 0 || b.WaitIdleMS < 0 || b.TimeoutMS < 0 {
+			return nil, errors.New("bake waits and timeout must not be negative")
+		}
+	}
+	return &cfg, nil
+}
+
+func saveSiteConfig(dir, host string, raw []byte) error {
+	if !validSiteHost(host) {
+		return fmt.Errorf("invalid host %q", host)
+	}
+	if _, err := validateSiteConfig(raw); err != nil {
+		return err
+	}
+	if dir == "" {
+		return errors.New("no sites directory configured")
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return err
+	}
+	path := filepath.Join(dir, host+".json")
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, raw, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+func validSiteHost(host string) bool {
+	if host == "" || len(host) > 253 || strings.HasPrefix(host, ".") || strings.HasSuffix(host, ".") || strings.Contains(host, "..") {
+		return false
+	}
+	for _, c := range host {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-' || c == '.') {
+			return false
+		}
+	}
+	return true
+}
+
+func validHeaderName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for _, c := range name {
+		if c <= ' ' || c >= 0x7f || strings.ContainsRune(`"(),/:;<=>?@[\]{}`, c) {
+			return false
+		}
+	}
+	return true
+}
+
+func shortSecret(v string) string {
+	if len(v) <= 8 {
+		return v
+	}
+	return v[:8] + "…"
+}
+
+var consoleTemplate = template.Must(template.New("console").Funcs(template.FuncMap{
+	"since": func(now, t time.Time) string {
+		if t.IsZero() {
+			return "-"
+		}
+		return t.Sub(now).Round(time.Second).String()
+	},
+	"kb": func(n int64) string { return fmt.Sprintf("%.1f KB", float64(n)/1024) },
+	"q": func(token string) template.URL {
+		if token == "" {
+			return ""
+		}
+		return template.URL("token=" + url.QueryEscape(token))
+	},
+}).Parse(`{{define "head"}}<!DOCTYPE html>
+<html><head><meta charset="utf-8"><title>Operetta admin</title>
+<style>
+body{font:14px sans-serif;margin:1em 2em}table{border-collapse:collapse;margin:.5em 0}
+td,th{border:1px solid #ccc;padding:2px 6px;text-align:left;vertical-align:top}
+.msg{background:#e6f4e6;padding:4px}.err{background:#f8e0e0;padding:4px}
+textarea{width:100%;font-family:monospace}.split{display:flex;gap:1em}.split>div{flex:1;min-width:0}
+iframe{width:100%;height:80vh;border:1px solid #ccc}pre{white-space:pre-wrap}
+</style></head><body>{{end}}
+{{define "console"}}{{template "head"}}
+<h1>Operetta admin</h1>
+{{with .Message}}<p class="msg">{{.}}</p>{{end}}{{with .Error}}<p class="err">{{.}}</p>{{end}}
+
+<h2>Render</h2>
+<form action="/admin/render" method="get">{{with .Token}}<input type="hidden" name="token" value="{{.}}">{{end}}
+URL <input name="url" size="60"> <button>Render side by side</button></form>
+
+<h2>Sessions ({{len .Sessions}})</h2>
+<p>Cookie jars {{.Stats.CookieJars}}, form entries {{.Stats.FormEntries}}, render prefs {{.Stats.RenderPrefs}}, evicted {{.Stats.Evicted}}.</p>
+<table><tr><th>Client key</th><th>Prefix</th><th>Code</th><th>Expires in</th><th>Cookie domains</th><th>Render prefs</th></tr>
+{{range .Sessions}}<tr><td>{{.ClientKey}}</td><td>{{.Prefix}}</td><td>{{.Code}}</td><td>{{since $.Now .Expires}}</td>
+<td>{{range .Domains}}{{.}}<br>{{end}}</td>
+<td>{{range .Prefs}}{{.Target}}: images={{.Pref.ImagesOn}} hq={{.Pref.HighQuality}} {{.Pref.ImageMIME}} max={{.Pref.MaxInlineKB}}KB<br>{{end}}</td></tr>
+{{end}}</table>
+
+<h2>Page cache ({{len .Pages}} entries, {{kb .PageBytes}})</h2>
+<form action="/admin/pages/purge?{{q .Token}}" method="post">URL <input name="url" size="40"> or host <input name="host" size="20">
+<button>Purge</button> <button name="all" value="1">Purge all</button></form>
+<table><tr><th>Target</th><th>Scope</th><th>Size</th><th>Expires in</th><th>Validators</th><th></th></tr>
+{{range .Pages}}<tr><td>{{.Target}}</td><td>{{.Scope}}</td><td>{{kb .Bytes}}</td><td>{{since $.Now .Expires}}</td><td>{{.Validators}}</td>
+<td><form action="/admin/pages/purge?{{q $.Token}}" method="post"><input type="hidden" name="key" value="{{.Key}}"><button>Drop</button></form></td></tr>
+{{end}}</table>
+
+<h2>Image cache</h2>
+<p>Memory {{.ImageUse.MemoryEntries}} images, {{kb .ImageUse.MemoryBytes}} of {{kb .ImageUse.MemoryLimit}};
+disk {{.ImageUse.DiskFiles}} files, {{kb .ImageUse.DiskBytes}} of {{kb .ImageUse.DiskLimit}} in {{.ImageUse.DiskDir}}.
+Hits: memory {{.ImageHits.MemoryHits}}, disk {{.ImageHits.DiskHits}}, revalidated {{.ImageHits.Revalidated}}, origin {{.ImageHits.Misses}}.</p>
+<form action="/admin/images/purge?{{q .Token}}" method="post">Image URL <input name="url" size="60">
+<button>Purge</button> <button name="all" value="1">Purge all</button></form>
+<table><tr><th>URL</th><th>Format</th><th>Size</th><th>Dimensions</th><th>Expires in</th></tr>
+{{range .Images}}<tr><td>{{.URL}}</td><td>{{.Format}} q={{.Quality}}</td><td>{{.Bytes}} B</td><td>{{.Width}}x{{.Height}}</td><td>{{since $.Now .Expires}}</td></tr>
+{{end}}</table>
+
+<h2>Site overrides ({{.SitesDir}})</h2>
+<table><tr><th>Host</th><th>Mode</th><th>Size</th><th>Status</th></tr>
+{{range .Sites}}<tr><td><a href="/admin?site={{.Host}}&amp;{{q $.Token}}">{{.Host}}</a></td><td>{{.Mode}}</td><td>{{.Bytes}} B</td><td>{{if .Error}}invalid: {{.Error}}{{else}}ok{{end}}</td></tr>
+{{end}}</table>
+<form action="/admin" method="get">{{with .Token}}<input type="hidden" name="token" value="{{.}}">{{end}}
+New host <input name="site" size="30"> <button>Edit</button></form>
+{{if .EditHost}}<h3>{{.EditHost}}.json</h3>
+<form action="/admin/sites?{{q .Token}}" method="post"><input type="hidden" name="host" value="{{.EditHost}}">
+<textarea name="config" rows="14">{{.EditBody}}</textarea><br><button>Validate and save</button></form>{{end}}
+</body></html>{{end}}
+{{define "render"}}{{template "head"}}
+<p><a href="/admin?{{q .Token}}">&larr; admin</a> &middot; {{.URL}}</p>
+<div class="split"><div><h2>HTML</h2>
+{{if .SourceErr}}<p class="err">{{.SourceErr}}</p>{{else}}<iframe sandbox srcdoc="{{.Source}}"></iframe>{{end}}
+</div><div><h2>OBML ({{.Bytes}} bytes, part {{.Part}}/{{.Parts}})</h2>
+{{if .RenderErr}}<p class="err">{{.RenderErr}}</p>{{end}}
+<table><tr><th>Tag</th><th>Payload</th></tr>{{range .Tokens}}<tr><td>{{.Tag}}</td><td><pre>{{.Info}}</pre></td></tr>{{end}}</table>
+</div></div></body></html>{{end}}`))
@@ -0,0 +1,208 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"operetta/oms"
+)
+
+func newConsoleServer(t *testing.T) *Server {
+	t.Helper()
+	s := New(Config{
+		Logger:     slog.New(slog.DiscardHandler),
+		SitesDir:   t.TempDir(),
+		AdminToken: "secret",
+	})
+	t.Cleanup(func() { _ = s.Close() })
+	return s
+}
+
+func TestAdminConsoleListsSessionsAndCaches(t *testing.T) {
+	s := newConsoleServer(t)
+	s.auth.updateToken("client-1", authTokens{Prefix: "t19-14", Code: "0123456789abcdef"})
+	jarKey := "AUTH|t19-14|0123456789abcdef"
+	jarURL, _ := url.Parse("http://news.example.com/")
+	s.cookieJars.Get(jarKey).SetCookies(jarURL, []*http.Cookie{{Name: "sid", Value: "1"}})
+	s.renderPrefs.Remember(jarKey+"|http://news.example.com/", &oms.RenderOptions{ImagesOn: true, ImageMIME: "image/png"})
+	s.cache.Store("http://cached.example.com/", defaultRenderOptions(), nil, &oms.Page{Data: []byte("packed")})
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/admin", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/admin?token=secret", nil))
+	cookies := rec.Result().Cookies()
+	if rec.Code != http.StatusSeeOther || rec.Header().Get("Location") != "/admin" || len(cookies) != 1 || !cookies[0].HttpOnly {
+		t.Fatalf("query token should be traded for a cookie, got %d %q %v", rec.Code, rec.Header().Get("Location"), cookies)
+	}
+
+	rec = httptest.NewRecorder()
+	req := httptest.NewRequest(http.MethodGet, "http://operetta/admin", nil)
+	req.AddCookie(cookies[0])
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if strings.Contains(rec.Body.String(), "token=secret") {
+		t.Errorf("console links must not carry the token")
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"client-1", "01234567…", "news.example.com", "image/png", "http://cached.example.com/"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("console missing %q", want)
+		}
+	}
+	if strings.Contains(body, "0123456789abcdef") {
+		t.Errorf("console must not show the full auth code")
+	}
+
+	form := url.Values{"host": {"cached.example.com"}}
+	req = httptest.NewRequest(http.MethodPost, "http://operetta/admin/pages/purge?token=secret", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set("Origin", "http://evil.example")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusForbidden {
+		t.Fatalf("expected cross-origin purge to be rejected, got %d", rec.Code)
+	}
+
+	req = httptest.NewRequest(http.MethodPost, "http://operetta/admin/pages/purge?token=secret", strings.NewReader(form.Encode()))
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusSeeOther || !strings.Contains(rec.Header().Get("Location"), "token=secret") {
+		t.Fatalf("expected redirect back to the console, got %d %q", rec.Code, rec.Header().Get("Location"))
+	}
+	if n, _ := s.cache.Len(); n != 0 {
+		t.Fatalf("expected page cache to be empty, have %d", n)
+	}
+}
+
+func TestAdminConsoleSavesValidSiteConfig(t *testing.T) {
+	s := newConsoleServer(t)
+	dir := s.config().SitesDir
+	post := func(host, cfg string) *httptest.ResponseRecorder {
+		form := url.Values{"host": {host}, "config": {cfg}}
+		req := httptest.NewRequest(http.MethodPost, "http://operetta/admin/sites?token=secret", strings.NewReader(form.Encode()))
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec
+	}
+
+	for _, tc := range []struct{ host, cfg string }{
+		{"example.com", `{"mode":"wide"}`},
+		{"example.com", `{"mode":"full","extra":1}`},
+		{"example.com", `{"headers":{"Bad Name":"x"}}`},
+		{"example.com", `{"bake":{"mode":"sometimes"}}`},
+		{"example.com", `{"layoutTables":"sideways"}`},
+		{"../etc", `{"mode":"full"}`},
+	} {
+		if rec := post(tc.host, tc.cfg); rec.Code != http.StatusBadRequest {
+			t.Errorf("%s %s: expected 400, got %d", tc.host, tc.cfg, rec.Code)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(dir, "example.com.json")); !os.IsNotExist(err) {
+		t.Fatalf("invalid configs must not be written")
+	}
+
+	if cfg := s.sites.Find("http://example.com/"); cfg != nil {
+		t.Fatalf("unexpected config before save: %+v", cfg)
+	}
+	if rec := post("example.com", `{"mode":"compact","headers":{"X-Test":"1"},"layoutTables":"source"}`); rec.Code != http.StatusSeeOther {
+		t.Fatalf("expected save to redirect, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if cfg := s.sites.Find("http://example.com/"); cfg == nil || cfg.Mode != "compact" || !cfg.KeepLayoutTables() {
+		t.Fatalf("expected saved config to be picked up, got %+v", cfg)
+	}
+}
+
+func TestAdminConsoleRenderShowsTokens(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		_, _ = w.Write([]byte(`<html><head><title>Hi</title></head><body><p>Hello console</p><a href="/next">Next</a></body></html>`))
+	}))
+	defer origin.Close()
+
+	s := newConsoleServer(t)
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/admin/render?token=secret&url="+url.QueryEscape(origin.URL+"/"), nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	body := rec.Body.String()
+	for _, want := range []string{"<iframe sandbox srcdoc=", "&#34;Hello console&#34;", "/next"} {
+		if !strings.Contains(body, want) {
+			t.Errorf("render page missing %q", want)
+		}
+	}
+}
+
+func TestAdminEndpointsNeedTokenOrLoopbackOptIn(t *testing.T) {
+	s := New(Config{Logger: slog.New(slog.DiscardHandler), SitesDir: t.TempDir()})
+	t.Cleanup(func() { _ = s.Close() })
+
+	// A reverse proxy on the same host makes every client look local.
+	get := func(path string, header http.Header) int {
+		req := httptest.NewRequest(http.MethodGet, "http://operetta"+path, nil)
+		req.RemoteAddr = "127.0.0.1:4242"
+		for k, v := range header {
+			req.Header[k] = v
+		}
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, path := range []string{"/admin", "/metrics", "/admin/render?url=http://example.com/"} {
+		if code := get(path, nil); code != http.StatusForbidden {
+			t.Fatalf("%s without a token: expected 403, got %d", path, code)
+		}
+	}
+
+	cfg := s.config()
+	cfg.AdminLoopback = true
+	s.Reload(cfg)
+	if code := get("/metrics", nil); code != http.StatusOK {
+		t.Fatalf("loopback opt-in: expected 200, got %d", code)
+	}
+
+	cfg.AdminToken = "secret"
+	s.Reload(cfg)
+	if code := get("/metrics", nil); code != http.StatusUnauthorized {
+		t.Fatalf("a token overrides loopback trust, got %d", code)
+	}
+	if code := get("/metrics", http.Header{"X-Admin-Token": {"secret"}}); code != http.StatusOK {
+		t.Fatalf("X-Admin-Token header: expected 200, got %d", code)
+	}
+}
+
+func TestAdminHandlerServesOnlyAdminRoutes(t *testing.T) {
+	s := newConsoleServer(t)
+	get := func(path string) int {
+		req := httptest.NewRequest(http.MethodGet, "http://operetta"+path, nil)
+		req.Header.Set("X-Admin-Token", "secret")
+		rec := httptest.NewRecorder()
+		s.AdminHandler().ServeHTTP(rec, req)
+		return rec.Code
+	}
+	for _, path := range []string{"/admin", "/metrics", "/ping"} {
+		if code := get(path); code != http.StatusOK {
+			t.Fatalf("%s on the admin listener: expected 200, got %d", path, code)
+		}
+	}
+	for _, path := range []string{"/", "/fetch?url=http://example.com/", "/download?url=http://example.com/f"} {
+		if code := get(path); code != http.StatusNotFound {
+			t.Fatalf("%s on the admin listener: expected 404, got %d", path, code)
+		}
+	}
+}
@@ -1,92 +1,99 @@
 package proxy
 
 import (
-    "crypto/rand"
-    "crypto/sha256"
-    "encoding/hex"
-    "net/http"
-    "strings"
-    "sync"
-    "time"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
 )
 
 const authCookieName = "OPERETTA_AUTH"
 
 type authTokens struct {
-    Code      string
-    Prefix    string
-    ExpiresAt time.Time
+	Code      string
+	Prefix    string
+	ExpiresAt time.Time
 }
 
 type authStore struct {
-    mu       sync.Mutex
-    sessions map[string]authTokens
-    ttl      time.Duration
-    clock    func() time.Time
+	mu       sync.Mutex
+	sessions map[string]authTokens
+	index    *sessionIndex
+	ttl      time.Duration
+	clock    func() time.Time
 }
 
 func newAuthStore(clock func() time.Time) *authStore {
-    if clock == nil {
-        clock = time.Now
-    }
-    return &authStore{sessions: make(map[string]authTokens), ttl: 7 * 24 * time.Hour, clock: clock}
+	if clock == nil {
+		clock = time.Now
+	}
+	return &authStore{sessions: make(map[string]authTokens), index: newSessionIndex(), ttl: 7 * 24 * time.Hour, clock: clock}
 }
 
 func (s *authStore) get(key string) (authTokens, bool) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    tok, ok := s.sessions[key]
-    if !ok {
-        return authTokens{}, false
-    }
-    if !tok.ExpiresAt.IsZero() && s.clock().After(tok.ExpiresAt) {
-        delete(s.sessions, key)
-        return authTokens{}, false
-    }
-    return tok, true
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	tok, ok := s.sessions[key]
+	if !ok {
+		return authTokens{}, false
+	}
+	now := s.clock()
+	if !tok.ExpiresAt.IsZero() && now.After(tok.ExpiresAt) {
+		delete(s.sessions, key)
+		s.index.remove(key)
+		return authTokens{}, false
+	}
+	s.index.touch(key, now)
+	return tok, true
 }
 
 func (s *authStore) put(key string, tok authTokens) {
-    s.mu.Lock()
-    tok.ExpiresAt = s.clock().Add(s.ttl)
-    s.sessions[key] = tok
-    s.mu.Unlock()
+	s.mu.Lock()
+	now := s.clock()
+	tok.ExpiresAt = now.Add(s.ttl)
+	s.sessions[key] = tok
+	s.index.touch(key, now)
+	s.mu.Unlock()
 }
 
 func (s *authStore) ensure(key string) authTokens {
-    if tok, ok := s.get(key); ok {
-        return tok
-    }
-    tok := generateAuthTokens()
-    s.put(key, tok)
-    return tok
+	if tok, ok := s.get(key); ok {
+		return tok
+	}
+	tok := generateAuthTokens()
+	s.put(key, tok)
+	return tok
 }
 
 func (s *authStore) cookieFor(key string) *http.Cookie {
-    return &http.Cookie{
-        Name:     authCookieName,
-        Value:    key,
-        Path:     "/",
-        HttpOnly: true,
-        SameSite: http.SameSiteLaxMode,
-        Expires:  s.clock().Add(s.ttl),
-    }
+	return &http.Cookie{
+		Name:     authCookieName,
+		Value:    key,
+		Path:     "/",
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+		Expires:  s.clock().Add(s.ttl),
+	}
 }
 
 func clientAuthKeyFromRequest(r *http.Request) string {
-    if c, err := r.Cookie(authCookieName); err == nil && c != nil && strings.TrimSpace(c.Value) != "" {
-        return c.Value
-    }
-    return DeriveClientKey(r)
+	if c, err := r.Cookie(authCookieName); err == nil && c != nil && strings.TrimSpace(c.Value) != "" {
+		return c.Value
+	}
+	return DeriveClientKey(r)
 }
 
 func generateAuthTokens() authTokens {
-    prefix := "t19-14"
-    buf := make([]byte, 32)
-    _, _ = rand.Read(buf)
-    sum := sha256.Sum256(buf)
-    code := hex.EncodeToString(sum[:])
-    return authTokens{Code: code, Prefix: prefix}
+	prefix := "t19-14"
+	buf := make([]byte, 32)
+	_, _ = rand.Read(buf)
+	sum := sha256.Sum256(buf)
+	code := hex.EncodeToString(sum[:])
+	return authTokens{Code: code, Prefix: prefix}
 }
 
 func (s *authStore) ensureByCode(prefix, code string) (authTokens, bool) {
@@ -103,8 +110,10 @@ func (s *authStore) ensureByCode(prefix, code string) (authTokens, bool) {
 
 	for key, tok := range s.sessions {
 		if tok.Prefix == prefix && tok.Code == code {
-			tok.ExpiresAt = s.clock().Add(s.ttl)
+			now := s.clock()
+			tok.ExpiresAt = now.Add(s.ttl)
 			s.sessions[key] = tok
+			s.index.touch(key, now)
 			return tok, true
 		}
 	}
@@ -114,8 +123,84 @@ func (s *authStore) ensureByCode(prefix, code string) (authTokens, bool) {
 }
 
 func (s *authStore) updateToken(key string, tok authTokens) {
-    s.mu.Lock()
-    defer s.mu.Unlock()
-    tok.ExpiresAt = s.clock().Add(s.ttl)
-    s.sessions[key] = tok
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock()
+	tok.ExpiresAt = now.Add(s.ttl)
+	s.sessions[key] = tok
+	s.index.touch(key, now)
+}
+
+// bound evicts the least recently used session once an insert exceeds cap.
+func (s *authStore) bound(cap *sessionCap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.bound(cap, func(key string) { delete(s.sessions, key) })
+}
+
+// snapshot returns the live (non-expired) sessions keyed by client key.
+func (s *authStore) snapshot() map[string]authTokens {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock()
+	out := make(map[string]authTokens, len(s.sessions))
+	for key, tok := range s.sessions {
+		if !tok.ExpiresAt.IsZero() && now.After(tok.ExpiresAt) {
+			continue
+		}
+		out[key] = tok
+	}
+	return out
+}
+
+// restore loads previously persisted sessions, keeping their original expiry.
+// Sessions enter the LRU index oldest first so idle and size sweeps evict them
+// in the order they were last used.
+func (s *authStore) restore(sessions map[string]authTokens) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	now := s.clock()
+	var order []sessionIndexEntry
+	for key, tok := range sessions {
+		if key == "" || (!tok.ExpiresAt.IsZero() && now.After(tok.ExpiresAt)) {
+			continue
+		}
+		s.sessions[key] = tok
+		seen := now
+		if !tok.ExpiresAt.IsZero() {
+			seen = tok.ExpiresAt.Add(-s.ttl)
+		}
+		order = append(order, sessionIndexEntry{key: key, seen: seen})
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].seen.Before(order[j].seen) })
+	for _, e := range order {
+		s.index.touch(e.key, e.seen)
+	}
+}
+
+// Len reports the number of tracked sessions, including ones not yet swept.
+func (s *authStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.sessions)
+}
+
+// Sweep removes expired sessions, sessions idle longer than idle and, when the
+// store holds more than max sessions, the least recently used ones.
+func (s *authStore) Sweep(now time.Time, idle time.Duration, max int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	evicted := 0
+	for key, tok := range s.sessions {
+		if !tok.ExpiresAt.IsZero() && now.After(tok.ExpiresAt) {
+			delete(s.sessions, key)
+			s.index.remove(key)
+			evicted++
+		}
+	}
+	for _, key := range s.index.evictable(now, idle, max) {
+		delete(s.sessions, key)
+		evicted++
+	}
+	return evicted
 }
@@ -7,18 +7,20 @@ import (
 )
 
 func (s *Server) shouldServeLocalBookmarks() bool {
-	switch s.cfg.BookmarkMode {
+	cfg := s.config()
+	switch cfg.BookmarkMode {
 	case BookmarkModeRemote:
 		return false
 	case BookmarkModeLocal:
 		return true
 	default:
-		return len(s.cfg.Bookmarks) > 0
+		return len(cfg.Bookmarks) > 0
 	}
 }
 
 func (s *Server) renderLocalBookmarks(authCode, authPrefix string, opts *oms.RenderOptions) *oms.Page {
-	if len(s.cfg.Bookmarks) == 0 && s.cfg.BookmarkMode == BookmarkModeAuto {
+	cfg := s.config()
+	if len(cfg.Bookmarks) == 0 && cfg.BookmarkMode == BookmarkModeAuto {
 		return nil
 	}
 	page := oms.NewPage()
@@ -36,7 +38,7 @@ func (s *Server) renderLocalBookmarks(authCode, authPrefix string, opts *oms.Ren
 	page.AddPlus()
 	page.AddText("Bookmarks")
 	page.AddBreak()
-	bookmarks := s.cfg.Bookmarks
+	bookmarks := cfg.Bookmarks
 	if len(bookmarks) == 0 {
 		bookmarks = parseBookmarks(defaultBookmarksSpec)
 	}
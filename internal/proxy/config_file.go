@@ -0,0 +1,143 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+	"time"
+
+	"operetta/oms"
+)
+
+// FileConfig is the JSON configuration file read by `cmd/operetta -config`.
+// Every field is optional; OMS_* environment variables override file values.
+// Durations use Go syntax ("72h", "30s").
+type FileConfig struct {
+	// Listener settings consumed by cmd/operetta.
+	Addr            string `json:"addr,omitempty"`
+	TLSCert         string `json:"tlsCert,omitempty"`
+	TLSKey          string `json:"tlsKey,omitempty"`
+	TLSAddr         string `json:"tlsAddr,omitempty"`
+	ShutdownTimeout string `json:"shutdownTimeout,omitempty"`
+
+	SitesDir      string      `json:"sitesDir,omitempty"`
+	BookmarksMode string      `json:"bookmarksMode,omitempty"`
+	Bookmarks     []Bookmark  `json:"bookmarks,omitempty"`
+	SessionFile   string      `json:"sessionFile,omitempty"`
+	SessionIdle   string      `json:"sessionIdle,omitempty"`
+	SessionMax    int         `json:"sessionMax,omitempty"`
+	PageCacheMB   int         `json:"pageCacheMB,omitempty"`
+	UploadSlotKB  int         `json:"uploadSlotKB,omitempty"`
+	UploadTotalMB int         `json:"uploadTotalMB,omitempty"`
+	AdminToken    string      `json:"adminToken,omitempty"`
+	AdminLoopback bool        `json:"adminLoopback,omitempty"`
+	Render        oms.Options `json:"render"`
+
+	// Logging: level is debug, info, warn or error (default info, or debug
+	// with render.httpDebug); format is json or text. Auth codes and form
+	// passwords are redacted unless logSecrets is set.
+	LogLevel   string `json:"logLevel,omitempty"`
+	LogFormat  string `json:"logFormat,omitempty"`
+	LogSecrets bool   `json:"logSecrets,omitempty"`
+}
+
+// ReadConfigFile parses and validates the JSON file at path. Unknown keys are
+// rejected so that typos do not silently fall back to defaults.
+func ReadConfigFile(path string) (*FileConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var fc FileConfig
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&fc); err != nil {
+		return nil, fmt.Errorf("config %s: %w", path, err)
+	}
+	for name, v := range map[string]string{"sessionIdle": fc.SessionIdle, "shutdownTimeout": fc.ShutdownTimeout} {
+		if v == "" {
+			continue
+		}
+		if d, err := time.ParseDuration(v); err != nil || d <= 0 {
+			return nil, fmt.Errorf("config %s: invalid %s %q", path, name, v)
+		}
+	}
+	if fc.LogLevel != "" {
+		var lvl slog.Level
+		if err := lvl.UnmarshalText([]byte(fc.LogLevel)); err != nil {
+			return nil, fmt.Errorf("config %s: invalid logLevel %q", path, fc.LogLevel)
+		}
+	}
+	return &fc, nil
+}
+
+// ShutdownDuration returns the configured drain timeout or fallback.
+func (fc *FileConfig) ShutdownDuration(fallback time.Duration) time.Duration {
+	if d, err := time.ParseDuration(fc.ShutdownTimeout); err == nil && d > 0 {
+		return d
+	}
+	return fallback
+}
+
+// Config converts the file into a server Config, applying the environment on
+// top and filling defaults for anything left unset.
+func (fc *FileConfig) Config() Config {
+	cfg := Config{
+		IndexHTML:     defaultIndexHTML,
+		Clock:         time.Now,
+		SitesDir:      fc.SitesDir,
+		BookmarkMode:  parseBookmarkMode(fc.BookmarksMode),
+		Bookmarks:     append([]Bookmark(nil), fc.Bookmarks...),
+		AdminToken:    fc.AdminToken,
+		AdminLoopback: fc.AdminLoopback,
+		Render:        fc.Render,
+		SessionLimits: SessionLimits{
+			MaxSessions: fc.SessionMax,
+		},
+	}
+	if d, err := time.ParseDuration(fc.SessionIdle); err == nil && d > 0 {
+		cfg.SessionLimits.IdleTTL = d
+	}
+	if fc.PageCacheMB > 0 {
+		cfg.PageCacheBytes = int64(fc.PageCacheMB) << 20
+	}
+	if fc.UploadSlotKB != 0 {
+		cfg.UploadSlotBytes = int64(fc.UploadSlotKB) << 10
+	}
+	if fc.UploadTotalMB > 0 {
+		cfg.UploadTotalBytes = int64(fc.UploadTotalMB) << 20
+	}
+	if fc.SessionFile != "" {
+		cfg.SessionStore = NewFileSessionStore(fc.SessionFile)
+	}
+	applyEnv(&cfg)
+	if cfg.SitesDir == "" {
+		cfg.SitesDir = defaultSitesDir
+	}
+	finishBookmarks(&cfg)
+	cfg.Logger = fc.logger(cfg.Render.HTTPDebug)
+	return cfg
+}
+
+// logger builds the structured logger from the file settings, overridden by
+// OMS_LOG_LEVEL, OMS_LOG_FORMAT and OMS_LOG_SECRETS.
+func (fc *FileConfig) logger(httpDebug bool) *slog.Logger {
+	level, format, secrets := fc.LogLevel, fc.LogFormat, fc.LogSecrets
+	if v := strings.TrimSpace(os.Getenv("OMS_LOG_LEVEL")); v != "" {
+		level = v
+	}
+	if v := strings.TrimSpace(os.Getenv("OMS_LOG_FORMAT")); v != "" {
+		format = v
+	}
+	if v := strings.TrimSpace(os.Getenv("OMS_LOG_SECRETS")); v != "" {
+		secrets = v == "1"
+	}
+	fallback := slog.LevelInfo
+	if httpDebug {
+		fallback = slog.LevelDebug
+	}
+	return NewLogger(os.Stdout, format, parseLogLevel(level, fallback), secrets)
+}
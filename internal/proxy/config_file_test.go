@@ -0,0 +1,64 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReadConfigFileWithEnvOverrides(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "operetta.json")
+	body := `{
+	"addr": ":9000",
+	"sitesDir": "sites",
+	"bookmarksMode": "local",
+	"bookmarks": [{"title": "Wiki", "url": "https://en.wikipedia.org"}],
+	"sessionIdle": "12h",
+	"pageCacheMB": 8,
+	"render": {"paginateTags": 900, "imageCacheMB": 5}
+}`
+	if err := os.WriteFile(path, []byte(body), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	fc, err := ReadConfigFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fc.Addr != ":9000" {
+		t.Fatalf("addr = %q", fc.Addr)
+	}
+
+	t.Setenv("OMS_PAGE_CACHE_MB", "")
+	t.Setenv("OMS_SITES_DIR", "")
+	t.Setenv("OMS_PAGINATE_TAGS", "1200")
+	cfg := fc.Config()
+	if cfg.SitesDir != "sites" || cfg.BookmarkMode != BookmarkModeLocal || len(cfg.Bookmarks) != 1 {
+		t.Fatalf("file values not applied: %+v", cfg)
+	}
+	if cfg.SessionLimits.IdleTTL != 12*time.Hour || cfg.PageCacheBytes != 8<<20 {
+		t.Fatalf("unexpected limits: idle=%s cache=%d", cfg.SessionLimits.IdleTTL, cfg.PageCacheBytes)
+	}
+	if cfg.Render.PaginateTags != 1200 || cfg.Render.ImageCacheMB != 5 {
+		t.Fatalf("expected env to override paginateTags only, got %+v", cfg.Render)
+	}
+
+	if err := os.WriteFile(path, []byte(`{"sitesDirr": "typo"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfigFile(path); err == nil {
+		t.Fatalf("expected unknown key to be rejected")
+	}
+	if err := os.WriteFile(path, []byte(`{"sessionIdle": "soon"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfigFile(path); err == nil {
+		t.Fatalf("expected invalid duration to be rejected")
+	}
+	if err := os.WriteFile(path, []byte(`{"logLevel": "loud"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ReadConfigFile(path); err == nil {
+		t.Fatalf("expected invalid log level to be rejected")
+	}
+}
@@ -4,32 +4,257 @@ import (
 	"net"
 	"net/http"
 	"net/http/cookiejar"
+	"net/url"
+	"sort"
+	"strings"
 	"sync"
+	"time"
 )
 
 // CookieJarStore keeps a map of per-client cookie jars keyed by a stable client identifier.
 // It allows the proxy and the OMS renderer to share upstream session state transparently.
 type CookieJarStore struct {
-	mu   sync.Mutex
-	jars map[string]http.CookieJar
+	mu    sync.Mutex
+	jars  map[string]http.CookieJar
+	index *sessionIndex
+	clock func() time.Time
 }
 
 func NewCookieJarStore() *CookieJarStore {
-	return &CookieJarStore{jars: make(map[string]http.CookieJar)}
+	return &CookieJarStore{jars: make(map[string]http.CookieJar), index: newSessionIndex(), clock: time.Now}
+}
+
+// SetClock overrides the time source used to track jar usage.
+func (s *CookieJarStore) SetClock(clock func() time.Time) {
+	if clock == nil {
+		clock = time.Now
+	}
+	s.mu.Lock()
+	s.clock = clock
+	s.mu.Unlock()
 }
 
 // Get returns the existing jar for the provided key or allocates a new one on demand.
 func (s *CookieJarStore) Get(key string) http.CookieJar {
 	s.mu.Lock()
 	defer s.mu.Unlock()
+	s.index.touch(key, s.clock())
 	if jar, ok := s.jars[key]; ok {
 		return jar
 	}
-	jar, _ := cookiejar.New(nil)
+	jar := newRecordingJar(s.clock)
 	s.jars[key] = jar
 	return jar
 }
 
+// bound evicts the least recently used jar once an insert exceeds cap.
+func (s *CookieJarStore) bound(cap *sessionCap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.bound(cap, func(key string) { delete(s.jars, key) })
+}
+
+// Len reports the number of live jars.
+func (s *CookieJarStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.jars)
+}
+
+// Sweep drops jars unused for longer than idle and trims the store to max
+// entries, least recently used first. It returns the number of evicted jars.
+func (s *CookieJarStore) Sweep(now time.Time, idle time.Duration, max int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.evictable(now, idle, max)
+	for _, key := range keys {
+		delete(s.jars, key)
+	}
+	return len(keys)
+}
+
+// Snapshot exports the cookies of every jar that can be serialised, skipping
+// expired entries. Jars installed from outside the store are ignored.
+func (s *CookieJarStore) Snapshot(now time.Time) map[string][]PersistedCookie {
+	s.mu.Lock()
+	jars := make(map[string]*recordingJar, len(s.jars))
+	for key, jar := range s.jars {
+		if rj, ok := jar.(*recordingJar); ok {
+			jars[key] = rj
+		}
+	}
+	s.mu.Unlock()
+	out := make(map[string][]PersistedCookie, len(jars))
+	for key, jar := range jars {
+		if cookies := jar.export(now); len(cookies) > 0 {
+			out[key] = cookies
+		}
+	}
+	return out
+}
+
+// Domains lists the cookie domains held in the jar for key, sorted.
+func (s *CookieJarStore) Domains(key string) []string {
+	s.mu.Lock()
+	jar, _ := s.jars[key].(*recordingJar)
+	now := s.clock()
+	s.mu.Unlock()
+	if jar == nil {
+		return nil
+	}
+	seen := map[string]bool{}
+	var out []string
+	for _, c := range jar.export(now) {
+		domain := strings.TrimPrefix(strings.ToLower(c.Domain), ".")
+		if domain == "" {
+			if u, err := url.Parse(c.URL); err == nil {
+				domain = strings.ToLower(u.Hostname())
+			}
+		}
+		if domain != "" && !seen[domain] {
+			seen[domain] = true
+			out = append(out, domain)
+		}
+	}
+	sort.Strings(out)
+	return out
+}
+
+// LastUsed reports when each jar was last used, for RestoreWithLastUsed.
+func (s *CookieJarStore) LastUsed() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.lastUsed()
+}
+
+// Restore recreates jars from a snapshot as if they were used at now.
+// Existing jars with the same key are replaced.
+func (s *CookieJarStore) Restore(data map[string][]PersistedCookie, now time.Time) {
+	s.RestoreWithLastUsed(data, nil, now)
+}
+
+// RestoreWithLastUsed is Restore keeping the last-use times reported by
+// LastUsed, so a restart neither renews idle jars nor shuffles their
+// eviction order.
+func (s *CookieJarStore) RestoreWithLastUsed(data map[string][]PersistedCookie, lastUsed map[string]time.Time, now time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(data))
+	for key, cookies := range data {
+		jar := newRecordingJar(s.clock)
+		jar.load(cookies, now)
+		s.jars[key] = jar
+		keys = append(keys, key)
+	}
+	s.index.restore(keys, lastUsed, now)
+}
+
+// PersistedCookie is the serialisable form of a cookie kept in a client jar.
+// URL records the origin the cookie was received from so that it can be replayed
+// into a fresh cookiejar.Jar with the same domain and path scoping.
+type PersistedCookie struct {
+	URL      string    `json:"url"`
+	Name     string    `json:"name"`
+	Value    string    `json:"value"`
+	Path     string    `json:"path,omitempty"`
+	Domain   string    `json:"domain,omitempty"`
+	Expires  time.Time `json:"expires,omitempty"`
+	Secure   bool      `json:"secure,omitempty"`
+	HttpOnly bool      `json:"httpOnly,omitempty"`
+}
+
+// recordingJar wraps cookiejar.Jar and remembers every cookie it accepts so the
+// jar contents can be exported; the standard library jar keeps them private.
+type recordingJar struct {
+	jar   *cookiejar.Jar
+	clock func() time.Time
+
+	mu      sync.Mutex
+	entries map[string]PersistedCookie
+}
+
+func newRecordingJar(clock func() time.Time) *recordingJar {
+	jar, _ := cookiejar.New(nil)
+	return &recordingJar{jar: jar, clock: clock, entries: make(map[string]PersistedCookie)}
+}
+
+func (j *recordingJar) SetCookies(u *url.URL, cookies []*http.Cookie) {
+	j.jar.SetCookies(u, cookies)
+	if u == nil || len(cookies) == 0 {
+		return
+	}
+	now := j.clock()
+	origin := url.URL{Scheme: u.Scheme, Host: u.Host, Path: u.Path}
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	for _, c := range cookies {
+		if c == nil || c.Name == "" {
+			continue
+		}
+		key := strings.ToLower(c.Domain) + "|" + c.Path + "|" + c.Name + "|" + strings.ToLower(u.Host)
+		if c.MaxAge < 0 || (!c.Expires.IsZero() && c.Expires.Before(now)) {
+			delete(j.entries, key)
+			continue
+		}
+		expires := c.Expires
+		if c.MaxAge > 0 {
+			expires = now.Add(time.Duration(c.MaxAge) * time.Second)
+		}
+		j.entries[key] = PersistedCookie{
+			URL:      origin.String(),
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			Expires:  expires,
+			Secure:   c.Secure,
+			HttpOnly: c.HttpOnly,
+		}
+	}
+}
+
+func (j *recordingJar) Cookies(u *url.URL) []*http.Cookie {
+	return j.jar.Cookies(u)
+}
+
+func (j *recordingJar) export(now time.Time) []PersistedCookie {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	out := make([]PersistedCookie, 0, len(j.entries))
+	for key, c := range j.entries {
+		if !c.Expires.IsZero() && c.Expires.Before(now) {
+			delete(j.entries, key)
+			continue
+		}
+		out = append(out, c)
+	}
+	return out
+}
+
+func (j *recordingJar) load(cookies []PersistedCookie, now time.Time) {
+	for _, pc := range cookies {
+		if pc.Name == "" || (!pc.Expires.IsZero() && pc.Expires.Before(now)) {
+			continue
+		}
+		u, err := url.Parse(pc.URL)
+		if err != nil || u.Host == "" {
+			continue
+		}
+		j.SetCookies(u, []*http.Cookie{{
+			Name:     pc.Name,
+			Value:    pc.Value,
+			Path:     pc.Path,
+			Domain:   pc.Domain,
+			Expires:  pc.Expires,
+			Secure:   pc.Secure,
+			HttpOnly: pc.HttpOnly,
+		}})
+	}
+}
+
 // DeriveClientKey synthesises a stable identifier for the incoming HTTP request combining
 // the remote host and User-Agent. The value is suitable for addressing CookieJarStore entries.
 func DeriveClientKey(r *http.Request) string {
@@ -40,4 +265,8 @@ func DeriveClientKey(r *http.Request) string {
 	return host + "|" + r.UserAgent()
 }
 
+// CookieJarStoreInstance is a process-wide store kept for callers that predate
+// per-server stores; it is not connected to any Server.
+//
+// Deprecated: use Server.CookieJars, or NewCookieJarStore for a standalone store.
 var CookieJarStoreInstance = NewCookieJarStore()
@@ -4,29 +4,30 @@ import (
 	"bytes"
 	"compress/flate"
 	"compress/gzip"
+	"context"
 	"encoding/binary"
 	"encoding/hex"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"os"
 
 	"operetta/oms"
 )
 
-func dumpOMS(logger *log.Logger, b []byte) {
-	if logger == nil || len(b) == 0 {
+func dumpOMS(logger *slog.Logger, b []byte) {
+	if logger == nil || len(b) == 0 || !logger.Enabled(context.Background(), slog.LevelDebug) {
 		return
 	}
 	size := len(b)
 	if size > 256 {
 		size = 256
 	}
-	logger.Printf("OMS %d bytes (first %d shown): %s", len(b), size, hexBlock(b, 0, size))
+	logger.Debug("oms dump", "bytes", len(b), "shown", size, "hex", hexBlock(b, 0, size))
 
 	if os.Getenv("OMS_DEBUG_SCAN") == "1" {
 		if msg := scanOMSForSuspicious(b); msg != "" {
-			logger.Print(msg)
+			logger.Debug("oms scan", "msg", msg)
 		}
 	}
 }
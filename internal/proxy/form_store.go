@@ -4,19 +4,46 @@ import (
 	"net/url"
 	"strings"
 	"sync"
+	"time"
+
+	"operetta/oms"
 )
 
 // formStore remembers hidden form fields discovered on origin pages so that
 // subsequent POST submissions can be augmented with the expected tokens (e.g. CK/CSRF).
 // Entries are stored per logical client and form action and consumed on first use
 // to avoid leaking stale tokens across sessions.
+// The store also keeps the form registry of the client's recent pages so that
+// submissions can be replayed exactly; the registry is not consumed. The submit
+// charset of each action is kept apart from the registry, so forms the registry
+// no longer knows are still encoded the way their page expects.
 type formStore struct {
-	mu   sync.Mutex
-	data map[string]map[string]string
+	mu           sync.Mutex
+	data         map[string]map[string]string
+	index        *sessionIndex
+	specs        map[string][]*oms.FormSpec
+	specIndex    *sessionIndex
+	charsets     map[string]string
+	charsetIndex *sessionIndex
+	clock        func() time.Time
 }
 
-func newFormStore() *formStore {
-	return &formStore{data: make(map[string]map[string]string)}
+// maxFormSpecsPerClient bounds the registry entries kept per client.
+const maxFormSpecsPerClient = 32
+
+func newFormStore(clock func() time.Time) *formStore {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &formStore{
+		data:         make(map[string]map[string]string),
+		index:        newSessionIndex(),
+		specs:        make(map[string][]*oms.FormSpec),
+		specIndex:    newSessionIndex(),
+		charsets:     make(map[string]string),
+		charsetIndex: newSessionIndex(),
+		clock:        clock,
+	}
 }
 
 // Store snapshots the hidden fields for one or more form actions under the given client key.
@@ -29,6 +56,7 @@ func (s *formStore) Store(clientKey string, forms map[string]map[string]string)
 	if s.data == nil {
 		s.data = make(map[string]map[string]string)
 	}
+	now := s.clock()
 	for action, fields := range forms {
 		actionKey := normalizeFormActionKey(action)
 		if actionKey == "" || len(fields) == 0 {
@@ -40,10 +68,148 @@ func (s *formStore) Store(clientKey string, forms map[string]map[string]string)
 			clone[name] = val
 		}
 		s.data[key] = clone
+		s.index.touch(key, now)
 	}
 	s.mu.Unlock()
 }
 
+// StoreSpecs adds the form registry of a rendered page to the client's
+// known forms and remembers the submit charset of each action. A form
+// replaces an older one with the same action and field names; the oldest
+// forms are dropped beyond maxFormSpecsPerClient.
+func (s *formStore) StoreSpecs(clientKey string, specs []*oms.FormSpec) {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" || len(specs) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.specs == nil {
+		s.specs = make(map[string][]*oms.FormSpec)
+	}
+	if s.charsets == nil {
+		s.charsets = make(map[string]string)
+	}
+	now := s.clock()
+	known := s.specs[clientKey]
+	for _, spec := range specs {
+		actionKey := ""
+		if spec != nil {
+			actionKey = normalizeFormActionKey(spec.Action)
+		}
+		if actionKey == "" {
+			continue
+		}
+		if spec.Charset != "" {
+			s.charsets[clientKey+"|"+actionKey] = spec.Charset
+			s.charsetIndex.touch(clientKey+"|"+actionKey, now)
+		}
+		sig := formSignature(spec)
+		kept := known[:0]
+		for _, old := range known {
+			if formSignature(old) != sig {
+				kept = append(kept, old)
+			}
+		}
+		known = append(kept, spec)
+	}
+	if len(known) > maxFormSpecsPerClient {
+		known = append([]*oms.FormSpec(nil), known[len(known)-maxFormSpecsPerClient:]...)
+	}
+	s.specs[clientKey] = known
+	s.specIndex.touch(clientKey, now)
+}
+
+// Charset returns the submit charset remembered for the client's form
+// action, or "" when the action was never seen.
+func (s *formStore) Charset(clientKey, action string) string {
+	clientKey = strings.TrimSpace(clientKey)
+	actionKey := normalizeFormActionKey(action)
+	if clientKey == "" || actionKey == "" {
+		return ""
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	cs, ok := s.charsets[clientKey+"|"+actionKey]
+	if ok {
+		s.charsetIndex.touch(clientKey+"|"+actionKey, s.clock())
+	}
+	return cs
+}
+
+// bound evicts the least recently used hidden fields and form registries
+// once an insert exceeds cap.
+func (s *formStore) bound(cap *sessionCap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.bound(cap, func(key string) { delete(s.data, key) })
+	s.specIndex.bound(cap, func(key string) { delete(s.specs, key) })
+	s.charsetIndex.bound(cap, func(key string) { delete(s.charsets, key) })
+}
+
+func formSignature(spec *oms.FormSpec) string {
+	var b strings.Builder
+	b.WriteString(normalizeFormActionKey(spec.Action))
+	for _, fld := range spec.Fields {
+		b.WriteByte('|')
+		b.WriteString(fld.Name)
+	}
+	return b.String()
+}
+
+// Spec finds the registry entry of the form a payload was submitted from.
+// Payload fields must all belong to the form unless it posts to action;
+// among candidates the one knowing most of the fields wins, with forms
+// posting to action and newer forms preferred. It returns nil when no
+// form fits, and the caller falls back to guessing.
+func (s *formStore) Spec(clientKey, action, formBody string) *oms.FormSpec {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" {
+		return nil
+	}
+	actionKey := normalizeFormActionKey(action)
+	vals, _ := url.ParseQuery(formBody)
+	var names []string
+	for name := range vals {
+		switch strings.ToLower(name) {
+		case "opf", "opa", "action", "dname":
+			continue
+		}
+		if !isOperaMiniActionKey(name) {
+			names = append(names, name)
+		}
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	known := s.specs[clientKey]
+	var best *oms.FormSpec
+	bestScore := 0
+	for i := len(known) - 1; i >= 0; i-- {
+		spec := known[i]
+		matches := 0
+		for _, name := range names {
+			if spec.Has(name) {
+				matches++
+			}
+		}
+		sameAction := actionKey != "" && normalizeFormActionKey(spec.Action) == actionKey
+		if !sameAction && (matches == 0 || matches < len(names)) {
+			continue
+		}
+		score := 2*matches + 1
+		if sameAction {
+			score += len(names) + 1
+		}
+		if score > bestScore {
+			best, bestScore = spec, score
+		}
+	}
+	if best != nil {
+		s.specIndex.touch(clientKey, s.clock())
+	}
+	return best
+}
+
 // Augment merges cached hidden fields into the outgoing form body if none of the
 // stored fields are already present. When augmentation succeeds the cached entry
 // is consumed to avoid reusing tokens after the POST completes.
@@ -75,6 +241,7 @@ func (s *formStore) Augment(clientKey, action, formBody string) (string, bool) {
 	}
 	s.mu.Lock()
 	delete(s.data, clientKey+"|"+actionKey)
+	s.index.remove(clientKey + "|" + actionKey)
 	s.mu.Unlock()
 	return vals.Encode(), true
 }
@@ -86,3 +253,136 @@ func normalizeFormActionKey(action string) string {
 	}
 	return normalizeObmlURL(action)
 }
+
+// Snapshot returns a deep copy of the remembered hidden fields keyed by client|action.
+func (s *formStore) Snapshot() map[string]map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]map[string]string, len(s.data))
+	for key, fields := range s.data {
+		clone := make(map[string]string, len(fields))
+		for name, val := range fields {
+			clone[name] = val
+		}
+		out[key] = clone
+	}
+	return out
+}
+
+// Restore merges a snapshot produced by Snapshot back into the store.
+func (s *formStore) Restore(data map[string]map[string]string) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.data == nil {
+		s.data = make(map[string]map[string]string)
+	}
+	now := s.clock()
+	for key, fields := range data {
+		if key == "" || len(fields) == 0 {
+			continue
+		}
+		s.data[key] = fields
+		s.index.touch(key, now)
+	}
+}
+
+// SpecSnapshot returns the form registry of every client.
+func (s *formStore) SpecSnapshot() map[string][]*oms.FormSpec {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string][]*oms.FormSpec, len(s.specs))
+	for key, specs := range s.specs {
+		out[key] = append([]*oms.FormSpec(nil), specs...)
+	}
+	return out
+}
+
+// SpecsLastUsed reports when each client's registry was last used.
+func (s *formStore) SpecsLastUsed() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.specIndex.lastUsed()
+}
+
+// RestoreSpecs loads registries saved by SpecSnapshot, oldest first by
+// lastUsed; registries without a time count as used now.
+func (s *formStore) RestoreSpecs(data map[string][]*oms.FormSpec, lastUsed map[string]time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.specs == nil {
+		s.specs = make(map[string][]*oms.FormSpec)
+	}
+	keys := make([]string, 0, len(data))
+	for key, specs := range data {
+		if key == "" || len(specs) == 0 {
+			continue
+		}
+		if len(specs) > maxFormSpecsPerClient {
+			specs = specs[len(specs)-maxFormSpecsPerClient:]
+		}
+		s.specs[key] = specs
+		keys = append(keys, key)
+	}
+	s.specIndex.restore(keys, lastUsed, s.clock())
+}
+
+// CharsetSnapshot returns the remembered submit charsets keyed by client|action.
+func (s *formStore) CharsetSnapshot() map[string]string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]string, len(s.charsets))
+	for key, cs := range s.charsets {
+		out[key] = cs
+	}
+	return out
+}
+
+// RestoreCharsets merges a snapshot produced by CharsetSnapshot back into the store.
+func (s *formStore) RestoreCharsets(data map[string]string) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.charsets == nil {
+		s.charsets = make(map[string]string)
+	}
+	now := s.clock()
+	for key, cs := range data {
+		if key == "" || cs == "" {
+			continue
+		}
+		s.charsets[key] = cs
+		s.charsetIndex.touch(key, now)
+	}
+}
+
+// Len reports the number of remembered client|action entries.
+func (s *formStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// Sweep evicts idle entries and trims the store to max entries.
+func (s *formStore) Sweep(now time.Time, idle time.Duration, max int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.evictable(now, idle, max)
+	for _, key := range keys {
+		delete(s.data, key)
+	}
+	for _, key := range s.specIndex.evictable(now, idle, max) {
+		delete(s.specs, key)
+	}
+	for _, key := range s.charsetIndex.evictable(now, idle, max) {
+		delete(s.charsets, key)
+	}
+	return len(keys)
+}
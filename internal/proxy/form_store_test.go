@@ -0,0 +1,46 @@
+package proxy
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"operetta/oms"
+)
+
+func TestFormStoreSpecMatchesPayloadFields(t *testing.T) {
+	store := newFormStore(time.Now)
+	login := &oms.FormSpec{Action: "http://mail.test/login", Method: http.MethodPost,
+		Fields: []oms.FormField{{Name: "user", Type: "text"}, {Name: "pass", Type: "password"}}}
+	search := &oms.FormSpec{Action: "http://mail.test/find", Method: http.MethodGet,
+		Fields: []oms.FormField{{Name: "q", Type: "text"}}}
+	store.StoreSpecs("client", []*oms.FormSpec{login, search})
+
+	// The payload names tell the forms apart even when the client posts to
+	// the page URL instead of the action.
+	if got := store.Spec("client", "http://mail.test/", "user=a&pass=b&opf=1"); got != login {
+		t.Fatalf("expected the login form, got %+v", got)
+	}
+	if got := store.Spec("client", "http://mail.test/", "q=x&dname=Go"); got != search {
+		t.Fatalf("expected the search form, got %+v", got)
+	}
+	if got := store.Spec("client", "http://mail.test/find", "q=x&extra=1"); got != search {
+		t.Fatalf("expected the action to pick the search form, got %+v", got)
+	}
+	if got := store.Spec("client", "http://mail.test/", "q=x&extra=1"); got != nil {
+		t.Fatalf("a payload with unknown fields must not match another action, got %+v", got)
+	}
+	if got := store.Spec("other", "http://mail.test/login", "user=a"); got != nil {
+		t.Fatalf("forms are per client, got %+v", got)
+	}
+
+	// A re-rendered form replaces its older entry.
+	again := &oms.FormSpec{Action: login.Action, Method: http.MethodPost, Fields: login.Fields}
+	store.StoreSpecs("client", []*oms.FormSpec{again})
+	if got := store.Spec("client", "", "user=a&pass=b"); got != again {
+		t.Fatalf("expected the newest login form, got %+v", got)
+	}
+	if n := len(store.specs["client"]); n != 2 {
+		t.Fatalf("expected two registry entries, got %d", n)
+	}
+}
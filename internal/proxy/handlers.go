@@ -1,18 +1,15 @@
 package proxy
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"mime"
 	"net/http"
 	"net/url"
-	"os"
 	"path"
-	"regexp"
 	"sort"
 	"strconv"
 	"strings"
@@ -65,6 +62,20 @@ func parseOperaBool(raw string) (bool, bool) {
 	return false, false
 }
 
+// deviceCharset returns the handset's preferred encoding: the E= parameter,
+// else the first label of its Accept-Charset header.
+func deviceCharset(r *http.Request, params map[string]string) string {
+	if e := strings.TrimSpace(params["E"]); e != "" {
+		return e
+	}
+	label, _, _ := strings.Cut(r.Header.Get("Accept-Charset"), ",")
+	label, _, _ = strings.Cut(label, ";")
+	if label = strings.TrimSpace(label); label == "*" {
+		return ""
+	}
+	return label
+}
+
 func interpretImageMode(raw string) (bool, bool) {
 	val := strings.TrimSpace(raw)
 	if val == "" {
@@ -85,38 +96,15 @@ func interpretImageMode(raw string) (bool, bool) {
 func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 	if r.Method == http.MethodPost {
 		body, _ := io.ReadAll(r.Body)
-		debugHTTP := os.Getenv("OMS_HTTP_DEBUG") != "1"
-
-		////if debugHTTP {
-		s.logger.Printf("===> Incoming %s %s from %s", r.Method, r.URL.Path, r.RemoteAddr)
-		s.logger.Printf("Headers:")
-		for k, v := range r.Header {
-			s.logger.Printf("  %s: %s", k, strings.Join(v, "; "))
-		}
-		s.logger.Printf("Body length: %d", len(body))
-		if bytes.Contains(body, []byte("h=")) || bytes.Contains(body, []byte("c=")) {
-			reH := regexp.MustCompile(`h=([^\x00]+)`)
-			reC := regexp.MustCompile(`c=([^\x00]+)`)
-			mH := reH.FindSubmatch(body)
-			mC := reC.FindSubmatch(body)
-			s.logger.Printf("Auth fields detected in body: prefix=%q code=%q",
-				func() string {
-					if len(mH) > 1 {
-						return string(mH[1])
-					}
-					return ""
-				}(),
-				func() string {
-					if len(mC) > 1 {
-						return string(mC[1])
-					}
-					return ""
-				}(),
-			)
-		} else {
-			s.logger.Printf("No h=/c= fields found in POST body.")
+		debugHTTP := s.config().Render.HTTPDebug
+		lg := s.requestLogger(r)
+		if debugHTTP {
+			hdrs := make([]any, 0, len(r.Header))
+			for k, v := range r.Header {
+				hdrs = append(hdrs, slog.String(k, strings.Join(v, "; ")))
+			}
+			lg.Debug("opera mini request", "path", r.URL.Path, "body_len", len(body), slog.Group("headers", hdrs...))
 		}
-		////}
 
 		r.Body.Close()
 		params := parseNullKV(body)
@@ -155,11 +143,17 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 				if k == "" {
 					continue
 				}
+				if k == "c" || k == "h" {
+					continue // logged separately so they can be redacted
+				}
 				v := params[k]
 				mask := strings.ToLower(k)
 				display := v
 				if strings.Contains(mask, "pass") || strings.Contains(mask, "pwd") {
 					display = "***"
+				} else if k == "j" {
+					// Form payloads carry field values, passwords included.
+					display = fmt.Sprintf("<%d bytes>", len(v))
 				} else {
 					if _, full := fullKeys[strings.ToLower(k)]; !full && len(display) > 32 {
 						display = display[:32] + "..."
@@ -167,10 +161,7 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 				}
 				pairs = append(pairs, fmt.Sprintf("%s=%q", k, display))
 			}
-			s.logger.Printf("Parsed params: c=%q, h=%q, u=%q keys=%v", params["c"], params["h"], params["u"], keys)
-			if len(pairs) > 0 {
-				s.logger.Printf("Param snapshot: %s", strings.Join(pairs, ", "))
-			}
+			lg.Debug("parsed params", "auth_code", params["c"], "auth_prefix", params["h"], "u", params["u"], "keys", keys, "snapshot", strings.Join(pairs, ", "))
 		}
 
 		// Ensure per-client auth tokens are present or create them.
@@ -186,18 +177,17 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		if params["h"] != "" && params["c"] != "" {
 			tok, ok = s.auth.ensureByCode(params["h"], params["c"])
 			if ok {
-				s.logger.Printf("AuthStore: restored existing session for h=%q c=%q", params["h"], params["c"])
+				lg.Info("auth session restored", "auth_prefix", params["h"], "auth_code", params["c"])
 			} else {
 				// создаём или обновляем токен для clientKey
 				tok.Prefix = params["h"]
 				tok.Code = params["c"]
 				s.auth.updateToken(clientKey, tok)
-				s.logger.Printf("AuthStore: registered new session for h=%q c=%q (clientKey=%q)",
-					params["h"], params["c"], clientKey)
+				lg.Info("auth session registered", "auth_prefix", params["h"], "auth_code", params["c"], "client_key", clientKey)
 			}
 		} else {
 			tok = s.auth.ensure(clientKey)
-			s.logger.Printf("AuthStore: created new session for %q", clientKey)
+			lg.Info("auth session created", "client_key", clientKey)
 
 			h := strings.TrimSpace(params["h"])
 			c := strings.TrimSpace(params["c"])
@@ -209,15 +199,14 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 					tok.Code = c
 				}
 				s.auth.updateToken(clientKey, tok)
-				s.logger.Printf("AuthStore: updated token for %q with prefix=%q code=%q", clientKey, tok.Prefix, tok.Code)
+				lg.Info("auth token updated", "client_key", clientKey, "auth_prefix", tok.Prefix, "auth_code", tok.Code)
 			} else {
-				s.logger.Printf("AuthStore: kept generated token for %q (no prefix/code provided)", clientKey)
+				lg.Debug("auth token kept", "client_key", clientKey)
 			}
 		}
 
 		if debugHTTP {
-			s.logger.Printf("AuthStore.ensure for clientKey=%q => prefix=%q code=%q",
-				clientKey, tok.Prefix, tok.Code)
+			lg.Debug("auth token", "client_key", clientKey, "auth_prefix", tok.Prefix, "auth_code", tok.Code)
 		}
 
 		if strings.TrimSpace(params["c"]) == "" {
@@ -233,7 +222,7 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 				http.SetCookie(w, s.auth.cookieFor(clientKey))
 
 				if debugHTTP {
-					s.logger.Printf("Set auth cookie for %q: %+v", clientKey, s.auth.cookieFor(clientKey))
+					lg.Debug("set auth cookie", "client_key", clientKey)
 				}
 			}
 			page := s.renderBootstrapPage(tok.Code, tok.Prefix)
@@ -245,34 +234,51 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 			effectiveTarget := target
 			jarKey := s.clientJarKey(r, params)
 			hdr := s.headersFromParams(r, params)
+			var formSpec *oms.FormSpec
 			if form := strings.TrimSpace(params["j"]); form != "" {
-				logOperaMiniForm(s.logger, "Inbound", form)
-				if derived := deriveOperaMiniFormTarget(target, form); derived != "" {
+				logOperaMiniForm(lg, "Inbound", form)
+				derived := deriveOperaMiniFormTarget(target, form)
+				// A form from the client's registry is replayed as rendered;
+				// the payload-based guesses only apply to unknown forms.
+				if formSpec = s.forms.Spec(jarKey, firstNonEmpty(derived, target), form); formSpec != nil {
+					if formSpec.Action != effectiveTarget {
+						lg.Debug("form target from registry", "from", effectiveTarget, "to", formSpec.Action, "method", formSpec.Method)
+					}
+					effectiveTarget = formSpec.Action
+				} else if derived != "" {
 					if derived != effectiveTarget {
-						s.logger.Printf("Form target override: %q -> %q", effectiveTarget, derived)
+						lg.Debug("form target override", "from", effectiveTarget, "to", derived)
 					}
 					effectiveTarget = derived
 				}
 				if augmented, changed := s.forms.Augment(jarKey, effectiveTarget, form); changed {
 					params["j"] = augmented
-					logOperaMiniForm(s.logger, "Augmented", augmented)
+					logOperaMiniForm(lg, "Augmented", augmented)
 					if debugHTTP {
-						s.logger.Printf("Form augment: applied stored hidden fields for %q", effectiveTarget)
+						lg.Debug("form augmented from stored hidden fields", "target", effectiveTarget)
 					}
-				} else if s.prefetchFormHidden(r, params, effectiveTarget, hdr, jarKey, debugHTTP) {
+				} else if formSpec == nil && s.prefetchFormHidden(r, params, effectiveTarget, hdr, jarKey, debugHTTP) {
 					if augmented, changed := s.forms.Augment(jarKey, effectiveTarget, form); changed {
 						params["j"] = augmented
-						logOperaMiniForm(s.logger, "Augmented", augmented)
+						logOperaMiniForm(lg, "Augmented", augmented)
 						if debugHTTP {
-							s.logger.Printf("Form augment: applied prefetched hidden fields for %q", effectiveTarget)
+							lg.Debug("form augmented from prefetched hidden fields", "target", effectiveTarget)
 						}
 					}
 				}
 			}
 			opt := s.renderOptionsFromParams(r, params, hdr, jarKey)
+			if formSpec != nil {
+				opt.Form = formSpec
+				opt.FormFiles = s.uploads.Attach(jarKey, formSpec.FileFields(), params["j"])
+			} else if opt.FormBody != "" {
+				opt.FormCharset = s.forms.Charset(jarKey, effectiveTarget)
+			}
+			opt.UploadSlots = s.uploads.Slots(jarKey)
+			s.metrics.request(clientVersionLabel(opt.ClientVersion))
 			if debugHTTP {
-				s.logger.Printf("FETCH target(raw=%q norm=%q effective=%q) jarKey=%q formLen=%d hdrCookieLen=%d",
-					raw, target, effectiveTarget, jarKey, len(opt.FormBody), len(hdr.Get("Cookie")))
+				lg.Debug("fetch target", "raw", raw, "normalized", target, "effective", effectiveTarget,
+					"jar_key", jarKey, "form_len", len(opt.FormBody), "cookie_len", len(hdr.Get("Cookie")))
 			}
 			if s.isInternalAboutRequest(raw, effectiveTarget) {
 				page := s.renderAboutPage(params)
@@ -286,7 +292,7 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 						http.SetCookie(w, s.auth.cookieFor(clientKey))
 
 						if debugHTTP {
-							s.logger.Printf("Set auth cookie for %q: %+v", clientKey, s.auth.cookieFor(clientKey))
+							lg.Debug("set auth cookie", "client_key", clientKey)
 						}
 					}
 					s.writeOMS(w, page.Data, page.SetCookies, &page.Stats)
@@ -294,22 +300,22 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 				}
 			}
 			s.renderPrefs.Remember(s.renderPrefKeyWithOptions(r, params["u"], opt), opt)
-			cacheHit := s.serveFromCache(w, effectiveTarget, opt)
+			version := clientVersionLabel(opt.ClientVersion)
+			cacheHit := s.serveFromCache(w, effectiveTarget, opt, jarKey)
+			noteAccess(r, effectiveTarget, version, opt.Page, cacheHit)
 			if cacheHit {
 				return
 			}
-			page, err := s.loadPage(r.Context(), effectiveTarget, hdr, opt)
+			page, err := s.loadPageRevalidating(r.Context(), effectiveTarget, hdr, opt)
 			if err != nil {
 				http.Error(w, err.Error(), http.StatusBadGateway)
 				return
 			}
-			if len(page.FormHidden) > 0 && jarKey != "" {
-				s.forms.Store(jarKey, page.FormHidden)
-			}
+			s.rememberForms(jarKey, page)
 			for i, sc := range page.SetCookies {
 				w.Header().Add("Set-Cookie", sc)
 				if debugHTTP && i < 3 {
-					s.logger.Printf("FORWARD Set-Cookie[%d]=%s", i, sc)
+					lg.Debug("forward set-cookie", "index", i, "value", sc)
 				}
 			}
 			page.Normalize()
@@ -318,7 +324,7 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 				http.SetCookie(w, s.auth.cookieFor(clientKey))
 
 				if debugHTTP {
-					s.logger.Printf("Set auth cookie for %q: %+v", clientKey, s.auth.cookieFor(clientKey))
+					lg.Debug("set auth cookie", "client_key", clientKey)
 				}
 			}
 			s.writeOMS(w, page.Data, page.SetCookies, &page.Stats)
@@ -330,10 +336,11 @@ func (s *Server) handleRoot(w http.ResponseWriter, r *http.Request) {
 		w.WriteHeader(http.StatusOK)
 		return
 	}
+	indexHTML := s.config().IndexHTML
 	w.Header().Set("Content-Type", "text/html; charset=utf-8")
-	w.Header().Set("Content-Length", strconv.Itoa(len(s.cfg.IndexHTML)))
+	w.Header().Set("Content-Length", strconv.Itoa(len(indexHTML)))
 	w.Header().Set("Connection", "close")
-	io.WriteString(w, s.cfg.IndexHTML)
+	io.WriteString(w, indexHTML)
 }
 
 func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
@@ -349,25 +356,25 @@ func (s *Server) handleFetch(w http.ResponseWriter, r *http.Request) {
 	action := firstNonEmpty(r.FormValue("action"), r.URL.Query().Get("action"))
 	get := firstNonEmpty(r.FormValue("get"), r.URL.Query().Get("get"))
 	finalURL := buildURL(base, action, get)
-	s.logger.Printf("IN %s %s from %s | action=%q get=%q -> final=%s", r.Method, r.URL.String(), r.RemoteAddr, action, get, finalURL)
+	s.requestLogger(r).Debug("fetch", "action", action, "get", get, "final", finalURL)
 
 	hdr := s.headersFromQuery(r)
 	opt := s.renderOptionsFromQuery(r, hdr)
+	s.metrics.request("fetch")
 	s.renderPrefs.Remember(s.renderPrefKeyWithOptions(r, finalURL, opt), opt)
-	if s.serveFromCache(w, finalURL, opt) {
+	jarKey := s.clientJarKey(r, map[string]string{"h": opt.AuthPrefix, "c": opt.AuthCode})
+	cacheHit := s.serveFromCache(w, finalURL, opt, jarKey)
+	noteAccess(r, finalURL, "fetch", opt.Page, cacheHit)
+	if cacheHit {
 		return
 	}
-	page, err := s.loadPage(r.Context(), finalURL, hdr, opt)
+	page, err := s.loadPageRevalidating(r.Context(), finalURL, hdr, opt)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
 	}
-	if len(page.FormHidden) > 0 {
-		params := map[string]string{"h": opt.AuthPrefix, "c": opt.AuthCode}
-		jarKey := s.clientJarKey(r, params)
-		if jarKey != "" {
-			s.forms.Store(jarKey, page.FormHidden)
-		}
+	if len(page.FormHidden) > 0 || len(page.Forms) > 0 {
+		s.rememberForms(jarKey, page)
 	}
 	for _, sc := range page.SetCookies {
 		w.Header().Add("Set-Cookie", sc)
@@ -457,8 +464,22 @@ func (s *Server) handleDownload(w http.ResponseWriter, r *http.Request) {
 	}
 	w.Header().Set("Connection", "close")
 	w.WriteHeader(resp.StatusCode)
-	if _, err := io.Copy(w, resp.Body); err != nil {
-		s.logger.Printf("download stream error for %s: %v", target, err)
+	// Keep a copy of complete, small downloads as upload slots for file inputs.
+	var capture *slotCapture
+	body := io.Reader(resp.Body)
+	if limit := s.uploadSlotLimit(); limit > 0 && resp.StatusCode == http.StatusOK && resp.ContentLength <= limit {
+		capture = &slotCapture{limit: limit}
+		body = io.TeeReader(resp.Body, capture)
+	}
+	if _, err := io.Copy(w, body); err != nil {
+		s.requestLogger(r).Warn("download stream failed", "target", target, "err", err)
+		return
+	}
+	if capture != nil && !capture.over {
+		mediaType, _, _ := mime.ParseMediaType(ct)
+		if id := s.uploads.Save(clientKey, filename, mediaType, capture.buf); id != "" {
+			s.requestLogger(r).Debug("download kept as upload slot", "slot", id, "bytes", len(capture.buf))
+		}
 	}
 }
 
@@ -475,7 +496,7 @@ func (s *Server) handleValidate(w http.ResponseWriter, r *http.Request) {
 	if lang := r.URL.Query().Get("lang"); lang != "" {
 		hdr.Set("Accept-Language", lang)
 	}
-	pageFull, err := oms.LoadPageWithHeaders(u, hdr)
+	pageFull, err := oms.LoadPageWithJar(u, hdr, s.cookieJars.Get(s.clientJarKey(r, nil)))
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusBadGateway)
 		return
@@ -577,6 +598,8 @@ func (s *Server) headersFromQuery(r *http.Request) http.Header {
 
 func (s *Server) renderOptionsFromParams(r *http.Request, params map[string]string, hdr http.Header, jarKey string) *oms.RenderOptions {
 	opt := defaultRenderOptions()
+	opt.Engine = s.renderEngine()
+	opt.Logger = s.requestLogger(r)
 	if km := params["k"]; strings.HasPrefix(strings.ToLower(km), "image/") {
 		opt.ImageMIME = km
 	}
@@ -640,6 +663,12 @@ func (s *Server) renderOptionsFromParams(r *http.Request, params map[string]stri
 			opt.HighQuality = b
 		}
 	}
+	if v := params["reader"]; v != "" {
+		if b, ok := parseOperaBool(v); ok {
+			opt.Reader = b
+		}
+	}
+	opt.DeviceCharset = deviceCharset(r, params)
 	opt.AuthCode = params["c"]
 	opt.AuthPrefix = params["h"]
 	if form := strings.TrimSpace(params["j"]); form != "" {
@@ -700,6 +729,8 @@ func (s *Server) renderOptionsFromParams(r *http.Request, params map[string]stri
 func (s *Server) renderOptionsFromQuery(r *http.Request, hdr http.Header) *oms.RenderOptions {
 	q := r.URL.Query()
 	opt := defaultRenderOptions()
+	opt.Engine = s.renderEngine()
+	opt.Logger = s.requestLogger(r)
 	if v := q.Get("img"); v != "" {
 		if b, ok := interpretImageMode(v); ok {
 			opt.ImagesOn = b
@@ -721,6 +752,11 @@ func (s *Server) renderOptionsFromQuery(r *http.Request, hdr http.Header) *oms.R
 			opt.MaxInlineKB = n
 		}
 	}
+	if v := q.Get("reader"); v != "" {
+		if b, ok := parseOperaBool(v); ok {
+			opt.Reader = b
+		}
+	}
 	// Preserve device characteristics when passed on query to keep cache keys stable
 	if v := strings.TrimSpace(q.Get("w")); v != "" {
 		if n, err := strconv.Atoi(v); err == nil && n > 0 {
@@ -989,20 +1025,48 @@ func defaultRenderOptions() *oms.RenderOptions {
 	}
 }
 
-func (s *Server) serveFromCache(w http.ResponseWriter, target string, opt *oms.RenderOptions) bool {
-	if raw, cookies, cur, cnt, stats, ok := s.cache.Select(target, opt); ok {
-		if cur > 0 || cnt > 0 {
-			w.Header().Set("X-Operetta-Page", strconv.Itoa(cur))
-			w.Header().Set("X-Operetta-Pages", strconv.Itoa(cnt))
-		}
-		for _, sc := range cookies {
-			w.Header().Add("Set-Cookie", sc)
-		}
-		statsCopy := stats
-		s.writeOMS(w, raw, cookies, &statsCopy)
-		return true
+// serveFromCache answers the request from a cached render. The forms of a
+// cached first page are registered for jarKey as a fresh render's would be.
+func (s *Server) serveFromCache(w http.ResponseWriter, target string, opt *oms.RenderOptions, jarKey string) bool {
+	part, ok := s.cache.Select(target, opt)
+	if !ok {
+		return false
 	}
-	return false
+	s.metrics.pageCacheEvent("hit")
+	if opt.Page <= 1 {
+		s.rememberForms(jarKey, &oms.Page{Forms: part.forms})
+	}
+	if part.page > 0 || part.pages > 0 {
+		w.Header().Set("X-Operetta-Page", strconv.Itoa(part.page))
+		w.Header().Set("X-Operetta-Pages", strconv.Itoa(part.pages))
+	}
+	for _, sc := range part.setCookies {
+		w.Header().Add("Set-Cookie", sc)
+	}
+	stats := part.stats
+	s.writeOMS(w, part.data, part.setCookies, &stats)
+	return true
+}
+
+// loadPageRevalidating behaves like loadPage but first offers the origin the
+// validators of an expired cached render; a 304 is answered from the cached bytes.
+func (s *Server) loadPageRevalidating(ctx context.Context, target string, hdr http.Header, opt *oms.RenderOptions) (*oms.Page, error) {
+	stale, ok := s.cache.Stale(target, opt)
+	if !ok {
+		return s.loadPage(ctx, target, hdr, opt)
+	}
+	opt.IfNoneMatch, opt.IfModifiedSince = stale.etag, stale.lastModified
+	page, err := s.loadPage(ctx, target, hdr, opt)
+	opt.IfNoneMatch, opt.IfModifiedSince = "", ""
+	if err != nil || page == nil || !page.NotModified {
+		return page, err
+	}
+	if revalidated, ok := s.cache.Revalidated(stale, target, opt, page); ok {
+		s.ctxLogger(ctx).Debug("page cache revalidated", "target", target)
+		s.metrics.pageCacheEvent("revalidated")
+		return revalidated, nil
+	}
+	return s.loadPage(ctx, target, hdr, opt)
 }
 
 func (s *Server) renderPrefKeyWithOptions(r *http.Request, target string, opt *oms.RenderOptions) string {
@@ -1014,6 +1078,27 @@ func (s *Server) renderPrefKeyWithOptions(r *http.Request, target string, opt *o
 	return s.clientJarKey(r, params) + "|" + target
 }
 
+// rememberForms keeps the hidden fields and the form registry of page for the
+// client's next submission.
+func (s *Server) rememberForms(jarKey string, page *oms.Page) {
+	if jarKey == "" {
+		return
+	}
+	if len(page.FormHidden) > 0 {
+		s.forms.Store(jarKey, page.FormHidden)
+	}
+	s.forms.StoreSpecs(jarKey, page.Forms)
+}
+
+// uploadSlotLimit returns the largest download kept as an upload slot, or a
+// negative value when slots are disabled.
+func (s *Server) uploadSlotLimit() int64 {
+	if n := s.config().UploadSlotBytes; n != 0 {
+		return n
+	}
+	return defaultUploadSlotBytes
+}
+
 // prefetchFormHidden performs a lightweight GET for the target page to collect hidden form fields
 // before issuing a POST. The fetched tokens are cached under the provided client key and consumed
 // by formStore when the client resubmits the request with the same action.
@@ -1035,19 +1120,20 @@ func (s *Server) prefetchFormHidden(r *http.Request, params map[string]string, t
 	page, err := s.loadPage(r.Context(), target, hdrCopy, opt)
 	if err != nil {
 		if debug {
-			s.logger.Printf("Form prefetch error for %q: %v", target, err)
+			s.requestLogger(r).Debug("form prefetch failed", "target", target, "err", err)
 		}
 		return false
 	}
+	s.forms.StoreSpecs(jarKey, page.Forms)
 	if len(page.FormHidden) == 0 {
 		if debug {
-			s.logger.Printf("Form prefetch: no hidden fields detected for %q", target)
+			s.requestLogger(r).Debug("form prefetch found no hidden fields", "target", target)
 		}
 		return false
 	}
 	s.forms.Store(jarKey, page.FormHidden)
 	if debug {
-		s.logger.Printf("Form prefetch: cached %d hidden fields for %q", len(page.FormHidden), target)
+		s.requestLogger(r).Debug("form prefetch cached hidden fields", "target", target, "fields", len(page.FormHidden))
 	}
 	return true
 }
@@ -1132,7 +1218,7 @@ func isOperaMiniActionKey(key string) bool {
 	return strings.HasPrefix(key, "/")
 }
 
-func logOperaMiniForm(logger *log.Logger, prefix, body string) {
+func logOperaMiniForm(logger *slog.Logger, prefix, body string) {
 	if logger == nil {
 		return
 	}
@@ -1155,10 +1241,10 @@ func logOperaMiniForm(logger *log.Logger, prefix, body string) {
 			items = append(items, fmt.Sprintf("%s(len=%d)=%s", k, len(val), display))
 		}
 		sort.Strings(items)
-		logger.Printf("%s form: %s", prefix, strings.Join(items, ", "))
+		logger.Debug("opera mini form", "stage", prefix, "fields", strings.Join(items, ", "))
 		return
 	}
-	logger.Printf("%s form raw len=%d", prefix, len(body))
+	logger.Debug("opera mini form", "stage", prefix, "raw_len", len(body))
 }
 
 func serverBase(r *http.Request) string {
@@ -1170,6 +1256,15 @@ func serverBase(r *http.Request) string {
 }
 
 func (s *Server) loadPage(ctx context.Context, target string, hdr http.Header, opt *oms.RenderOptions) (*oms.Page, error) {
+	start := time.Now()
+	page, err := s.renderPage(ctx, target, hdr, opt)
+	if err == nil {
+		s.metrics.observeRender(time.Since(start).Seconds(), page)
+	}
+	return page, err
+}
+
+func (s *Server) renderPage(ctx context.Context, target string, hdr http.Header, opt *oms.RenderOptions) (*oms.Page, error) {
 	cfg := s.sites.Find(target)
 	header := http.Header{}
 	copyHeader(header, hdr)
@@ -1182,6 +1277,12 @@ func (s *Server) loadPage(ctx context.Context, target string, hdr http.Header, o
 			return oms.LoadCompactPageWithHeaders(target, header)
 		}
 	}
+	if opt != nil && (cfg.KeepLayoutTables() || cfg.ReaderMode()) {
+		copied := *opt
+		copied.KeepLayoutTables = copied.KeepLayoutTables || cfg.KeepLayoutTables()
+		copied.Reader = copied.Reader || cfg.ReaderMode()
+		opt = &copied
+	}
 	var cfgJS *oms.JSBakingOptions
 	if cfg != nil {
 		cfgJS = cfg.JSOptions()
@@ -1195,32 +1296,30 @@ func (s *Server) loadPage(ctx context.Context, target string, hdr http.Header, o
 	if shouldUseJS(mergedJS) {
 		baker, err := s.getJSBaker()
 		if err != nil {
+			s.metrics.jsBakerEvent("unavailable")
 			if mergedJS != nil && mergedJS.Mode == oms.JSExecutionModeRequired {
 				return nil, err
 			}
-			if s.logger != nil {
-				s.logger.Printf("js baker unavailable: %v", err)
-			}
+			s.ctxLogger(ctx).Warn("js baker unavailable", "err", err)
 		} else {
 			doc, err := baker.Fetch(ctx, target, header, opt, mergedJS)
 			if err == nil && doc != nil {
 				page, renderErr := oms.RenderDocument(doc, header, opt)
 				if renderErr == nil {
+					s.metrics.jsBakerEvent("rendered")
 					return page, nil
 				}
+				s.metrics.jsBakerEvent("failed")
 				if mergedJS != nil && mergedJS.Mode == oms.JSExecutionModeRequired {
 					return nil, renderErr
 				}
-				if s.logger != nil {
-					s.logger.Printf("js render fallback for %s: %v", target, renderErr)
-				}
+				s.ctxLogger(ctx).Warn("js render failed, falling back", "target", target, "err", renderErr)
 			} else if err != nil {
+				s.metrics.jsBakerEvent("failed")
 				if mergedJS != nil && mergedJS.Mode == oms.JSExecutionModeRequired {
 					return nil, err
 				}
-				if s.logger != nil {
-					s.logger.Printf("js fetch fallback for %s: %v", target, err)
-				}
+				s.ctxLogger(ctx).Warn("js fetch failed, falling back", "target", target, "err", err)
 			}
 		}
 	}
@@ -1233,6 +1332,7 @@ func (s *Server) writeOMS(w http.ResponseWriter, data []byte, _ []string, stats
 	w.Header().Set("Connection", "close")
 	dumpOMS(s.logger, data)
 	s.logTrafficSavings(stats, len(data))
+	s.metrics.observeTraffic(stats, len(data))
 	_, _ = w.Write(data)
 }
 
@@ -1243,12 +1343,32 @@ func (s *Server) logTrafficSavings(stats *oms.TrafficStats, encoded int) {
 	////if os.Getenv("OMS_HTTP_DEBUG") != "1" {
 	////	return
 	////}
-	if encoded <= 0 {
+	origin, saved, basis, ok := trafficSavings(stats, encoded)
+	if !ok {
 		return
 	}
+	if saved < 0 {
+		extra := -saved
+		percent := (float64(extra) / float64(origin)) * 100
+		s.logger.Debug("traffic delta", "basis", basis, "origin_bytes", origin, "oms_bytes", encoded, "extra_bytes", extra, "percent", percent)
+	} else {
+		percent := (float64(saved) / float64(origin)) * 100
+		s.logger.Debug("traffic saved", "basis", basis, "origin_bytes", origin, "oms_bytes", encoded, "saved_bytes", saved, "percent", percent)
+	}
+	if stats.OriginTransferBytes > 0 && stats.OriginDecodedBytes > 0 && stats.OriginTransferBytes != stats.OriginDecodedBytes {
+		s.logger.Debug("traffic reference", "transfer_bytes", stats.OriginTransferBytes, "decoded_bytes", stats.OriginDecodedBytes)
+	}
+}
+
+// trafficSavings picks the origin size to compare the encoded OMS against,
+// preferring transfer bytes and falling back to decoded bytes.
+func trafficSavings(stats *oms.TrafficStats, encoded int) (origin, saved int, basis string, ok bool) {
+	if stats == nil || encoded <= 0 {
+		return 0, 0, "", false
+	}
 	stats.EncodedBytes = encoded
-	origin := stats.OriginTransferBytes
-	basis := "transfer"
+	origin = stats.OriginTransferBytes
+	basis = "transfer"
 	if origin <= 0 {
 		origin = stats.OriginDecodedBytes
 		basis = "decoded"
@@ -1257,33 +1377,16 @@ func (s *Server) logTrafficSavings(stats *oms.TrafficStats, encoded int) {
 		origin = stats.OriginDecodedBytes
 		basis = "decoded"
 	}
-	if origin <= 0 && stats.OriginDecodedBytes <= 0 {
-		return
-	}
-	if origin <= 0 {
-		origin = stats.OriginDecodedBytes
-		basis = "decoded"
-	}
 	if origin <= 0 {
-		return
+		return 0, 0, "", false
 	}
-	saved := origin - encoded
+	saved = origin - encoded
 	if saved < 0 && basis != "decoded" && stats.OriginDecodedBytes > encoded {
 		origin = stats.OriginDecodedBytes
 		basis = "decoded"
 		saved = origin - encoded
 	}
-	if saved < 0 {
-		extra := -saved
-		percent := (float64(extra) / float64(origin)) * 100
-		s.logger.Printf("Traffic delta (%s): origin=%dB operetta=%dB extra=%dB (+%.1f%%)", basis, origin, encoded, extra, percent)
-	} else {
-		percent := (float64(saved) / float64(origin)) * 100
-		s.logger.Printf("Traffic saved (%s): origin=%dB operetta=%dB saved=%dB (%.1f%%)", basis, origin, encoded, saved, percent)
-	}
-	if stats.OriginTransferBytes > 0 && stats.OriginDecodedBytes > 0 && stats.OriginTransferBytes != stats.OriginDecodedBytes {
-		s.logger.Printf("Traffic reference: transfer=%dB decoded=%dB", stats.OriginTransferBytes, stats.OriginDecodedBytes)
-	}
+	return origin, saved, basis, true
 }
 
 func (s *Server) isInternalAboutRequest(raw, normalized string) bool {
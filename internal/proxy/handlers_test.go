@@ -5,6 +5,8 @@ import (
 	"net/http/httptest"
 	"testing"
 	"time"
+
+	"operetta/oms"
 )
 
 func TestParseOperaBool(t *testing.T) {
@@ -37,10 +39,10 @@ func TestParseOperaBool(t *testing.T) {
 
 func newTestServer() *Server {
 	return &Server{
-		renderPrefs: newRenderPrefStore(),
+		renderPrefs: newRenderPrefStore(time.Now),
 		cookieJars:  NewCookieJarStore(),
 		auth:        newAuthStore(time.Now),
-		cache:       newPageCache(time.Now),
+		cache:       newPageCache(time.Now, 0),
 	}
 }
 
@@ -105,6 +107,29 @@ func TestRenderOptionsFromParamsQuality(t *testing.T) {
 	if fragOpt.MaxTagsPerPage != 1600 {
 		t.Fatalf("expected fragment pp=1600, got %d", fragOpt.MaxTagsPerPage)
 	}
+
+	readerParams := map[string]string{}
+	base, extras = extractOMFragment(oms.BuildReaderLink("https://example.com/story"))
+	for k, v := range extras {
+		readerParams[k] = v
+	}
+	readerOpt := s.renderOptionsFromParams(r, readerParams, hdr, "")
+	if base != "https://example.com/story" || !readerOpt.Reader {
+		t.Fatalf("expected reader link to request reader mode, got base=%q reader=%v", base, readerOpt.Reader)
+	}
+	full := *readerOpt
+	full.Reader = false
+	if cacheKey(base, readerOpt) == cacheKey(base, &full) {
+		t.Fatalf("reader renders must not share a cache key with full renders")
+	}
+
+	r.Header.Set("Accept-Charset", "windows-1251, utf-8;q=0.7")
+	if opt := s.renderOptionsFromParams(r, map[string]string{}, hdr, ""); opt.DeviceCharset != "windows-1251" {
+		t.Fatalf("expected the Accept-Charset preference, got %q", opt.DeviceCharset)
+	}
+	if opt := s.renderOptionsFromParams(r, map[string]string{"E": "ISO-8859-1"}, hdr, ""); opt.DeviceCharset != "ISO-8859-1" {
+		t.Fatalf("expected E= to take precedence, got %q", opt.DeviceCharset)
+	}
 }
 
 func TestRenderOptionsFromQueryQuality(t *testing.T) {
@@ -3,7 +3,7 @@ package proxy
 import (
 	"context"
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
 	"net/http"
 	"net/url"
@@ -23,10 +23,10 @@ import (
 type jsBaker struct {
 	allocator context.Context
 	cancel    context.CancelFunc
-	logger    *log.Logger
+	logger    *slog.Logger
 }
 
-func newJSBaker(logger *log.Logger) (*jsBaker, error) {
+func newJSBaker(logger *slog.Logger) (*jsBaker, error) {
 	opts := append(chromedp.DefaultExecAllocatorOptions[:],
 		chromedp.Flag("headless", true),
 		chromedp.Flag("disable-gpu", true),
@@ -1,27 +1,248 @@
 package proxy
 
 import (
-	"log"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"io"
+	"log/slog"
 	"net/http"
+	"os"
+	"strings"
+	"time"
 )
 
-func withLogging(logger *log.Logger, next http.Handler) http.Handler {
+// secretLogKeys are attribute keys whose values are replaced with "***"
+// unless the logger was built with secrets enabled.
+var secretLogKeys = map[string]bool{
+	"auth_code":   true,
+	"auth_prefix": true,
+	"jar_key":     true,
+	"password":    true,
+}
+
+// secretHeaders are the request headers redacted inside a "headers" group.
+var secretHeaders = map[string]bool{
+	"Authorization": true,
+	"Cookie":        true,
+	"Set-Cookie":    true,
+}
+
+// NewLogger builds the JSON (or text) logger used by the proxy. Values logged
+// under the auth code, auth prefix, jar key and password keys, and credential
+// headers in a "headers" group, are redacted unless secrets is set.
+func NewLogger(w io.Writer, format string, level slog.Level, secrets bool) *slog.Logger {
+	if w == nil {
+		w = os.Stdout
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	var h slog.Handler
+	if strings.EqualFold(strings.TrimSpace(format), "text") {
+		h = slog.NewTextHandler(w, opts)
+	} else {
+		h = slog.NewJSONHandler(w, opts)
+	}
+	if secrets {
+		return slog.New(revealHandler{h})
+	}
+	return slog.New(&redactHandler{next: h})
+}
+
+// redactingLogger wraps logger so that secrets are redacted, unless it already
+// redacts or was built by NewLogger with secrets enabled.
+func redactingLogger(logger *slog.Logger) *slog.Logger {
+	switch logger.Handler().(type) {
+	case *redactHandler, revealHandler:
+		return logger
+	}
+	return slog.New(&redactHandler{next: logger.Handler()})
+}
+
+// revealHandler marks a handler that deliberately logs secrets.
+type revealHandler struct{ slog.Handler }
+
+// redactHandler replaces secret attribute values with "***" before passing
+// records on.
+type redactHandler struct {
+	next  slog.Handler
+	group string // innermost group opened with WithGroup
+}
+
+func (h *redactHandler) Enabled(ctx context.Context, level slog.Level) bool {
+	return h.next.Enabled(ctx, level)
+}
+
+func (h *redactHandler) Handle(ctx context.Context, r slog.Record) error {
+	out := slog.NewRecord(r.Time, r.Level, r.Message, r.PC)
+	r.Attrs(func(a slog.Attr) bool {
+		out.AddAttrs(redactAttr(h.group, a))
+		return true
+	})
+	return h.next.Handle(ctx, out)
+}
+
+func (h *redactHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	redacted := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		redacted[i] = redactAttr(h.group, a)
+	}
+	return &redactHandler{next: h.next.WithAttrs(redacted), group: h.group}
+}
+
+func (h *redactHandler) WithGroup(name string) slog.Handler {
+	return &redactHandler{next: h.next.WithGroup(name), group: name}
+}
+
+func redactAttr(group string, a slog.Attr) slog.Attr {
+	a.Value = a.Value.Resolve()
+	if a.Value.Kind() == slog.KindGroup {
+		attrs := a.Value.Group()
+		redacted := make([]slog.Attr, len(attrs))
+		for i, ga := range attrs {
+			redacted[i] = redactAttr(a.Key, ga)
+		}
+		a.Value = slog.GroupValue(redacted...)
+		return a
+	}
+	secret := secretLogKeys[a.Key] || (group == "headers" && secretHeaders[http.CanonicalHeaderKey(a.Key)])
+	if secret && a.Value.String() != "" {
+		a.Value = slog.StringValue("***")
+	}
+	return a
+}
+
+// parseLogLevel maps debug/info/warn/error onto slog levels.
+func parseLogLevel(raw string, fallback slog.Level) slog.Level {
+	var lvl slog.Level
+	if err := lvl.UnmarshalText([]byte(strings.TrimSpace(raw))); err != nil {
+		return fallback
+	}
+	return lvl
+}
+
+type ctxKey int
+
+const accessKey ctxKey = iota
+
+// accessRecord carries the fields handlers contribute to the access log entry.
+type accessRecord struct {
+	logger   *slog.Logger
+	target   string
+	version  string
+	part     int
+	cacheHit bool
+}
+
+func accessFrom(ctx context.Context) *accessRecord {
+	rec, _ := ctx.Value(accessKey).(*accessRecord)
+	return rec
+}
+
+// requestLogger returns the logger tagged with the request ID of r.
+func (s *Server) requestLogger(r *http.Request) *slog.Logger {
+	return s.ctxLogger(r.Context())
+}
+
+func (s *Server) ctxLogger(ctx context.Context) *slog.Logger {
+	if rec := accessFrom(ctx); rec != nil && rec.logger != nil {
+		return rec.logger
+	}
+	if s.logger != nil {
+		return s.logger
+	}
+	return slog.Default()
+}
+
+// noteAccess records the Opera Mini specific fields of the access log entry.
+func noteAccess(r *http.Request, target, version string, part int, cacheHit bool) {
+	if rec := accessFrom(r.Context()); rec != nil {
+		rec.target, rec.version, rec.part, rec.cacheHit = target, version, part, cacheHit
+	}
+}
+
+// requestID reuses a sane inbound X-Request-ID or generates a new one.
+func requestID(r *http.Request) string {
+	if id := strings.TrimSpace(r.Header.Get("X-Request-ID")); id != "" && len(id) <= 64 && !strings.ContainsAny(id, " \t\r\n\"") {
+		return id
+	}
+	var b [8]byte
+	_, _ = rand.Read(b[:])
+	return hex.EncodeToString(b[:])
+}
+
+func withLogging(logger *slog.Logger, next http.Handler) http.Handler {
 	if logger == nil {
-		logger = log.Default()
+		logger = slog.Default()
 	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		logger.Printf("REQ %s %s Host=%s UA=%q From=%s", r.Method, r.URL.String(), r.Host, r.UserAgent(), r.RemoteAddr)
-		logHeader := func(name string) {
-			if v := r.Header.Get(name); v != "" {
-				logger.Printf("HDR %s: %s", name, v)
-			}
+		start := time.Now()
+		id := requestID(r)
+		rec := &accessRecord{logger: logger.With("req_id", id)}
+		w.Header().Set("X-Request-ID", id)
+		rec.logger.Debug("request",
+			"method", r.Method,
+			"path", r.URL.Path,
+			"host", r.Host,
+			"ua", r.UserAgent(),
+			"remote", r.RemoteAddr,
+			"x_online_host", r.Header.Get("X-Online-Host"),
+			"content_type", r.Header.Get("Content-Type"),
+			"content_length", r.ContentLength,
+		)
+		in := &countingReader{ReadCloser: r.Body}
+		if r.Body != nil {
+			r.Body = in
 		}
-		logHeader("X-Online-Host")
-		logHeader("Proxy-Connection")
-		logHeader("Connection")
-		logHeader("Content-Type")
-		logHeader("Content-Length")
+		cw := &countingWriter{ResponseWriter: w, status: http.StatusOK}
+		next.ServeHTTP(cw, r.WithContext(context.WithValue(r.Context(), accessKey, rec)))
 
-		next.ServeHTTP(w, r)
+		attrs := []any{
+			"method", r.Method,
+			"path", r.URL.Path,
+			"remote", r.RemoteAddr,
+			"status", cw.status,
+			"bytes_in", in.n,
+			"bytes_out", cw.n,
+			"duration_ms", float64(time.Since(start).Microseconds()) / 1000,
+		}
+		if rec.target != "" {
+			attrs = append(attrs,
+				"target", rec.target,
+				"client_version", rec.version,
+				"part", rec.part,
+				"cache_hit", rec.cacheHit,
+			)
+		}
+		rec.logger.Info("access", attrs...)
 	})
 }
+
+type countingReader struct {
+	io.ReadCloser
+	n int64
+}
+
+func (c *countingReader) Read(p []byte) (int, error) {
+	n, err := c.ReadCloser.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+type countingWriter struct {
+	http.ResponseWriter
+	status int
+	n      int64
+}
+
+func (c *countingWriter) WriteHeader(code int) {
+	c.status = code
+	c.ResponseWriter.WriteHeader(code)
+}
+
+func (c *countingWriter) Write(p []byte) (int, error) {
+	n, err := c.ResponseWriter.Write(p)
+	c.n += int64(n)
+	return n, err
+}
+
+func (c *countingWriter) Unwrap() http.ResponseWriter { return c.ResponseWriter }
@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"operetta/oms"
+)
+
+func TestWithLoggingEmitsAccessRecord(t *testing.T) {
+	var buf bytes.Buffer
+	logger := NewLogger(&buf, "json", slog.LevelInfo, false)
+	s := &Server{logger: logger}
+	h := withLogging(logger, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.ReadAll(r.Body)
+		noteAccess(r, "http://example.com/", "2", 3, true)
+		s.requestLogger(r).Info("auth session registered", "auth_code", "secret-code", "auth_prefix", "pfx", "jar_key", "AUTH|pfx|secret-code")
+		_, _ = w.Write([]byte("hello"))
+	}))
+
+	req := httptest.NewRequest(http.MethodPost, "http://operetta/", strings.NewReader("payload"))
+	req.Header.Set("X-Request-ID", "abc123")
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, req)
+	if got := rec.Header().Get("X-Request-ID"); got != "abc123" {
+		t.Fatalf("expected request ID to be echoed, got %q", got)
+	}
+	if strings.Contains(buf.String(), "secret-code") || strings.Contains(buf.String(), "pfx") {
+		t.Fatalf("auth codes must be redacted: %s", buf.String())
+	}
+
+	lines := strings.Split(strings.TrimSpace(buf.String()), "\n")
+	if len(lines) != 2 {
+		t.Fatalf("expected event and access records, got %d: %s", len(lines), buf.String())
+	}
+	var event, access map[string]any
+	if err := json.Unmarshal([]byte(lines[0]), &event); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(lines[1]), &access); err != nil {
+		t.Fatal(err)
+	}
+	if event["req_id"] != "abc123" || event["auth_code"] != "***" {
+		t.Fatalf("unexpected event record: %v", event)
+	}
+	want := map[string]any{
+		"msg":            "access",
+		"req_id":         "abc123",
+		"target":         "http://example.com/",
+		"client_version": "2",
+		"part":           float64(3),
+		"cache_hit":      true,
+		"bytes_in":       float64(len("payload")),
+		"bytes_out":      float64(len("hello")),
+		"status":         float64(http.StatusOK),
+	}
+	for k, v := range want {
+		if access[k] != v {
+			t.Errorf("access[%q] = %v, want %v", k, access[k], v)
+		}
+	}
+}
+
+func TestNewLoggerKeepsSecretsWhenAsked(t *testing.T) {
+	var buf bytes.Buffer
+	NewLogger(&buf, "text", slog.LevelInfo, true).Info("x", "auth_code", "visible")
+	if !strings.Contains(buf.String(), "auth_code=visible") {
+		t.Fatalf("expected unredacted auth code, got %s", buf.String())
+	}
+	if id := requestID(httptest.NewRequest(http.MethodGet, "/", nil)); len(id) != 16 {
+		t.Fatalf("expected generated 16-char request ID, got %q", id)
+	}
+}
+
+func TestDebugLogsRedactSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(Config{
+		Logger:   NewLogger(&buf, "json", slog.LevelDebug, false),
+		SitesDir: t.TempDir(),
+		Render:   oms.Options{HTTPDebug: true},
+	})
+	defer s.Close()
+
+	body := "u=server:about\x00h=pfx\x00c=secret-code\x00j=user=bob&password=hunter2\x00"
+	req := httptest.NewRequest(http.MethodPost, "http://operetta/?c=secret-code&token=admin-token", strings.NewReader(body))
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := buf.String()
+	for _, secret := range []string{"secret-code", "hunter2", "admin-token"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("debug log leaks %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, `"jar_key":"***"`) {
+		t.Errorf("expected redacted jar key in %s", out)
+	}
+}
+
+func TestNewRedactsPlainLoggers(t *testing.T) {
+	var buf bytes.Buffer
+	s := New(Config{
+		Logger:   slog.New(slog.NewJSONHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug})),
+		SitesDir: t.TempDir(),
+		Render:   oms.Options{HTTPDebug: true},
+	})
+	defer s.Close()
+
+	s.logger.Info("auth session registered", "auth_code", "secret-code")
+	req := httptest.NewRequest(http.MethodPost, "http://operetta/", strings.NewReader("u=server:about\x00"))
+	req.Header.Set("Cookie", "sid=cookie-secret")
+	req.Header.Set("Authorization", "Basic basic-secret")
+	s.ServeHTTP(httptest.NewRecorder(), req)
+
+	out := buf.String()
+	for _, secret := range []string{"secret-code", "cookie-secret", "basic-secret"} {
+		if strings.Contains(out, secret) {
+			t.Errorf("log leaks %q: %s", secret, out)
+		}
+	}
+	if !strings.Contains(out, `"Cookie":"***"`) {
+		t.Errorf("expected redacted Cookie header in %s", out)
+	}
+}
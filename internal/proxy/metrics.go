@@ -0,0 +1,231 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"operetta/oms"
+)
+
+// serverMetrics collects the counters exposed on /metrics. All record methods
+// accept a nil receiver so that partially wired servers (tests) keep working.
+type serverMetrics struct {
+	requests    labeledCounter // by client version
+	pageCache   labeledCounter // hit, revalidated
+	jsBaker     labeledCounter // rendered, failed, unavailable
+	originBytes atomic.Uint64
+	omsBytes    atomic.Uint64
+	savedBytes  atomic.Uint64
+	paginated   atomic.Uint64
+	render      *histogram
+}
+
+func newServerMetrics() *serverMetrics {
+	return &serverMetrics{
+		render: newHistogram(0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30),
+	}
+}
+
+func (m *serverMetrics) request(version string) {
+	if m != nil {
+		m.requests.inc(version)
+	}
+}
+
+func (m *serverMetrics) pageCacheEvent(result string) {
+	if m != nil {
+		m.pageCache.inc(result)
+	}
+}
+
+func (m *serverMetrics) jsBakerEvent(result string) {
+	if m != nil {
+		m.jsBaker.inc(result)
+	}
+}
+
+func (m *serverMetrics) observeRender(seconds float64, page *oms.Page) {
+	if m == nil {
+		return
+	}
+	m.render.observe(seconds)
+	if page != nil {
+		if _, parts := page.Parts(); parts > 1 {
+			m.paginated.Add(1)
+		}
+	}
+}
+
+func (m *serverMetrics) observeTraffic(stats *oms.TrafficStats, encoded int) {
+	if m == nil || encoded <= 0 {
+		return
+	}
+	m.omsBytes.Add(uint64(encoded))
+	if origin, saved, _, ok := trafficSavings(stats, encoded); ok {
+		m.originBytes.Add(uint64(origin))
+		if saved > 0 {
+			m.savedBytes.Add(uint64(saved))
+		}
+	}
+}
+
+func clientVersionLabel(v oms.ClientVersion) string {
+	if v == 0 {
+		return "unknown"
+	}
+	return strconv.Itoa(int(v))
+}
+
+// handleMetrics serves the counters in the Prometheus text exposition format.
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if !s.authorizeAdmin(w, r) {
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	s.writeMetrics(w)
+}
+
+func (s *Server) writeMetrics(w io.Writer) {
+	m := s.metrics
+	if m == nil {
+		m = newServerMetrics()
+	}
+	writeLabeled(w, "operetta_requests_total", "Opera Mini requests by client version.", "counter", "client_version", m.requests.snapshot())
+	writeMetric(w, "operetta_origin_bytes_total", "Origin bytes behind rendered responses.", "counter", float64(m.originBytes.Load()))
+	writeMetric(w, "operetta_oms_bytes_total", "OMS bytes sent to clients.", "counter", float64(m.omsBytes.Load()))
+	writeMetric(w, "operetta_bytes_saved_total", "Bytes saved compared to the origin response.", "counter", float64(m.savedBytes.Load()))
+	m.render.write(w, "operetta_render_duration_seconds", "Time spent fetching and rendering a page.")
+	writeMetric(w, "operetta_paginated_renders_total", "Renders split into more than one part.", "counter", float64(m.paginated.Load()))
+	writeLabeled(w, "operetta_page_cache_total", "Page cache hits and 304 revalidations.", "counter", "result", m.pageCache.snapshot())
+	writeLabeled(w, "operetta_js_baker_total", "Headless Chrome rendering outcomes.", "counter", "result", m.jsBaker.snapshot())
+
+	img := oms.ImageCacheStats()
+	writeLabeled(w, "operetta_image_requests_total", "Image lookups by the tier that served them.", "counter", "source", map[string]uint64{
+		"memory":      img.MemoryHits,
+		"disk":        img.DiskHits,
+		"revalidated": img.Revalidated,
+		"origin":      img.Misses,
+	})
+	ratio := 0.0
+	if total := img.MemoryHits + img.DiskHits + img.Revalidated + img.Misses; total > 0 {
+		ratio = float64(img.MemoryHits+img.DiskHits+img.Revalidated) / float64(total)
+	}
+	writeMetric(w, "operetta_image_cache_hit_ratio", "Share of image lookups served without a full origin fetch.", "gauge", ratio)
+	writeLabeled(w, "operetta_image_prefetch_total", "Prefetched images shared with a concurrent render or given up at the render deadline.", "counter", "result", map[string]uint64{
+		"shared": img.Shared,
+		"late":   img.Late,
+	})
+	writeLabeled(w, "operetta_upstream_errors_total", "Failed origin page loads by error class.", "counter", "class", oms.UpstreamErrorCounts())
+
+	st := s.SessionStats()
+	writeLabeled(w, "operetta_sessions", "Live per-client state entries.", "gauge", "store", map[string]uint64{
+		"auth":         uint64(st.AuthSessions),
+		"cookie_jars":  uint64(st.CookieJars),
+		"forms":        uint64(st.FormEntries),
+		"render_prefs": uint64(st.RenderPrefs),
+		"upload_slots": uint64(st.UploadSlots),
+	})
+	writeMetric(w, "operetta_sessions_evicted_total", "Per-client state entries evicted by the janitor or on insert past the cap.", "counter", float64(st.Evicted))
+	writeMetric(w, "operetta_upload_slot_bytes", "Bytes held by upload slots of all clients.", "gauge", float64(st.UploadBytes))
+	writeMetric(w, "operetta_upload_slots_evicted_total", "Upload slot files dropped to stay within the byte budget.", "counter", float64(st.UploadEvicted))
+	if s.cache != nil {
+		n, size := s.cache.Len()
+		writeMetric(w, "operetta_page_cache_entries", "Rendered pages held in the page cache.", "gauge", float64(n))
+		writeMetric(w, "operetta_page_cache_bytes", "Bytes held in the page cache.", "gauge", float64(size))
+	}
+}
+
+// labeledCounter is a counter family with a single label.
+type labeledCounter struct {
+	mu   sync.Mutex
+	vals map[string]uint64
+}
+
+func (c *labeledCounter) inc(label string) {
+	c.mu.Lock()
+	if c.vals == nil {
+		c.vals = make(map[string]uint64)
+	}
+	c.vals[label]++
+	c.mu.Unlock()
+}
+
+func (c *labeledCounter) snapshot() map[string]uint64 {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make(map[string]uint64, len(c.vals))
+	for k, v := range c.vals {
+		out[k] = v
+	}
+	return out
+}
+
+// histogram is a fixed-bucket histogram with cumulative exposition.
+type histogram struct {
+	mu     sync.Mutex
+	bounds []float64
+	counts []uint64
+	sum    float64
+	count  uint64
+}
+
+func newHistogram(bounds ...float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds))}
+}
+
+func (h *histogram) observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, b := range h.bounds {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.sum += v
+	h.count++
+}
+
+func (h *histogram) write(w io.Writer, name, help string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, help, name)
+	for i, b := range h.bounds {
+		fmt.Fprintf(w, "%s_bucket{le=\"%s\"} %d\n", name, formatFloat(b), h.counts[i])
+	}
+	fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+	fmt.Fprintf(w, "%s_sum %s\n%s_count %d\n", name, formatFloat(h.sum), name, h.count)
+}
+
+func writeMetric(w io.Writer, name, help, typ string, v float64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n%s %s\n", name, help, name, typ, name, formatFloat(v))
+}
+
+func writeLabeled(w io.Writer, name, help, typ, label string, vals map[string]uint64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, typ)
+	keys := make([]string, 0, len(vals))
+	for k := range vals {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(w, "%s{%s=\"%s\"} %d\n", name, label, escapeLabel(k), vals[k])
+	}
+}
+
+func escapeLabel(v string) string {
+	return strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`).Replace(v)
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
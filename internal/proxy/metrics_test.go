@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"operetta/oms"
+)
+
+func TestMetricsExposition(t *testing.T) {
+	s := New(Config{
+		Logger:     slog.New(slog.DiscardHandler),
+		SitesDir:   t.TempDir(),
+		AdminToken: "secret",
+	})
+	defer s.Close()
+
+	s.metrics.request(clientVersionLabel(oms.ClientVersion2))
+	s.metrics.request(clientVersionLabel(oms.ClientVersion2))
+	s.metrics.request("fetch")
+	s.metrics.observeTraffic(&oms.TrafficStats{OriginTransferBytes: 1000}, 250)
+	s.metrics.observeRender(0.3, nil)
+	s.metrics.jsBakerEvent("unavailable")
+
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/metrics", nil))
+	if rec.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without token, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/metrics?token=secret", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200, got %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); !strings.HasPrefix(ct, "text/plain; version=0.0.4") {
+		t.Fatalf("unexpected content type %q", ct)
+	}
+	body := rec.Body.String()
+	for _, want := range []string{
+		`operetta_requests_total{client_version="2"} 2`,
+		`operetta_requests_total{client_version="fetch"} 1`,
+		"operetta_origin_bytes_total 1000",
+		"operetta_oms_bytes_total 250",
+		"operetta_bytes_saved_total 750",
+		`operetta_render_duration_seconds_bucket{le="0.25"} 0`,
+		`operetta_render_duration_seconds_bucket{le="0.5"} 1`,
+		`operetta_render_duration_seconds_bucket{le="+Inf"} 1`,
+		"operetta_render_duration_seconds_count 1",
+		`operetta_js_baker_total{result="unavailable"} 1`,
+		"# TYPE operetta_image_cache_hit_ratio gauge",
+		`operetta_sessions{store="auth"} 0`,
+		"operetta_page_cache_entries 0",
+	} {
+		if !strings.Contains(body, want) {
+			t.Errorf("metrics output missing %q", want)
+		}
+	}
+}
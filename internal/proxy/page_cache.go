@@ -1,34 +1,90 @@
 package proxy
 
 import (
+	"container/list"
 	"net/http"
+	"net/url"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
 	"operetta/oms"
 )
 
+const (
+	defaultPageCacheBytes = 32 << 20
+	// defaultPageCacheTTL applies when the origin sends no freshness information.
+	defaultPageCacheTTL = 10 * time.Minute
+	// minPaginationTTL keeps uncacheable (no-cache, max-age=0) renders around
+	// long enough for the requesting client to page through them.
+	minPaginationTTL = 2 * time.Minute
+	maxPageCacheTTL  = 24 * time.Hour
+)
+
 type cacheEntry struct {
+	key        string
+	target     string
+	host       string
+	scope      string
 	data       []byte
 	setCookies []string
 	created    time.Time
+	expires    time.Time
 	stats      oms.TrafficStats
+	// fresh is when the origin's own freshness ends. Entries kept longer
+	// for pagination (no-cache, short max-age) still revalidate page 1.
+	fresh time.Time
+	// Origin validators used to revalidate the entry once it expires.
+	etag         string
+	lastModified string
+	maxTags      int
+	// forms is the form registry of the render, handed out again when a 304
+	// replays it.
+	forms []*oms.FormSpec
+}
+
+func (e *cacheEntry) hasValidators() bool {
+	return e.etag != "" || e.lastModified != ""
 }
 
+func (e *cacheEntry) size() int64 {
+	n := len(e.data) + len(e.key)
+	for _, sc := range e.setCookies {
+		n += len(sc)
+	}
+	return int64(n)
+}
+
+// pageCache keeps packed OMS renders so that later pagination parts can be served
+// without refetching the origin. It is a byte-bounded LRU; entries expire according
+// to the origin's Cache-Control/Expires headers and personalised renders are only
+// visible to the client that produced them.
 type pageCache struct {
-	mu   sync.RWMutex
-	now  func() time.Time
-	data map[string]cacheEntry
+	mu       sync.Mutex
+	now      func() time.Time
+	maxBytes int64
+	size     int64
+	ll       *list.List
+	items    map[string]*list.Element
+	// vary remembers the Vary header names announced for a base cache key.
+	vary map[string][]string
 }
 
-func newPageCache(now func() time.Time) *pageCache {
+func newPageCache(now func() time.Time, maxBytes int64) *pageCache {
 	if now == nil {
 		now = time.Now
 	}
+	if maxBytes <= 0 {
+		maxBytes = defaultPageCacheBytes
+	}
 	return &pageCache{
-		now:  now,
-		data: make(map[string]cacheEntry),
+		now:      now,
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+		vary:     make(map[string][]string),
 	}
 }
 
@@ -36,10 +92,18 @@ func cacheKey(target string, opt *oms.RenderOptions) string {
 	if opt == nil {
 		return target
 	}
-	return target + "|" + opt.ImageMIME +
+	key := target + "|" + opt.ImageMIME +
 		":i=" + strconv.Itoa(boolToInt(opt.ImagesOn)) +
 		":q=" + strconv.Itoa(boolToInt(opt.HighQuality)) +
 		":w=" + strconv.Itoa(opt.ScreenW)
+	if opt.Reader {
+		key += ":r=1"
+	}
+	if cs := strings.ToLower(strings.TrimSpace(opt.DeviceCharset)); cs != "" {
+		// Pages without a declared charset are decoded with the device's.
+		key += ":cs=" + cs
+	}
+	return key
 }
 
 func boolToInt(v bool) int {
@@ -49,50 +113,508 @@ func boolToInt(v bool) int {
 	return 0
 }
 
-func (c *pageCache) Store(target string, opt *oms.RenderOptions, _ http.Header, page *oms.Page) {
+// cachePolicy is the freshness decision derived from an origin response.
+type cachePolicy struct {
+	store   bool
+	private bool
+	ttl     time.Duration
+	// fresh is the lifetime the origin granted, before ttl was raised to
+	// minPaginationTTL.
+	fresh time.Duration
+}
+
+// cachePolicyFromHeaders interprets Cache-Control, Pragma, Expires, Date and Age
+// the way a shared cache would. Responses without explicit freshness fall back to
+// a heuristic TTL based on Last-Modified or defaultPageCacheTTL.
+func cachePolicyFromHeaders(h http.Header, now time.Time) cachePolicy {
+	pol := cachePolicy{store: true, ttl: -1}
+	if h == nil {
+		pol.ttl = defaultPageCacheTTL
+		return pol
+	}
+	cc := oms.ParseCacheControl(h)
+	pol.store = !cc.NoStore
+	pol.private = cc.Private
+	noCache := cc.NoCache
+	if !pol.store {
+		return pol
+	}
+	if strings.Contains(strings.ToLower(h.Get("Pragma")), "no-cache") && len(h.Values("Cache-Control")) == 0 {
+		noCache = true
+	}
+	date := now
+	if d, err := http.ParseTime(h.Get("Date")); err == nil {
+		date = d
+	}
+	age := time.Duration(0)
+	if n, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && n > 0 {
+		age = time.Duration(n) * time.Second
+	}
+	switch {
+	case noCache:
+		pol.ttl = 0
+	case cc.SMaxAge >= 0 && !pol.private:
+		pol.ttl = time.Duration(cc.SMaxAge)*time.Second - age
+	case cc.MaxAge >= 0:
+		pol.ttl = time.Duration(cc.MaxAge)*time.Second - age
+	case h.Get("Expires") != "":
+		if exp, err := http.ParseTime(h.Get("Expires")); err == nil {
+			pol.ttl = exp.Sub(date)
+		} else {
+			pol.ttl = 0
+		}
+	default:
+		pol.ttl = defaultPageCacheTTL
+		if lm, err := http.ParseTime(h.Get("Last-Modified")); err == nil && date.After(lm) {
+			if heuristic := date.Sub(lm) / 10; heuristic < pol.ttl {
+				pol.ttl = heuristic
+			}
+		}
+	}
+	if pol.ttl > maxPageCacheTTL {
+		pol.ttl = maxPageCacheTTL
+	}
+	pol.fresh = max(pol.ttl, 0)
+	if pol.ttl < minPaginationTTL {
+		pol.ttl = minPaginationTTL
+		pol.private = true
+	}
+	return pol
+}
+
+// varyNames returns the canonical header names listed in Vary. A "*" entry makes
+// the response unshareable, which is reported via the second return value.
+func varyNames(h http.Header) ([]string, bool) {
+	var names []string
+	for _, raw := range h.Values("Vary") {
+		for _, name := range strings.Split(raw, ",") {
+			name = strings.TrimSpace(name)
+			if name == "" {
+				continue
+			}
+			if name == "*" {
+				return nil, false
+			}
+			names = append(names, http.CanonicalHeaderKey(name))
+		}
+	}
+	sort.Strings(names)
+	return names, true
+}
+
+func varySuffix(names []string, hdr http.Header) string {
+	if len(names) == 0 {
+		return ""
+	}
+	var b strings.Builder
+	for _, name := range names {
+		b.WriteString("|v:")
+		b.WriteString(name)
+		b.WriteByte('=')
+		if hdr != nil {
+			b.WriteString(strings.Join(hdr.Values(name), ","))
+		}
+	}
+	return b.String()
+}
+
+// cacheScope returns the client key a personalised entry is bound to.
+func cacheScope(opt *oms.RenderOptions) string {
+	if opt == nil || opt.ReqHeaders == nil {
+		return ""
+	}
+	return strings.TrimSpace(opt.ReqHeaders.Get("X-Operetta-Client-Key"))
+}
+
+// isPersonalised reports whether a render depends on per-client state: form
+// submissions, cookies sent upstream or cookies set by the origin.
+func isPersonalised(target string, opt *oms.RenderOptions, hdr http.Header, page *oms.Page) bool {
+	if len(page.SetCookies) > 0 {
+		return true
+	}
+	if opt != nil && isFormSubmission(opt) {
+		return true
+	}
+	if hdr != nil && (hdr.Get("Cookie") != "" || hdr.Get("Authorization") != "") {
+		return true
+	}
+	if opt != nil && opt.Jar != nil {
+		if u, err := url.Parse(target); err == nil && len(opt.Jar.Cookies(u)) > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+func (c *pageCache) Store(target string, opt *oms.RenderOptions, hdr http.Header, page *oms.Page) {
 	if opt == nil || page == nil || len(page.Data) == 0 || opt.Page > 1 {
 		return
 	}
 	if page.NoCache {
 		return
 	}
+	now := c.now()
+	pol := cachePolicyFromHeaders(page.OriginHeader, now)
+	if !pol.store {
+		return
+	}
+	names, shareable := varyNames(page.OriginHeader)
+	scope := ""
+	if pol.private || !shareable || isPersonalised(target, opt, hdr, page) {
+		scope = cacheScope(opt)
+		if scope == "" {
+			return
+		}
+	}
 	data := page.Data
 	if len(page.CachePacked) > 0 {
 		data = page.CachePacked
 	}
-	entry := cacheEntry{
+	base := cacheKey(target, opt)
+	key := base + varySuffix(names, hdr) + "|s=" + scope
+	entry := &cacheEntry{
+		key:        key,
+		target:     target,
+		host:       hostOf(target),
+		scope:      scope,
 		data:       append([]byte(nil), data...),
 		setCookies: append([]string(nil), page.SetCookies...),
-		created:    c.now(),
+		created:    now,
+		expires:    now.Add(pol.ttl),
+		fresh:      now.Add(pol.fresh),
 		stats:      page.Stats,
+		maxTags:    page.MaxTags,
+		forms:      page.Forms,
+	}
+	if page.OriginHeader != nil {
+		entry.etag = strings.TrimSpace(page.OriginHeader.Get("ETag"))
+		entry.lastModified = strings.TrimSpace(page.OriginHeader.Get("Last-Modified"))
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(names) > 0 {
+		c.vary[base] = names
+	} else {
+		delete(c.vary, base)
 	}
-	key := cacheKey(target, opt)
+	c.removeLocked(key)
+	c.items[key] = c.ll.PushFront(entry)
+	c.size += entry.size()
+	for c.size > c.maxBytes && c.ll.Len() > 0 {
+		c.removeElementLocked(c.ll.Back())
+	}
+}
+
+// lookup returns the entry visible to the requesting client that accept
+// admits, preferring a personalised render over a shared one. Expired entries
+// without origin validators are dropped on the way; the others are kept for
+// revalidation.
+func (c *pageCache) lookup(target string, opt *oms.RenderOptions, accept func(e *cacheEntry, now time.Time) bool) (*cacheEntry, bool) {
+	base := cacheKey(target, opt)
+	now := c.now()
 	c.mu.Lock()
-	c.data[key] = entry
-	c.mu.Unlock()
+	defer c.mu.Unlock()
+	keyBase := base + varySuffix(c.vary[base], opt.ReqHeaders)
+	candidates := []string{keyBase + "|s="}
+	if scope := cacheScope(opt); scope != "" {
+		candidates = append([]string{keyBase + "|s=" + scope}, candidates...)
+	}
+	for _, key := range candidates {
+		el, ok := c.items[key]
+		if !ok {
+			continue
+		}
+		entry := el.Value.(*cacheEntry)
+		if now.After(entry.expires) && !entry.hasValidators() {
+			c.removeElementLocked(el)
+			continue
+		}
+		if !accept(entry, now) {
+			continue
+		}
+		c.ll.MoveToFront(el)
+		return entry, true
+	}
+	return nil, false
+}
+
+// Entry filters for lookup.
+func entryUnexpired(e *cacheEntry, now time.Time) bool { return !now.After(e.expires) }
+func entryExpired(e *cacheEntry, now time.Time) bool   { return now.After(e.expires) }
+func entryFresh(e *cacheEntry, now time.Time) bool     { return now.Before(e.fresh) }
+
+// cachedPart is a pagination part cut from a cached render.
+type cachedPart struct {
+	data        []byte
+	setCookies  []string
+	page, pages int
+	stats       oms.TrafficStats
+	forms       []*oms.FormSpec
 }
 
-func (c *pageCache) Select(target string, opt *oms.RenderOptions) ([]byte, []string, int, int, oms.TrafficStats, bool) {
-	if opt == nil || opt.Page <= 1 || opt.MaxTagsPerPage <= 0 {
-		return nil, nil, 0, 0, oms.TrafficStats{}, false
+// Select serves a request from the cache. Later pages come from any unexpired
+// render; page 1 only while the origin's own freshness lasts, and a shared
+// render is not handed to a client that sends cookies of its own.
+func (c *pageCache) Select(target string, opt *oms.RenderOptions) (*cachedPart, bool) {
+	if opt == nil || isFormSubmission(opt) {
+		return nil, false
+	}
+	maxTags := opt.MaxTagsPerPage
+	var entry *cacheEntry
+	var ok bool
+	if opt.Page > 1 {
+		if maxTags <= 0 {
+			return nil, false
+		}
+		entry, ok = c.lookup(target, opt, entryUnexpired)
+	} else {
+		personal := isPersonalised(target, opt, opt.ReqHeaders, &oms.Page{})
+		entry, ok = c.lookup(target, opt, func(e *cacheEntry, now time.Time) bool {
+			return entryFresh(e, now) && (e.scope != "" || !personal)
+		})
+		if ok && maxTags <= 0 {
+			maxTags = entry.maxTags
+		}
 	}
-	key := cacheKey(target, opt)
-	c.mu.RLock()
-	entry, ok := c.data[key]
-	c.mu.RUnlock()
 	if !ok {
-		return nil, nil, 0, 0, oms.TrafficStats{}, false
+		return nil, false
+	}
+	raw, cur, cnt, err := selectPart(entry, target, opt, maxTags)
+	if err != nil {
+		return nil, false
 	}
+	return &cachedPart{
+		data:       raw,
+		setCookies: append([]string(nil), entry.setCookies...),
+		page:       cur,
+		pages:      cnt,
+		stats:      entry.stats,
+		forms:      entry.forms,
+	}, true
+}
+
+// isFormSubmission reports whether opt carries a form payload.
+func isFormSubmission(opt *oms.RenderOptions) bool {
+	fb := strings.TrimSpace(opt.FormBody)
+	return fb != "" && fb != "0"
+}
+
+func selectPart(entry *cacheEntry, target string, opt *oms.RenderOptions, maxTags int) ([]byte, int, int, error) {
 	var raw []byte
 	var cur, cnt int
 	var err error
 	if opt.ServerBase != "" {
-		raw, cur, cnt, err = oms.SelectOMSPartFromPackedWithNav(entry.data, opt.Page, opt.MaxTagsPerPage, opt.ServerBase, target, opt)
+		raw, cur, cnt, err = oms.SelectOMSPartFromPackedWithNav(entry.data, opt.Page, maxTags, opt.ServerBase, target, opt)
 	} else {
-		raw, cur, cnt, err = oms.SelectOMSPartFromPacked(entry.data, opt.Page, opt.MaxTagsPerPage)
+		raw, cur, cnt, err = oms.SelectOMSPartFromPacked(entry.data, opt.Page, maxTags)
+	}
+	if err != nil {
+		return nil, 0, 0, err
+	}
+	return append([]byte(nil), raw...), cur, cnt, nil
+}
+
+// Stale returns an entry that can be revalidated with the origin: any entry
+// with validators for page 1, which Select did not answer, and expired ones
+// for later pages. Form submissions never revalidate.
+func (c *pageCache) Stale(target string, opt *oms.RenderOptions) (*cacheEntry, bool) {
+	if opt == nil || isFormSubmission(opt) {
+		return nil, false
+	}
+	if opt.Page <= 1 {
+		return c.lookup(target, opt, func(e *cacheEntry, _ time.Time) bool { return e.hasValidators() })
+	}
+	return c.lookup(target, opt, entryExpired)
+}
+
+// Revalidated turns a 304 answer into a Page rebuilt from the stale entry's
+// packed render, so the caller can serve and re-store it like a fresh load.
+// Validators and caching headers missing from the 304 are inherited.
+func (c *pageCache) Revalidated(entry *cacheEntry, target string, opt *oms.RenderOptions, notModified *oms.Page) (*oms.Page, bool) {
+	if entry == nil || notModified == nil || opt == nil {
+		return nil, false
+	}
+	maxTags := opt.MaxTagsPerPage
+	if maxTags <= 0 {
+		maxTags = entry.maxTags
+	}
+	raw, _, _, err := selectPart(entry, target, opt, maxTags)
+	if err != nil {
+		return nil, false
+	}
+	header := http.Header{}
+	for k, vs := range notModified.OriginHeader {
+		header[k] = append([]string(nil), vs...)
+	}
+	if header.Get("ETag") == "" && entry.etag != "" {
+		header.Set("ETag", entry.etag)
+	}
+	if header.Get("Last-Modified") == "" && entry.lastModified != "" {
+		header.Set("Last-Modified", entry.lastModified)
+	}
+	c.refresh(entry, header)
+	cookies := notModified.SetCookies
+	if len(cookies) == 0 {
+		cookies = entry.setCookies
+	}
+	stats := entry.stats
+	stats.EncodedBytes = len(raw)
+	return &oms.Page{
+		Data:         raw,
+		CachePacked:  append([]byte(nil), entry.data...),
+		SetCookies:   append([]string(nil), cookies...),
+		OriginHeader: header,
+		MaxTags:      maxTags,
+		Stats:        stats,
+		Forms:        entry.forms,
+	}, true
+}
+
+// refresh extends the freshness of a revalidated entry according to the headers
+// of the 304 response, or drops it when the origin no longer allows storing.
+func (c *pageCache) refresh(entry *cacheEntry, header http.Header) {
+	now := c.now()
+	pol := cachePolicyFromHeaders(header, now)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[entry.key]
+	if !ok || el.Value.(*cacheEntry) != entry {
+		return
+	}
+	if !pol.store {
+		c.removeElementLocked(el)
+		return
+	}
+	entry.expires = now.Add(pol.ttl)
+	entry.fresh = now.Add(pol.fresh)
+	if v := strings.TrimSpace(header.Get("ETag")); v != "" {
+		entry.etag = v
+	}
+	if v := strings.TrimSpace(header.Get("Last-Modified")); v != "" {
+		entry.lastModified = v
+	}
+	c.ll.MoveToFront(el)
+}
+
+// Purge drops entries whose target equals rawURL (ignoring the fragment) or whose
+// host matches host, including its subdomains. It returns the number of entries removed.
+func (c *pageCache) Purge(rawURL, host string) int {
+	rawURL = strings.TrimSpace(rawURL)
+	if i := strings.IndexByte(rawURL, '#'); i != -1 {
+		rawURL = rawURL[:i]
+	}
+	host = strings.ToLower(strings.TrimSpace(host))
+	if rawURL == "" && host == "" {
+		return 0
 	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	removed := 0
+	for el := c.ll.Front(); el != nil; {
+		next := el.Next()
+		entry := el.Value.(*cacheEntry)
+		match := rawURL != "" && entry.target == rawURL
+		if !match && host != "" {
+			match = entry.host == host || strings.HasSuffix(entry.host, "."+host)
+		}
+		if match {
+			c.removeElementLocked(el)
+			removed++
+		}
+		el = next
+	}
+	return removed
+}
+
+// pageCacheEntry describes a cached render for the admin console.
+type pageCacheEntry struct {
+	Key        string
+	Target     string
+	Scope      string
+	Bytes      int64
+	Created    time.Time
+	Expires    time.Time
+	Validators bool
+}
+
+// Entries lists the cached renders, most recently used first.
+func (c *pageCache) Entries() []pageCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	out := make([]pageCacheEntry, 0, c.ll.Len())
+	for el := c.ll.Front(); el != nil; el = el.Next() {
+		e := el.Value.(*cacheEntry)
+		out = append(out, pageCacheEntry{
+			Key:        e.key,
+			Target:     e.target,
+			Scope:      e.scope,
+			Bytes:      e.size(),
+			Created:    e.created,
+			Expires:    e.expires,
+			Validators: e.hasValidators(),
+		})
+	}
+	return out
+}
+
+// Remove drops the entry stored under key.
+func (c *pageCache) Remove(key string) bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	_, ok := c.items[key]
+	c.removeLocked(key)
+	return ok
+}
+
+// Clear drops every entry and returns how many were removed.
+func (c *pageCache) Clear() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := c.ll.Len()
+	c.ll.Init()
+	c.items = make(map[string]*list.Element)
+	c.vary = make(map[string][]string)
+	c.size = 0
+	return n
+}
+
+// Resize changes the byte budget, evicting least recently used entries as needed.
+func (c *pageCache) Resize(maxBytes int64) {
+	if maxBytes <= 0 {
+		maxBytes = defaultPageCacheBytes
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.maxBytes = maxBytes
+	for c.size > c.maxBytes && c.ll.Len() > 0 {
+		c.removeElementLocked(c.ll.Back())
+	}
+}
+
+// Len reports the number of cached renders and their total size in bytes.
+func (c *pageCache) Len() (int, int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.ll.Len(), c.size
+}
+
+func (c *pageCache) removeLocked(key string) {
+	if el, ok := c.items[key]; ok {
+		c.removeElementLocked(el)
+	}
+}
+
+func (c *pageCache) removeElementLocked(el *list.Element) {
+	entry := el.Value.(*cacheEntry)
+	c.ll.Remove(el)
+	delete(c.items, entry.key)
+	c.size -= entry.size()
+}
+
+func hostOf(target string) string {
+	u, err := url.Parse(target)
 	if err != nil {
-		return nil, nil, 0, 0, oms.TrafficStats{}, false
+		return ""
 	}
-	return append([]byte(nil), raw...), append([]string(nil), entry.setCookies...), cur, cnt, entry.stats, true
+	return strings.ToLower(u.Hostname())
 }
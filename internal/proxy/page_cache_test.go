@@ -0,0 +1,197 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"operetta/oms"
+)
+
+func TestCachePolicyFromHeaders(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name    string
+		hdr     http.Header
+		store   bool
+		private bool
+		ttl     time.Duration
+	}{
+		{"none", nil, true, false, defaultPageCacheTTL},
+		{"max-age", http.Header{"Cache-Control": {"public, max-age=600"}, "Age": {"60"}}, true, false, 540 * time.Second},
+		{"s-maxage", http.Header{"Cache-Control": {"max-age=60, s-maxage=3600"}}, true, false, time.Hour},
+		{"no-store", http.Header{"Cache-Control": {"no-store"}}, false, false, -1},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, true, true, minPaginationTTL},
+		{"private", http.Header{"Cache-Control": {"private, max-age=900"}}, true, true, 15 * time.Minute},
+		{"expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(30 * time.Minute).Format(http.TimeFormat)},
+		}, true, false, 30 * time.Minute},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			pol := cachePolicyFromHeaders(tc.hdr, now)
+			if pol.store != tc.store || pol.private != tc.private || (tc.store && pol.ttl != tc.ttl) {
+				t.Fatalf("got %+v, want store=%v private=%v ttl=%v", pol, tc.store, tc.private, tc.ttl)
+			}
+		})
+	}
+}
+
+func cacheTestOptions(clientKey string) *oms.RenderOptions {
+	opt := defaultRenderOptions()
+	opt.ReqHeaders = http.Header{"X-Operetta-Client-Key": {clientKey}}
+	return opt
+}
+
+func TestPageCacheScopesPersonalisedPages(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	c := newPageCache(func() time.Time { return now }, 0)
+	page := &oms.Page{Data: []byte("packed"), SetCookies: []string{"sid=1"}}
+	c.Store("http://example.com/", cacheTestOptions("alice"), nil, page)
+
+	if _, ok := c.lookup("http://example.com/", cacheTestOptions("bob"), entryUnexpired); ok {
+		t.Fatalf("personalised page leaked to another client")
+	}
+	if _, ok := c.lookup("http://example.com/", cacheTestOptions("alice"), entryUnexpired); !ok {
+		t.Fatalf("expected owner to hit personalised entry")
+	}
+
+	public := &oms.Page{Data: []byte("public"), OriginHeader: http.Header{"Cache-Control": {"max-age=300"}}}
+	c.Store("http://example.org/", cacheTestOptions("alice"), nil, public)
+	if _, ok := c.lookup("http://example.org/", cacheTestOptions("bob"), entryUnexpired); !ok {
+		t.Fatalf("expected public entry to be shared")
+	}
+	now = now.Add(6 * time.Minute)
+	if _, ok := c.lookup("http://example.org/", cacheTestOptions("bob"), entryUnexpired); ok {
+		t.Fatalf("expected entry to expire after max-age")
+	}
+}
+
+func TestPageCacheBoundsAndPurge(t *testing.T) {
+	c := newPageCache(time.Now, 2048)
+	for _, u := range []string{"http://a.example.com/1", "http://a.example.com/2", "http://b.example.net/"} {
+		c.Store(u, cacheTestOptions("k"), nil, &oms.Page{Data: make([]byte, 900)})
+	}
+	if n, size := c.Len(); n != 2 || size > 2048 {
+		t.Fatalf("expected LRU to keep 2 entries within budget, got n=%d size=%d", n, size)
+	}
+	if _, ok := c.lookup("http://a.example.com/1", cacheTestOptions("k"), entryUnexpired); ok {
+		t.Fatalf("expected oldest entry to be evicted")
+	}
+	if removed := c.Purge("", "example.com"); removed != 1 {
+		t.Fatalf("expected host purge to remove 1 entry, got %d", removed)
+	}
+	if removed := c.Purge("http://b.example.net/", ""); removed != 1 {
+		t.Fatalf("expected url purge to remove 1 entry, got %d", removed)
+	}
+	c.Store("http://x/", cacheTestOptions("k"), nil, &oms.Page{Data: []byte("x"), NoCache: true})
+	if n, _ := c.Len(); n != 0 {
+		t.Fatalf("expected NoCache page to be skipped, have %d entries", n)
+	}
+}
+
+func TestLoadPageRevalidatesStaleEntry(t *testing.T) {
+	var full, conditional int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Cache-Control", "max-age=300")
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body><p>hello</p></body></html>")
+	}))
+	defer origin.Close()
+
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	s := newTestServer()
+	s.logger = slog.New(slog.DiscardHandler)
+	s.sites = newSiteConfigStore(t.TempDir())
+	s.cache = newPageCache(func() time.Time { return now }, 0)
+	target := origin.URL + "/"
+
+	page, err := s.loadPageRevalidating(context.Background(), target, http.Header{}, cacheTestOptions("k"))
+	if err != nil || page.NotModified {
+		t.Fatalf("initial load: err=%v notModified=%v", err, page.NotModified)
+	}
+	s.cache.Store(target, cacheTestOptions("k"), nil, page)
+
+	now = now.Add(10 * time.Minute)
+	if _, ok := s.cache.lookup(target, cacheTestOptions("k"), entryUnexpired); ok {
+		t.Fatalf("expected entry to be stale")
+	}
+	again, err := s.loadPageRevalidating(context.Background(), target, http.Header{}, cacheTestOptions("k"))
+	if err != nil || again.NotModified || len(again.Data) == 0 {
+		t.Fatalf("revalidated load: err=%v page=%+v", err, again)
+	}
+	if full != 1 || conditional != 1 {
+		t.Fatalf("expected one full and one conditional fetch, got %d/%d", full, conditional)
+	}
+	if _, ok := s.cache.lookup(target, cacheTestOptions("k"), entryUnexpired); !ok {
+		t.Fatalf("expected 304 to refresh the entry")
+	}
+}
+
+func TestFetchReloadUsesPageCache(t *testing.T) {
+	var full, conditional int32
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/news" {
+			w.Header().Set("Cache-Control", "no-cache")
+		} else {
+			w.Header().Set("Cache-Control", "max-age=300")
+		}
+		w.Header().Set("ETag", `"v1"`)
+		if r.Header.Get("If-None-Match") == `"v1"` {
+			atomic.AddInt32(&conditional, 1)
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		atomic.AddInt32(&full, 1)
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		io.WriteString(w, "<html><body><p>hello</p></body></html>")
+	}))
+	defer origin.Close()
+
+	s := New(Config{Logger: slog.New(slog.DiscardHandler), SitesDir: t.TempDir()})
+	t.Cleanup(func() { _ = s.Close() })
+	load := func(path string) string {
+		rec := httptest.NewRecorder()
+		s.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "http://operetta/fetch?url="+origin.URL+path, nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("%s: status %d", path, rec.Code)
+		}
+		tokens, err := decodeOMSTokens(rec.Body.Bytes())
+		if err != nil {
+			t.Fatalf("%s: %v", path, err)
+		}
+		return fmt.Sprint(tokens)
+	}
+
+	// A fresh page is answered from the cache on reload.
+	first := load("/")
+	if again := load("/"); again != first {
+		t.Fatalf("cached reload differs from the first render:\n%s\n%s", first, again)
+	}
+	if full != 1 || conditional != 0 {
+		t.Fatalf("fresh reload: expected one origin fetch, got %d full and %d conditional", full, conditional)
+	}
+
+	// A no-cache page is revalidated, and a 304 replays the render.
+	first = load("/news")
+	if again := load("/news"); again != first {
+		t.Fatalf("revalidated reload differs from the first render:\n%s\n%s", first, again)
+	}
+	if full != 2 || conditional != 1 {
+		t.Fatalf("no-cache reload: expected a conditional fetch, got %d full and %d conditional", full, conditional)
+	}
+}
@@ -0,0 +1,45 @@
+package proxy
+
+import "errors"
+
+var errServerClosed = errors.New("proxy: server closed")
+
+// Reload applies the runtime-tunable parts of cfg to a running server: the
+// index page, bookmarks, site-config directory (whose lookup cache is dropped),
+// admin credentials, session limits, page cache and upload budgets and
+// renderer options. Per-client state, caches and the session store are kept,
+// so no client loses its session. Logger, Clock, SessionStore and the
+// background intervals only take effect in New.
+func (s *Server) Reload(cfg Config) {
+	if cfg.IndexHTML == "" {
+		cfg.IndexHTML = defaultIndexHTML
+	}
+	if cfg.SitesDir == "" {
+		cfg.SitesDir = defaultSitesDir
+	}
+	limits := cfg.SessionLimits.withDefaults()
+
+	s.cfgMu.Lock()
+	limits.JanitorInterval = s.cfg.SessionLimits.JanitorInterval
+	s.cfg.IndexHTML = cfg.IndexHTML
+	s.cfg.Bookmarks = cfg.Bookmarks
+	s.cfg.BookmarkMode = cfg.BookmarkMode
+	s.cfg.SitesDir = cfg.SitesDir
+	s.cfg.AdminToken = cfg.AdminToken
+	s.cfg.AdminLoopback = cfg.AdminLoopback
+	s.cfg.SessionLimits = limits
+	s.cfg.PageCacheBytes = cfg.PageCacheBytes
+	s.cfg.UploadSlotBytes = cfg.UploadSlotBytes
+	s.cfg.UploadTotalBytes = cfg.UploadTotalBytes
+	s.cfg.Render = cfg.Render
+	s.cfgMu.Unlock()
+
+	if s.sessionCap != nil {
+		s.sessionCap.max.Store(int64(limits.MaxSessions))
+	}
+	s.sites.Reset(cfg.SitesDir)
+	s.cache.Resize(cfg.PageCacheBytes)
+	s.uploads.Resize(cfg.UploadTotalBytes)
+	s.logger.Info("config reloaded", "bookmarks", len(cfg.Bookmarks), "bookmark_mode", int(cfg.BookmarkMode),
+		"sites_dir", cfg.SitesDir, "session_idle", limits.IdleTTL.String(), "session_max", limits.MaxSessions)
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReloadKeepsSessionsAndRereadsSites(t *testing.T) {
+	dir := t.TempDir()
+	s := New(Config{
+		Logger:       slog.New(slog.DiscardHandler),
+		SitesDir:     dir,
+		BookmarkMode: BookmarkModeAuto,
+	})
+	defer s.Close()
+
+	if s.shouldServeLocalBookmarks() {
+		t.Fatalf("auto mode without bookmarks must not serve the local portal")
+	}
+	if cfg := s.sites.Find("http://example.com/"); cfg != nil {
+		t.Fatalf("unexpected site config before the file exists: %+v", cfg)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "example.com.json"), []byte(`{"mode":"compact"}`), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if cfg := s.sites.Find("http://example.com/"); cfg != nil {
+		t.Fatalf("expected negative lookup to stay cached until reload")
+	}
+	s.auth.ensure("client")
+
+	s.Reload(Config{
+		SitesDir:      dir,
+		Bookmarks:     []Bookmark{{Title: "Wiki", URL: "https://en.wikipedia.org"}},
+		SessionLimits: SessionLimits{IdleTTL: time.Hour},
+	})
+	if !s.shouldServeLocalBookmarks() {
+		t.Fatalf("expected reloaded bookmarks to enable the local portal")
+	}
+	if cfg := s.sites.Find("http://example.com/"); cfg == nil || cfg.Mode != "compact" {
+		t.Fatalf("expected site config to be re-read after reload, got %+v", cfg)
+	}
+	if got := s.config().SessionLimits; got.IdleTTL != time.Hour || got.JanitorInterval != defaultSessionJanitorEvery {
+		t.Fatalf("unexpected session limits after reload: %+v", got)
+	}
+	if s.auth.Len() != 1 {
+		t.Fatalf("reload must not drop sessions, have %d", s.auth.Len())
+	}
+}
+
+func TestCloseDisablesJSBaker(t *testing.T) {
+	s := New(Config{Logger: slog.New(slog.DiscardHandler), SitesDir: t.TempDir()})
+	if err := s.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.getJSBaker(); err == nil {
+		t.Fatalf("expected JS baker to be unavailable after Close")
+	}
+}
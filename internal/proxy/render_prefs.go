@@ -2,7 +2,9 @@ package proxy
 
 import (
 	"net/url"
+	"strings"
 	"sync"
+	"time"
 
 	"operetta/oms"
 )
@@ -15,12 +17,17 @@ type renderPref struct {
 }
 
 type renderPrefStore struct {
-	mu   sync.RWMutex
-	data map[string]renderPref
+	mu    sync.RWMutex
+	data  map[string]renderPref
+	index *sessionIndex
+	clock func() time.Time
 }
 
-func newRenderPrefStore() *renderPrefStore {
-	return &renderPrefStore{data: make(map[string]renderPref)}
+func newRenderPrefStore(clock func() time.Time) *renderPrefStore {
+	if clock == nil {
+		clock = time.Now
+	}
+	return &renderPrefStore{data: make(map[string]renderPref), index: newSessionIndex(), clock: clock}
 }
 
 func (s *renderPrefStore) Remember(key string, opt *oms.RenderOptions) {
@@ -34,16 +41,28 @@ func (s *renderPrefStore) Remember(key string, opt *oms.RenderOptions) {
 		ImageMIME:   opt.ImageMIME,
 		MaxInlineKB: opt.MaxInlineKB,
 	}
+	s.index.touch(key, s.clock())
 	s.mu.Unlock()
 }
 
+// bound evicts the least recently used preference once an insert exceeds cap.
+func (s *renderPrefStore) bound(cap *sessionCap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.bound(cap, func(key string) { delete(s.data, key) })
+}
+
 func (s *renderPrefStore) Apply(key string, opt *oms.RenderOptions, overrides url.Values) {
 	if opt == nil {
 		return
 	}
-	s.mu.RLock()
+	// Reading a preference counts as use, so it ages from here.
+	s.mu.Lock()
 	pref, ok := s.data[key]
-	s.mu.RUnlock()
+	if ok {
+		s.index.touch(key, s.clock())
+	}
+	s.mu.Unlock()
 	if !ok {
 		return
 	}
@@ -60,3 +79,66 @@ func (s *renderPrefStore) Apply(key string, opt *oms.RenderOptions, overrides ur
 		opt.MaxInlineKB = pref.MaxInlineKB
 	}
 }
+
+func (s *renderPrefStore) Snapshot() map[string]renderPref {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := make(map[string]renderPref, len(s.data))
+	for key, pref := range s.data {
+		out[key] = pref
+	}
+	return out
+}
+
+// WithPrefix returns the remembered preferences whose key starts with prefix,
+// keyed by the remainder of the key.
+func (s *renderPrefStore) WithPrefix(prefix string) map[string]renderPref {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := map[string]renderPref{}
+	for key, pref := range s.data {
+		if rest, ok := strings.CutPrefix(key, prefix); ok {
+			out[rest] = pref
+		}
+	}
+	return out
+}
+
+// LastUsed reports when each preference was last used.
+func (s *renderPrefStore) LastUsed() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.index.lastUsed()
+}
+
+// Restore loads persisted preferences with their last-use times; entries
+// without one count as used now.
+func (s *renderPrefStore) Restore(data map[string]renderPref, lastUsed map[string]time.Time) {
+	if len(data) == 0 {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := make([]string, 0, len(data))
+	for key, pref := range data {
+		s.data[key] = pref
+		keys = append(keys, key)
+	}
+	s.index.restore(keys, lastUsed, s.clock())
+}
+
+func (s *renderPrefStore) Len() int {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return len(s.data)
+}
+
+func (s *renderPrefStore) Sweep(now time.Time, idle time.Duration, max int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.evictable(now, idle, max)
+	for _, key := range keys {
+		delete(s.data, key)
+	}
+	return len(keys)
+}
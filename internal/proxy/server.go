@@ -1,12 +1,15 @@
 package proxy
 
 import (
-	"log"
+	"log/slog"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"operetta/oms"
 )
 
 const defaultIndexHTML = `<!DOCTYPE html>
@@ -25,8 +28,8 @@ const defaultSitesDir = "config/sites"
 
 // Bookmark represents a quick link shown in the local bookmarks portal.
 type Bookmark struct {
-	Title string
-	URL   string
+	Title string `json:"title"`
+	URL   string `json:"url"`
 }
 
 // BookmarkMode controls how the proxy handles portal requests.
@@ -44,40 +47,103 @@ type Config struct {
 	Bookmarks    []Bookmark
 	BookmarkMode BookmarkMode
 	SitesDir     string
-	Logger       *log.Logger
-	Clock        func() time.Time
+	// Logger receives structured access and event records. It is fixed for
+	// the lifetime of the server; Reload does not replace it. Secrets are
+	// redacted unless it comes from NewLogger with secrets enabled.
+	Logger *slog.Logger
+	Clock  func() time.Time
+	// SessionStore persists auth tokens, cookie jars, form tokens and render
+	// preferences across restarts. Nil keeps all per-client state in memory.
+	SessionStore SessionStore
+	// SessionFlushInterval controls how often the session snapshot is saved.
+	SessionFlushInterval time.Duration
+	// SessionLimits bounds memory used by per-client state.
+	SessionLimits SessionLimits
+	// PageCacheBytes caps the rendered page cache; zero uses the default.
+	PageCacheBytes int64
+	// UploadSlotBytes caps the size of a /download kept as an upload slot
+	// for file inputs; zero uses the default (2 MiB), negative disables slots.
+	UploadSlotBytes int64
+	// UploadTotalBytes caps the memory held by the upload slots of all
+	// clients together; zero uses the default (64 MiB).
+	UploadTotalBytes int64
+	// AdminToken protects operator endpoints under /admin and /metrics. When
+	// empty they are disabled unless AdminLoopback is set.
+	AdminToken string
+	// AdminLoopback opens the operator endpoints to loopback clients when no
+	// AdminToken is set. Leave it off behind a reverse proxy or stunnel on
+	// the same host, where every request arrives from loopback.
+	AdminLoopback bool
+	// Render holds the renderer options passed to oms for every request.
+	Render oms.Options
 }
 
 // DefaultConfig populates configuration from environment variables.
 func DefaultConfig() Config {
-	cfg := Config{
-		IndexHTML: defaultIndexHTML,
-		Logger:    log.Default(),
-		Clock:     time.Now,
-		SitesDir:  strings.TrimSpace(os.Getenv("OMS_SITES_DIR")),
+	return (&FileConfig{}).Config()
+}
+
+// applyEnv overrides cfg with the OMS_* environment variables.
+func applyEnv(cfg *Config) {
+	if v := strings.TrimSpace(os.Getenv("OMS_SITES_DIR")); v != "" {
+		cfg.SitesDir = v
 	}
-	if cfg.SitesDir == "" {
-		cfg.SitesDir = defaultSitesDir
+	if v := strings.TrimSpace(os.Getenv("OMS_ADMIN_TOKEN")); v != "" {
+		cfg.AdminToken = v
 	}
-	mode := strings.ToLower(strings.TrimSpace(os.Getenv("OMS_BOOKMARKS_MODE")))
-	switch mode {
-	case "remote", "pass", "passthrough":
-		cfg.BookmarkMode = BookmarkModeRemote
-	case "local", "inline":
-		cfg.BookmarkMode = BookmarkModeLocal
-	default:
-		cfg.BookmarkMode = BookmarkModeAuto
+	if v := strings.TrimSpace(os.Getenv("OMS_ADMIN_LOOPBACK")); v != "" {
+		cfg.AdminLoopback = v == "1"
+	}
+	cfg.SessionLimits = sessionLimitsFromEnv(cfg.SessionLimits)
+	cfg.Render = oms.OptionsFromEnv(cfg.Render)
+	if mb := strings.TrimSpace(os.Getenv("OMS_PAGE_CACHE_MB")); mb != "" {
+		if n, err := strconv.Atoi(mb); err == nil && n > 0 {
+			cfg.PageCacheBytes = int64(n) << 20
+		}
+	}
+	if kb := strings.TrimSpace(os.Getenv("OMS_UPLOAD_SLOT_KB")); kb != "" {
+		if n, err := strconv.Atoi(kb); err == nil {
+			cfg.UploadSlotBytes = int64(n) << 10
+			if n == 0 {
+				cfg.UploadSlotBytes = -1
+			}
+		}
+	}
+	if mb := strings.TrimSpace(os.Getenv("OMS_UPLOAD_TOTAL_MB")); mb != "" {
+		if n, err := strconv.Atoi(mb); err == nil && n > 0 {
+			cfg.UploadTotalBytes = int64(n) << 20
+		}
+	}
+	if path := strings.TrimSpace(os.Getenv("OMS_SESSION_FILE")); path != "" {
+		cfg.SessionStore = NewFileSessionStore(path)
+	}
+	if mode := strings.TrimSpace(os.Getenv("OMS_BOOKMARKS_MODE")); mode != "" {
+		cfg.BookmarkMode = parseBookmarkMode(mode)
 	}
 	if raw := strings.TrimSpace(os.Getenv("OMS_BOOKMARKS")); raw != "" {
 		cfg.Bookmarks = parseBookmarks(raw)
-		if len(cfg.Bookmarks) > 0 && cfg.BookmarkMode == BookmarkModeRemote {
-			// honour explicit remote request; ignore list.
-			cfg.Bookmarks = nil
-		}
-	} else if cfg.BookmarkMode == BookmarkModeLocal {
+	}
+}
+
+// finishBookmarks reconciles the bookmark list with the mode: an explicit remote
+// mode ignores the list, local mode falls back to the built-in portal link.
+func finishBookmarks(cfg *Config) {
+	if cfg.BookmarkMode == BookmarkModeRemote {
+		cfg.Bookmarks = nil
+	} else if cfg.BookmarkMode == BookmarkModeLocal && len(cfg.Bookmarks) == 0 {
 		cfg.Bookmarks = parseBookmarks(defaultBookmarksSpec)
 	}
-	return cfg
+}
+
+func parseBookmarkMode(raw string) BookmarkMode {
+	switch strings.ToLower(strings.TrimSpace(raw)) {
+	case "remote", "pass", "passthrough":
+		return BookmarkModeRemote
+	case "local", "inline":
+		return BookmarkModeLocal
+	default:
+		return BookmarkModeAuto
+	}
 }
 
 const defaultBookmarksSpec = "Bookmarks|http://www.google.com/xhtml?client=ms-opera_mb_no&channel=bm"
@@ -102,10 +168,13 @@ func parseBookmarks(raw string) []Bookmark {
 
 // Server exposes the HTTP handlers implementing the proxy behaviour.
 type Server struct {
+	// cfgMu guards the fields of cfg that Reload may replace.
+	cfgMu       sync.RWMutex
 	cfg         Config
 	mux         *http.ServeMux
 	handler     http.Handler
-	logger      *log.Logger
+	admin       http.Handler
+	logger      *slog.Logger
 	renderPrefs *renderPrefStore
 	cookieJars  *CookieJarStore
 	auth        *authStore
@@ -113,50 +182,89 @@ type Server struct {
 	sites       *siteConfigStore
 	clock       func() time.Time
 	forms       *formStore
+	uploads     *uploadStore
+	metrics     *serverMetrics
 	jsBakerOnce sync.Once
 	jsBaker     *jsBaker
 	jsBakerErr  error
+	bgStop      chan struct{}
+	bgWG        sync.WaitGroup
+	closeOnce   sync.Once
+
+	sessionsEvicted uint64
+	sessionCap      *sessionCap
 }
 
-// New wires a new proxy server with the provided configuration.
+// New wires a new proxy server with the provided configuration. It starts a
+// session janitor goroutine, and a session flusher when cfg.SessionStore is
+// set; they run until Close, which embedders and tests must call to stop them.
 func New(cfg Config) *Server {
 	if cfg.IndexHTML == "" {
 		cfg.IndexHTML = defaultIndexHTML
 	}
 	if cfg.Logger == nil {
-		cfg.Logger = log.Default()
+		cfg.Logger = slog.Default()
 	}
+	cfg.Logger = redactingLogger(cfg.Logger)
 	if cfg.Clock == nil {
 		cfg.Clock = time.Now
 	}
 	if cfg.SitesDir == "" {
 		cfg.SitesDir = defaultSitesDir
 	}
+	if cfg.SessionFlushInterval <= 0 {
+		cfg.SessionFlushInterval = defaultSessionFlushInterval
+	}
+	cfg.SessionLimits = cfg.SessionLimits.withDefaults()
 	s := &Server{
 		cfg:         cfg,
 		mux:         http.NewServeMux(),
 		logger:      cfg.Logger,
-		renderPrefs: newRenderPrefStore(),
-		cookieJars:  CookieJarStoreInstance,
+		renderPrefs: newRenderPrefStore(cfg.Clock),
+		cookieJars:  NewCookieJarStore(),
 		auth:        newAuthStore(cfg.Clock),
-		cache:       newPageCache(cfg.Clock),
+		cache:       newPageCache(cfg.Clock, cfg.PageCacheBytes),
 		sites:       newSiteConfigStore(cfg.SitesDir),
 		clock:       cfg.Clock,
-		forms:       newFormStore(),
+		forms:       newFormStore(cfg.Clock),
+		uploads:     newUploadStore(cfg.Clock, cfg.UploadTotalBytes),
+		metrics:     newServerMetrics(),
+	}
+	s.cookieJars.SetClock(cfg.Clock)
+	s.boundSessions(newSessionCap(cfg.SessionLimits.MaxSessions))
+	s.loadSessions()
+	s.bgStop = make(chan struct{})
+	s.bgWG.Add(1)
+	go s.runSessionJanitor(cfg.SessionLimits.JanitorInterval)
+	if cfg.SessionStore != nil {
+		s.bgWG.Add(1)
+		go s.runSessionFlusher(cfg.SessionFlushInterval)
 	}
 	s.registerRoutes()
 	s.handler = withLogging(s.logger, s.mux)
+	admin := http.NewServeMux()
+	s.registerAdminRoutes(admin)
+	s.admin = withLogging(s.logger, admin)
 	return s
 }
 
-// NewServer keeps backwards compatibility with the old factory signature.
+// NewServer keeps backwards compatibility with the old factory signature. The
+// handler is a *Server whose background goroutines only stop on Close.
 func NewServer() http.Handler {
 	return New(DefaultConfig())
 }
 
+// CookieJars returns the server's upstream cookie jars. Handlers pass the
+// client's jar to the renderer per request.
+func (s *Server) CookieJars() *CookieJarStore { return s.cookieJars }
+
 // Handler exposes the HTTP handler with middleware applied.
 func (s *Server) Handler() http.Handler { return s }
 
+// AdminHandler serves only the admin console, metrics and debug routes, for a
+// listener kept apart from the handset port.
+func (s *Server) AdminHandler() http.Handler { return s.admin }
+
 // ServeHTTP implements http.Handler.
 func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 	s.handler.ServeHTTP(w, r)
@@ -165,9 +273,34 @@ func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
 func (s *Server) registerRoutes() {
 	s.mux.HandleFunc("/", s.handleRoot)
 	s.mux.HandleFunc("/fetch", s.handleFetch)
-	s.mux.HandleFunc("/validate", s.handleValidate)
-	s.mux.HandleFunc("/ping", s.handlePing)
 	s.mux.HandleFunc("/download", s.handleDownload)
+	s.registerAdminRoutes(s.mux)
+}
+
+// registerAdminRoutes adds the admin console, metrics and debug routes to mux.
+func (s *Server) registerAdminRoutes(mux *http.ServeMux) {
+	mux.HandleFunc("/validate", s.handleValidate)
+	mux.HandleFunc("/ping", s.handlePing)
+	mux.HandleFunc("/admin/cache/purge", s.handleCachePurge)
+	mux.HandleFunc("/admin", s.handleAdminConsole)
+	mux.HandleFunc("/admin/pages/purge", s.handleConsolePagePurge)
+	mux.HandleFunc("/admin/images/purge", s.handleConsoleImagePurge)
+	mux.HandleFunc("/admin/sites", s.handleConsoleSiteSave)
+	mux.HandleFunc("/admin/render", s.handleConsoleRender)
+	mux.HandleFunc("/metrics", s.handleMetrics)
+}
+
+// renderEngine returns a copy of the renderer options for one request.
+func (s *Server) renderEngine() *oms.Options {
+	eng := s.config().Render
+	return &eng
+}
+
+// config returns a snapshot of the current configuration.
+func (s *Server) config() Config {
+	s.cfgMu.RLock()
+	defer s.cfgMu.RUnlock()
+	return s.cfg
 }
 
 func (s *Server) getJSBaker() (*jsBaker, error) {
@@ -0,0 +1,268 @@
+package proxy
+
+import (
+	"container/list"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+const (
+	defaultSessionIdleTTL      = 72 * time.Hour
+	defaultSessionMax          = 10000
+	defaultSessionJanitorEvery = 5 * time.Minute
+)
+
+// SessionLimits bounds the per-client stores (auth tokens, cookie jars, form
+// tokens and render preferences). Zero values fall back to the defaults.
+type SessionLimits struct {
+	// IdleTTL drops entries that have not been touched for this long.
+	IdleTTL time.Duration
+	// MaxSessions caps the number of entries per store; inserts past it
+	// evict the least recently used entry.
+	MaxSessions int
+	// JanitorInterval controls how often idle entries are swept.
+	JanitorInterval time.Duration
+}
+
+func (l SessionLimits) withDefaults() SessionLimits {
+	if l.IdleTTL <= 0 {
+		l.IdleTTL = defaultSessionIdleTTL
+	}
+	if l.MaxSessions <= 0 {
+		l.MaxSessions = defaultSessionMax
+	}
+	if l.JanitorInterval <= 0 {
+		l.JanitorInterval = defaultSessionJanitorEvery
+	}
+	return l
+}
+
+// sessionLimitsFromEnv applies OMS_SESSION_IDLE and OMS_SESSION_MAX on top of l.
+func sessionLimitsFromEnv(l SessionLimits) SessionLimits {
+	if v := strings.TrimSpace(os.Getenv("OMS_SESSION_IDLE")); v != "" {
+		if d, err := time.ParseDuration(v); err == nil && d > 0 {
+			l.IdleTTL = d
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("OMS_SESSION_MAX")); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			l.MaxSessions = n
+		}
+	}
+	return l
+}
+
+// SessionStats reports how many live entries each per-client store holds and
+// how many were evicted since start-up.
+type SessionStats struct {
+	AuthSessions int
+	CookieJars   int
+	FormEntries  int
+	RenderPrefs  int
+	UploadSlots  int
+	// UploadBytes is the memory held by upload slots; UploadEvicted counts
+	// files dropped to keep it within Config.UploadTotalBytes.
+	UploadBytes   int64
+	UploadEvicted uint64
+	Evicted       uint64
+}
+
+// sessionCap is the SessionLimits.MaxSessions bound shared by the per-client
+// stores. Their indexes enforce it on insert, so a flood of new clients
+// cannot outgrow the stores between janitor sweeps.
+type sessionCap struct {
+	max     atomic.Int64
+	evicted atomic.Uint64
+}
+
+func newSessionCap(max int) *sessionCap {
+	c := &sessionCap{}
+	c.max.Store(int64(max))
+	return c
+}
+
+// sessionIndex tracks last-use times of store keys in LRU order. It is not
+// safe for concurrent use; owners guard it with their own mutex.
+type sessionIndex struct {
+	ll    *list.List
+	items map[string]*list.Element
+	// cap, when set, bounds the index on insert; evict drops the owner's
+	// data for a key pushed out of the tail.
+	cap   *sessionCap
+	evict func(key string)
+}
+
+type sessionIndexEntry struct {
+	key  string
+	seen time.Time
+}
+
+func newSessionIndex() *sessionIndex {
+	return &sessionIndex{ll: list.New(), items: make(map[string]*list.Element)}
+}
+
+// bound makes the index evict its least recently used keys through evict
+// whenever an insert takes it past cap.
+func (x *sessionIndex) bound(cap *sessionCap, evict func(key string)) {
+	x.cap, x.evict = cap, evict
+}
+
+func (x *sessionIndex) touch(key string, now time.Time) {
+	if el, ok := x.items[key]; ok {
+		el.Value.(*sessionIndexEntry).seen = now
+		x.ll.MoveToFront(el)
+		return
+	}
+	x.items[key] = x.ll.PushFront(&sessionIndexEntry{key: key, seen: now})
+	if x.cap == nil {
+		return
+	}
+	for max := x.cap.max.Load(); max > 0 && int64(x.ll.Len()) > max; {
+		tail := x.ll.Back().Value.(*sessionIndexEntry).key
+		x.remove(tail)
+		if x.evict != nil {
+			x.evict(tail)
+		}
+		x.cap.evicted.Add(1)
+	}
+}
+
+// oldest returns the least recently used key.
+func (x *sessionIndex) oldest() (string, bool) {
+	el := x.ll.Back()
+	if el == nil {
+		return "", false
+	}
+	return el.Value.(*sessionIndexEntry).key, true
+}
+
+func (x *sessionIndex) remove(key string) {
+	if el, ok := x.items[key]; ok {
+		x.ll.Remove(el)
+		delete(x.items, key)
+	}
+}
+
+// lastUsed returns the time each key was last used.
+func (x *sessionIndex) lastUsed() map[string]time.Time {
+	out := make(map[string]time.Time, len(x.items))
+	for key, el := range x.items {
+		out[key] = el.Value.(*sessionIndexEntry).seen
+	}
+	return out
+}
+
+// restore enters restored keys oldest first, so idle and size sweeps evict
+// them in the order they were last used. Keys without a time count as used
+// at now.
+func (x *sessionIndex) restore(keys []string, seen map[string]time.Time, now time.Time) {
+	order := make([]sessionIndexEntry, 0, len(keys))
+	for _, key := range keys {
+		t, ok := seen[key]
+		if !ok || t.IsZero() || t.After(now) {
+			t = now
+		}
+		order = append(order, sessionIndexEntry{key: key, seen: t})
+	}
+	sort.Slice(order, func(i, j int) bool { return order[i].seen.Before(order[j].seen) })
+	for _, e := range order {
+		x.touch(e.key, e.seen)
+	}
+}
+
+// evictable removes and returns keys that are idle longer than idle or exceed
+// max, oldest first. A zero idle or max disables the respective check.
+func (x *sessionIndex) evictable(now time.Time, idle time.Duration, max int) []string {
+	var out []string
+	for el := x.ll.Back(); el != nil; {
+		entry := el.Value.(*sessionIndexEntry)
+		over := max > 0 && x.ll.Len() > max
+		stale := idle > 0 && now.Sub(entry.seen) > idle
+		if !over && !stale {
+			break
+		}
+		prev := el.Prev()
+		x.ll.Remove(el)
+		delete(x.items, entry.key)
+		out = append(out, entry.key)
+		el = prev
+	}
+	return out
+}
+
+// SessionStats returns the current per-store entry counts.
+func (s *Server) SessionStats() SessionStats {
+	st := SessionStats{
+		AuthSessions: s.auth.Len(),
+		RenderPrefs:  s.renderPrefs.Len(),
+		Evicted:      atomic.LoadUint64(&s.sessionsEvicted),
+	}
+	if s.sessionCap != nil {
+		st.Evicted += s.sessionCap.evicted.Load()
+	}
+	if s.cookieJars != nil {
+		st.CookieJars = s.cookieJars.Len()
+	}
+	if s.forms != nil {
+		st.FormEntries = s.forms.Len()
+	}
+	if s.uploads != nil {
+		st.UploadSlots = s.uploads.Len()
+		st.UploadBytes, st.UploadEvicted = s.uploads.Usage()
+	}
+	return st
+}
+
+// boundSessions makes every per-client store enforce cap on insert.
+func (s *Server) boundSessions(cap *sessionCap) {
+	s.sessionCap = cap
+	s.auth.bound(cap)
+	s.cookieJars.bound(cap)
+	s.forms.bound(cap)
+	s.uploads.bound(cap)
+	s.renderPrefs.bound(cap)
+}
+
+// sweepSessions drops idle and overflowing entries from every per-client store.
+func (s *Server) sweepSessions() int {
+	now := s.clock()
+	lim := s.config().SessionLimits
+	n := s.auth.Sweep(now, lim.IdleTTL, lim.MaxSessions)
+	if s.cookieJars != nil {
+		n += s.cookieJars.Sweep(now, lim.IdleTTL, lim.MaxSessions)
+	}
+	if s.forms != nil {
+		n += s.forms.Sweep(now, lim.IdleTTL, lim.MaxSessions)
+	}
+	if s.uploads != nil {
+		n += s.uploads.Sweep(now, lim.IdleTTL, lim.MaxSessions)
+	}
+	n += s.renderPrefs.Sweep(now, lim.IdleTTL, lim.MaxSessions)
+	if n > 0 {
+		atomic.AddUint64(&s.sessionsEvicted, uint64(n))
+	}
+	return n
+}
+
+func (s *Server) runSessionJanitor(interval time.Duration) {
+	defer s.bgWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if n := s.sweepSessions(); n > 0 {
+				st := s.SessionStats()
+				s.logger.Info("session janitor", "evicted", n, "auth", st.AuthSessions,
+					"jars", st.CookieJars, "forms", st.FormEntries, "prefs", st.RenderPrefs,
+					"uploads", st.UploadSlots, "upload_bytes", st.UploadBytes)
+			}
+		case <-s.bgStop:
+			return
+		}
+	}
+}
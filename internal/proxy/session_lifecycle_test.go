@@ -0,0 +1,127 @@
+package proxy
+
+import (
+	"net/http"
+	"net/url"
+	"testing"
+	"time"
+
+	"operetta/oms"
+)
+
+func TestCookieJarStoreSweep(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewCookieJarStore()
+	store.SetClock(func() time.Time { return now })
+	store.Get("a")
+	now = now.Add(time.Minute)
+	store.Get("b")
+	now = now.Add(time.Minute)
+	store.Get("c")
+	store.Get("a")
+
+	if n := store.Sweep(now, 0, 2); n != 1 {
+		t.Fatalf("expected one LRU eviction, got %d", n)
+	}
+	if store.Len() != 2 {
+		t.Fatalf("expected 2 jars after trim, got %d", store.Len())
+	}
+	store.mu.Lock()
+	_, hasB := store.jars["b"]
+	store.mu.Unlock()
+	if hasB {
+		t.Fatalf("expected least recently used jar b to be evicted")
+	}
+
+	if n := store.Sweep(now.Add(2*time.Hour), time.Hour, 0); n != 2 {
+		t.Fatalf("expected idle jars to be evicted, got %d", n)
+	}
+	if store.Len() != 0 {
+		t.Fatalf("expected empty store, got %d", store.Len())
+	}
+}
+
+func TestCookieJarExpiryFollowsStoreClock(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := NewCookieJarStore()
+	store.SetClock(func() time.Time { return now })
+	u, _ := url.Parse("http://example.com/")
+	store.Get("a").SetCookies(u, []*http.Cookie{{Name: "sid", Value: "1", MaxAge: 3600}})
+
+	cookies := store.Snapshot(now)["a"]
+	if len(cookies) != 1 || !cookies[0].Expires.Equal(now.Add(time.Hour)) {
+		t.Fatalf("expected expiry one hour after the store clock, got %+v", cookies)
+	}
+}
+
+func TestServerSweepSessions(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := &Server{
+		cfg:         Config{SessionLimits: SessionLimits{IdleTTL: time.Hour, MaxSessions: 10}},
+		clock:       clock,
+		auth:        newAuthStore(clock),
+		renderPrefs: newRenderPrefStore(clock),
+		forms:       newFormStore(clock),
+		cookieJars:  NewCookieJarStore(),
+	}
+	s.cookieJars.SetClock(clock)
+	s.auth.ensure("client")
+	s.cookieJars.Get("client")
+	s.forms.Store("client", map[string]map[string]string{"http://example.com/": {"ck": "1"}})
+	s.renderPrefs.Remember("client|http://example.com", defaultRenderOptions())
+
+	st := s.SessionStats()
+	if st.AuthSessions != 1 || st.CookieJars != 1 || st.FormEntries != 1 || st.RenderPrefs != 1 {
+		t.Fatalf("unexpected stats before sweep: %+v", st)
+	}
+	now = now.Add(2 * time.Hour)
+	if n := s.sweepSessions(); n != 4 {
+		t.Fatalf("expected 4 evictions, got %d", n)
+	}
+	st = s.SessionStats()
+	if st.AuthSessions != 0 || st.CookieJars != 0 || st.FormEntries != 0 || st.RenderPrefs != 0 || st.Evicted != 4 {
+		t.Fatalf("unexpected stats after sweep: %+v", st)
+	}
+}
+
+func TestSessionCapEvictsOnInsert(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	s := &Server{
+		clock:       clock,
+		auth:        newAuthStore(clock),
+		renderPrefs: newRenderPrefStore(clock),
+		forms:       newFormStore(clock),
+		cookieJars:  NewCookieJarStore(),
+		uploads:     newUploadStore(clock, 0),
+	}
+	s.cookieJars.SetClock(clock)
+	s.boundSessions(newSessionCap(2))
+
+	for _, key := range []string{"a", "b", "c"} {
+		s.auth.ensure(key)
+		s.cookieJars.Get(key)
+		s.uploads.Save(key, "f", "text/plain", []byte("x"))
+		now = now.Add(time.Minute)
+	}
+	st := s.SessionStats()
+	if st.AuthSessions != 2 || st.CookieJars != 2 || st.UploadSlots != 2 || st.UploadBytes != 2 || st.Evicted != 3 {
+		t.Fatalf("expected the cap to hold without a sweep: %+v", st)
+	}
+	if _, ok := s.auth.get("a"); ok {
+		t.Fatalf("expected least recently used session a to be evicted")
+	}
+}
+
+func TestRenderPrefApplyKeepsEntryAlive(t *testing.T) {
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	store := newRenderPrefStore(func() time.Time { return now })
+	store.Remember("client|http://example.com", &oms.RenderOptions{ImagesOn: true})
+
+	now = now.Add(50 * time.Minute)
+	store.Apply("client|http://example.com", &oms.RenderOptions{}, url.Values{})
+	if n := store.Sweep(now.Add(20*time.Minute), time.Hour, 0); n != 0 {
+		t.Fatalf("preference read 20 minutes ago was evicted as idle")
+	}
+}
@@ -0,0 +1,303 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"operetta/oms"
+)
+
+const (
+	sessionSnapshotVersion      = 1
+	defaultSessionFlushInterval = time.Minute
+)
+
+// SessionStore persists per-client proxy state (auth tokens, upstream cookie jars,
+// hidden form fields, form registries and charsets, and render preferences) so that a restart does
+// not log every handset out. Load is called once from New; Save is called
+// periodically and on Close.
+type SessionStore interface {
+	Load() (*SessionSnapshot, error)
+	Save(*SessionSnapshot) error
+}
+
+// SessionSnapshot is the serialisable view of all per-client state.
+type SessionSnapshot struct {
+	Version       int                          `json:"version"`
+	SavedAt       time.Time                    `json:"savedAt"`
+	Auth          map[string]AuthSession       `json:"auth,omitempty"`
+	CookieJars    map[string][]PersistedCookie `json:"cookieJars,omitempty"`
+	JarsLastUsed  map[string]time.Time         `json:"jarsLastUsed,omitempty"`
+	Forms         map[string]map[string]string `json:"forms,omitempty"`
+	FormSpecs     map[string][]PersistedForm   `json:"formSpecs,omitempty"`
+	SpecsLastUsed map[string]time.Time         `json:"specsLastUsed,omitempty"`
+	FormCharsets  map[string]string            `json:"formCharsets,omitempty"`
+	RenderPrefs   map[string]RenderPreference  `json:"renderPrefs,omitempty"`
+}
+
+// AuthSession mirrors the h/c auth pair handed out to a client together with its expiry.
+type AuthSession struct {
+	Code      string    `json:"code"`
+	Prefix    string    `json:"prefix"`
+	ExpiresAt time.Time `json:"expiresAt"`
+}
+
+// PersistedForm mirrors a form registry entry (oms.FormSpec).
+type PersistedForm struct {
+	Action        string               `json:"action"`
+	Method        string               `json:"method"`
+	Enctype       string               `json:"enctype,omitempty"`
+	AcceptCharset string               `json:"acceptCharset,omitempty"`
+	Charset       string               `json:"charset,omitempty"`
+	Fields        []PersistedFormField `json:"fields,omitempty"`
+}
+
+// PersistedFormField mirrors one control of a persisted form (oms.FormField).
+type PersistedFormField struct {
+	Name     string `json:"name"`
+	Type     string `json:"type,omitempty"`
+	Value    string `json:"value,omitempty"`
+	Checked  bool   `json:"checked,omitempty"`
+	Disabled bool   `json:"disabled,omitempty"`
+}
+
+// RenderPreference mirrors the remembered per-client image settings and when
+// they were last used.
+type RenderPreference struct {
+	ImagesOn    bool      `json:"imagesOn"`
+	HighQuality bool      `json:"highQuality"`
+	ImageMIME   string    `json:"imageMime,omitempty"`
+	MaxInlineKB int       `json:"maxInlineKb,omitempty"`
+	LastUsed    time.Time `json:"lastUsed,omitempty"`
+}
+
+// FileSessionStore keeps the session snapshot in a single JSON file. Writes go
+// through a temporary file and rename so a crash never leaves a truncated snapshot.
+type FileSessionStore struct {
+	path string
+	mu   sync.Mutex
+}
+
+// NewFileSessionStore returns a store backed by the file at path. The parent
+// directory is created on first save.
+func NewFileSessionStore(path string) *FileSessionStore {
+	return &FileSessionStore{path: path}
+}
+
+// Path reports the snapshot file location.
+func (f *FileSessionStore) Path() string { return f.path }
+
+// Load reads the snapshot. A missing file yields an empty snapshot and no error.
+func (f *FileSessionStore) Load() (*SessionSnapshot, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	data, err := os.ReadFile(f.path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return &SessionSnapshot{Version: sessionSnapshotVersion}, nil
+		}
+		return nil, err
+	}
+	var snap SessionSnapshot
+	if err := json.Unmarshal(data, &snap); err != nil {
+		return nil, fmt.Errorf("session store %s: %w", f.path, err)
+	}
+	if snap.Version > sessionSnapshotVersion {
+		return nil, fmt.Errorf("session store %s: unsupported version %d", f.path, snap.Version)
+	}
+	return &snap, nil
+}
+
+// Save atomically replaces the snapshot file.
+func (f *FileSessionStore) Save(snap *SessionSnapshot) error {
+	if snap == nil {
+		return nil
+	}
+	data, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if dir := filepath.Dir(f.path); dir != "" {
+		if err := os.MkdirAll(dir, 0o700); err != nil {
+			return err
+		}
+	}
+	tmp := f.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, f.path)
+}
+
+// snapshotSessions collects the current state of every per-client store.
+func (s *Server) snapshotSessions() *SessionSnapshot {
+	now := s.clock()
+	snap := &SessionSnapshot{
+		Version:     sessionSnapshotVersion,
+		SavedAt:     now,
+		Auth:        map[string]AuthSession{},
+		RenderPrefs: map[string]RenderPreference{},
+	}
+	for key, tok := range s.auth.snapshot() {
+		snap.Auth[key] = AuthSession{Code: tok.Code, Prefix: tok.Prefix, ExpiresAt: tok.ExpiresAt}
+	}
+	if s.cookieJars != nil {
+		snap.CookieJars = s.cookieJars.Snapshot(now)
+		snap.JarsLastUsed = map[string]time.Time{}
+		for key, t := range s.cookieJars.LastUsed() {
+			if _, ok := snap.CookieJars[key]; ok {
+				snap.JarsLastUsed[key] = t
+			}
+		}
+	}
+	if s.forms != nil {
+		snap.Forms = s.forms.Snapshot()
+		snap.FormSpecs = map[string][]PersistedForm{}
+		for key, specs := range s.forms.SpecSnapshot() {
+			forms := make([]PersistedForm, 0, len(specs))
+			for _, spec := range specs {
+				forms = append(forms, persistForm(spec))
+			}
+			snap.FormSpecs[key] = forms
+		}
+		snap.SpecsLastUsed = s.forms.SpecsLastUsed()
+		snap.FormCharsets = s.forms.CharsetSnapshot()
+	}
+	prefsUsed := s.renderPrefs.LastUsed()
+	for key, pref := range s.renderPrefs.Snapshot() {
+		snap.RenderPrefs[key] = RenderPreference{
+			ImagesOn:    pref.ImagesOn,
+			HighQuality: pref.HighQuality,
+			ImageMIME:   pref.ImageMIME,
+			MaxInlineKB: pref.MaxInlineKB,
+			LastUsed:    prefsUsed[key],
+		}
+	}
+	return snap
+}
+
+// restoreSessions applies a previously saved snapshot to the in-memory stores.
+func (s *Server) restoreSessions(snap *SessionSnapshot) {
+	if snap == nil {
+		return
+	}
+	auth := make(map[string]authTokens, len(snap.Auth))
+	for key, as := range snap.Auth {
+		auth[key] = authTokens{Code: as.Code, Prefix: as.Prefix, ExpiresAt: as.ExpiresAt}
+	}
+	s.auth.restore(auth)
+	if s.cookieJars != nil {
+		s.cookieJars.RestoreWithLastUsed(snap.CookieJars, snap.JarsLastUsed, s.clock())
+	}
+	if s.forms != nil {
+		s.forms.Restore(snap.Forms)
+		specs := make(map[string][]*oms.FormSpec, len(snap.FormSpecs))
+		for key, forms := range snap.FormSpecs {
+			for _, pf := range forms {
+				specs[key] = append(specs[key], pf.spec())
+			}
+		}
+		s.forms.RestoreSpecs(specs, snap.SpecsLastUsed)
+		s.forms.RestoreCharsets(snap.FormCharsets)
+	}
+	prefs := make(map[string]renderPref, len(snap.RenderPrefs))
+	prefsUsed := make(map[string]time.Time, len(snap.RenderPrefs))
+	for key, rp := range snap.RenderPrefs {
+		prefs[key] = renderPref{ImagesOn: rp.ImagesOn, HighQuality: rp.HighQuality, ImageMIME: rp.ImageMIME, MaxInlineKB: rp.MaxInlineKB}
+		prefsUsed[key] = rp.LastUsed
+	}
+	s.renderPrefs.Restore(prefs, prefsUsed)
+}
+
+func persistForm(spec *oms.FormSpec) PersistedForm {
+	pf := PersistedForm{
+		Action:        spec.Action,
+		Method:        spec.Method,
+		Enctype:       spec.Enctype,
+		AcceptCharset: spec.AcceptCharset,
+		Charset:       spec.Charset,
+	}
+	for _, f := range spec.Fields {
+		pf.Fields = append(pf.Fields, PersistedFormField(f))
+	}
+	return pf
+}
+
+func (pf PersistedForm) spec() *oms.FormSpec {
+	spec := &oms.FormSpec{
+		Action:        pf.Action,
+		Method:        pf.Method,
+		Enctype:       pf.Enctype,
+		AcceptCharset: pf.AcceptCharset,
+		Charset:       pf.Charset,
+	}
+	for _, f := range pf.Fields {
+		spec.Fields = append(spec.Fields, oms.FormField(f))
+	}
+	return spec
+}
+
+// loadSessions restores state from the configured SessionStore, if any.
+func (s *Server) loadSessions() {
+	if s.cfg.SessionStore == nil {
+		return
+	}
+	snap, err := s.cfg.SessionStore.Load()
+	if err != nil {
+		s.logger.Error("session store load failed", "err", err)
+		return
+	}
+	s.restoreSessions(snap)
+	if snap != nil {
+		s.logger.Info("session store restored", "auth", len(snap.Auth), "jars", len(snap.CookieJars))
+	}
+}
+
+// SaveSessions writes the current per-client state to the configured SessionStore.
+// It is a no-op when persistence is disabled.
+func (s *Server) SaveSessions() error {
+	if s.cfg.SessionStore == nil {
+		return nil
+	}
+	return s.cfg.SessionStore.Save(s.snapshotSessions())
+}
+
+func (s *Server) runSessionFlusher(interval time.Duration) {
+	defer s.bgWG.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := s.SaveSessions(); err != nil {
+				s.logger.Error("session store save failed", "err", err)
+			}
+		case <-s.bgStop:
+			return
+		}
+	}
+}
+
+// Close stops the background janitor and persistence loops, shuts down the
+// headless browser used for JS baking and flushes a final session snapshot.
+func (s *Server) Close() error {
+	s.closeOnce.Do(func() {
+		if s.bgStop != nil {
+			close(s.bgStop)
+			s.bgWG.Wait()
+		}
+		// Prevent a late request from starting a new browser after shutdown.
+		s.jsBakerOnce.Do(func() { s.jsBakerErr = errServerClosed })
+		if s.jsBaker != nil {
+			s.jsBaker.Close()
+		}
+	})
+	return s.SaveSessions()
+}
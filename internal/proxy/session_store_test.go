@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"operetta/oms"
+)
+
+func TestFileSessionStoreRoundTrip(t *testing.T) {
+	now := time.Date(2024, 1, 2, 3, 4, 5, 0, time.UTC)
+	clock := func() time.Time { return now }
+	store := NewFileSessionStore(filepath.Join(t.TempDir(), "state", "sessions.json"))
+
+	cfg := Config{
+		Logger:       slog.New(slog.DiscardHandler),
+		Clock:        clock,
+		SessionStore: store,
+	}
+	s := New(cfg)
+	s.auth.updateToken("client-a", authTokens{Prefix: "t19-14", Code: "abc"})
+	u, _ := url.Parse("http://example.com/login")
+	s.cookieJars.Get("AUTH|t19-14|abc").SetCookies(u, []*http.Cookie{
+		{Name: "sid", Value: "42", Path: "/", Expires: time.Now().Add(time.Hour)},
+	})
+	s.forms.Store("AUTH|t19-14|abc", map[string]map[string]string{"http://example.com/post": {"ck": "x"}})
+	s.forms.StoreSpecs("AUTH|t19-14|abc", []*oms.FormSpec{{
+		Action:  "http://example.com/post",
+		Method:  http.MethodPost,
+		Enctype: "multipart/form-data",
+		Charset: "windows-1251",
+		Fields:  []oms.FormField{{Name: "msg", Type: "textarea"}, {Name: "go", Type: "submit", Value: "Send"}},
+	}})
+	s.renderPrefs.data["AUTH|t19-14|abc|http://example.com"] = renderPref{ImagesOn: true, ImageMIME: "image/png"}
+	if err := s.Close(); err != nil {
+		t.Fatalf("Close: %v", err)
+	}
+
+	restored := New(cfg)
+	defer restored.Close()
+	if restored.CookieJars() == s.CookieJars() {
+		t.Fatalf("servers should not share a cookie jar store")
+	}
+
+	tok, ok := restored.auth.get("client-a")
+	if !ok || tok.Code != "abc" || tok.Prefix != "t19-14" {
+		t.Fatalf("auth session not restored: %+v ok=%v", tok, ok)
+	}
+	if !tok.ExpiresAt.Equal(now.Add(restored.auth.ttl)) {
+		t.Fatalf("expected expiry to survive restore, got %v", tok.ExpiresAt)
+	}
+	cookies := restored.cookieJars.Get("AUTH|t19-14|abc").Cookies(u)
+	if len(cookies) != 1 || cookies[0].Name != "sid" || cookies[0].Value != "42" {
+		t.Fatalf("cookie jar not restored: %+v", cookies)
+	}
+	if body, ok := restored.forms.Augment("AUTH|t19-14|abc", "http://example.com/post", "q=1"); !ok || body != "ck=x&q=1" {
+		t.Fatalf("form fields not restored: %q ok=%v", body, ok)
+	}
+	spec := restored.forms.Spec("AUTH|t19-14|abc", "http://example.com/post", "msg=hi")
+	if spec == nil || spec.Method != http.MethodPost || spec.Enctype != "multipart/form-data" || len(spec.Fields) != 2 || spec.Fields[1].Value != "Send" {
+		t.Fatalf("form registry not restored: %+v", spec)
+	}
+	if cs := restored.forms.Charset("AUTH|t19-14|abc", "http://example.com/post"); cs != "windows-1251" {
+		t.Fatalf("form charset not restored: %q", cs)
+	}
+	if pref := restored.renderPrefs.data["AUTH|t19-14|abc|http://example.com"]; pref.ImageMIME != "image/png" || !pref.ImagesOn {
+		t.Fatalf("render pref not restored: %+v", pref)
+	}
+}
+
+func TestAuthStoreRestoreDropsExpired(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	store := newAuthStore(func() time.Time { return now })
+	store.restore(map[string]authTokens{
+		"live":    {Code: "a", Prefix: "p", ExpiresAt: now.Add(time.Hour)},
+		"expired": {Code: "b", Prefix: "p", ExpiresAt: now.Add(-time.Hour)},
+	})
+	if _, ok := store.get("live"); !ok {
+		t.Fatalf("expected live session to be restored")
+	}
+	if _, ok := store.get("expired"); ok {
+		t.Fatalf("expected expired session to be dropped")
+	}
+}
+
+func TestAuthStoreRestoreKeepsLRUOrder(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	store := newAuthStore(func() time.Time { return now })
+	sessions := make(map[string]authTokens)
+	for i := 0; i < 20; i++ {
+		// Session i was last used i hours ago.
+		seen := now.Add(-time.Duration(i) * time.Hour)
+		sessions[fmt.Sprintf("k%02d", i)] = authTokens{Code: "c", Prefix: "p", ExpiresAt: seen.Add(store.ttl)}
+	}
+	store.restore(sessions)
+
+	if n := store.Sweep(now, 90*time.Minute, 0); n != 18 {
+		t.Fatalf("idle sweep evicted %d sessions, want 18", n)
+	}
+	for _, key := range []string{"k00", "k01"} {
+		if _, ok := store.get(key); !ok {
+			t.Fatalf("recent session %s was evicted", key)
+		}
+	}
+	store.restore(sessions)
+	store.Sweep(now, 0, 5)
+	for i := 0; i < 20; i++ {
+		_, ok := store.get(fmt.Sprintf("k%02d", i))
+		if ok != (i < 5) {
+			t.Fatalf("size sweep: session k%02d kept=%v", i, ok)
+		}
+	}
+}
+
+func TestJarAndPrefRestoreKeepsLastUsed(t *testing.T) {
+	now := time.Date(2024, 1, 2, 0, 0, 0, 0, time.UTC)
+	clock := func() time.Time { return now }
+	jars := NewCookieJarStore()
+	jars.SetClock(clock)
+	prefs := newRenderPrefStore(clock)
+	cookies := map[string][]PersistedCookie{}
+	lastUsed := map[string]time.Time{}
+	data := map[string]renderPref{}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		// Entry i was last used i hours ago.
+		lastUsed[key] = now.Add(-time.Duration(i) * time.Hour)
+		cookies[key] = []PersistedCookie{{URL: "http://example.com/", Name: "sid", Value: key}}
+		data[key] = renderPref{ImagesOn: true}
+	}
+	jars.RestoreWithLastUsed(cookies, lastUsed, now)
+	prefs.Restore(data, lastUsed)
+
+	if n := jars.Sweep(now, 90*time.Minute, 0); n != 18 {
+		t.Fatalf("idle sweep evicted %d jars, want 18", n)
+	}
+	if n := prefs.Sweep(now, 0, 5); n != 15 {
+		t.Fatalf("size sweep evicted %d prefs, want 15", n)
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("k%02d", i)
+		if _, ok := prefs.Snapshot()[key]; ok != (i < 5) {
+			t.Fatalf("size sweep: pref %s kept=%v", key, ok)
+		}
+	}
+}
+
+func TestServersKeepSeparateCookieJars(t *testing.T) {
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.SetCookie(w, &http.Cookie{Name: "sid", Value: "1", Path: "/"})
+		w.Header().Set("Content-Type", "text/html; charset=utf-8")
+		fmt.Fprint(w, "<html><body><p>hello</p></body></html>")
+	}))
+	defer origin.Close()
+
+	newServer := func() *Server {
+		s := New(Config{Logger: slog.New(slog.DiscardHandler), SitesDir: t.TempDir()})
+		t.Cleanup(func() { _ = s.Close() })
+		return s
+	}
+	a, b := newServer(), newServer()
+	req := httptest.NewRequest(http.MethodGet, "http://operetta/validate?url="+url.QueryEscape(origin.URL+"/"), nil)
+	a.ServeHTTP(httptest.NewRecorder(), req)
+
+	u, _ := url.Parse(origin.URL)
+	key := a.clientJarKey(req, nil)
+	if got := a.CookieJars().Get(key).Cookies(u); len(got) != 1 {
+		t.Fatalf("expected the validating server to keep the origin cookie, got %v", got)
+	}
+	if got := b.CookieJars().Get(key).Cookies(u); len(got) != 0 {
+		t.Fatalf("expected the other server's jar to stay empty, got %v", got)
+	}
+}
@@ -15,6 +15,9 @@ type SiteConfig struct {
 	Mode    string            `json:"mode"`
 	Headers map[string]string `json:"headers,omitempty"`
 	Bake    *BakeConfig       `json:"bake,omitempty"`
+	// LayoutTables is "linearize" (default) to flatten layout tables with the
+	// main content first, or "source" to walk them in document order.
+	LayoutTables string `json:"layoutTables,omitempty"`
 }
 
 type BakeConfig struct {
@@ -68,11 +71,23 @@ func (s *siteConfigStore) Find(target string) *SiteConfig {
 	return nil
 }
 
+// Reset points the store at dir and forgets every cached lookup so edited or
+// new JSON files are picked up.
+func (s *siteConfigStore) Reset(dir string) {
+	s.mu.Lock()
+	s.dir = dir
+	s.cache = make(map[string]*SiteConfig)
+	s.mu.Unlock()
+}
+
 func (s *siteConfigStore) load(host string) *SiteConfig {
-	if s.dir == "" {
+	s.mu.RLock()
+	dir := s.dir
+	s.mu.RUnlock()
+	if dir == "" {
 		return nil
 	}
-	path := filepath.Join(s.dir, host+".json")
+	path := filepath.Join(dir, host+".json")
 	data, err := os.ReadFile(path)
 	if err != nil {
 		return nil
@@ -82,9 +97,21 @@ func (s *siteConfigStore) load(host string) *SiteConfig {
 		return nil
 	}
 	cfg.Mode = strings.TrimSpace(strings.ToLower(cfg.Mode))
+	cfg.LayoutTables = strings.TrimSpace(strings.ToLower(cfg.LayoutTables))
 	return &cfg
 }
 
+// ReaderMode reports whether pages of the site are rendered as reader views.
+func (cfg *SiteConfig) ReaderMode() bool {
+	return cfg != nil && cfg.Mode == "reader"
+}
+
+// KeepLayoutTables reports whether the site asked for layout tables to be
+// rendered in source order.
+func (cfg *SiteConfig) KeepLayoutTables() bool {
+	return cfg != nil && cfg.LayoutTables == "source"
+}
+
 func (cfg *SiteConfig) JSOptions() *oms.JSBakingOptions {
 	if cfg == nil || cfg.Bake == nil {
 		return nil
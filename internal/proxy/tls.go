@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+)
+
+// CertReloader serves certificates loaded from PEM files and picks one per
+// connection by SNI. Reload re-reads the files so renewed certificates can be
+// installed without restarting the listener.
+type CertReloader struct {
+	certFiles []string
+	keyFiles  []string
+
+	mu    sync.RWMutex
+	certs []tls.Certificate
+}
+
+// NewCertReloader loads the given certificate/key pairs. Both arguments accept a
+// comma-separated list; the first pair is the default for clients without SNI.
+func NewCertReloader(certFiles, keyFiles string) (*CertReloader, error) {
+	certs := splitList(certFiles)
+	keys := splitList(keyFiles)
+	if len(certs) == 0 {
+		return nil, errors.New("tls: no certificate configured")
+	}
+	if len(certs) != len(keys) {
+		return nil, fmt.Errorf("tls: %d certificates but %d keys", len(certs), len(keys))
+	}
+	r := &CertReloader{certFiles: certs, keyFiles: keys}
+	if err := r.Reload(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+// Reload re-reads every certificate pair. On error the previously loaded
+// certificates stay in use.
+func (r *CertReloader) Reload() error {
+	certs := make([]tls.Certificate, 0, len(r.certFiles))
+	for i, certFile := range r.certFiles {
+		cert, err := tls.LoadX509KeyPair(certFile, r.keyFiles[i])
+		if err != nil {
+			return fmt.Errorf("tls: load %s: %w", certFile, err)
+		}
+		certs = append(certs, cert)
+	}
+	r.mu.Lock()
+	r.certs = certs
+	r.mu.Unlock()
+	return nil
+}
+
+// GetCertificate implements tls.Config.GetCertificate.
+func (r *CertReloader) GetCertificate(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	if len(r.certs) == 0 {
+		return nil, errors.New("tls: no certificate loaded")
+	}
+	if hello != nil && hello.ServerName != "" {
+		for i := range r.certs {
+			if hello.SupportsCertificate(&r.certs[i]) == nil {
+				return &r.certs[i], nil
+			}
+		}
+	}
+	return &r.certs[0], nil
+}
+
+// TLSConfig returns a server configuration backed by the reloader.
+func (r *CertReloader) TLSConfig() *tls.Config {
+	return &tls.Config{GetCertificate: r.GetCertificate}
+}
+
+func splitList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
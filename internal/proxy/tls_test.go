@@ -0,0 +1,111 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func writeTestCert(t *testing.T, dir, name string, serial int64) (string, string) {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, tmpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	certPath := filepath.Join(dir, name+".crt")
+	keyPath := filepath.Join(dir, name+".key")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func leafSerial(t *testing.T, cert *tls.Certificate) int64 {
+	t.Helper()
+	leaf, err := x509.ParseCertificate(cert.Certificate[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return leaf.SerialNumber.Int64()
+}
+
+func TestCertReloaderSNIAndReload(t *testing.T) {
+	dir := t.TempDir()
+	aCert, aKey := writeTestCert(t, dir, "a.example", 1)
+	bCert, bKey := writeTestCert(t, dir, "b.example", 2)
+
+	r, err := NewCertReloader(aCert+","+bCert, aKey+","+bKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hello := func(name string) *tls.ClientHelloInfo {
+		return &tls.ClientHelloInfo{
+			ServerName:        name,
+			SupportedVersions: []uint16{tls.VersionTLS13},
+			SignatureSchemes:  []tls.SignatureScheme{tls.ECDSAWithP256AndSHA256},
+			SupportedCurves:   []tls.CurveID{tls.CurveP256},
+		}
+	}
+	for name, want := range map[string]int64{"b.example": 2, "a.example": 1, "": 1, "other.example": 1} {
+		cert, err := r.GetCertificate(hello(name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if got := leafSerial(t, cert); got != want {
+			t.Fatalf("SNI %q: got certificate %d, want %d", name, got, want)
+		}
+	}
+
+	writeTestCert(t, dir, "b.example", 3)
+	if err := r.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := r.GetCertificate(hello("b.example"))
+	if got := leafSerial(t, cert); got != 3 {
+		t.Fatalf("expected reloaded certificate, got serial %d", got)
+	}
+
+	if err := os.WriteFile(bCert, []byte("garbage"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if err := r.Reload(); err == nil {
+		t.Fatalf("expected reload of a broken certificate to fail")
+	}
+	cert, _ = r.GetCertificate(hello("b.example"))
+	if got := leafSerial(t, cert); got != 3 {
+		t.Fatalf("failed reload must keep previous certificates, got serial %d", got)
+	}
+
+	if _, err := NewCertReloader(aCert, ""); err == nil {
+		t.Fatalf("expected mismatched cert/key lists to fail")
+	}
+}
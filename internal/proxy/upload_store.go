@@ -0,0 +1,233 @@
+package proxy
+
+import (
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"operetta/oms"
+)
+
+const (
+	// defaultUploadSlotBytes caps a download kept as an upload slot.
+	defaultUploadSlotBytes = 2 << 20
+	// defaultUploadTotalBytes caps the slots of all clients together; the
+	// least recently used client loses its oldest file first.
+	defaultUploadTotalBytes = 64 << 20
+	// maxUploadSlotsPerClient bounds the slots kept per client; the oldest
+	// file is dropped first.
+	maxUploadSlotsPerClient = 8
+)
+
+// uploadStore keeps the files a client downloaded through /download so that
+// <input type=file> controls can attach them later. Handsets cannot browse
+// their own file system from a form, so these "upload slots" are the only
+// files they can submit. Slots live in memory and are not persisted.
+type uploadStore struct {
+	mu       sync.Mutex
+	data     map[string][]*uploadSlot
+	index    *sessionIndex
+	clock    func() time.Time
+	seq      uint64
+	bytes    int64
+	maxBytes int64
+	evicted  uint64
+}
+
+type uploadSlot struct {
+	id          string
+	name        string
+	contentType string
+	body        []byte
+}
+
+// newUploadStore returns a store holding at most maxBytes of files across all
+// clients; zero or negative uses the default.
+func newUploadStore(clock func() time.Time, maxBytes int64) *uploadStore {
+	if clock == nil {
+		clock = time.Now
+	}
+	s := &uploadStore{data: make(map[string][]*uploadSlot), index: newSessionIndex(), clock: clock}
+	s.Resize(maxBytes)
+	return s
+}
+
+// Save keeps a downloaded file for clientKey and returns its slot ID. Files
+// larger than the whole store budget are not kept.
+func (s *uploadStore) Save(clientKey, name, contentType string, body []byte) string {
+	clientKey = strings.TrimSpace(clientKey)
+	if clientKey == "" || len(body) == 0 {
+		return ""
+	}
+	name = strings.TrimSpace(name)
+	if name == "" {
+		name = "download"
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if int64(len(body)) > s.maxBytes {
+		return ""
+	}
+	s.seq++
+	slot := &uploadSlot{id: "f" + strconv.FormatUint(s.seq, 10), name: name, contentType: contentType, body: body}
+	slots := append(s.data[clientKey], slot)
+	if over := len(slots) - maxUploadSlotsPerClient; over > 0 {
+		for _, old := range slots[:over] {
+			s.bytes -= int64(len(old.body))
+		}
+		slots = slots[over:]
+	}
+	s.data[clientKey] = slots
+	s.bytes += int64(len(body))
+	s.index.touch(clientKey, s.clock())
+	s.trimLocked()
+	return slot.id
+}
+
+// bound evicts the files of the least recently used client once an insert
+// exceeds cap.
+func (s *uploadStore) bound(cap *sessionCap) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.index.bound(cap, func(key string) {
+		for _, slot := range s.data[key] {
+			s.bytes -= int64(len(slot.body))
+		}
+		delete(s.data, key)
+	})
+}
+
+// Resize changes the byte budget, evicting files as needed.
+func (s *uploadStore) Resize(maxBytes int64) {
+	if maxBytes <= 0 {
+		maxBytes = defaultUploadTotalBytes
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.maxBytes = maxBytes
+	s.trimLocked()
+}
+
+// trimLocked drops the oldest file of the least recently used client until
+// the store fits its budget. A client left without files is forgotten.
+func (s *uploadStore) trimLocked() {
+	for s.bytes > s.maxBytes {
+		key, ok := s.index.oldest()
+		if !ok {
+			return
+		}
+		slots := s.data[key]
+		if len(slots) > 0 {
+			s.bytes -= int64(len(slots[0].body))
+			slots = slots[1:]
+			s.evicted++
+		}
+		if len(slots) == 0 {
+			delete(s.data, key)
+			s.index.remove(key)
+			continue
+		}
+		s.data[key] = slots
+	}
+}
+
+// Slots lists the client's files, newest first, as choices for file inputs.
+func (s *uploadStore) Slots(clientKey string) []oms.UploadSlot {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	slots := s.data[strings.TrimSpace(clientKey)]
+	out := make([]oms.UploadSlot, 0, len(slots))
+	for i := len(slots) - 1; i >= 0; i-- {
+		out = append(out, oms.UploadSlot{ID: slots[i].id, Name: fmt.Sprintf("%s (%s)", slots[i].name, formatSlotSize(len(slots[i].body)))})
+	}
+	return out
+}
+
+func formatSlotSize(n int) string {
+	if n < 1024 {
+		return strconv.Itoa(n) + " B"
+	}
+	return strconv.Itoa((n+1023)/1024) + " KB"
+}
+
+// Attach resolves the slot IDs a form payload carries for its file inputs.
+// Every field gets an entry; inputs left at "(no file)" or naming an unknown
+// slot map to nil and are submitted empty.
+func (s *uploadStore) Attach(clientKey string, fields []string, formBody string) map[string]*oms.FormUpload {
+	if len(fields) == 0 {
+		return nil
+	}
+	vals, _ := url.ParseQuery(formBody)
+	clientKey = strings.TrimSpace(clientKey)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	out := make(map[string]*oms.FormUpload, len(fields))
+	for _, field := range fields {
+		out[field] = nil
+		id := strings.TrimSpace(vals.Get(field))
+		if id == "" {
+			continue
+		}
+		for _, slot := range s.data[clientKey] {
+			if slot.id == id {
+				out[field] = &oms.FormUpload{Filename: slot.name, ContentType: slot.contentType, Data: slot.body}
+				break
+			}
+		}
+	}
+	if len(s.data[clientKey]) > 0 {
+		s.index.touch(clientKey, s.clock())
+	}
+	return out
+}
+
+// Len reports the number of clients with upload slots.
+func (s *uploadStore) Len() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.data)
+}
+
+// Usage reports the bytes held by all slots and how many files were dropped
+// to stay within the byte budget.
+func (s *uploadStore) Usage() (bytes int64, evicted uint64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.bytes, s.evicted
+}
+
+// Sweep evicts idle clients and trims the store to max clients.
+func (s *uploadStore) Sweep(now time.Time, idle time.Duration, max int) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	keys := s.index.evictable(now, idle, max)
+	for _, key := range keys {
+		for _, slot := range s.data[key] {
+			s.bytes -= int64(len(slot.body))
+		}
+		delete(s.data, key)
+	}
+	return len(keys)
+}
+
+// slotCapture collects a streamed download for an upload slot and gives up
+// once it grows past limit.
+type slotCapture struct {
+	limit int64
+	buf   []byte
+	over  bool
+}
+
+func (c *slotCapture) Write(b []byte) (int, error) {
+	if !c.over {
+		if int64(len(c.buf)+len(b)) > c.limit {
+			c.over, c.buf = true, nil
+		} else {
+			c.buf = append(c.buf, b...)
+		}
+	}
+	return len(b), nil
+}
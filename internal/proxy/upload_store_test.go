@@ -0,0 +1,121 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"operetta/oms"
+)
+
+func TestDownloadBecomesUploadSlotForMultipartForm(t *testing.T) {
+	received := make(chan string, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/files/note.txt":
+			w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+			_, _ = w.Write([]byte("hello from the handset"))
+		case "/topic":
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><body><form action="/post" method="post" enctype="multipart/form-data">` +
+				`<input name="subject"><input type="file" name="attach"><input type="submit" value="Send"></form></body></html>`))
+		case "/post":
+			if err := r.ParseMultipartForm(1 << 20); err != nil {
+				received <- "error: " + err.Error()
+				return
+			}
+			got := "subject=" + r.FormValue("subject")
+			if f, fh, err := r.FormFile("attach"); err == nil {
+				buf := make([]byte, 64)
+				n, _ := f.Read(buf)
+				got += fmt.Sprintf(" file=%s:%s", fh.Filename, buf[:n])
+			}
+			received <- got
+			w.Header().Set("Content-Type", "text/html; charset=utf-8")
+			_, _ = w.Write([]byte(`<html><body>Posted</body></html>`))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer origin.Close()
+
+	s := New(Config{Logger: slog.New(slog.DiscardHandler), SitesDir: t.TempDir()})
+	t.Cleanup(func() { _ = s.Close() })
+
+	req := httptest.NewRequest(http.MethodGet, "http://operetta/download?url="+url.QueryEscape(origin.URL+"/files/note.txt"), nil)
+	req.Header.Set("User-Agent", "Opera/9.80 (J2ME/MIDP)")
+	rec := httptest.NewRecorder()
+	s.ServeHTTP(rec, req)
+	if rec.Code != http.StatusOK || rec.Body.String() != "hello from the handset" {
+		t.Fatalf("download failed: %d %q", rec.Code, rec.Body.String())
+	}
+	clientKey := s.clientJarKey(req, nil)
+	slots := s.uploads.Slots(clientKey)
+	if len(slots) != 1 || !strings.HasPrefix(slots[0].Name, "note.txt") {
+		t.Fatalf("expected the download as an upload slot, got %+v", slots)
+	}
+
+	ctx := context.Background()
+	page, err := s.loadPage(ctx, origin.URL+"/topic", http.Header{}, &oms.RenderOptions{UploadSlots: slots})
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.rememberForms(clientKey, page)
+
+	form := "subject=Hello&attach=" + slots[0].ID
+	spec := s.forms.Spec(clientKey, origin.URL+"/topic", form)
+	if spec == nil || spec.Enctype != "multipart/form-data" || len(spec.FileFields()) != 1 {
+		t.Fatalf("expected the multipart form from the registry, got %+v", spec)
+	}
+	action := spec.Action
+	opt := &oms.RenderOptions{
+		FormBody:  form,
+		Form:      spec,
+		FormFiles: s.uploads.Attach(clientKey, spec.FileFields(), form),
+	}
+	if _, err := s.loadPage(ctx, action, http.Header{}, opt); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-received; got != "subject=Hello file=note.txt:hello from the handset" {
+		t.Fatalf("origin received %q", got)
+	}
+}
+
+func TestUploadStoreEvictsByTotalBytes(t *testing.T) {
+	now := time.Unix(1700000000, 0)
+	s := newUploadStore(func() time.Time { return now }, 10)
+	file := func(n int) []byte { return []byte(strings.Repeat("x", n)) }
+
+	s.Save("a", "a1", "text/plain", file(4))
+	now = now.Add(time.Second)
+	s.Save("b", "b1", "text/plain", file(4))
+	now = now.Add(time.Second)
+	s.Save("a", "a2", "text/plain", file(1))
+	if bytes, evicted := s.Usage(); bytes != 9 || evicted != 0 {
+		t.Fatalf("usage %d bytes, %d evicted", bytes, evicted)
+	}
+
+	// b is now the least recently used client and loses its only file.
+	now = now.Add(time.Second)
+	s.Save("c", "c1", "text/plain", file(3))
+	if bytes, evicted := s.Usage(); bytes != 8 || evicted != 1 {
+		t.Fatalf("usage %d bytes, %d evicted", bytes, evicted)
+	}
+	if len(s.Slots("b")) != 0 || len(s.Slots("a")) != 2 || s.Len() != 2 {
+		t.Fatalf("expected b evicted, got a=%v b=%v", s.Slots("a"), s.Slots("b"))
+	}
+
+	if id := s.Save("d", "huge", "text/plain", file(11)); id != "" {
+		t.Fatalf("file over the whole budget should not be kept")
+	}
+	s.Resize(4)
+	if bytes, _ := s.Usage(); bytes > 4 {
+		t.Fatalf("resize left %d bytes", bytes)
+	}
+}
@@ -4,7 +4,11 @@ import (
 	"bytes"
 	"compress/flate"
 	"encoding/binary"
+	"encoding/hex"
+	"fmt"
 	"io"
+	"strconv"
+	"strings"
 
 	"operetta/oms"
 )
@@ -107,113 +111,177 @@ func hexU16(v uint16) string {
 }
 
 func parseTags(dec []byte, version oms.ClientVersion) (int, []byte, map[byte]int) {
+	tags := make([]byte, 0, 256)
+	counts := map[byte]int{}
+	walkTags(dec, version, func(tag byte, _ []byte) {
+		tags = append(tags, tag)
+		counts[tag]++
+	})
+	return len(tags), tags, counts
+}
+
+// walkTags visits every tag of a decoded OMS body with its payload. It stops
+// after the first unknown or truncated tag, which is visited with a nil payload.
+func walkTags(dec []byte, version oms.ClientVersion, visit func(tag byte, payload []byte)) {
 	if len(dec) < 35 {
-		return 0, nil, map[byte]int{}
+		return
 	}
 	p := 35
 	if p+2 <= len(dec) {
 		l := int(binary.BigEndian.Uint16(dec[p : p+2]))
 		p += 2 + l
 	}
-	tags := make([]byte, 0, 256)
-	counts := map[byte]int{}
 	limit := len(dec)
-	styleDataLen := 4
-	if version == oms.ClientVersion3 {
-		styleDataLen = 6
-	}
 	for p < limit {
 		tag := dec[p]
-		tags = append(tags, tag)
-		counts[tag]++
 		p++
-		switch tag {
-		case 'T', 'L':
+		end, ok := tagEnd(dec, p, tag, version)
+		if !ok {
+			visit(tag, nil)
+			return
+		}
+		visit(tag, dec[p:min(end, limit)])
+		p = end
+	}
+}
+
+// tagEnd returns the offset just past the payload of tag starting at p.
+func tagEnd(dec []byte, p int, tag byte, version oms.ClientVersion) (int, bool) {
+	limit := len(dec)
+	str := func(n int) bool {
+		for i := 0; i < n; i++ {
 			if p+2 > limit {
-				return len(tags), tags, counts
+				return false
 			}
-			l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-			p += 2 + l
-		case 'E', 'B', '+', 'V', 'Q', 'l':
-		case 'D', 'R':
-			p += 2
-		case 'S':
-			p += styleDataLen
-		case 'J':
+			p += 2 + int(binary.BigEndian.Uint16(dec[p:p+2]))
+		}
+		return true
+	}
+	switch tag {
+	case 'T', 'L':
+		if !str(1) {
+			return p, false
+		}
+	case 'E', 'B', '+', 'V', 'Q', 'l':
+	case 'D', 'R':
+		p += 2
+	case 'S':
+		if version == oms.ClientVersion3 {
+			p += 6
+		} else {
 			p += 4
-		case 'I':
-			if p+8 > limit {
-				return len(tags), tags, counts
-			}
-			dl := int(binary.BigEndian.Uint16(dec[p+4 : p+6]))
-			p += 8 + dl
-		case 'k':
-			p++
-			if p+2 > limit {
-				return len(tags), tags, counts
-			}
-			l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-			p += 2 + l
-		case 'h':
-			for i := 0; i < 2; i++ {
-				if p+2 > limit {
-					return len(tags), tags, counts
-				}
-				l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-				p += 2 + l
-			}
-		case 'x':
-			p++
-			for i := 0; i < 2; i++ {
-				if p+2 > limit {
-					return len(tags), tags, counts
-				}
-				l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-				p += 2 + l
-			}
-		case 'p', 'u', 'i', 'b', 'e':
-			for i := 0; i < 2; i++ {
-				if p+2 > limit {
-					return len(tags), tags, counts
-				}
-				l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-				p += 2 + l
-			}
-		case 'c', 'r':
-			for i := 0; i < 2; i++ {
-				if p+2 > limit {
-					return len(tags), tags, counts
-				}
-				l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-				p += 2 + l
-			}
-			p++
-		case 's':
-			if p+2 > limit {
-				return len(tags), tags, counts
-			}
-			l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-			p += 2 + l
-			if p+1 > limit {
-				return len(tags), tags, counts
-			}
-			p++
-			if p+2 > limit {
-				return len(tags), tags, counts
-			}
-			p += 2
-		case 'o':
-			for i := 0; i < 2; i++ {
-				if p+2 > limit {
-					return len(tags), tags, counts
-				}
-				l := int(binary.BigEndian.Uint16(dec[p : p+2]))
-				p += 2 + l
-			}
-			p++
-		default:
-			return len(tags), tags, counts
 		}
+	case 'J':
+		p += 4
+	case 'I':
+		if p+8 > limit {
+			return p, false
+		}
+		p += 8 + int(binary.BigEndian.Uint16(dec[p+4:p+6]))
+	case 'k':
+		p++
+		if !str(1) {
+			return p, false
+		}
+	case 'h', 'p', 'u', 'i', 'b', 'e':
+		if !str(2) {
+			return p, false
+		}
+	case 'x':
+		p++
+		if !str(2) {
+			return p, false
+		}
+	case 'c', 'r', 'o':
+		if !str(2) {
+			return p, false
+		}
+		p++
+	case 's':
+		if !str(1) {
+			return p, false
+		}
+		if p+1 > limit {
+			return p, false
+		}
+		p++
+		if p+2 > limit {
+			return p, false
+		}
+		p += 2
+	default:
+		return p, false
 	}
-	return len(tags), tags, counts
+	return p, true
+}
+
+// omsToken is one decoded tag in the admin console's OBML dump.
+type omsToken struct {
+	Tag  string
+	Info string
+}
+
+// decodeOMSTokens unpacks a packed OMS response into a readable tag list,
+// starting with the page URL carried in the header.
+func decodeOMSTokens(b []byte) ([]omsToken, error) {
+	if len(b) < 6 {
+		return nil, fmt.Errorf("payload shorter than header (%d bytes)", len(b))
+	}
+	word := binary.LittleEndian.Uint16(b[:2])
+	dec, err := decompressOMSBody(byte(word>>8), b[6:])
+	if err != nil {
+		return nil, err
+	}
+	if len(dec) < 35 {
+		return nil, fmt.Errorf("decoded body too short (%d bytes)", len(dec))
+	}
+	var out []omsToken
+	if len(dec) >= 37 {
+		if n := int(binary.BigEndian.Uint16(dec[35:37])); 37+n <= len(dec) {
+			out = append(out, omsToken{Tag: "url", Info: strconv.Quote(string(dec[37 : 37+n]))})
+		}
+	}
+	walkTags(dec, headerByteToClientVersion(byte(word)), func(tag byte, payload []byte) {
+		out = append(out, omsToken{Tag: string([]byte{tag}), Info: describeTag(tag, payload)})
+	})
+	return out, nil
+}
+
+func describeTag(tag byte, payload []byte) string {
+	if payload == nil {
+		return "(unknown or truncated)"
+	}
+	skip, strs := 0, 0
+	switch tag {
+	case 'T', 'L', 's':
+		strs = 1
+	case 'k':
+		skip, strs = 1, 1
+	case 'x':
+		skip, strs = 1, 2
+	case 'h', 'p', 'u', 'i', 'b', 'e', 'c', 'r', 'o':
+		strs = 2
+	case 'I':
+		if len(payload) >= 8 {
+			return fmt.Sprintf("%dx%d %d bytes", binary.BigEndian.Uint16(payload[0:2]),
+				binary.BigEndian.Uint16(payload[2:4]), binary.BigEndian.Uint16(payload[4:6]))
+		}
+	}
+	var parts []string
+	if skip > 0 && len(payload) >= skip {
+		parts = append(parts, hex.EncodeToString(payload[:skip]))
+		payload = payload[skip:]
+	}
+	for i := 0; i < strs && len(payload) >= 2; i++ {
+		n := int(binary.BigEndian.Uint16(payload[:2]))
+		if 2+n > len(payload) {
+			break
+		}
+		parts = append(parts, strconv.Quote(string(payload[2:2+n])))
+		payload = payload[2+n:]
+	}
+	if len(payload) > 0 {
+		parts = append(parts, hex.EncodeToString(payload))
+	}
+	return strings.Join(parts, " ")
 }
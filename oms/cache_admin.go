@@ -0,0 +1,181 @@
+package oms
+
+import (
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ImageCacheEntry describes one image held in the in-memory cache.
+type ImageCacheEntry struct {
+	URL     string
+	Format  string
+	Quality int
+	Bytes   int
+	Width   int
+	Height  int
+	Expires time.Time // zero when the origin sent no freshness information
+}
+
+// ImageCacheUsage summarises the memory and disk image caches.
+type ImageCacheUsage struct {
+	MemoryEntries int
+	MemoryBytes   int64
+	MemoryLimit   int64
+	DiskDir       string
+	DiskFiles     int
+	DiskBytes     int64
+	DiskLimit     int64
+}
+
+// ImageCacheSummary reports the size of both image cache tiers. It walks the
+// disk cache directory, so callers should not use it on hot paths.
+func ImageCacheSummary() ImageCacheUsage {
+	c := imageCache()
+	c.mu.Lock()
+	u := ImageCacheUsage{MemoryEntries: len(c.m), MemoryBytes: c.size, MemoryLimit: c.max}
+	c.mu.Unlock()
+	diskCacheOnce.Do(initDiskCache)
+	u.DiskDir, u.DiskLimit = diskCacheSettings()
+	walkDiskCache(u.DiskDir, func(_ string, size int64) {
+		u.DiskFiles++
+		u.DiskBytes += size
+	})
+	return u
+}
+
+// ImageCacheEntries lists up to limit in-memory images, most recently used
+// first. A non-positive limit lists everything.
+func ImageCacheEntries(limit int) []ImageCacheEntry {
+	c := imageCache()
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	var out []ImageCacheEntry
+	for e := c.head; e != nil; e = e.next {
+		if limit > 0 && len(out) >= limit {
+			break
+		}
+		format, quality, url := splitImgCacheKey(e.key)
+		out = append(out, ImageCacheEntry{
+			URL:     url,
+			Format:  format,
+			Quality: quality,
+			Bytes:   len(e.data),
+			Width:   e.w,
+			Height:  e.h,
+			Expires: e.meta.Expires,
+		})
+	}
+	return out
+}
+
+// PurgeImageCache drops url from the memory cache in every variant and from
+// the disk cache in every format and quality the renderer produces at the
+// colour depths in use. An empty url empties both caches. It returns the
+// number of memory entries and disk files removed.
+func PurgeImageCache(url string) (memory, disk int) {
+	c := imageCache()
+	diskCacheOnce.Do(initDiskCache)
+	if url == "" {
+		c.mu.Lock()
+		memory = len(c.m)
+		c.m = map[string]*imgEntry{}
+		c.head, c.tail, c.size = nil, nil, 0
+		c.mu.Unlock()
+		root, _ := diskCacheSettings()
+		diskCacheMu.Lock()
+		defer diskCacheMu.Unlock()
+		walkDiskCache(root, func(path string, _ int64) {
+			if os.Remove(path) == nil {
+				disk++
+			}
+		})
+		return memory, disk
+	}
+	memory = c.removeURL(url)
+	for _, cand := range allCacheCandidates() {
+		if _, path := diskKey(cand.format, cand.quality, url); os.Remove(path) == nil {
+			disk++
+		}
+	}
+	return memory, disk
+}
+
+// allCacheCandidates enumerates every format/quality pair cacheCandidatesFor
+// can return, for every frame selection and the colour depths in use.
+func allCacheCandidates() []cacheCandidate {
+	seen := map[cacheCandidate]bool{}
+	var out []cacheCandidate
+	depths := depthKeys()
+	var all []RenderOptions
+	for _, frames := range []string{framesAuto, framesFirst, framesLast, framesStrip} {
+		engine := &Options{ImageFrames: frames}
+		all = append(all, RenderOptions{Engine: engine}, RenderOptions{HighQuality: true, Engine: engine},
+			RenderOptions{ImageMIME: "image/png", Engine: engine}, RenderOptions{ImageMIME: "image/gif", Engine: engine})
+	}
+	for _, prefs := range all {
+		for _, cand := range cacheCandidatesFor(prefs) {
+			for _, depth := range depths {
+				c := cacheCandidate{format: cand.format + depth, quality: cand.quality}
+				if !seen[c] {
+					seen[c] = true
+					out = append(out, c)
+				}
+			}
+		}
+	}
+	return out
+}
+
+// removeURL drops every cached variant of url and reports how many there were.
+func (c *imgLRU) removeURL(url string) int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	n := 0
+	for key, e := range c.m {
+		if _, _, u := splitImgCacheKey(key); u != url {
+			continue
+		}
+		if e.prev != nil {
+			e.prev.next = e.next
+		} else {
+			c.head = e.next
+		}
+		if e.next != nil {
+			e.next.prev = e.prev
+		} else {
+			c.tail = e.prev
+		}
+		delete(c.m, key)
+		c.size -= int64(len(e.data))
+		n++
+	}
+	return n
+}
+
+func splitImgCacheKey(key string) (string, int, string) {
+	parts := strings.SplitN(key, "|", 3)
+	if len(parts) != 3 {
+		return "", 0, key
+	}
+	q, _ := strconv.Atoi(strings.TrimPrefix(parts[1], "q="))
+	return parts[0], q, parts[2]
+}
+
+func walkDiskCache(root string, visit func(path string, size int64)) {
+	if root == "" {
+		return
+	}
+	_ = filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil || d.IsDir() || !strings.HasSuffix(strings.ToLower(p), ".bin") {
+			return nil
+		}
+		if info, e := d.Info(); e == nil {
+			visit(p, info.Size())
+		}
+		return nil
+	})
+}
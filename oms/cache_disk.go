@@ -1,9 +1,9 @@
 package oms
 
 import (
+	"bytes"
 	"crypto/sha1"
 	"encoding/binary"
-	"io"
 	"io/fs"
 	"os"
 	"path/filepath"
@@ -16,29 +16,39 @@ import (
 
 var (
 	diskCacheOnce sync.Once
-	diskCacheDir  string
-	diskCacheMax  int64
 	diskCacheMu   sync.Mutex
+	// diskCfgMu guards diskCacheDir/diskCacheMax, which SetDefaultOptions may replace.
+	diskCfgMu    sync.RWMutex
+	diskCacheDir string
+	diskCacheMax int64
 )
 
 func initDiskCache() {
-	diskCacheDir = os.Getenv("OMS_IMG_CACHE_DIR")
-	if diskCacheDir == "" {
-		diskCacheDir = filepath.Join("cache", "img")
+	diskCfgMu.RLock()
+	configured := diskCacheDir != ""
+	diskCfgMu.RUnlock()
+	if !configured {
+		configureDiskCache(DefaultOptions())
 	}
-	if err := os.MkdirAll(diskCacheDir, 0o755); err != nil {
-		return
-	}
-	mb := 100
-	if s := os.Getenv("OMS_IMG_CACHE_MB"); s != "" {
-		if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && v >= 0 {
-			mb = v
-		}
-	}
-	diskCacheMax = int64(mb) * 1024 * 1024
+}
+
+func configureDiskCache(o Options) {
+	dir := o.imageCacheDir()
+	_ = os.MkdirAll(dir, 0o755)
+	diskCfgMu.Lock()
+	diskCacheDir = dir
+	diskCacheMax = o.imageCacheBytes()
+	diskCfgMu.Unlock()
+}
+
+func diskCacheSettings() (string, int64) {
+	diskCfgMu.RLock()
+	defer diskCfgMu.RUnlock()
+	return diskCacheDir, diskCacheMax
 }
 
 func diskKey(format string, quality int, url string) (string, string) {
+	root, _ := diskCacheSettings()
 	h := sha1.Sum([]byte(format + "|q=" + strconv.Itoa(quality) + "|" + url))
 	hex := make([]byte, 40)
 	const hexd = "0123456789abcdef"
@@ -46,34 +56,75 @@ func diskKey(format string, quality int, url string) (string, string) {
 		hex[i*2] = hexd[b>>4]
 		hex[i*2+1] = hexd[b&0xF]
 	}
-	dir := filepath.Join(diskCacheDir, string(hex[0]), string(hex[1]))
+	dir := filepath.Join(root, string(hex[0]), string(hex[1]))
 	return dir, filepath.Join(dir, string(hex)+".bin")
 }
 
-func diskCacheGet(format string, quality int, url string) ([]byte, int, int, bool) {
+// diskCacheMagic prefixes entries that carry validator metadata. Files written
+// before it existed start directly with the width/height header and are treated
+// as never stale.
+var diskCacheMagic = [4]byte{'O', 'M', 'I', '2'}
+
+func diskCacheGet(format string, quality int, url string) ([]byte, int, int, imgMeta, bool) {
 	diskCacheOnce.Do(initDiskCache)
 	dir, path := diskKey(format, quality, url)
-	f, err := os.Open(path)
-	if err != nil {
-		return nil, 0, 0, false
-	}
-	defer f.Close()
-	header := make([]byte, 4)
-	if _, err := io.ReadFull(f, header); err != nil {
-		return nil, 0, 0, false
+	raw, err := os.ReadFile(path)
+	if err != nil || len(raw) < 4 {
+		return nil, 0, 0, imgMeta{}, false
 	}
-	w := int(binary.BigEndian.Uint16(header[0:2]))
-	h := int(binary.BigEndian.Uint16(header[2:4]))
-	b, err := io.ReadAll(f)
-	if err != nil {
-		return nil, 0, 0, false
+	var meta imgMeta
+	var w, h int
+	var b []byte
+	if bytes.Equal(raw[:4], diskCacheMagic[:]) {
+		var ok bool
+		w, h, meta, b, ok = decodeDiskCacheEntry(raw[4:])
+		if !ok {
+			return nil, 0, 0, imgMeta{}, false
+		}
+	} else {
+		w = int(binary.BigEndian.Uint16(raw[0:2]))
+		h = int(binary.BigEndian.Uint16(raw[2:4]))
+		b = raw[4:]
 	}
 	_ = os.Chtimes(path, time.Now(), time.Now())
 	_ = os.MkdirAll(dir, 0o755)
-	return b, w, h, true
+	return b, w, h, meta, true
 }
 
-func diskCachePut(format string, quality int, url string, data []byte, w, h int) {
+func decodeDiskCacheEntry(raw []byte) (int, int, imgMeta, []byte, bool) {
+	var meta imgMeta
+	if len(raw) < 12 {
+		return 0, 0, meta, nil, false
+	}
+	w := int(binary.BigEndian.Uint16(raw[0:2]))
+	h := int(binary.BigEndian.Uint16(raw[2:4]))
+	if exp := int64(binary.BigEndian.Uint64(raw[4:12])); exp != 0 {
+		meta.Expires = time.Unix(exp, 0)
+	}
+	rest := raw[12:]
+	readString := func() (string, bool) {
+		if len(rest) < 2 {
+			return "", false
+		}
+		n := int(binary.BigEndian.Uint16(rest[0:2]))
+		if len(rest) < 2+n {
+			return "", false
+		}
+		v := string(rest[2 : 2+n])
+		rest = rest[2+n:]
+		return v, true
+	}
+	var ok bool
+	if meta.ETag, ok = readString(); !ok {
+		return 0, 0, meta, nil, false
+	}
+	if meta.LastModified, ok = readString(); !ok {
+		return 0, 0, meta, nil, false
+	}
+	return w, h, meta, rest, true
+}
+
+func diskCachePut(format string, quality int, url string, data []byte, w, h int, meta imgMeta) {
 	diskCacheOnce.Do(initDiskCache)
 	dir, path := diskKey(format, quality, url)
 	if err := os.MkdirAll(dir, 0o755); err != nil {
@@ -84,10 +135,25 @@ func diskCachePut(format string, quality int, url string, data []byte, w, h int)
 	if err != nil {
 		return
 	}
-	var hdr [4]byte
+	var buf bytes.Buffer
+	buf.Write(diskCacheMagic[:])
+	var hdr [12]byte
 	binary.BigEndian.PutUint16(hdr[0:2], uint16(w))
 	binary.BigEndian.PutUint16(hdr[2:4], uint16(h))
-	_, _ = f.Write(hdr[:])
+	if !meta.Expires.IsZero() {
+		binary.BigEndian.PutUint64(hdr[4:12], uint64(meta.Expires.Unix()))
+	}
+	buf.Write(hdr[:])
+	for _, v := range []string{meta.ETag, meta.LastModified} {
+		if len(v) > 0xFFFF {
+			v = ""
+		}
+		var n [2]byte
+		binary.BigEndian.PutUint16(n[:], uint16(len(v)))
+		buf.Write(n[:])
+		buf.WriteString(v)
+	}
+	_, _ = f.Write(buf.Bytes())
 	_, _ = f.Write(data)
 	_ = f.Close()
 	_ = os.Rename(tmp, path)
@@ -97,13 +163,14 @@ func diskCachePut(format string, quality int, url string, data []byte, w, h int)
 func pruneDiskCache() {
 	diskCacheMu.Lock()
 	defer diskCacheMu.Unlock()
+	root, limit := diskCacheSettings()
 	var files []struct {
 		p  string
 		sz int64
 		mt time.Time
 	}
 	var total int64
-	filepath.WalkDir(diskCacheDir, func(p string, d fs.DirEntry, err error) error {
+	filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
 		if err != nil {
 			return nil
 		}
@@ -123,12 +190,12 @@ func pruneDiskCache() {
 		}
 		return nil
 	})
-	if total <= diskCacheMax || diskCacheMax <= 0 {
+	if total <= limit || limit <= 0 {
 		return
 	}
 	sort.Slice(files, func(i, j int) bool { return files[i].mt.Before(files[j].mt) })
 	for _, f := range files {
-		if total <= diskCacheMax {
+		if total <= limit {
 			break
 		}
 		_ = os.Remove(f.p)
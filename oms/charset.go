@@ -0,0 +1,383 @@
+package oms
+
+import (
+	"bytes"
+	"mime"
+	"net/url"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/encoding"
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+// guessCandidates are the legacy encodings tried, in order of preference,
+// when a non-UTF-8 page declares no charset.
+var guessCandidates = []string{
+	"windows-1251", "koi8-r", "windows-1252", "windows-1250", "iso-8859-2",
+	"iso-8859-5", "windows-1253", "windows-1254", "windows-1255", "windows-1256",
+	"windows-1257", "windows-874", "shift_jis", "gbk", "euc-jp", "big5", "euc-kr",
+}
+
+// maxWordLetters is the longest letter run charsetScore accepts as a word
+// of an alphabetic script.
+const maxWordLetters = 12
+
+// guessSampleBytes bounds the part of a body the statistical guess reads.
+const guessSampleBytes = 32 << 10
+
+// detectCharset determines the encoding of an HTML body the way HTML5 does:
+// a byte order mark, then the Content-Type charset, then a <meta> prescan of
+// the first 1024 bytes, then a guess from the content itself in which the
+// handset's preferred encoding wins ties. The result is a WHATWG name.
+func detectCharset(body []byte, contentType, deviceCharset string) string {
+	if cs := bomCharset(body); cs != "" {
+		return cs
+	}
+	if cs := headerCharset(contentType); cs != "" {
+		return cs
+	}
+	if cs := prescanCharset(body); cs != "" {
+		return cs
+	}
+	return guessCharset(body, canonicalCharset(deviceCharset))
+}
+
+func bomCharset(body []byte) string {
+	switch {
+	case bytes.HasPrefix(body, []byte{0xEF, 0xBB, 0xBF}):
+		return "utf-8"
+	case bytes.HasPrefix(body, []byte{0xFE, 0xFF}):
+		return "utf-16be"
+	case bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		return "utf-16le"
+	}
+	return ""
+}
+
+// headerCharset returns the known charset of a Content-Type value. Sloppy
+// headers that mime rejects are searched for charset= directly.
+func headerCharset(contentType string) string {
+	if _, params, err := mime.ParseMediaType(contentType); err == nil {
+		return canonicalCharset(params["charset"])
+	}
+	low := strings.ToLower(contentType)
+	if i := strings.Index(low, "charset="); i != -1 {
+		return canonicalCharset(charsetLabel(low[i+8:]))
+	}
+	return ""
+}
+
+// charsetLabel cuts the label off the text following "charset=", skipping
+// an opening quote.
+func charsetLabel(v string) string {
+	v = strings.TrimLeft(v, `"' `)
+	if j := strings.IndexAny(v, `;"' >/`); j != -1 {
+		v = v[:j]
+	}
+	return strings.TrimSpace(v)
+}
+
+// prescanCharset looks for <meta charset> or an http-equiv Content-Type in
+// the first 1024 bytes. As in HTML5, a declared UTF-16 means UTF-8 (the page
+// would have had a BOM) and x-user-defined means windows-1252.
+func prescanCharset(body []byte) string {
+	if len(body) > 1024 {
+		body = body[:1024]
+	}
+	z := html.NewTokenizer(bytes.NewReader(body))
+	for {
+		switch z.Next() {
+		case html.ErrorToken:
+			return ""
+		case html.StartTagToken, html.SelfClosingTagToken:
+			name, hasAttr := z.TagName()
+			if string(name) != "meta" || !hasAttr {
+				continue
+			}
+			var label, content string
+			httpEquiv := false
+			for more := true; more; {
+				var key, val []byte
+				key, val, more = z.TagAttr()
+				switch string(key) {
+				case "charset":
+					label = string(val)
+				case "content":
+					content = string(val)
+				case "http-equiv":
+					httpEquiv = strings.EqualFold(strings.TrimSpace(string(val)), "content-type")
+				}
+			}
+			if label == "" && httpEquiv {
+				if i := strings.Index(strings.ToLower(content), "charset="); i != -1 {
+					label = charsetLabel(content[i+8:])
+				}
+			}
+			switch cs := canonicalCharset(label); cs {
+			case "":
+			case "utf-16be", "utf-16le":
+				return "utf-8"
+			case "x-user-defined":
+				return "windows-1252"
+			default:
+				return cs
+			}
+		}
+	}
+}
+
+// guessCharset picks the encoding of an undeclared page. ASCII and valid
+// UTF-8 are UTF-8. Otherwise the handset's encoding is taken if the sample
+// reads as text in it, which settles what letter statistics cannot tell
+// apart (windows-1250 and ISO-8859-2, Korean and Cyrillic). Failing that,
+// every candidate decodes the sample, decodings with invalid sequences, C1
+// controls or private-use characters are dropped, and the one whose letters
+// read most like text wins.
+func guessCharset(body []byte, deviceCharset string) string {
+	sample := body
+	if len(sample) > guessSampleBytes {
+		sample = sample[:guessSampleBytes]
+		// Cut at a line end so no multi-byte character is split.
+		if i := bytes.LastIndexByte(sample, '\n'); i > 0 {
+			sample = sample[:i+1]
+		}
+	}
+	if isASCII(string(sample)) || utf8.Valid(sample) {
+		return "utf-8"
+	}
+	switch deviceCharset {
+	case "", "utf-8", "utf-16be", "utf-16le", "replacement", "x-user-defined":
+	default:
+		if score, ok := charsetScore(sample, deviceCharset); ok && score > 0 {
+			return deviceCharset
+		}
+	}
+	best, bestScore := "", 0
+	for _, cs := range guessCandidates {
+		score, ok := charsetScore(sample, cs)
+		if ok && (best == "" || score > bestScore) {
+			best, bestScore = cs, score
+		}
+	}
+	if best == "" {
+		if deviceCharset != "" {
+			return deviceCharset
+		}
+		return "windows-1252"
+	}
+	return best
+}
+
+// frequentLetters are the most common letters of the scripts whose
+// single-byte encodings read as each other; a decoding hitting them often is
+// more likely right.
+var frequentLetters = map[*unicode.RangeTable]string{
+	unicode.Cyrillic: "оеаинтсрвлкмдпуяыь",
+	unicode.Greek:    "αοιετσνηυρπκμλάέίόή",
+	unicode.Han:      "的一是不了人我在有他这中大来上个国们到说时要就出会也你对生能而子那得于着下自之年过发后作",
+	unicode.Hangul:   "이다는의에가하고을를지기서로한사어도",
+}
+
+// charsetScore decodes sample as cs and rates it. Adjacent letter pairs that
+// involve a non-ASCII letter score within one script and cost across
+// scripts or on a lower-to-upper case change; Latin is the exception, as
+// accented letters sit next to ASCII letters rather than each other.
+// Frequent letters add to the score. CJK characters span two bytes, so
+// their pairs and letters count double to stay comparable with single-byte
+// decodings of the same sample.
+func charsetScore(sample []byte, cs string) (int, bool) {
+	enc, err := htmlindex.Get(cs)
+	if err != nil {
+		return 0, false
+	}
+	text, err := enc.NewDecoder().Bytes(sample)
+	if err != nil {
+		return 0, false
+	}
+	score, run := 0, 0
+	prev := ' '
+	for _, r := range string(text) {
+		if !unicode.IsLetter(r) {
+			run = 0
+		} else {
+			run++
+		}
+		if r < 0x80 {
+			prev = r
+			continue
+		}
+		if r == utf8.RuneError || r <= 0x9F || unicode.Is(unicode.Co, r) {
+			return 0, false
+		}
+		if run == 0 {
+			prev = r
+			continue
+		}
+		weight := 1
+		script := letterScript(r)
+		if script == unicode.Han || script == unicode.Hangul {
+			weight = 2
+		}
+		if unicode.IsLetter(prev) {
+			pair := letterPairScore(prev, r)
+			if weight == 1 && run > maxWordLetters {
+				// Alphabets separate words with spaces; a run this
+				// long is unspaced CJK text read in a single-byte code.
+				pair = -2
+			}
+			score += weight * pair
+		}
+		if unicode.Is(unicode.Hiragana, r) || strings.ContainsRune(frequentLetters[script], unicode.ToLower(r)) {
+			score += weight
+		}
+		prev = r
+	}
+	return score, true
+}
+
+func letterPairScore(a, b rune) int {
+	sa, sb := letterScript(a), letterScript(b)
+	score := 1
+	switch {
+	case sa != sb:
+		score = -2
+	case sa == unicode.Latin && a >= 0x80:
+		score = -1
+	}
+	if unicode.IsLower(a) && unicode.IsUpper(b) {
+		score--
+	}
+	if isHalfwidthKana(a) || isHalfwidthKana(b) {
+		// The single-byte kana of Shift_JIS are what other CJK text
+		// turns into when misread; real pages rarely use them.
+		score -= 2
+	}
+	return score
+}
+
+// letterScript returns the script of a letter, folding kana into Han since
+// Japanese mixes them within words.
+func letterScript(r rune) *unicode.RangeTable {
+	for _, t := range []*unicode.RangeTable{
+		unicode.Latin, unicode.Cyrillic, unicode.Greek, unicode.Arabic,
+		unicode.Hebrew, unicode.Thai, unicode.Hangul,
+	} {
+		if unicode.Is(t, r) {
+			return t
+		}
+	}
+	if unicode.In(r, unicode.Han, unicode.Hiragana, unicode.Katakana) {
+		return unicode.Han
+	}
+	return nil
+}
+
+func isHalfwidthKana(r rune) bool {
+	return r >= 0xFF61 && r <= 0xFF9F
+}
+
+// decodeToUTF8 converts body from charset to UTF-8, dropping a byte order
+// mark. Undecodable bodies are returned unchanged.
+func decodeToUTF8(body []byte, charset string) []byte {
+	switch {
+	case charset == "utf-8":
+		return bytes.TrimPrefix(body, []byte{0xEF, 0xBB, 0xBF})
+	case charset == "utf-16be" && bytes.HasPrefix(body, []byte{0xFE, 0xFF}),
+		charset == "utf-16le" && bytes.HasPrefix(body, []byte{0xFF, 0xFE}):
+		body = body[2:]
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return body
+	}
+	out, err := enc.NewDecoder().Bytes(body)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// canonicalCharset maps a charset label to its WHATWG encoding name
+// ("cp1251" -> "windows-1251", "sjis" -> "shift_jis"). Unknown labels
+// yield "".
+func canonicalCharset(label string) string {
+	label = strings.Trim(strings.TrimSpace(label), `"'`)
+	if label == "" {
+		return ""
+	}
+	enc, err := htmlindex.Get(label)
+	if err != nil {
+		return ""
+	}
+	name, err := htmlindex.Name(enc)
+	if err != nil {
+		return ""
+	}
+	return name
+}
+
+// formCharset picks the encoding a form submits with, as browsers do: the
+// first accept-charset label we can encode, else the page's own charset.
+// UTF-16 pages submit UTF-8.
+func formCharset(acceptCharset, pageCharset string) string {
+	for _, label := range strings.FieldsFunc(acceptCharset, func(r rune) bool { return r == ' ' || r == ',' || r == '\t' }) {
+		if cs := canonicalCharset(label); cs != "" {
+			return submitCharset(cs)
+		}
+	}
+	return submitCharset(canonicalCharset(pageCharset))
+}
+
+func submitCharset(cs string) string {
+	switch cs {
+	case "", "utf-16be", "utf-16le", "replacement":
+		return "utf-8"
+	}
+	return cs
+}
+
+// encodeCharset transcodes UTF-8 text to charset for an outgoing form.
+// Characters the charset lacks become &#N; references, which is what
+// browsers send in their place.
+func encodeCharset(s, charset string) string {
+	if charset == "" || charset == "utf-8" || isASCII(s) {
+		return s
+	}
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		return s
+	}
+	out, err := encoding.HTMLEscapeUnsupported(enc.NewEncoder()).String(s)
+	if err != nil {
+		return s
+	}
+	return out
+}
+
+// encodeFormValues transcodes the names and values of a guessed form
+// submission to charset.
+func encodeFormValues(values url.Values, charset string) url.Values {
+	if charset == "" || charset == "utf-8" {
+		return values
+	}
+	out := make(url.Values, len(values))
+	for name, vs := range values {
+		key := encodeCharset(name, charset)
+		for _, v := range vs {
+			out[key] = append(out[key], encodeCharset(v, charset))
+		}
+	}
+	return out
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,122 @@
+package oms
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"testing"
+
+	"golang.org/x/text/encoding/htmlindex"
+)
+
+func TestDetectCharsetFollowsHTML5Order(t *testing.T) {
+	cases := []struct {
+		name, body, contentType, device, want string
+	}{
+		{"bom beats header", "\xFE\xFF\x00<", "text/html; charset=utf-8", "", "utf-16be"},
+		{"header label", "", "text/html; charset=CP1251", "", "windows-1251"},
+		{"quoted header", "", `text/html; charset="koi8-r"`, "", "koi8-r"},
+		{"sloppy header", "", "text/html; charset=latin1;;", "", "windows-1252"},
+		{"unknown header falls to meta", `<meta charset="Shift_JIS">`, "text/html; charset=x-bogus", "", "shift_jis"},
+		{"http-equiv", `<meta http-equiv="Content-Type" content="text/html; charset=gb2312">`, "", "", "gbk"},
+		{"meta utf-16", `<meta charset="utf-16">`, "", "", "utf-8"},
+		{"ascii", "<p>plain</p>", "text/html", "ISO-8859-2", "utf-8"},
+		{"utf-8", "<p>\xD0\x9F\xD1\x80\xD0\xB8</p>", "text/html", "windows-1251", "utf-8"},
+	}
+	for _, c := range cases {
+		if got := detectCharset([]byte(c.body), c.contentType, c.device); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestGuessCharsetReadsUndeclaredPages(t *testing.T) {
+	cases := []struct {
+		name, text, charset, device, want string
+	}{
+		{"russian cp1251", "<p>Привет, мир! Это старый форум о погоде в Москве.</p>", "windows-1251", "ISO-8859-1", "windows-1251"},
+		{"russian koi8", "<p>Привет, мир! Это старый форум о погоде в Москве.</p>", "koi8-r", "", "koi8-r"},
+		{"russian iso-8859-5", "<p>Привет, мир! Это старый форум о погоде в Москве.</p>", "iso-8859-5", "", "iso-8859-5"},
+		{"german", "<p>Grüße aus München, schöne Straße.</p>", "windows-1252", "", "windows-1252"},
+		{"greek", "<p>Καλημέρα κόσμε, τι κάνεις;</p>", "windows-1253", "", "windows-1253"},
+		{"japanese", "<p>こんにちは、世界。今日はいい天気ですね。</p>", "shift_jis", "", "shift_jis"},
+		{"chinese", "<p>你好，世界。今天天气很好，我们去公园散步吧。</p>", "gbk", "", "gbk"},
+		{"czech with device hint", "<p>Příliš žluťoučký kůň úpěl ďábelské ódy.</p>", "windows-1250", "windows-1250", "windows-1250"},
+		{"korean with device hint", "<p>안녕하세요 세계, 오늘 날씨가 좋네요.</p>", "euc-kr", "EUC-KR", "euc-kr"},
+	}
+	for _, c := range cases {
+		body := encodeFixture(t, c.text, c.charset)
+		if got := detectCharset(body, "text/html", c.device); got != c.want {
+			t.Errorf("%s: got %q, want %q", c.name, got, c.want)
+		}
+	}
+}
+
+func TestRenderDecodesLegacyPages(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name:        "shift_jis",
+		url:         "http://news.test/",
+		contentType: "text/html",
+		html:        string(encodeFixture(t, `<html><head><meta charset="Shift_JIS"></head><body><p>日本語のニュース</p></body></html>`, "shift_jis")),
+	})
+	if !bytes.Contains(res.payload, []byte("日本語のニュース")) {
+		t.Fatalf("expected the Shift_JIS text decoded to UTF-8")
+	}
+	res = renderFixture(t, obmlFixture{
+		name:        "utf-16",
+		url:         "http://news.test/",
+		contentType: "text/html; charset=iso-8859-1",
+		html:        string(encodeFixture(t, "\uFEFF<html><body><p>Ελληνικά</p></body></html>", "utf-16le")),
+	})
+	if !bytes.Contains(res.payload, []byte("Ελληνικά")) {
+		t.Fatalf("expected the UTF-16 text decoded by its byte order mark")
+	}
+}
+
+func encodeFixture(t *testing.T, text, charset string) []byte {
+	t.Helper()
+	enc, err := htmlindex.Get(charset)
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := enc.NewEncoder().Bytes([]byte(text))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return out
+}
+
+func TestFormSubmissionUsesPageCharset(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name:        "charset",
+		url:         "http://forum.test/topic",
+		contentType: "text/html; charset=windows-1251",
+		html: `<html><body><form action="/post" method="post"><input type="hidden" name="_charset_">` +
+			`<input name="msg"><input type="submit" value="Send"></form>` +
+			`<form action="/search" accept-charset="bogus koi8-r"><input name="q"></form></body></html>`,
+	})
+	post, search := res.page.Forms[0], res.page.Forms[1]
+	if post.Charset != "windows-1251" || search.Charset != "koi8-r" {
+		t.Fatalf("charsets = %q, %q", post.Charset, search.Charset)
+	}
+
+	sub := prepareOperaMiniSubmission("http://forum.test/topic", "msg=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82+%E6%97%A5", post, nil, "", slog.Default())
+	if want := "_charset_=windows-1251&msg=%CF%F0%E8%E2%E5%F2+%26%2326085%3B"; sub.Body != want {
+		t.Fatalf("body = %q, want %q", sub.Body, want)
+	}
+	sub = prepareOperaMiniSubmission("http://forum.test/topic", "q=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82", search, nil, "", slog.Default())
+	if sub.Method != http.MethodGet || sub.URL != "http://forum.test/search?q=%F0%D2%C9%D7%C5%D4" {
+		t.Fatalf("unexpected GET submission %+v", sub)
+	}
+}
+
+func TestGuessedSubmissionUsesRememberedCharset(t *testing.T) {
+	sub := prepareOperaMiniSubmission("http://forum.test/post", "msg=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82&opf=2", nil, nil, "windows-1251", slog.Default())
+	if sub == nil || sub.Method != http.MethodPost || sub.Body != "msg=%CF%F0%E8%E2%E5%F2" {
+		t.Fatalf("unexpected submission %+v", sub)
+	}
+	sub = prepareOperaMiniSubmission("http://forum.test/search", "q=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82", nil, nil, "", slog.Default())
+	if sub == nil || sub.URL != "http://forum.test/search?q=%D0%9F%D1%80%D0%B8%D0%B2%D0%B5%D1%82" {
+		t.Fatalf("expected UTF-8 without a remembered charset, got %+v", sub)
+	}
+}
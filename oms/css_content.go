@@ -0,0 +1,396 @@
+package oms
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+)
+
+// replacedTags cannot hold generated content: browsers draw no ::before or
+// ::after for them.
+var replacedTags = map[string]bool{
+	"img": true, "br": true, "hr": true, "input": true, "select": true,
+	"textarea": true, "iframe": true, "object": true, "embed": true,
+	"video": true, "audio": true, "canvas": true, "meta": true, "link": true,
+	"wbr": true, "area": true, "source": true, "track": true,
+}
+
+// counterInstance is one CSS counter. Counters reset by an element are
+// scoped to its parent's children, so they die with that sibling list.
+type counterInstance struct {
+	name  string
+	value int
+}
+
+// contentGen evaluates ::before/::after content in document order, keeping
+// the counters and quote depth that evaluation needs.
+type contentGen struct {
+	ss       *Stylesheet
+	counters []counterInstance
+	quotes   int
+}
+
+// applyGeneratedContent inserts the text of ::before and ::after content as
+// the first and last text children of each element, so walkRich and the
+// handlers that collect text (headings, list items, links) render it in
+// place. Strings, counter(), counters(), attr() and quotes are evaluated;
+// private-use glyphs of icon fonts are dropped, and pseudo-elements whose
+// content is only such glyphs add nothing.
+func applyGeneratedContent(doc *html.Node, ss *Stylesheet) {
+	if doc == nil || ss == nil {
+		return
+	}
+	hasPseudo := false
+	for _, rule := range ss.rules {
+		hasPseudo = hasPseudo || rule.pseudo != ""
+	}
+	if !hasPseudo {
+		return
+	}
+	body := findFirstByTag(doc, "body")
+	if body == nil {
+		return
+	}
+	g := &contentGen{ss: ss}
+	g.walk(body)
+}
+
+func (g *contentGen) walk(n *html.Node) {
+	mark := len(g.counters)
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		props := computeStyleFor(c, g.ss)
+		if strings.Contains(strings.ToLower(props["display"]), "none") {
+			continue
+		}
+		g.applyCounters(props)
+		if replacedTags[strings.ToLower(c.Data)] {
+			continue
+		}
+		before := g.pseudoText(c, "before")
+		g.walk(c)
+		after := g.pseudoText(c, "after")
+		if before != "" {
+			if last := []rune(before)[len([]rune(before))-1]; unicode.IsLetter(last) || unicode.IsDigit(last) {
+				before += " "
+			}
+			c.InsertBefore(&html.Node{Type: html.TextNode, Data: before}, c.FirstChild)
+		}
+		if after != "" {
+			if first := []rune(after)[0]; unicode.IsLetter(first) || unicode.IsDigit(first) {
+				after = " " + after
+			}
+			c.AppendChild(&html.Node{Type: html.TextNode, Data: after})
+		}
+	}
+	g.counters = g.counters[:mark]
+}
+
+// pseudoText evaluates the content of n's ::before or ::after.
+func (g *contentGen) pseudoText(n *html.Node, pseudo string) string {
+	props := pseudoStyleFor(n, g.ss, pseudo)
+	content, ok := props["content"]
+	if !ok || strings.Contains(strings.ToLower(props["display"]), "none") {
+		return ""
+	}
+	g.applyCounters(props)
+	if text := g.evaluate(n, content); strings.TrimSpace(text) != "" {
+		return text
+	}
+	return ""
+}
+
+// applyCounters applies counter-reset, counter-set and counter-increment
+// in that order.
+func (g *contentGen) applyCounters(props map[string]string) {
+	for _, kv := range counterList(props["counter-reset"], 0) {
+		g.counters = append(g.counters, counterInstance{name: kv.name, value: kv.value})
+	}
+	for _, kv := range counterList(props["counter-set"], 0) {
+		*g.counter(kv.name) = kv.value
+	}
+	for _, kv := range counterList(props["counter-increment"], 1) {
+		*g.counter(kv.name) += kv.value
+	}
+}
+
+// counter returns the innermost counter called name, creating it in the
+// current scope when none is in effect, as an increment of an unknown
+// counter does.
+func (g *contentGen) counter(name string) *int {
+	for i := len(g.counters) - 1; i >= 0; i-- {
+		if g.counters[i].name == name {
+			return &g.counters[i].value
+		}
+	}
+	g.counters = append(g.counters, counterInstance{name: name})
+	return &g.counters[len(g.counters)-1].value
+}
+
+type counterValue struct {
+	name  string
+	value int
+}
+
+// counterList parses "name [integer]" pairs; def is the value a name
+// without an integer gets.
+func counterList(v string, def int) []counterValue {
+	fields := strings.Fields(v)
+	if len(fields) == 0 || strings.EqualFold(fields[0], "none") {
+		return nil
+	}
+	var out []counterValue
+	for i := 0; i < len(fields); i++ {
+		kv := counterValue{name: fields[i], value: def}
+		if i+1 < len(fields) {
+			if n, err := strconv.Atoi(fields[i+1]); err == nil {
+				kv.value = n
+				i++
+			}
+		}
+		out = append(out, kv)
+	}
+	return out
+}
+
+// evaluate renders a content value: strings, counter(), counters(),
+// attr(), open-quote and close-quote. Images, alt text after "/" and
+// unknown functions produce nothing.
+func (g *contentGen) evaluate(n *html.Node, content string) string {
+	switch strings.ToLower(strings.TrimSpace(content)) {
+	case "", "none", "normal":
+		return ""
+	}
+	var b strings.Builder
+	s := content
+	for i := 0; i < len(s); {
+		switch c := s[i]; {
+		case c == '"' || c == '\'':
+			str, next := readCSSString(s, i)
+			b.WriteString(str)
+			i = next
+		case c == '/':
+			i = len(s)
+		case isCSSIdentChar(c) || c == '-':
+			j := i
+			for j < len(s) && (isCSSIdentChar(s[j]) || s[j] == '-') {
+				j++
+			}
+			name := strings.ToLower(s[i:j])
+			if j < len(s) && s[j] == '(' {
+				args, next := readCSSArgs(s, j)
+				b.WriteString(g.function(n, name, args))
+				i = next
+				continue
+			}
+			switch name {
+			case "open-quote":
+				b.WriteString(quoteMark(g.quotes, true))
+				g.quotes++
+			case "close-quote":
+				if g.quotes > 0 {
+					g.quotes--
+				}
+				b.WriteString(quoteMark(g.quotes, false))
+			case "no-open-quote":
+				g.quotes++
+			case "no-close-quote":
+				if g.quotes > 0 {
+					g.quotes--
+				}
+			}
+			i = j
+		default:
+			i++
+		}
+	}
+	return strings.Map(func(r rune) rune {
+		switch {
+		case unicode.Is(unicode.Co, r):
+			return -1
+		case r == '\n' || r == '\t':
+			return ' '
+		}
+		return r
+	}, b.String())
+}
+
+func (g *contentGen) function(n *html.Node, name string, args []string) string {
+	arg := func(i int) string {
+		if i < len(args) {
+			return args[i]
+		}
+		return ""
+	}
+	switch name {
+	case "attr":
+		// attr(name type, fallback): only the name is used.
+		if name, _, _ := strings.Cut(arg(0), " "); name != "" {
+			return getAttr(n, name)
+		}
+	case "counter":
+		return formatCounter(g.value(arg(0)), arg(1))
+	case "counters":
+		var parts []string
+		for _, ci := range g.counters {
+			if ci.name == arg(0) {
+				parts = append(parts, formatCounter(ci.value, arg(2)))
+			}
+		}
+		if len(parts) == 0 {
+			parts = []string{formatCounter(0, arg(2))}
+		}
+		return strings.Join(parts, arg(1))
+	}
+	return ""
+}
+
+func (g *contentGen) value(name string) int {
+	for i := len(g.counters) - 1; i >= 0; i-- {
+		if g.counters[i].name == name {
+			return g.counters[i].value
+		}
+	}
+	return 0
+}
+
+// readCSSString reads the quoted string starting at s[i], resolving CSS
+// escapes, and returns it with the index after the closing quote.
+func readCSSString(s string, i int) (string, int) {
+	quote := s[i]
+	var b strings.Builder
+	i++
+	for i < len(s) && s[i] != quote {
+		if s[i] != '\\' || i+1 >= len(s) {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+		i++
+		j := i
+		for j < len(s) && j-i < 6 && strings.IndexByte("0123456789abcdefABCDEF", s[j]) != -1 {
+			j++
+		}
+		if j == i {
+			if s[i] != '\n' {
+				b.WriteByte(s[i])
+			}
+			i++
+			continue
+		}
+		if r, err := strconv.ParseUint(s[i:j], 16, 32); err == nil && r > 0 && r <= unicode.MaxRune {
+			b.WriteRune(rune(r))
+		}
+		i = j
+		if i < len(s) && (s[i] == ' ' || s[i] == '\t' || s[i] == '\n') {
+			i++
+		}
+	}
+	return b.String(), i + 1
+}
+
+// readCSSArgs splits the comma-separated arguments of the function whose
+// opening parenthesis is s[open]. String arguments are unquoted.
+func readCSSArgs(s string, open int) ([]string, int) {
+	var args []string
+	var cur strings.Builder
+	i := open + 1
+	for i < len(s) && s[i] != ')' {
+		switch s[i] {
+		case '"', '\'':
+			str, next := readCSSString(s, i)
+			cur.WriteString(str)
+			i = next
+			continue
+		case ',':
+			args = append(args, strings.TrimSpace(cur.String()))
+			cur.Reset()
+		default:
+			cur.WriteByte(s[i])
+		}
+		i++
+	}
+	args = append(args, strings.TrimSpace(cur.String()))
+	return args, i + 1
+}
+
+func quoteMark(depth int, open bool) string {
+	marks := [2][2]string{{"“", "”"}, {"‘", "’"}}
+	pair := marks[min(depth, 1)]
+	if open {
+		return pair[0]
+	}
+	return pair[1]
+}
+
+// formatCounter renders a counter value in a list-style-type.
+func formatCounter(v int, style string) string {
+	switch strings.ToLower(strings.TrimSpace(style)) {
+	case "none":
+		return ""
+	case "disc":
+		return "•"
+	case "circle":
+		return "◦"
+	case "square":
+		return "▪"
+	case "decimal-leading-zero":
+		if v >= 0 && v < 10 {
+			return "0" + strconv.Itoa(v)
+		}
+	case "lower-roman":
+		return strings.ToLower(romanNumeral(v))
+	case "upper-roman":
+		return romanNumeral(v)
+	case "lower-alpha", "lower-latin":
+		return alphabetic(v, 'a', 26)
+	case "upper-alpha", "upper-latin":
+		return alphabetic(v, 'A', 26)
+	case "lower-greek":
+		return alphabetic(v, 'α', 24)
+	}
+	return strconv.Itoa(v)
+}
+
+func romanNumeral(v int) string {
+	if v <= 0 || v >= 4000 {
+		return strconv.Itoa(v)
+	}
+	var b strings.Builder
+	for _, r := range []struct {
+		value int
+		digit string
+	}{
+		{1000, "M"}, {900, "CM"}, {500, "D"}, {400, "CD"}, {100, "C"}, {90, "XC"},
+		{50, "L"}, {40, "XL"}, {10, "X"}, {9, "IX"}, {5, "V"}, {4, "IV"}, {1, "I"},
+	} {
+		for v >= r.value {
+			b.WriteString(r.digit)
+			v -= r.value
+		}
+	}
+	return b.String()
+}
+
+// alphabetic renders v in the bijective base of an alphabet starting at
+// first: a, b, ... z, aa, ab for Latin.
+func alphabetic(v int, first rune, size int) string {
+	if v <= 0 {
+		return strconv.Itoa(v)
+	}
+	var out []rune
+	for v > 0 {
+		v--
+		r := first + rune(v%size)
+		if first == 'α' && r >= 'ς' {
+			r++ // skip final sigma
+		}
+		out = append([]rune{r}, out...)
+		v /= size
+	}
+	return string(out)
+}
@@ -0,0 +1,77 @@
+package oms
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestGeneratedContentRendersAroundElements(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "generated",
+		url:  "http://news.test/",
+		html: `<html><head><style>
+.new::after{content:"New!"}
+q::before{content:open-quote} q::after{content:close-quote}
+ol.steps{counter-reset:step;list-style:none}
+ol.steps li::before{counter-increment:step;content:"Step " counter(step, upper-roman) ":"}
+.toc,.toc ul{counter-reset:sec} .toc li{counter-increment:sec}
+.toc li li::before{content:counters(sec, ".") " "}
+a.ext::after{content:" (" attr(href) ")"}
+.icon::before{content:"\f007";font-family:FontAwesome}
+.price::before{content:"\20AC\00a0"}
+a:hover::after{content:"hovering"}
+p::first-line{color:#ff0000}
+</style></head><body>
+<p><span class="new">Item</span> <q>Quoted</q> <span class="icon">Profile</span> <span class="price">5</span></p>
+<ol class="steps"><li>Open</li><li>Close</li></ol>
+<ul class="toc"><li>Intro<ul><li>Scope</li><li>Terms</li></ul></li></ul>
+<a class="ext" href="http://x.test/doc">Spec</a>
+</body></html>`,
+	})
+	for _, want := range []string{"Item", "New!", "“", "Quoted", "”", "Step I:", "Step II:", "1.1 ", "1.2 ", "(http://x.test/doc)", "€"} {
+		if !bytes.Contains(res.payload, []byte(want)) {
+			t.Errorf("expected %q in the page", want)
+		}
+	}
+	if bytes.Contains(res.payload, []byte("hovering")) {
+		t.Errorf(":hover content must not be rendered")
+	}
+	if bytes.ContainsRune(res.payload, '') {
+		t.Errorf("icon font glyphs must be filtered")
+	}
+}
+
+func TestPseudoElementRulesDoNotStyleTheElement(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "pseudo-style",
+		url:  "http://news.test/",
+		html: `<html><head><style>p::first-line{display:none} p::selection{display:none} p::before{display:none;content:"x"}</style></head>` +
+			`<body><p>Still visible</p></body></html>`,
+	})
+	if !bytes.Contains(res.payload, []byte("Still visible")) {
+		t.Fatalf("pseudo-element rules must not apply to the element")
+	}
+}
+
+func TestFormatCounterStyles(t *testing.T) {
+	cases := []struct {
+		v     int
+		style string
+		want  string
+	}{
+		{4, "", "4"},
+		{3, "decimal-leading-zero", "03"},
+		{14, "lower-roman", "xiv"},
+		{1999, "upper-roman", "MCMXCIX"},
+		{28, "lower-alpha", "ab"},
+		{26, "upper-latin", "Z"},
+		{18, "lower-greek", "σ"},
+		{2, "square", "▪"},
+		{0, "lower-alpha", "0"},
+	}
+	for _, c := range cases {
+		if got := formatCounter(c.v, c.style); got != c.want {
+			t.Errorf("formatCounter(%d, %q) = %q, want %q", c.v, c.style, got, c.want)
+		}
+	}
+}
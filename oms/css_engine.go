@@ -8,7 +8,6 @@ import (
 	"io"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
 	"strings"
 	"time"
@@ -38,10 +37,16 @@ type cssRule struct {
 	specificity  cascadia.Specificity
 	declarations []cssDeclaration
 	order        int
+	// pseudo is "before" or "after" for generated-content rules, which do
+	// not style the element itself.
+	pseudo string
 }
 
 type Stylesheet struct {
 	rules []cssRule
+	// computed memoises computeStyleFor, so styles stay those of the parsed
+	// document after linearizeCSSLayout has moved nodes around.
+	computed map[*html.Node]map[string]string
 }
 
 // Expose limited helpers for debug tools.
@@ -257,30 +262,9 @@ func parseCSSText(txt string, startOrder int, ctx *cssParseContext) ([]cssRule,
 				if len(decls) == 0 || len(rule.Selectors) == 0 {
 					continue
 				}
-				// Sanitize unsupported pseudo selectors to avoid parser errors
-				sanitized := make([]string, 0, len(rule.Selectors))
-				for _, s := range rule.Selectors {
-					if ss := sanitizeSelectorForCascadia(s); ss != "" {
-						sanitized = append(sanitized, ss)
-					}
-				}
-				if len(sanitized) == 0 {
-					continue
-				}
-				group, err := cascadia.ParseGroup(strings.Join(sanitized, ","))
-				if err != nil {
-					if cssDebug() {
-						fmt.Println("Error parsing CSS group:", err)
-					}
-					continue
-				}
-				for _, sel := range group {
-					if sel == nil || sel.PseudoElement() != "" {
-						continue
-					}
-					rules = append(rules, cssRule{selector: sel, specificity: sel.Specificity(), declarations: cloneDecls(decls), order: order})
-					order++
-				}
+				var rs []cssRule
+				rs, order = selectorRules(rule.Selectors, decls, order)
+				rules = append(rules, rs...)
 			}
 		}
 	}
@@ -388,29 +372,89 @@ func parseSimpleCSSFallback(txt string, startOrder int) ([]cssRule, int) {
 			continue
 		}
 		// Build rules for each selector in group
-		for _, sel := range strings.Split(pre, ",") {
-			sel = strings.TrimSpace(sanitizeSelectorForCascadia(sel))
-			if sel == "" {
+		var rs []cssRule
+		rs, order = selectorRules(strings.Split(pre, ","), decls, order)
+		out = append(out, rs...)
+	}
+	if len(out) == 0 {
+		return nil, startOrder
+	}
+	return out, order
+}
+
+// selectorRules builds the rules of one rule set. Pseudo-classes are
+// sanitised away; ::before and ::after selectors become pseudo rules for
+// generated content, unless they depend on user interaction, and other
+// pseudo-elements are dropped so they do not style the element itself.
+func selectorRules(selectors []string, decls []cssDeclaration, order int) ([]cssRule, int) {
+	var rules []cssRule
+	for _, s := range selectors {
+		base, pseudo := splitPseudoElement(s)
+		switch pseudo {
+		case "":
+		case "before", "after":
+			if hasDynamicPseudoClass(base) {
 				continue
 			}
-			// Ignore complex combinators; keep simple selectors (.class, tag.class, #id)
-			gr, err := cascadia.ParseGroup(sel)
-			if err != nil || len(gr) == 0 {
+		default:
+			continue
+		}
+		sel := strings.TrimSpace(sanitizeSelectorForCascadia(base))
+		if sel == "" {
+			if pseudo == "" {
 				continue
 			}
-			for _, ssel := range gr {
-				if ssel == nil || ssel.PseudoElement() != "" {
-					continue
-				}
-				out = append(out, cssRule{selector: ssel, specificity: ssel.Specificity(), declarations: cloneDecls(decls), order: order})
-				order++
+			sel = "*"
+		}
+		group, err := cascadia.ParseGroup(sel)
+		if err != nil {
+			if cssDebug() {
+				fmt.Println("Error parsing CSS group:", err)
+			}
+			continue
+		}
+		for _, cs := range group {
+			if cs == nil || cs.PseudoElement() != "" {
+				continue
 			}
+			rules = append(rules, cssRule{selector: cs, specificity: cs.Specificity(), declarations: cloneDecls(decls), order: order, pseudo: pseudo})
+			order++
 		}
 	}
-	if len(out) == 0 {
-		return nil, startOrder
+	return rules, order
+}
+
+// splitPseudoElement separates a trailing pseudo-element from a selector,
+// accepting the legacy single-colon forms of before, after, first-line and
+// first-letter. The name is returned in lower case.
+func splitPseudoElement(sel string) (base, pseudo string) {
+	sel = strings.TrimSpace(sel)
+	lower := strings.ToLower(sel)
+	if i := strings.LastIndex(lower, "::"); i != -1 {
+		j := i + 2
+		for j < len(lower) && (isCSSIdentChar(lower[j]) || lower[j] == '-') {
+			j++
+		}
+		return sel[:i] + sel[j:], lower[i+2 : j]
 	}
-	return out, order
+	for _, name := range []string{"before", "after", "first-line", "first-letter"} {
+		if strings.HasSuffix(lower, ":"+name) {
+			return sel[:len(sel)-len(name)-1], name
+		}
+	}
+	return sel, ""
+}
+
+// hasDynamicPseudoClass reports whether a selector only matches while the
+// user interacts with the page, which a proxy render never sees.
+func hasDynamicPseudoClass(sel string) bool {
+	lower := strings.ToLower(sel)
+	for _, pc := range []string{":hover", ":focus", ":active", ":visited", ":target"} {
+		if strings.Contains(lower, pc) {
+			return true
+		}
+	}
+	return false
 }
 
 // sanitizeSelectorForCascadia removes pseudo-classes/elements (including vendor-specific)
@@ -459,7 +503,7 @@ func isCSSIdentChar(c byte) bool {
 	return (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') || c == '_' || c == '\\'
 }
 
-func cssDebug() bool { return os.Getenv("OMS_CSS_DEBUG") == "1" }
+func cssDebug() bool { return DefaultOptions().CSSDebug }
 
 func cloneDecls(src []cssDeclaration) []cssDeclaration {
 	out := make([]cssDeclaration, len(src))
@@ -827,11 +871,32 @@ func computeStyleFor(n *html.Node, ss *Stylesheet) map[string]string {
 	if ss == nil || n == nil || n.Type != html.ElementNode {
 		return nil
 	}
+	if props, ok := ss.computed[n]; ok {
+		return props
+	}
+	props := cascadeStyleFor(n, ss, "")
+	if ss.computed == nil {
+		ss.computed = make(map[*html.Node]map[string]string)
+	}
+	ss.computed[n] = props
+	return props
+}
+
+// pseudoStyleFor cascades the ::before or ::after rules matching n.
+func pseudoStyleFor(n *html.Node, ss *Stylesheet, pseudo string) map[string]string {
+	if ss == nil || n == nil || n.Type != html.ElementNode {
+		return nil
+	}
+	return cascadeStyleFor(n, ss, pseudo)
+}
 
+// cascadeStyleFor cascades the rules for n, or for its pseudo-element when
+// pseudo is set; inline styles only apply to the element itself.
+func cascadeStyleFor(n *html.Node, ss *Stylesheet, pseudo string) map[string]string {
 	props := map[string]propState{}
 
 	for _, rule := range ss.rules {
-		if rule.selector == nil || !rule.selector.Match(n) {
+		if rule.pseudo != pseudo || rule.selector == nil || !rule.selector.Match(n) {
 			continue
 		}
 		for _, decl := range rule.declarations {
@@ -839,7 +904,7 @@ func computeStyleFor(n *html.Node, ss *Stylesheet) map[string]string {
 		}
 	}
 
-	if inline := strings.TrimSpace(getAttr(n, "style")); inline != "" {
+	if inline := strings.TrimSpace(getAttr(n, "style")); pseudo == "" && inline != "" {
 		if decls, err := parser.ParseDeclarations(inline); err == nil {
 			for i, d := range decls {
 				if d == nil {
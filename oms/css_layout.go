@@ -0,0 +1,261 @@
+package oms
+
+import (
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// offscreenPx is how far past the viewport edge a positioned box must
+	// sit to count as parked off-canvas rather than nudged.
+	offscreenPx = 100
+	// layoutOverlayShare is the share of the page text from which a fixed or
+	// off-screen box is kept: it is the page itself, not an overlay.
+	layoutOverlayShare = 0.5
+	// floatMainMinRunes is the non-link text a column needs before floats
+	// around it are reordered; headers of floated logo and menu boxes stay.
+	floatMainMinRunes = 200
+)
+
+// translateArgRe captures the arguments of translate, translateX/Y and
+// translate3d in a transform value.
+var translateArgRe = regexp.MustCompile(`translate(?:x|y|3d)?\(([^)]*)\)`)
+
+// floatContainerTags are the elements whose floats are page columns or
+// asides; floated images and inline boxes stay where they are.
+var floatContainerTags = map[string]bool{
+	"div": true, "aside": true, "nav": true, "section": true, "article": true,
+	"main": true, "header": true, "footer": true, "ul": true, "ol": true,
+	"dl": true, "table": true, "form": true,
+}
+
+// linearizeCSSLayout rewrites the document body into the order a narrow
+// screen reads it in, driven by computed styles:
+//   - position:fixed boxes and boxes parked off-screen (negative offsets,
+//     translate(-100%), clip rects) are dropped, unless they hold most of
+//     the page text;
+//   - children of flex and grid containers follow their order property, and
+//     row-reverse/column-reverse flex containers run backwards;
+//   - floated columns and asides go after the main flow, or the main column
+//     goes first when it is itself floated.
+//
+// Styles are computed before any node moves and stay memoised on ss, so
+// structural selectors still see the source document during the walk.
+func linearizeCSSLayout(doc *html.Node, ss *Stylesheet, screenW int) {
+	if doc == nil || ss == nil || len(ss.rules) == 0 {
+		return
+	}
+	body := findFirstByTag(doc, "body")
+	if body == nil {
+		return
+	}
+	if screenW <= 0 {
+		screenW = 240
+	}
+	total := textWeight(body)
+	var drop []*html.Node
+	type reorder struct {
+		parent *html.Node
+		kids   []*html.Node
+	}
+	var moves []reorder
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if props := computeStyleFor(c, ss); layoutOverlay(props, screenW) &&
+				float64(textWeight(c)) < layoutOverlayShare*float64(total) {
+				drop = append(drop, c)
+				continue
+			}
+			visit(c)
+		}
+		if kids := cssChildOrder(n, ss); kids != nil {
+			moves = append(moves, reorder{parent: n, kids: kids})
+		}
+	}
+	visit(body)
+	for _, m := range moves {
+		for _, k := range m.kids {
+			m.parent.RemoveChild(k)
+		}
+		for _, k := range m.kids {
+			m.parent.AppendChild(k)
+		}
+	}
+	for _, n := range drop {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+	}
+}
+
+// layoutOverlay reports whether computed styles take a box out of the
+// reading flow: fixed positioning (cookie banners, sticky headers, chat
+// widgets) or a position off the screen (skip links, off-canvas menus).
+func layoutOverlay(props map[string]string, screenW int) bool {
+	if props == nil {
+		return false
+	}
+	position := strings.ToLower(strings.TrimSpace(props["position"]))
+	if position == "fixed" {
+		return true
+	}
+	if position == "absolute" {
+		for _, side := range []string{"left", "top", "right"} {
+			if px, ok := cssLengthToPx(props[side], screenW); ok && px <= -offscreenPx {
+				return true
+			}
+		}
+		if clip := strings.ToLower(strings.ReplaceAll(props["clip"], " ", "")); clip == "rect(0,0,0,0)" ||
+			clip == "rect(0000)" || clip == "rect(1px,1px,1px,1px)" || clip == "rect(1px1px1px1px)" {
+			return true
+		}
+		if strings.HasPrefix(strings.ToLower(strings.TrimSpace(props["clip-path"])), "inset(50%") {
+			return true
+		}
+	}
+	for _, m := range translateArgRe.FindAllStringSubmatch(strings.ToLower(props["transform"]), -1) {
+		for _, arg := range strings.Split(m[1], ",") {
+			arg = strings.TrimSpace(arg)
+			if strings.HasSuffix(arg, "%") {
+				if f, err := strconv.ParseFloat(strings.TrimSuffix(arg, "%"), 64); err == nil && f <= -100 {
+					return true
+				}
+			} else if px, ok := cssLengthToPx(arg, screenW); ok && px <= -offscreenPx {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// cssChildOrder returns the children of n in reading order, or nil when
+// source order stands.
+func cssChildOrder(n *html.Node, ss *Stylesheet) []*html.Node {
+	var kids []*html.Node
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		kids = append(kids, c)
+		if c.Type == html.ElementNode && strings.EqualFold(c.Data, "form") && c.FirstChild == nil {
+			// A stray form only owns its inputs through source order.
+			return nil
+		}
+	}
+	if len(kids) < 2 {
+		return nil
+	}
+	props := computeStyleFor(n, ss)
+	switch strings.ToLower(strings.TrimSpace(props["display"])) {
+	case "flex", "inline-flex":
+		direction := strings.ToLower(props["flex-direction"] + " " + props["flex-flow"])
+		return flexChildOrder(kids, strings.Contains(direction, "-reverse"), ss)
+	case "grid", "inline-grid":
+		return flexChildOrder(kids, false, ss)
+	}
+	return floatChildOrder(kids, ss)
+}
+
+// flexChildOrder sorts flex and grid items by their order property and
+// reverses them for row-reverse and column-reverse flex containers.
+func flexChildOrder(kids []*html.Node, reversed bool, ss *Stylesheet) []*html.Node {
+	order := make(map[*html.Node]int, len(kids))
+	moved := false
+	for _, k := range kids {
+		if v, err := strconv.Atoi(strings.TrimSpace(computeStyleFor(k, ss)["order"])); err == nil && v != 0 {
+			order[k] = v
+			moved = true
+		}
+	}
+	if !moved && !reversed {
+		return nil
+	}
+	out := append([]*html.Node(nil), kids...)
+	sort.SliceStable(out, func(i, j int) bool { return order[out[i]] < order[out[j]] })
+	if reversed {
+		for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+			out[i], out[j] = out[j], out[i]
+		}
+	}
+	return out
+}
+
+// floatChildOrder moves floated columns and asides after the main flow. The
+// heaviest of the non-floated flow and each floated container, by non-link
+// text, is the main column; when that is a float holding most of the text it
+// goes first instead.
+func floatChildOrder(kids []*html.Node, ss *Stylesheet) []*html.Node {
+	var floats []*html.Node
+	isFloat := make(map[*html.Node]bool)
+	for _, k := range kids {
+		if k.Type != html.ElementNode || !floatContainerTags[strings.ToLower(k.Data)] {
+			continue
+		}
+		switch strings.ToLower(strings.TrimSpace(computeStyleFor(k, ss)["float"])) {
+		case "left", "right", "inline-start", "inline-end":
+			floats = append(floats, k)
+			isFloat[k] = true
+		}
+	}
+	if len(floats) == 0 {
+		return nil
+	}
+	flow, total := 0, 0
+	var main *html.Node
+	mainWeight := 0
+	for _, k := range kids {
+		w := textWeight(k)
+		total += w
+		if !isFloat[k] {
+			flow += w
+		} else if w > mainWeight {
+			main, mainWeight = k, w
+		}
+	}
+	var out []*html.Node
+	switch {
+	case flow >= mainWeight && flow >= floatMainMinRunes:
+		for _, k := range kids {
+			if !isFloat[k] {
+				out = append(out, k)
+			}
+		}
+		out = append(out, floats...)
+	case main != nil && mainWeight >= floatMainMinRunes && float64(mainWeight) >= layoutMainShare*float64(total):
+		if main == kids[0] {
+			return nil
+		}
+		out = append(out, main)
+		for _, k := range kids {
+			if k != main {
+				out = append(out, k)
+			}
+		}
+	default:
+		return nil
+	}
+	for i := range out {
+		if out[i] != kids[i] {
+			return out
+		}
+	}
+	return nil
+}
+
+// textWeight counts the non-link text runes of a node.
+func textWeight(n *html.Node) int {
+	if n.Type == html.TextNode {
+		return utf8.RuneCountInString(strings.TrimSpace(n.Data))
+	}
+	if n.Type != html.ElementNode {
+		return 0
+	}
+	_, lr := linkStats(n)
+	return max(utf8.RuneCountInString(cellText(n))-lr, 0)
+}
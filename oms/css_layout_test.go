@@ -0,0 +1,98 @@
+package oms
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func payloadOrder(t *testing.T, payload []byte, texts ...string) {
+	t.Helper()
+	last := -1
+	for _, txt := range texts {
+		i := bytes.Index(payload, []byte(txt))
+		if i < 0 {
+			t.Fatalf("%q missing from the page", txt)
+		}
+		if i < last {
+			t.Fatalf("%q rendered out of order; want %q", txt, texts)
+		}
+		last = i
+	}
+}
+
+func TestCSSLayoutDropsOverlaysAndOffscreenBoxes(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "overlays",
+		url:  "http://news.test/",
+		html: `<html><head><style>
+.banner{position:fixed;bottom:0}
+.skip{position:absolute;left:-9999px}
+.sr{position:absolute;clip:rect(0 0 0 0)}
+.drawer{transform:translateX(-100%)}
+</style></head><body>
+<a class="skip" href="#main">Skip to content</a>
+<div class="drawer"><a href="/a">Drawer link</a></div>
+<p>Story text stays.</p><span class="sr">Screen reader note</span>
+<div class="banner">We use cookies</div>
+</body></html>`,
+	})
+	for _, gone := range []string{"Skip to content", "Drawer link", "Screen reader note", "We use cookies"} {
+		if bytes.Contains(res.payload, []byte(gone)) {
+			t.Errorf("%q should have been dropped", gone)
+		}
+	}
+	if !bytes.Contains(res.payload, []byte("Story text stays.")) {
+		t.Fatalf("main text missing")
+	}
+
+	// A fixed wrapper that holds the page is the page, not an overlay.
+	res = renderFixture(t, obmlFixture{
+		name: "fixed-shell",
+		url:  "http://app.test/",
+		html: `<html><head><style>#app{position:fixed;inset:0}</style></head><body><div id="app"><p>Whole application</p></div></body></html>`,
+	})
+	if !bytes.Contains(res.payload, []byte("Whole application")) {
+		t.Fatalf("a fixed shell holding the page must be kept")
+	}
+}
+
+func TestCSSLayoutMovesFloatedAsidesAfterMainFlow(t *testing.T) {
+	article := strings.Repeat("Long article sentence about the weather. ", 8)
+	res := renderFixture(t, obmlFixture{
+		name: "floats",
+		url:  "http://news.test/",
+		html: `<html><head><style>#side{float:left;width:25%}#main{margin-left:25%}img.thumb{float:right}</style></head><body>
+<div id="side"><a href="/1">Sidebar one</a> <a href="/2">Sidebar two</a></div>
+<div id="main"><img class="thumb" src="data:," alt="thumb"><p>Main start ` + article + `</p></div>
+</body></html>`,
+	})
+	payloadOrder(t, res.payload, "Main start", "Sidebar one")
+
+	// Both columns floated: the one holding most of the text goes first.
+	res = renderFixture(t, obmlFixture{
+		name: "float-columns",
+		url:  "http://news.test/",
+		html: `<html><head><style>.col{float:left}</style></head><body>
+<div class="col"><a href="/1">Menu link</a></div><div class="col"><p>Column text ` + article + `</p></div>
+</body></html>`,
+	})
+	payloadOrder(t, res.payload, "Column text", "Menu link")
+}
+
+func TestCSSLayoutHonoursFlexOrder(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "flex",
+		url:  "http://shop.test/",
+		html: `<html><head><style>
+.row{display:flex}.first{order:-1}.last{order:2}
+.stack{display:flex;flex-direction:column-reverse}
+li:first-child{font-weight:bold}
+</style></head><body>
+<div class="row"><p class="last">Gamma</p><p>Beta</p><p class="first">Alpha</p></div>
+<div class="stack"><p>Three</p><p>Two</p><p>One</p></div>
+<ul><li>Bold item</li></ul>
+</body></html>`,
+	})
+	payloadOrder(t, res.payload, "Alpha", "Beta", "Gamma", "One", "Two", "Three", "Bold item")
+}
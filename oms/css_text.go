@@ -0,0 +1,403 @@
+package oms
+
+import (
+	"strconv"
+	"strings"
+	"unicode"
+
+	"golang.org/x/net/html"
+	"golang.org/x/text/cases"
+	"golang.org/x/text/language"
+)
+
+// defaultFontPx is the medium font size of a page, which em, % and the
+// size keywords are relative to at the root.
+const defaultFontPx = 16.0
+
+const (
+	// largeFontRatio is the share of the medium size from which text reads
+	// as a heading and is set bold, as <big> is.
+	largeFontRatio = 1.125
+	// smallFontRatio is the share up to which text is small print and is set
+	// italic, as <small> is.
+	smallFontRatio = 0.85
+)
+
+// phrasingTags are the inline elements a word can continue through;
+// other elements start and end words for text-transform: capitalize.
+var phrasingTags = map[string]bool{
+	"a": true, "abbr": true, "b": true, "bdi": true, "bdo": true, "cite": true,
+	"code": true, "data": true, "dfn": true, "em": true, "font": true, "i": true,
+	"kbd": true, "mark": true, "q": true, "s": true, "samp": true, "small": true,
+	"span": true, "strong": true, "sub": true, "sup": true, "time": true, "u": true,
+	"var": true, "big": true, "tt": true, "strike": true, "del": true, "ins": true,
+	"label": true,
+}
+
+var fontSizeKeywords = map[string]float64{
+	"xx-small": 9, "x-small": 10, "small": 13, "medium": 16,
+	"large": 18, "x-large": 24, "xx-large": 32, "xxx-large": 48,
+}
+
+// cssTextStyle maps the computed font and decoration properties of n onto
+// the OBML style word cur: font-weight to the bold bit, font-style to the
+// italic bit, underline and line-through to the underline bit, and a
+// font-size that leaves the body range to bold for large text or italic
+// for small print. A size back in the body range clears the emphasis its
+// parent's size gave, unless weight or style ask for it themselves.
+func cssTextStyle(n *html.Node, ss *Stylesheet, props map[string]string, cur uint32) uint32 {
+	style := cur
+	bold, italic := false, false
+	if weight := strings.ToLower(strings.TrimSpace(cssEffectiveProp(n, ss, props, "font-weight"))); weight != "" {
+		if b, ok := fontWeightBold(weight); ok {
+			style = setStyleBit(style, styleBoldBit, b)
+			bold = b
+		}
+	}
+	if fs := strings.ToLower(strings.TrimSpace(cssEffectiveProp(n, ss, props, "font-style"))); fs != "" {
+		if strings.Contains(fs, "italic") || strings.Contains(fs, "oblique") {
+			style |= styleItalicBit
+			italic = true
+		} else if strings.Contains(fs, "normal") {
+			style &^= styleItalicBit
+		}
+	}
+	td := cssEffectiveProp(n, ss, props, "text-decoration")
+	if td == "" {
+		td = cssEffectiveProp(n, ss, props, "text-decoration-line")
+	}
+	if td = strings.ToLower(strings.TrimSpace(td)); td != "" {
+		// OBML has no strike-through bit; line-through is underlined, as
+		// <s> and <del> are.
+		if strings.Contains(td, "underline") || strings.Contains(td, "line-through") {
+			style |= styleUnderBit
+		} else if strings.Contains(td, "none") {
+			style &^= styleUnderBit
+		}
+	}
+	if strings.TrimSpace(props["font-size"]) == "" {
+		return style
+	}
+	size, parent := fontSizeClass(cssFontPx(n, ss)), fontSizeClass(cssFontPx(parentElement(n), ss))
+	switch {
+	case size == parent:
+	case size > 0:
+		style |= styleBoldBit
+		if parent < 0 && !italic {
+			style &^= styleItalicBit
+		}
+	case size < 0:
+		style |= styleItalicBit
+		if parent > 0 && !bold {
+			style &^= styleBoldBit
+		}
+	case parent > 0 && !bold:
+		style &^= styleBoldBit
+	case parent < 0 && !italic:
+		style &^= styleItalicBit
+	}
+	return style
+}
+
+// fontWeightBold reports whether a font-weight value is bold.
+func fontWeightBold(weight string) (bold, ok bool) {
+	switch weight {
+	case "bold", "bolder":
+		return true, true
+	case "normal", "lighter":
+		return false, true
+	}
+	if n, err := strconv.Atoi(weight); err == nil && n > 0 {
+		return n >= 600, true
+	}
+	return false, false
+}
+
+func setStyleBit(style, bit uint32, on bool) uint32 {
+	if on {
+		return style | bit
+	}
+	return style &^ bit
+}
+
+// fontSizeClass is 1 for heading-size text, -1 for small print and 0 for
+// body text.
+func fontSizeClass(px float64) int {
+	switch {
+	case px >= largeFontRatio*defaultFontPx:
+		return 1
+	case px <= smallFontRatio*defaultFontPx:
+		return -1
+	}
+	return 0
+}
+
+// cssFontPx resolves the computed font-size of n in pixels. Relative sizes
+// follow the parent's size; values we cannot resolve inherit it.
+func cssFontPx(n *html.Node, ss *Stylesheet) float64 {
+	if n == nil || ss == nil {
+		return defaultFontPx
+	}
+	v := strings.ToLower(strings.TrimSpace(computeStyleFor(n, ss)["font-size"]))
+	v = strings.TrimSpace(strings.TrimSuffix(v, "!important"))
+	if v == "" || v == "inherit" {
+		return cssFontPx(parentElement(n), ss)
+	}
+	if px, ok := fontSizeKeywords[v]; ok {
+		return px
+	}
+	parent := func() float64 { return cssFontPx(parentElement(n), ss) }
+	switch v {
+	case "larger":
+		return parent() * 1.2
+	case "smaller":
+		return parent() / 1.2
+	case "initial", "unset":
+		return defaultFontPx
+	}
+	num := func(suffix string) (float64, bool) {
+		if !strings.HasSuffix(v, suffix) {
+			return 0, false
+		}
+		f, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(v, suffix)), 64)
+		return f, err == nil && f >= 0
+	}
+	if f, ok := num("rem"); ok {
+		return f * defaultFontPx
+	}
+	if f, ok := num("px"); ok {
+		return f
+	}
+	if f, ok := num("pt"); ok {
+		return f * 96 / 72
+	}
+	if f, ok := num("em"); ok {
+		return f * parent()
+	}
+	if f, ok := num("%"); ok {
+		return f / 100 * parent()
+	}
+	if f, ok := num("ex"); ok {
+		return f / 2 * parent()
+	}
+	if f, ok := num("ch"); ok {
+		return f / 2 * parent()
+	}
+	return parent()
+}
+
+func parentElement(n *html.Node) *html.Node {
+	for p := n.Parent; p != nil; p = p.Parent {
+		if p.Type == html.ElementNode {
+			return p
+		}
+	}
+	return nil
+}
+
+// whiteSpaceMode is how a text run keeps its white space.
+type whiteSpaceMode int
+
+const (
+	whiteSpaceNormal  whiteSpaceMode = iota // runs collapse to one space
+	whiteSpacePreLine                       // line breaks kept, spaces collapse
+	whiteSpacePre                           // kept as written
+)
+
+// whiteSpaceFor returns the white-space mode of the text children of n: the
+// nearest white-space declaration on n or its ancestors, up to the nearest
+// pre or code element, decides; otherwise text inside pre and code keeps
+// its white space, as pre reports.
+func whiteSpaceFor(n *html.Node, ss *Stylesheet, pre bool) whiteSpaceMode {
+	for a := n; a != nil && ss != nil; a = a.Parent {
+		if a.Type != html.ElementNode {
+			continue
+		}
+		props := computeStyleFor(a, ss)
+		if v := strings.ToLower(strings.TrimSpace(props["white-space-collapse"])); v != "" {
+			switch {
+			case strings.HasPrefix(v, "preserve-breaks"):
+				return whiteSpacePreLine
+			case strings.HasPrefix(v, "preserve"), strings.HasPrefix(v, "break-spaces"):
+				return whiteSpacePre
+			case strings.HasPrefix(v, "collapse"):
+				return whiteSpaceNormal
+			}
+		}
+		switch v := strings.ToLower(strings.TrimSpace(props["white-space"])); {
+		case v == "":
+		case strings.HasPrefix(v, "pre-line"):
+			return whiteSpacePreLine
+		case strings.HasPrefix(v, "pre"), strings.HasPrefix(v, "break-spaces"):
+			return whiteSpacePre
+		case strings.HasPrefix(v, "normal"), strings.HasPrefix(v, "nowrap"):
+			return whiteSpaceNormal
+		}
+		if tag := strings.ToLower(a.Data); tag == "pre" || tag == "code" {
+			break
+		}
+	}
+	if pre {
+		return whiteSpacePre
+	}
+	return whiteSpaceNormal
+}
+
+// collapseWhiteSpace applies a white-space mode to text. Collapsed runs keep
+// a single space at either edge, which separates the text from its inline
+// neighbours.
+func collapseWhiteSpace(s string, mode whiteSpaceMode) string {
+	if mode == whiteSpacePre {
+		return s
+	}
+	s = strings.ReplaceAll(s, "\r\n", "\n")
+	var b strings.Builder
+	space, brk := false, false
+	flush := func() {
+		switch {
+		case brk:
+			b.WriteByte('\n')
+		case space:
+			b.WriteByte(' ')
+		}
+		space, brk = false, false
+	}
+	for _, r := range s {
+		switch r {
+		case '\n', '\r':
+			if mode == whiteSpacePreLine {
+				if brk {
+					b.WriteByte('\n')
+				}
+				brk = true
+			} else {
+				space = true
+			}
+		case ' ', '\t', '\f':
+			space = true
+		default:
+			flush()
+			b.WriteRune(r)
+		}
+	}
+	flush()
+	return b.String()
+}
+
+// applyTextTransforms rewrites the text of the document as text-transform
+// and font-variant display it: uppercase, lowercase and capitalize, with
+// small capitals shown as capitals. Case mapping follows the lang of the
+// text, so Turkish dotted i and German sharp s come out right. Form values
+// taken from text (textarea, option) keep their case.
+func applyTextTransforms(doc *html.Node, ss *Stylesheet) {
+	if doc == nil || ss == nil {
+		return
+	}
+	t := &textTransformer{ss: ss, casers: map[string]cases.Caser{}, prev: ' '}
+	t.walk(doc, "", false, "")
+}
+
+type textTransformer struct {
+	ss     *Stylesheet
+	casers map[string]cases.Caser
+	// prev is the last rune transformed, so capitalize sees words that
+	// span elements.
+	prev rune
+}
+
+func (t *textTransformer) walk(n *html.Node, transform string, caps bool, lang string) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		switch c.Type {
+		case html.TextNode:
+			c.Data = t.apply(c.Data, transform, caps, lang)
+		case html.ElementNode:
+			switch strings.ToLower(c.Data) {
+			case "script", "style", "textarea", "option", "head":
+				continue
+			}
+			props := computeStyleFor(c, t.ss)
+			tr, cp, lg := transform, caps, lang
+			switch v := strings.ToLower(strings.TrimSpace(props["text-transform"])); {
+			case v == "":
+			case strings.HasPrefix(v, "uppercase"), strings.HasPrefix(v, "lowercase"), strings.HasPrefix(v, "capitalize"):
+				tr = strings.Fields(v)[0]
+			default:
+				tr = ""
+			}
+			variant := props["font-variant-caps"]
+			if variant == "" {
+				variant = props["font-variant"]
+			}
+			if v := strings.ToLower(strings.TrimSpace(variant)); v != "" {
+				cp = strings.Contains(v, "small-caps") || strings.Contains(v, "petite-caps") || strings.Contains(v, "unicase")
+			}
+			if l := strings.TrimSpace(getAttr(c, "lang")); l != "" {
+				lg = l
+			}
+			display := strings.ToLower(strings.TrimSpace(props["display"]))
+			block := !strings.HasPrefix(display, "inline") && (display != "" || !phrasingTags[strings.ToLower(c.Data)])
+			if block {
+				t.prev = ' '
+			}
+			t.walk(c, tr, cp, lg)
+			if block {
+				t.prev = ' '
+			}
+		}
+	}
+}
+
+// apply transforms one text run. Small capitals win over text-transform,
+// since either way every letter shows as a capital.
+func (t *textTransformer) apply(s, transform string, caps bool, lang string) string {
+	if caps {
+		transform = "uppercase"
+	}
+	defer func() {
+		if r := []rune(s); len(r) > 0 {
+			t.prev = r[len(r)-1]
+		}
+	}()
+	switch transform {
+	case "uppercase":
+		s = t.caser(lang, true).String(s)
+	case "lowercase":
+		s = t.caser(lang, false).String(s)
+	case "capitalize":
+		out := []rune(s)
+		prev := t.prev
+		for i, r := range out {
+			if unicode.IsLetter(r) && !inWord(prev) {
+				out[i] = unicode.ToTitle(r)
+			}
+			prev = r
+		}
+		s = string(out)
+	}
+	return s
+}
+
+// inWord reports whether a letter following r continues a word; an
+// apostrophe does not start one ("don't" capitalises to "Don't").
+func inWord(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || unicode.IsMark(r) || r == '\'' || r == '’'
+}
+
+func (t *textTransformer) caser(lang string, upper bool) cases.Caser {
+	key := lang
+	if upper {
+		key = "U:" + lang
+	}
+	if c, ok := t.casers[key]; ok {
+		return c
+	}
+	tag := language.Make(lang)
+	var c cases.Caser
+	if upper {
+		c = cases.Upper(tag)
+	} else {
+		c = cases.Lower(tag)
+	}
+	t.casers[key] = c
+	return c
+}
@@ -0,0 +1,361 @@
+package oms
+
+import (
+	"net/http"
+	"net/url"
+	"strings"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	formEnctypeURLEncoded = "application/x-www-form-urlencoded"
+	formEnctypeText       = "text/plain"
+)
+
+// FormSpec is the registry entry of one rendered form: everything a desktop
+// browser uses to build its submission. The proxy keeps these per client and
+// passes the submitted form back in RenderOptions.Form.
+type FormSpec struct {
+	Action        string // absolute action URL
+	Method        string // http.MethodGet or http.MethodPost
+	Enctype       string // urlencoded, multipart/form-data or text/plain
+	AcceptCharset string
+	// Charset is the encoding the form submits with: the first usable
+	// accept-charset label, else the charset of the page it was rendered from.
+	Charset string
+	Fields  []FormField // controls in document order
+}
+
+// FormField is one control of a form. A select contributes one field per
+// option; Checked marks the options selected by default.
+type FormField struct {
+	Name     string
+	Type     string // input type, or "select", "textarea"; buttons use their type
+	Value    string // default value (value attribute for buttons)
+	Checked  bool
+	Disabled bool
+}
+
+// formPair is one entry of a form data set.
+type formPair struct {
+	name, value string
+	file        bool
+}
+
+func newFormSpec(form *html.Node, action string) *FormSpec {
+	spec := &FormSpec{Action: action, Method: http.MethodGet, Enctype: formEnctypeURLEncoded}
+	if strings.EqualFold(strings.TrimSpace(getAttr(form, "method")), "post") {
+		spec.Method = http.MethodPost
+		switch enctype := strings.ToLower(strings.TrimSpace(getAttr(form, "enctype"))); {
+		case isMultipartEnctype(enctype):
+			spec.Enctype = formEnctypeMultipart
+		case enctype == formEnctypeText:
+			spec.Enctype = formEnctypeText
+		}
+	}
+	spec.AcceptCharset = strings.TrimSpace(getAttr(form, "accept-charset"))
+	return spec
+}
+
+// FileFields returns the names of the form's file inputs.
+func (f *FormSpec) FileFields() []string {
+	var out []string
+	for _, fld := range f.Fields {
+		if fld.Type == "file" && fld.Name != "" && !fld.Disabled {
+			out = append(out, fld.Name)
+		}
+	}
+	return out
+}
+
+// Has reports whether the form has a control named name.
+func (f *FormSpec) Has(name string) bool {
+	for _, fld := range f.Fields {
+		if fld.Name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// openForm starts form n in the page and makes it the innermost open form.
+func (st *walkState) openForm(n *html.Node, base string, p *Page) {
+	action := getAttr(n, "action")
+	p.AddForm(action)
+	st.formStack = append(st.formStack, resolveFormActionURL(base, action))
+	spec := newFormSpec(n, st.formActionKey(base))
+	p.Forms = append(p.Forms, spec)
+	st.forms = append(st.forms, spec)
+}
+
+// closeForm ends the innermost open form.
+func (st *walkState) closeForm() {
+	if len(st.formStack) > 0 {
+		st.formStack = st.formStack[:len(st.formStack)-1]
+	}
+	if len(st.forms) > 0 {
+		st.forms = st.forms[:len(st.forms)-1]
+	}
+}
+
+// formActionKey returns the absolute action of the innermost open form, the
+// key FormHidden is recorded under.
+func (st *walkState) formActionKey(base string) string {
+	if len(st.formStack) == 0 {
+		return ""
+	}
+	actionKey := strings.TrimSpace(st.formStack[len(st.formStack)-1])
+	if actionKey == "" {
+		actionKey = resolveFormActionURL(base, "")
+	}
+	return actionKey
+}
+
+// recordField adds a control to the innermost open form. Controls that are
+// disabled themselves or sit in a disabled fieldset are kept but marked, so
+// a payload naming them is not mistaken for unknown fields.
+func (st *walkState) recordField(n *html.Node, fld FormField) {
+	if len(st.forms) == 0 {
+		return
+	}
+	fld.Disabled = boolAttr(n, "disabled") || inDisabledFieldset(n)
+	spec := st.forms[len(st.forms)-1]
+	spec.Fields = append(spec.Fields, fld)
+}
+
+func inDisabledFieldset(n *html.Node) bool {
+	for a := n.Parent; a != nil; a = a.Parent {
+		if a.Type == html.ElementNode && strings.EqualFold(a.Data, "fieldset") && boolAttr(a, "disabled") {
+			return true
+		}
+	}
+	return false
+}
+
+// recordSelect adds one field per option of a select; a single select with
+// nothing selected submits its first option, as browsers do.
+func (st *walkState) recordSelect(sel *html.Node, name string, multiple bool) {
+	first := len(st.forms) > 0
+	selected := false
+	for oc := sel.FirstChild; oc != nil; oc = oc.NextSibling {
+		if oc.Type == html.ElementNode && strings.EqualFold(oc.Data, "option") && boolAttr(oc, "selected") {
+			selected = true
+		}
+	}
+	for oc := sel.FirstChild; oc != nil; oc = oc.NextSibling {
+		if oc.Type != html.ElementNode || !strings.EqualFold(oc.Data, "option") {
+			continue
+		}
+		val := getAttr(oc, "value")
+		if val == "" {
+			val = strings.TrimSpace(collectText(oc))
+		}
+		checked := boolAttr(oc, "selected") || (first && !selected && !multiple)
+		first = false
+		st.recordField(sel, FormField{Name: name, Type: "select", Value: val, Checked: checked})
+	}
+}
+
+// parseFormPayload splits an Opera Mini form payload into name/value pairs,
+// dropping the client's own opf/opa/action markers.
+func parseFormPayload(payload string) []formPair {
+	var out []formPair
+	for _, part := range strings.Split(payload, "&") {
+		if part == "" {
+			continue
+		}
+		rawKey, rawVal, _ := strings.Cut(part, "=")
+		key, err := url.QueryUnescape(rawKey)
+		if err != nil {
+			key = rawKey
+		}
+		val, err := url.QueryUnescape(rawVal)
+		if err != nil {
+			val = rawVal
+		}
+		key = strings.TrimSpace(key)
+		if key == "" || looksLikeActionKey(key) {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "opf", "opa", "action":
+			continue
+		}
+		out = append(out, formPair{name: key, value: val})
+	}
+	return out
+}
+
+// pressedSubmit returns the index of the submit button the client pressed:
+// the one whose name and value are in the payload, else one whose name is,
+// else the form's first submit button, which browsers use for implicit
+// submission. Unnamed buttons arrive under the walker's "dname".
+func (f *FormSpec) pressedSubmit(sent map[string][]string) int {
+	first, byName := -1, -1
+	for i, fld := range f.Fields {
+		if fld.Type != "submit" || fld.Disabled {
+			continue
+		}
+		if first < 0 {
+			first = i
+		}
+		key := fld.Name
+		if key == "" {
+			key = "dname"
+		}
+		vals, ok := sent[key]
+		if !ok {
+			continue
+		}
+		for _, v := range vals {
+			if v == fld.Value {
+				return i
+			}
+		}
+		if byName < 0 {
+			byName = i
+		}
+	}
+	if byName >= 0 {
+		return byName
+	}
+	return first
+}
+
+// dataSet replays a client payload against the form the way a desktop
+// browser builds its form data set: controls in document order, disabled
+// and unnamed controls and unpressed buttons left out, and controls the
+// client did not send restored to their defaults. Checkboxes and radios the
+// client left out are unchecked and stay out. Payload entries the form does
+// not know, such as proxy overrides, are kept at the end.
+func (f *FormSpec) dataSet(payload string) []formPair {
+	pairs := parseFormPayload(payload)
+	sent := make(map[string][]string, len(pairs))
+	for _, kv := range pairs {
+		sent[kv.name] = append(sent[kv.name], kv.value)
+	}
+	submitter := f.pressedSubmit(sent)
+	var out []formPair
+	seen := make(map[string]bool)
+	for i, fld := range f.Fields {
+		if fld.Name == "" || fld.Disabled {
+			continue
+		}
+		switch fld.Type {
+		case "submit":
+			if i == submitter {
+				out = append(out, formPair{name: fld.Name, value: fld.Value})
+			}
+			continue
+		case "reset", "button":
+			continue
+		}
+		if seen[fld.Name] {
+			continue
+		}
+		seen[fld.Name] = true
+		file := fld.Type == "file"
+		if vals, ok := sent[fld.Name]; ok {
+			for _, v := range vals {
+				out = append(out, formPair{name: fld.Name, value: v, file: file})
+			}
+			continue
+		}
+		for _, d := range f.Fields[i:] {
+			if d.Name != fld.Name || d.Disabled {
+				continue
+			}
+			switch d.Type {
+			case "select":
+				if d.Checked {
+					out = append(out, formPair{name: d.Name, value: d.Value})
+				}
+			case "checkbox", "radio", "submit", "reset", "button":
+			default:
+				out = append(out, formPair{name: d.Name, value: d.Value, file: file})
+			}
+		}
+	}
+	for _, kv := range pairs {
+		if kv.name != "dname" && !f.Has(kv.name) {
+			out = append(out, kv)
+		}
+	}
+	return out
+}
+
+// setFormCharsets fills in the submit charset of every form of a page.
+func setFormCharsets(forms []*FormSpec, pageCharset string) {
+	for _, f := range forms {
+		f.Charset = formCharset(f.AcceptCharset, pageCharset)
+	}
+}
+
+// encodeDataSet transcodes names and values from the client's UTF-8 to the
+// form charset. A hidden _charset_ field left empty is given the charset
+// name, as browsers do.
+func (f *FormSpec) encodeDataSet(data []formPair) []formPair {
+	cs := f.Charset
+	if cs == "" {
+		cs = "utf-8"
+	}
+	for i, kv := range data {
+		if kv.file {
+			continue
+		}
+		if kv.name == "_charset_" && kv.value == "" {
+			data[i].value = cs
+			continue
+		}
+		data[i].name = encodeCharset(kv.name, cs)
+		data[i].value = encodeCharset(kv.value, cs)
+	}
+	return data
+}
+
+// submission builds the origin request for a payload submitted from f.
+func (f *FormSpec) submission(payload string, files map[string]*FormUpload) *formSubmission {
+	data := f.encodeDataSet(f.dataSet(payload))
+	target, err := url.Parse(f.Action)
+	if err != nil {
+		return nil
+	}
+	target.Fragment = ""
+	if f.Method != http.MethodPost {
+		target.RawQuery = encodeURLEncoded(data)
+		return &formSubmission{Method: http.MethodGet, URL: target.String()}
+	}
+	sub := &formSubmission{Method: http.MethodPost, URL: target.String()}
+	switch f.Enctype {
+	case formEnctypeMultipart:
+		body, ct, err := encodeMultipartBody(data, files)
+		if err != nil {
+			return nil
+		}
+		sub.Body, sub.ContentType = body, ct
+	case formEnctypeText:
+		var b strings.Builder
+		for _, kv := range data {
+			b.WriteString(kv.name + "=" + kv.value + "\r\n")
+		}
+		sub.Body, sub.ContentType = b.String(), formEnctypeText
+	default:
+		sub.Body, sub.ContentType = encodeURLEncoded(data), formEnctypeURLEncoded
+	}
+	return sub
+}
+
+// encodeURLEncoded encodes a form data set in order, unlike url.Values.
+func encodeURLEncoded(data []formPair) string {
+	var b strings.Builder
+	for i, kv := range data {
+		if i > 0 {
+			b.WriteByte('&')
+		}
+		b.WriteString(url.QueryEscape(kv.name))
+		b.WriteByte('=')
+		b.WriteString(url.QueryEscape(kv.value))
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package oms
+
+import (
+	"bytes"
+	"log/slog"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+const registryFixtureHTML = `<html><body>
+<form action="/search?old=1#top" accept-charset="windows-1251"><input name="q" value="opera"><input type="submit" value="Go"></form>
+<form action="/reply" method="POST">
+<input type="hidden" name="ck" value="abc">
+<textarea name="body">Quote</textarea>
+<select name="topic"><option value="1">News</option><option value="2">Help</option></select>
+<input type="checkbox" name="notify" value="yes" checked>
+<input name="nick" value="guest" disabled>
+<fieldset disabled><input name="legacy" value="x"></fieldset>
+<input type="submit" name="act" value="Preview">
+<input type="submit" name="act" value="Post">
+<button>Unnamed</button>
+</form></body></html>`
+
+func TestFormRegistryRecordsControls(t *testing.T) {
+	res := renderFixture(t, obmlFixture{name: "registry", url: "http://board.test/topic/7", html: registryFixtureHTML})
+	if len(res.page.Forms) != 2 {
+		t.Fatalf("expected two forms, got %d", len(res.page.Forms))
+	}
+	search, reply := res.page.Forms[0], res.page.Forms[1]
+	if search.Method != http.MethodGet || search.AcceptCharset != "windows-1251" || search.Action != "http://board.test/search?old=1" {
+		t.Fatalf("unexpected search form %+v", search)
+	}
+	if reply.Method != http.MethodPost || reply.Action != "http://board.test/reply" {
+		t.Fatalf("unexpected reply form %+v", reply)
+	}
+	want := []FormField{
+		{Name: "ck", Type: "hidden", Value: "abc"},
+		{Name: "body", Type: "textarea", Value: "Quote"},
+		{Name: "topic", Type: "select", Value: "1", Checked: true},
+		{Name: "topic", Type: "select", Value: "2"},
+		{Name: "notify", Type: "checkbox", Value: "yes", Checked: true},
+		{Name: "nick", Type: "text", Value: "guest", Disabled: true},
+		{Name: "legacy", Type: "text", Value: "x", Disabled: true},
+		{Name: "act", Type: "submit", Value: "Preview"},
+		{Name: "act", Type: "submit", Value: "Post"},
+		{Name: "", Type: "submit", Value: ""},
+	}
+	if len(reply.Fields) != len(want) {
+		t.Fatalf("expected %d fields, got %+v", len(want), reply.Fields)
+	}
+	for i, w := range want {
+		if reply.Fields[i] != w {
+			t.Errorf("field %d: got %+v, want %+v", i, reply.Fields[i], w)
+		}
+	}
+}
+
+func TestFormRegistryReplaysBrowserSubmission(t *testing.T) {
+	res := renderFixture(t, obmlFixture{name: "registry", url: "http://board.test/topic/7", html: registryFixtureHTML})
+	search, reply := res.page.Forms[0], res.page.Forms[1]
+
+	// The pressed button is sent alone; disabled fields, the walker's
+	// placeholder name and unchecked boxes stay out; fields the client did
+	// not send fall back to their defaults; unknown entries go last.
+	sub := prepareOperaMiniSubmission("http://board.test/topic/7",
+		"nick=bob&legacy=y&body=Hello+there&act=Post&dname=Unnamed&udm=2&opf=1", reply, nil, "", slog.Default())
+	if sub.Method != http.MethodPost || sub.URL != "http://board.test/reply" {
+		t.Fatalf("unexpected target %s %s", sub.Method, sub.URL)
+	}
+	if want := "ck=abc&body=Hello+there&topic=1&act=Post&udm=2"; sub.Body != want {
+		t.Fatalf("body = %q, want %q", sub.Body, want)
+	}
+	if sub.ContentType != "application/x-www-form-urlencoded" {
+		t.Fatalf("content type = %q", sub.ContentType)
+	}
+
+	// Without a named button in the payload the first submit button is the
+	// implicit submitter. GET forms replace the action's query string.
+	sub = prepareOperaMiniSubmission("http://board.test/topic/7", "q=mini+browser&opf=1", search, nil, "", slog.Default())
+	if sub.Method != http.MethodGet || sub.URL != "http://board.test/search?q=mini+browser" {
+		t.Fatalf("unexpected GET submission %+v", sub)
+	}
+	sub = prepareOperaMiniSubmission("http://board.test/topic/7", "body=Hi", reply, nil, "", slog.Default())
+	if want := "ck=abc&body=Hi&topic=1&act=Preview"; sub.Body != want {
+		t.Fatalf("implicit submission body = %q, want %q", sub.Body, want)
+	}
+}
+
+func TestGuessedPostIsLoggedThroughRenderLogger(t *testing.T) {
+	var buf bytes.Buffer
+	lg := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	sub := prepareOperaMiniSubmission("http://board.test/login", "user=bob&password=secret", nil, nil, "", lg)
+	if sub == nil || sub.Method != http.MethodPost {
+		t.Fatalf("expected a login form to be posted, got %+v", sub)
+	}
+	if !strings.Contains(buf.String(), "form submission forced to POST") {
+		t.Fatalf("expected the override in the render logger, got %q", buf.String())
+	}
+}
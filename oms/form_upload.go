@@ -0,0 +1,84 @@
+package oms
+
+import (
+	"bytes"
+	"fmt"
+	"mime/multipart"
+	"net/textproto"
+	"strings"
+)
+
+const formEnctypeMultipart = "multipart/form-data"
+
+// UploadSlot is a file the client may attach to an <input type=file>. The
+// proxy offers the files it kept from the client's earlier downloads.
+type UploadSlot struct {
+	ID   string
+	Name string
+}
+
+// FormUpload is the file sent for one file input of a multipart form.
+type FormUpload struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+func isMultipartEnctype(enctype string) bool {
+	mt, _, _ := strings.Cut(enctype, ";")
+	return strings.EqualFold(strings.TrimSpace(mt), formEnctypeMultipart)
+}
+
+// addFileInput renders a file input as a choice between the client's upload
+// slots and "(no file)", which submits the input empty. The choice depends
+// on the client, so the page is kept out of the shared render cache.
+func addFileInput(p *Page, name string, slots []UploadSlot) {
+	p.BeginSelect(name, false, len(slots)+1)
+	p.AddOption("", "(no file)", true)
+	for _, slot := range slots {
+		p.AddOption(slot.ID, slot.Name, false)
+	}
+	p.EndSelect()
+	p.NoCache = true
+}
+
+var quoteEscaper = strings.NewReplacer("\\", "\\\\", `"`, "\\\"")
+
+// encodeMultipartBody encodes a form data set as multipart/form-data. File
+// entries carry the upload picked for them; without one they are sent as an
+// empty part with no file name, the way browsers submit a blank file input.
+func encodeMultipartBody(data []formPair, files map[string]*FormUpload) (body, contentType string, err error) {
+	var buf bytes.Buffer
+	w := multipart.NewWriter(&buf)
+	for _, kv := range data {
+		if !kv.file {
+			if err := w.WriteField(kv.name, kv.value); err != nil {
+				return "", "", err
+			}
+			continue
+		}
+		up := files[kv.name]
+		if up == nil {
+			up = &FormUpload{}
+		}
+		ct := strings.TrimSpace(up.ContentType)
+		if ct == "" {
+			ct = "application/octet-stream"
+		}
+		h := make(textproto.MIMEHeader)
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="%s"; filename="%s"`,
+			quoteEscaper.Replace(kv.name), quoteEscaper.Replace(up.Filename)))
+		h.Set("Content-Type", ct)
+		part, err := w.CreatePart(h)
+		if err != nil {
+			return "", "", err
+		}
+		if _, err := part.Write(up.Data); err != nil {
+			return "", "", err
+		}
+	}
+	if err := w.Close(); err != nil {
+		return "", "", err
+	}
+	return buf.String(), w.FormDataContentType(), nil
+}
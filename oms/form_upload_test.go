@@ -0,0 +1,91 @@
+package oms
+
+import (
+	"bytes"
+	"io"
+	"log/slog"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestFileInputOffersUploadSlots(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "upload",
+		url:  "http://forum.test/topic",
+		html: `<html><body><form action="/post" method="post" enctype="multipart/form-data">` +
+			`<input type="hidden" name="ck" value="42"><input name="subject"><input type="file" name="attach">` +
+			`<input type="submit" value="Send"></form>` +
+			`<form action="/search" enctype="multipart/form-data"><input name="q"></form></body></html>`,
+		opts: &RenderOptions{UploadSlots: []UploadSlot{{ID: "f1", Name: "photo.jpg (2 KB)"}}},
+	})
+	if len(res.page.Forms) != 2 {
+		t.Fatalf("expected two registered forms, got %d", len(res.page.Forms))
+	}
+	post, search := res.page.Forms[0], res.page.Forms[1]
+	if post.Action != "http://forum.test/post" || post.Enctype != "multipart/form-data" {
+		t.Fatalf("unexpected post form %+v", post)
+	}
+	if search.Enctype != "application/x-www-form-urlencoded" {
+		t.Fatalf("GET forms must not be multipart, got %q", search.Enctype)
+	}
+	if files := post.FileFields(); len(files) != 1 || files[0] != "attach" {
+		t.Fatalf("expected file input attach, got %v", files)
+	}
+	if !bytes.Contains(res.payload, []byte("photo.jpg (2 KB)")) || !bytes.Contains(res.payload, []byte("(no file)")) {
+		t.Fatalf("expected upload slot choices in the page")
+	}
+	if !res.page.NoCache {
+		t.Fatalf("pages with per-client upload slots must not be cached")
+	}
+}
+
+func TestMultipartSubmissionAttachesFiles(t *testing.T) {
+	form := &FormSpec{
+		Action:  "http://forum.test/post",
+		Method:  http.MethodPost,
+		Enctype: formEnctypeMultipart,
+		Fields: []FormField{
+			{Name: "subject", Type: "text"},
+			{Name: "attach", Type: "file"},
+			{Name: "extra", Type: "file"},
+			{Name: "send", Type: "submit", Value: "Send"},
+		},
+	}
+	files := map[string]*FormUpload{
+		"attach": {Filename: `a "b".txt`, ContentType: "text/plain", Data: []byte("file body")},
+	}
+	sub := prepareOperaMiniSubmission(form.Action, "subject=Hi&attach=f1&extra=&opf=1", form, files, "", slog.Default())
+	if sub == nil || sub.Method != http.MethodPost {
+		t.Fatalf("multipart forms must be posted, got %+v", sub)
+	}
+	mt, params, err := mime.ParseMediaType(sub.ContentType)
+	if err != nil || mt != "multipart/form-data" {
+		t.Fatalf("unexpected content type %q", sub.ContentType)
+	}
+	r := multipart.NewReader(strings.NewReader(sub.Body), params["boundary"])
+	parsed, err := r.ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := parsed.Value["subject"]; len(got) != 1 || got[0] != "Hi" {
+		t.Fatalf("subject = %v", got)
+	}
+	if _, ok := parsed.Value["attach"]; ok {
+		t.Fatalf("the slot ID must not be sent as a text field")
+	}
+	fh := parsed.File["attach"]
+	if len(fh) != 1 || fh[0].Filename != `a "b".txt` || fh[0].Header.Get("Content-Type") != "text/plain" {
+		t.Fatalf("unexpected file part %+v", fh)
+	}
+	f, _ := fh[0].Open()
+	data, _ := io.ReadAll(f)
+	if string(data) != "file body" {
+		t.Fatalf("file data = %q", data)
+	}
+	if !strings.Contains(sub.Body, `name="extra"; filename=""`) {
+		t.Fatalf("expected an empty placeholder part for a blank file input:\n%s", sub.Body)
+	}
+}
@@ -0,0 +1,240 @@
+package oms
+
+import (
+	"bytes"
+	"image"
+	"image/gif"
+	"image/jpeg"
+	"image/png"
+	"math"
+	"strings"
+
+	"golang.org/x/image/draw"
+)
+
+const (
+	// defaultPageImageBytes is the image budget of a render when the
+	// handset does not report its heap.
+	defaultPageImageBytes = 192 << 10
+	minPageImageBytes     = 16 << 10
+	maxPageImageBytes     = 1 << 20
+	// heapImageShare is the part of the reported heap (1/n) the images of
+	// one render may take.
+	heapImageShare = 8
+	// Bytes per displayed pixel a content image may take at normal and
+	// high image quality.
+	lowQualityBytesPerPixel  = 0.15
+	highQualityBytesPerPixel = 0.4
+	// decorativeImageBytes caps icons, bullets and CSS backgrounds, which
+	// may also take at most 1/decorativeShare of what is left.
+	decorativeImageBytes = 2 << 10
+	decorativeShare      = 8
+	// decorativeImageSide is the largest box drawn as decoration.
+	decorativeImageSide = 48
+	// minImageBytes is the smallest target an image is fitted to.
+	minImageBytes  = 768
+	minJPEGQuality = 15
+	// minImageSide stops downscaling; a smaller image is not worth sending.
+	minImageSide = 16
+)
+
+// imageBudget is the byte budget of the images of one render. The page
+// budget follows the handset heap (m: in d=) and the image-quality setting;
+// each image gets a share of it by its displayed size relative to the
+// screen, with decorative images held to a small cap so content images get
+// the bulk.
+type imageBudget struct {
+	remaining  int
+	fullScreen int // bytes a full-screen content image may use
+	maxImage   int // MaxInlineKB in bytes (0 = none)
+	screenArea int
+}
+
+func newImageBudget(prefs RenderOptions) *imageBudget {
+	total := defaultPageImageBytes
+	if heap := prefs.HeapBytes; heap > 0 {
+		if heap < 64<<10 {
+			// No handset runs in under 64KB; such a value is in KB.
+			heap <<= 10
+		}
+		total = min(max(heap/heapImageShare, minPageImageBytes), maxPageImageBytes)
+	}
+	perPixel := lowQualityBytesPerPixel
+	if prefs.HighQuality {
+		total = total * 3 / 2
+		perPixel = highQualityBytesPerPixel
+	}
+	w, h := prefs.ScreenW, prefs.ScreenH
+	if w <= 0 {
+		w = 240
+	}
+	if h <= 0 {
+		h = w * 4 / 3
+	}
+	return &imageBudget{
+		remaining:  total,
+		fullScreen: int(float64(w*h) * perPixel),
+		maxImage:   max(prefs.MaxInlineKB, 0) * 1024,
+		screenArea: w * h,
+	}
+}
+
+// target returns the bytes an image displayed at w x h may take now; 0
+// means the budget is spent.
+func (b *imageBudget) target(w, h int, decorative bool) int {
+	share := 1.0
+	if w > 0 && h > 0 {
+		share = math.Min(1, float64(w*h)/float64(b.screenArea))
+	}
+	t := max(int(share*float64(b.fullScreen)), minImageBytes)
+	if decorative {
+		t = min(t, decorativeImageBytes, b.remaining/decorativeShare)
+	} else {
+		t = min(t, b.remaining)
+	}
+	if b.maxImage > 0 {
+		t = min(t, b.maxImage)
+	}
+	if t < minImageBytes/2 {
+		return 0
+	}
+	return t
+}
+
+// fitImage makes an encoded image fit this render's budget, re-encoding it
+// at a lower quality or size when it is over, and charges it. Without a
+// budget only MaxInlineKB applies. background marks CSS backgrounds, which
+// are decorative whatever their size; other images are when they are icon
+// sized. ok is false when the image cannot be fitted and becomes a
+// placeholder.
+func (o RenderOptions) fitImage(data []byte, w, h int, background bool) ([]byte, int, int, bool) {
+	b := o.imageBytes
+	if b == nil {
+		if o.MaxInlineKB > 0 && len(data) > o.MaxInlineKB*1024 {
+			return data, w, h, false
+		}
+		return data, w, h, true
+	}
+	decorative := background || (w <= decorativeImageSide && h <= decorativeImageSide)
+	target := b.target(w, h, decorative)
+	if target == 0 {
+		return data, w, h, false
+	}
+	if len(data) > target {
+		img, _, err := image.Decode(bytes.NewReader(data))
+		if err != nil {
+			return data, w, h, false
+		}
+		out, nw, nh, _, _, err := encodeImageWithin(img, o, target)
+		if err != nil || len(out) > target {
+			return data, w, h, false
+		}
+		data, w, h = out, nw, nh
+	}
+	b.remaining -= len(data)
+	return data, w, h, true
+}
+
+// encodeImageWithin encodes img like encodeImage, but keeps the result
+// within maxBytes (0 = no limit). The returned format may be PNG where JPEG
+// was asked for, see encodeForDevice. JPEG quality is binary-searched down from
+// the client's setting, and when even the lowest quality is too large the
+// image is downscaled by a quarter and tried again.
+func encodeImageWithin(img image.Image, prefs RenderOptions, maxBytes int) ([]byte, int, int, string, int, error) {
+	img, w, h := clampImageToScreenWidth(img, prefs.ScreenW)
+	if depthFor(prefs).alpha == 1 {
+		img = flattenImage(img)
+	}
+
+	want := strings.ToLower(strings.TrimSpace(prefs.ImageMIME))
+	if want == "" {
+		want = "image/jpeg"
+	}
+	if want == "image/jpeg" && imageHasAlpha(img) {
+		want = "image/png"
+	}
+	for {
+		data, format, quality, err := encodeForDevice(img, want, prefs, maxBytes)
+		if err != nil {
+			return nil, 0, 0, format, quality, err
+		}
+		if maxBytes <= 0 || len(data) <= maxBytes || w <= minImageSide || h <= minImageSide {
+			return data, w, h, format, quality, nil
+		}
+		nw, nh := max(w*3/4, 1), max(h*3/4, 1)
+		dst := image.NewRGBA(image.Rect(0, 0, nw, nh))
+		draw.CatmullRom.Scale(dst, dst.Bounds(), img, img.Bounds(), draw.Over, nil)
+		img, w, h = dst, nw, nh
+	}
+}
+
+// gifColors is the palette size of GIF images.
+func gifColors(prefs RenderOptions) int {
+	if prefs.HighQuality {
+		return 256
+	}
+	return 128
+}
+
+// encodeImageAs encodes img in format want. For JPEG with a byte limit it
+// returns the highest quality up to the client's that fits, or the lowest
+// quality when none does.
+func encodeImageAs(img image.Image, want string, prefs RenderOptions, maxBytes int) ([]byte, int, error) {
+	var out bytes.Buffer
+	switch want {
+	case "image/png":
+		enc := png.Encoder{CompressionLevel: png.DefaultCompression}
+		if prefs.HighQuality {
+			enc.CompressionLevel = png.BestCompression
+		}
+		if err := enc.Encode(&out, img); err != nil {
+			return nil, 0, err
+		}
+		return append([]byte(nil), out.Bytes()...), 0, nil
+	case "image/gif":
+		options := &gif.Options{NumColors: gifColors(prefs)}
+		if pm, ok := img.(*image.Paletted); ok {
+			options.NumColors = max(options.NumColors, len(pm.Palette))
+		}
+		if err := gif.Encode(&out, img, options); err != nil {
+			return nil, 0, err
+		}
+		return append([]byte(nil), out.Bytes()...), 0, nil
+	}
+	encode := func(q int) ([]byte, error) {
+		out.Reset()
+		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: q}); err != nil {
+			return nil, err
+		}
+		return append([]byte(nil), out.Bytes()...), nil
+	}
+	quality := jpegQualityFor(prefs)
+	data, err := encode(quality)
+	if err != nil || maxBytes <= 0 || len(data) <= maxBytes {
+		return data, quality, err
+	}
+	// Largest quality in [lo, hi] that fits; best holds its encoding.
+	lo, hi := minJPEGQuality, quality-1
+	var best []byte
+	bestQ := minJPEGQuality
+	for lo <= hi {
+		q := (lo + hi) / 2
+		d, err := encode(q)
+		if err != nil {
+			return nil, q, err
+		}
+		if len(d) <= maxBytes {
+			best, bestQ = d, q
+			lo = q + 1
+		} else {
+			hi = q - 1
+			if q == minJPEGQuality {
+				best, bestQ = d, q
+			}
+		}
+	}
+	if best == nil {
+		best, err = encode(minJPEGQuality)
+	}
+	return best, bestQ, err
+}
@@ -0,0 +1,136 @@
+package oms
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/jpeg"
+	"image/png"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+// noisyImage is hard to compress, so byte limits bite.
+func noisyImage(w, h int) *image.RGBA {
+	rng := rand.New(rand.NewSource(1))
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			img.Set(x, y, color.RGBA{uint8(rng.Intn(256)), uint8(x), uint8(y), 0xFF})
+		}
+	}
+	return img
+}
+
+func TestEncodeImageWithinSearchesQualityThenDownscales(t *testing.T) {
+	prefs := defaultRenderPrefs()
+	prefs.ScreenW = 240
+	img := noisyImage(200, 150)
+
+	full, w, _, _, q, err := encodeImageWithin(img, prefs, 0)
+	if err != nil || w != 200 || q != jpegQualityFor(prefs) {
+		t.Fatalf("unlimited encode: w=%d q=%d err=%v", w, q, err)
+	}
+
+	limit := len(full) * 2 / 3
+	data, w, _, _, q, err := encodeImageWithin(img, prefs, limit)
+	if err != nil || len(data) > limit {
+		t.Fatalf("expected at most %d bytes, got %d (err %v)", limit, len(data), err)
+	}
+	if w != 200 || q >= jpegQualityFor(prefs) || q < minJPEGQuality {
+		t.Fatalf("expected a lower quality at full size, got w=%d q=%d", w, q)
+	}
+
+	data, w, h, _, q, err := encodeImageWithin(img, prefs, 1500)
+	if err != nil || len(data) > 1500 {
+		t.Fatalf("expected at most 1500 bytes, got %d (err %v)", len(data), err)
+	}
+	if w >= 200 || q != minJPEGQuality {
+		t.Fatalf("expected a downscaled image at minimum quality, got %dx%d q=%d", w, h, q)
+	}
+	if cfg, err := jpeg.DecodeConfig(bytes.NewReader(data)); err != nil || cfg.Width != w || cfg.Height != h {
+		t.Fatalf("encoded size %+v does not match reported %dx%d (err %v)", cfg, w, h, err)
+	}
+}
+
+func TestImageBudgetFollowsDevice(t *testing.T) {
+	prefs := defaultRenderPrefs()
+	prefs.ScreenW, prefs.ScreenH = 240, 320
+	prefs.MaxInlineKB = 0
+
+	if b := newImageBudget(prefs); b.remaining != defaultPageImageBytes {
+		t.Fatalf("unknown heap: budget %d, want %d", b.remaining, defaultPageImageBytes)
+	}
+	prefs.HeapBytes = 1 << 20
+	low := newImageBudget(prefs)
+	if low.remaining != (1<<20)/heapImageShare {
+		t.Fatalf("1MB heap: budget %d", low.remaining)
+	}
+	prefs.HeapBytes = 1 << 10 // 1024KB
+	if b := newImageBudget(prefs); b.remaining != low.remaining {
+		t.Fatalf("heap in KB: budget %d, want %d", b.remaining, low.remaining)
+	}
+	prefs.HeapBytes = 80 << 10
+	if b := newImageBudget(prefs); b.remaining != minPageImageBytes {
+		t.Fatalf("tiny heap: budget %d, want the %d floor", b.remaining, minPageImageBytes)
+	}
+	prefs.HeapBytes = 1 << 20
+	prefs.HighQuality = true
+	high := newImageBudget(prefs)
+	if high.remaining <= low.remaining || high.fullScreen <= low.fullScreen {
+		t.Fatalf("high quality should get more bytes: %+v vs %+v", high, low)
+	}
+
+	content := low.target(240, 180, false)
+	half := low.target(120, 90, false)
+	icon := low.target(16, 16, true)
+	if content <= half || half < minImageBytes || icon > decorativeImageBytes || icon >= content {
+		t.Fatalf("targets content=%d half=%d icon=%d", content, half, icon)
+	}
+	low.remaining = 100
+	if got := low.target(240, 180, false); got != 0 {
+		t.Fatalf("spent budget should refuse images, got target %d", got)
+	}
+}
+
+func TestRenderFitsImagesIntoHeapBudget(t *testing.T) {
+	useTempDiskCache(t)
+	var body bytes.Buffer
+	if err := png.Encode(&body, noisyImage(240, 180)); err != nil {
+		t.Fatal(err)
+	}
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(body.Bytes())
+	}))
+	defer origin.Close()
+
+	var page strings.Builder
+	for _, name := range []string{"a", "b", "c", "d", "e", "f"} {
+		page.WriteString(`<p>photo</p><img src="/` + name + `.png" alt="` + name + `">`)
+	}
+	opts := defaultRenderPrefs()
+	opts.ScreenW, opts.ScreenH = 240, 320
+	opts.HeapBytes = 160 << 10 // a 20KB page budget
+	res := renderFixture(t, obmlFixture{name: "budget", url: origin.URL + "/", html: page.String(), opts: &opts})
+
+	total := 0
+	for _, tok := range res.tokensByTag('I') {
+		total += len(tok.extra)
+		if len(tok.extra) > opts.MaxInlineKB*1024 {
+			t.Fatalf("image of %d bytes exceeds MaxInlineKB", len(tok.extra))
+		}
+	}
+	if n := res.countTag('I'); n < 2 {
+		t.Fatalf("expected the first images inline, got %d", n)
+	}
+	if total > 20<<10 {
+		t.Fatalf("inline images take %d bytes, over the 20KB budget", total)
+	}
+	if res.countTag('I')+res.countTag('J') != 6 {
+		t.Fatalf("expected every image inline or as a placeholder, got I=%d J=%d", res.countTag('I'), res.countTag('J'))
+	}
+}
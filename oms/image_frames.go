@@ -0,0 +1,520 @@
+package oms
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/binary"
+	"hash/crc32"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"io"
+	"math"
+
+	"golang.org/x/image/draw"
+	"golang.org/x/image/webp"
+)
+
+// Frame selections of Options.ImageFrames.
+const (
+	framesAuto  = "auto"
+	framesFirst = "first"
+	framesLast  = "last"
+	framesStrip = "strip"
+)
+
+const (
+	// maxAnimFrames and maxAnimPixels bound the work of compositing an
+	// animation; frames past the limit are ignored, and larger canvases
+	// fall back to the first frame.
+	maxAnimFrames = 100
+	maxAnimPixels = 1 << 21
+	// stripFrames is the number of frames in a contact sheet, stripGap the
+	// white space between them.
+	stripFrames = 4
+	stripGap    = 2
+	// blankDeviation is the luma standard deviation under which a frame
+	// counts as blank.
+	blankDeviation = 4
+)
+
+// Frame disposal, applied after a frame is shown.
+const (
+	disposeNone       = iota
+	disposeBackground // clear the frame's area
+	disposePrevious   // restore the area to what it was before the frame
+)
+
+// animFrame is a frame of an animation, decoded on demand.
+type animFrame struct {
+	rect    image.Rectangle // area of the canvas the frame covers
+	over    bool            // blend onto the canvas rather than replace it
+	dispose int
+	decode  func() (image.Image, error)
+}
+
+// animation is an animated GIF, APNG or WebP. OM clients cannot animate,
+// so it is reduced to one static image.
+type animation struct {
+	w, h   int
+	frames []animFrame
+}
+
+// framesKey is appended to the image cache format, so images made static
+// one way are not served for another. The default selection adds nothing.
+func framesKey(prefs RenderOptions) string {
+	mode := prefs.engine().imageFrames()
+	if mode == framesAuto {
+		return ""
+	}
+	return ";frames=" + mode
+}
+
+// decodeImageBytes decodes a fetched image. SVG documents, gzipped or not,
+// are rasterised at their own size scaled down to the screen width, and
+// animations are reduced to the frame or contact sheet the engine options
+// select.
+func decodeImageBytes(raw []byte, contentType string, prefs RenderOptions) (image.Image, error) {
+	if len(raw) > 2 && raw[0] == 0x1f && raw[1] == 0x8b {
+		if zr, err := gzip.NewReader(bytes.NewReader(raw)); err == nil {
+			if unzipped, err := io.ReadAll(zr); err == nil && isSVG(unzipped, contentType) {
+				raw = unzipped
+			}
+		}
+	}
+	if isSVG(raw, contentType) {
+		root, err := parseSVG(raw)
+		if err != nil {
+			return nil, err
+		}
+		return rasterizeSVG(root, 0, 0, prefs.ScreenW, color.NRGBA{A: 0xFF})
+	}
+	if anim := decodeAnimation(raw); anim != nil {
+		if img := anim.static(prefs); img != nil {
+			return img, nil
+		}
+	}
+	img, _, err := image.Decode(bytes.NewReader(raw))
+	return img, err
+}
+
+// decodeAnimation returns the frames of an animated image, or nil when raw
+// is a still image or the animation is too large to composite.
+func decodeAnimation(raw []byte) *animation {
+	var a *animation
+	switch {
+	case bytes.HasPrefix(raw, []byte("GIF8")):
+		a = gifAnimation(raw)
+	case bytes.HasPrefix(raw, []byte(pngHeader)):
+		a = apngAnimation(raw)
+	case len(raw) >= 12 && string(raw[:4]) == "RIFF" && string(raw[8:12]) == "WEBP":
+		a = webpAnimation(raw)
+	}
+	if a == nil || len(a.frames) < 2 || a.w <= 0 || a.h <= 0 || int64(a.w)*int64(a.h) > maxAnimPixels {
+		return nil
+	}
+	return a
+}
+
+func gifAnimation(raw []byte) *animation {
+	cfg, err := gif.DecodeConfig(bytes.NewReader(raw))
+	if err != nil || cfg.Width <= 0 || cfg.Height <= 0 || cfg.Width*cfg.Height > maxAnimPixels {
+		return nil
+	}
+	g, err := gif.DecodeAll(bytes.NewReader(gifFramesPrefix(raw, maxAnimFrames)))
+	if err != nil || len(g.Image) < 2 {
+		return nil
+	}
+	a := &animation{w: g.Config.Width, h: g.Config.Height}
+	for i, fr := range g.Image {
+		f := animFrame{rect: fr.Bounds(), over: true, decode: func() (image.Image, error) { return fr, nil }}
+		if i < len(g.Disposal) {
+			switch g.Disposal[i] {
+			case gif.DisposalBackground:
+				// Browsers clear to transparent, not the background colour.
+				f.dispose = disposeBackground
+			case gif.DisposalPrevious:
+				f.dispose = disposePrevious
+			}
+		}
+		a.frames = append(a.frames, f)
+	}
+	return a
+}
+
+// gifFramesPrefix returns raw cut after its first n images and closed with
+// a trailer, so later frames are never decoded. Files it cannot follow are
+// returned unchanged for the decoder to reject.
+func gifFramesPrefix(raw []byte, n int) []byte {
+	if len(raw) < 13 {
+		return raw
+	}
+	p := 13
+	if raw[10]&0x80 != 0 {
+		p += 3 << (raw[10]&7 + 1)
+	}
+	// subBlocks skips data sub-blocks up to and including the terminator.
+	subBlocks := func(p int) int {
+		for p < len(raw) && raw[p] != 0 {
+			p += int(raw[p]) + 1
+		}
+		return p + 1
+	}
+	for images := 0; p < len(raw); {
+		switch raw[p] {
+		case 0x21: // extension: label, then sub-blocks
+			p = subBlocks(p + 2)
+		case 0x2C: // image descriptor, local colour table, LZW code size, data
+			if p+10 > len(raw) {
+				return raw
+			}
+			flags := raw[p+9]
+			p += 10
+			if flags&0x80 != 0 {
+				p += 3 << (flags&7 + 1)
+			}
+			p = subBlocks(p + 1)
+			if images++; images == n && p < len(raw) {
+				return append(raw[:p:p], 0x3B)
+			}
+		default:
+			return raw
+		}
+	}
+	return raw
+}
+
+const pngHeader = "\x89PNG\r\n\x1a\n"
+
+// apngAnimation reads the frames of an APNG. Each frame is decoded by
+// wrapping its image data in a PNG of its own, with the header, palette
+// and transparency chunks of the file.
+func apngAnimation(raw []byte) *animation {
+	type apngFrame struct {
+		fctl []byte
+		data []byte
+	}
+	var ihdr []byte
+	var shared [][]byte
+	var frames []*apngFrame
+	animated := false
+	for p := raw[len(pngHeader):]; len(p) >= 12; {
+		n := binary.BigEndian.Uint32(p)
+		if uint64(n)+12 > uint64(len(p)) {
+			break
+		}
+		typ, data := string(p[4:8]), p[8:8+n]
+		p = p[12+n:]
+		cur := (*apngFrame)(nil)
+		if len(frames) > 0 {
+			cur = frames[len(frames)-1]
+		}
+		switch typ {
+		case "IHDR":
+			ihdr = data
+		case "acTL":
+			animated = true
+		case "fcTL":
+			if len(data) < 26 {
+				return nil
+			}
+			frames = append(frames, &apngFrame{fctl: data})
+		case "IDAT":
+			// The default image is the first frame only when a frame
+			// control chunk precedes it.
+			if cur != nil {
+				cur.data = append(cur.data, data...)
+			}
+		case "fdAT":
+			if cur != nil && len(data) > 4 {
+				cur.data = append(cur.data, data[4:]...)
+			}
+		case "PLTE", "tRNS", "gAMA", "cHRM", "sRGB", "iCCP", "sBIT":
+			shared = append(shared, pngChunk(typ, data))
+		}
+	}
+	if !animated || len(ihdr) != 13 {
+		return nil
+	}
+	// The header dimensions are bounded before they become ints, so the
+	// area check cannot overflow.
+	iw, ih := binary.BigEndian.Uint32(ihdr), binary.BigEndian.Uint32(ihdr[4:])
+	if iw > maxAnimPixels || ih > maxAnimPixels {
+		return nil
+	}
+	a := &animation{w: int(iw), h: int(ih)}
+	for i, fr := range frames {
+		if len(fr.data) == 0 {
+			continue
+		}
+		c := fr.fctl
+		w, h := binary.BigEndian.Uint32(c[4:]), binary.BigEndian.Uint32(c[8:])
+		x, y := binary.BigEndian.Uint32(c[12:]), binary.BigEndian.Uint32(c[16:])
+		if w == 0 || h == 0 || uint64(x)+uint64(w) > uint64(a.w) || uint64(y)+uint64(h) > uint64(a.h) {
+			return nil
+		}
+		f := animFrame{
+			rect: image.Rect(int(x), int(y), int(x+w), int(y+h)),
+			over: c[25] == 1,
+		}
+		switch c[24] {
+		case 1:
+			f.dispose = disposeBackground
+		case 2:
+			if i > 0 {
+				f.dispose = disposePrevious
+			} else {
+				f.dispose = disposeBackground
+			}
+		}
+		header := append([]byte(nil), ihdr...)
+		binary.BigEndian.PutUint32(header, w)
+		binary.BigEndian.PutUint32(header[4:], h)
+		data := fr.data
+		f.decode = func() (image.Image, error) {
+			var b bytes.Buffer
+			b.WriteString(pngHeader)
+			b.Write(pngChunk("IHDR", header))
+			for _, chunk := range shared {
+				b.Write(chunk)
+			}
+			b.Write(pngChunk("IDAT", data))
+			b.Write(pngChunk("IEND", nil))
+			return png.Decode(&b)
+		}
+		a.frames = append(a.frames, f)
+	}
+	return a
+}
+
+// pngChunk encodes a PNG chunk with its length and checksum.
+func pngChunk(typ string, data []byte) []byte {
+	out := make([]byte, 0, len(data)+12)
+	out = binary.BigEndian.AppendUint32(out, uint32(len(data)))
+	out = append(out, typ...)
+	out = append(out, data...)
+	return binary.BigEndian.AppendUint32(out, crc32.ChecksumIEEE(out[4:]))
+}
+
+// webpAnimation reads the frames of an animated WebP. Each ANMF frame is
+// decoded as a WebP file of its own.
+func webpAnimation(raw []byte) *animation {
+	u24 := func(b []byte) int { return int(b[0]) | int(b[1])<<8 | int(b[2])<<16 }
+	a := &animation{}
+	animated := false
+	for p := raw[12:]; len(p) >= 8; {
+		typ, n := string(p[:4]), binary.LittleEndian.Uint32(p[4:8])
+		if uint64(n) > uint64(len(p)-8) {
+			break
+		}
+		data := p[8 : 8+n]
+		p = p[8+n:]
+		if n%2 == 1 && len(p) > 0 {
+			p = p[1:]
+		}
+		switch typ {
+		case "VP8X":
+			if len(data) < 10 {
+				return nil
+			}
+			animated = data[0]&0x02 != 0
+			a.w, a.h = 1+u24(data[4:]), 1+u24(data[7:])
+		case "ANMF":
+			if len(data) < 16 {
+				continue
+			}
+			x, y := 2*u24(data), 2*u24(data[3:])
+			w, h := 1+u24(data[6:]), 1+u24(data[9:])
+			flags := data[15]
+			payload := data[16:]
+			a.frames = append(a.frames, animFrame{
+				rect:    image.Rect(x, y, x+w, y+h),
+				over:    flags&0x02 == 0,
+				dispose: int(flags & 0x01), // disposeBackground when set
+				decode: func() (image.Image, error) {
+					return webp.Decode(bytes.NewReader(webpFrameFile(payload, w, h)))
+				},
+			})
+		}
+	}
+	if !animated {
+		return nil
+	}
+	return a
+}
+
+// webpFrameFile wraps the chunks of an ANMF frame in a WebP file. Frames
+// with an ALPH chunk need the extended header to carry it.
+func webpFrameFile(payload []byte, w, h int) []byte {
+	var body bytes.Buffer
+	body.WriteString("WEBP")
+	if bytes.HasPrefix(payload, []byte("ALPH")) {
+		body.WriteString("VP8X")
+		body.Write([]byte{10, 0, 0, 0, 0x10, 0, 0, 0})
+		body.Write([]byte{byte(w - 1), byte((w - 1) >> 8), byte((w - 1) >> 16)})
+		body.Write([]byte{byte(h - 1), byte((h - 1) >> 8), byte((h - 1) >> 16)})
+	}
+	body.Write(payload)
+	out := []byte("RIFF")
+	out = binary.LittleEndian.AppendUint32(out, uint32(body.Len()))
+	return append(out, body.Bytes()...)
+}
+
+// play composites the frames in order, calling visit with the canvas as
+// each frame is shown; visit returns false to stop. The canvas is reused,
+// so visit must copy what it keeps. A frame that fails to decode ends the
+// animation.
+func (a *animation) play(visit func(i int, canvas *image.RGBA) bool) {
+	canvas := image.NewRGBA(image.Rect(0, 0, a.w, a.h))
+	for i, f := range a.frames[:min(len(a.frames), maxAnimFrames)] {
+		img, err := f.decode()
+		if err != nil {
+			return
+		}
+		r := f.rect.Intersect(canvas.Rect)
+		var saved *image.RGBA
+		if f.dispose == disposePrevious {
+			saved = image.NewRGBA(r)
+			draw.Draw(saved, r, canvas, r.Min, draw.Src)
+		}
+		op := draw.Over
+		if !f.over {
+			op = draw.Src
+		}
+		draw.Draw(canvas, r, img, img.Bounds().Min.Add(r.Min.Sub(f.rect.Min)), op)
+		if !visit(i, canvas) {
+			return
+		}
+		switch f.dispose {
+		case disposeBackground:
+			draw.Draw(canvas, r, image.Transparent, image.Point{}, draw.Src)
+		case disposePrevious:
+			draw.Draw(canvas, r, saved, r.Min, draw.Src)
+		}
+	}
+}
+
+// static reduces the animation to the image Options.ImageFrames selects.
+// "auto" takes the most detailed frame, preferring later ones on a tie
+// since first frames are often blank or a loading state, and the last
+// frame when all are blank. nil means no frame could be decoded.
+func (a *animation) static(prefs RenderOptions) image.Image {
+	n := min(len(a.frames), maxAnimFrames)
+	mode := prefs.engine().imageFrames()
+	if mode == framesStrip {
+		return a.strip(n, prefs.ScreenW)
+	}
+	var best, last *image.RGBA
+	bestScore := 0.0
+	a.play(func(i int, canvas *image.RGBA) bool {
+		switch mode {
+		case framesFirst:
+			best = cloneRGBA(canvas)
+			return false
+		case framesAuto:
+			if s := frameDetail(canvas); s > 0 && s >= bestScore {
+				best, bestScore = cloneRGBA(canvas), s
+			}
+		}
+		if i == n-1 {
+			last = cloneRGBA(canvas)
+		}
+		return true
+	})
+	if best != nil && mode != framesLast {
+		return best
+	}
+	if last != nil {
+		return last
+	}
+	if best != nil {
+		return best
+	}
+	return nil
+}
+
+// strip lays up to stripFrames evenly spaced frames side by side within
+// maxW pixels, skipping blank frames when others remain.
+func (a *animation) strip(n, maxW int) image.Image {
+	if maxW <= 0 {
+		maxW = 240
+	}
+	k := min(n, stripFrames)
+	tw := max(min(a.w, (maxW-stripGap*(k-1))/k), 1)
+	th := max(a.h*tw/a.w, 1)
+	var thumbs, blank []*image.RGBA
+	a.play(func(i int, canvas *image.RGBA) bool {
+		t := image.NewRGBA(image.Rect(0, 0, tw, th))
+		draw.ApproxBiLinear.Scale(t, t.Rect, canvas, canvas.Rect, draw.Src, nil)
+		if frameDetail(canvas) > 0 {
+			thumbs = append(thumbs, t)
+		} else {
+			blank = append(blank, t)
+		}
+		return true
+	})
+	if len(thumbs) == 0 {
+		thumbs = blank
+	}
+	if len(thumbs) == 0 {
+		return nil
+	}
+	k = min(k, len(thumbs))
+	out := image.NewRGBA(image.Rect(0, 0, k*tw+(k-1)*stripGap, th))
+	draw.Draw(out, out.Rect, image.White, image.Point{}, draw.Src)
+	for j := 0; j < k; j++ {
+		idx := 0
+		if k > 1 {
+			idx = j * (len(thumbs) - 1) / (k - 1)
+		}
+		x := j * (tw + stripGap)
+		draw.Draw(out, image.Rect(x, 0, x+tw, th), thumbs[idx], image.Point{}, draw.Over)
+	}
+	return out
+}
+
+// frameDetail scores how much a frame shows: 0 for a blank frame (nearly
+// uniform once composited onto white), otherwise 1 plus the mean luma
+// difference between neighbouring pixels of a small copy.
+func frameDetail(img *image.RGBA) float64 {
+	b := img.Bounds()
+	scale := math.Min(1, 64/float64(max(b.Dx(), b.Dy())))
+	w, h := max(int(float64(b.Dx())*scale), 1), max(int(float64(b.Dy())*scale), 1)
+	small := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(small, small.Rect, image.White, image.Point{}, draw.Src)
+	draw.ApproxBiLinear.Scale(small, small.Rect, img, b, draw.Over, nil)
+
+	luma := make([]float64, w*h)
+	var sum, sq float64
+	for i := range luma {
+		p := small.Pix[i*4 : i*4+3]
+		v := 0.299*float64(p[0]) + 0.587*float64(p[1]) + 0.114*float64(p[2])
+		luma[i] = v
+		sum += v
+		sq += v * v
+	}
+	mean := sum / float64(len(luma))
+	if math.Sqrt(math.Max(sq/float64(len(luma))-mean*mean, 0)) < blankDeviation {
+		return 0
+	}
+	var edges float64
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := luma[y*w+x]
+			if x+1 < w {
+				edges += math.Abs(v - luma[y*w+x+1])
+			}
+			if y+1 < h {
+				edges += math.Abs(v - luma[(y+1)*w+x])
+			}
+		}
+	}
+	return 1 + edges/float64(len(luma))
+}
+
+func cloneRGBA(img *image.RGBA) *image.RGBA {
+	out := image.NewRGBA(img.Rect)
+	copy(out.Pix, img.Pix)
+	return out
+}
@@ -0,0 +1,388 @@
+package oms
+
+import (
+	"bytes"
+	"encoding/binary"
+	"image"
+	"image/color"
+	"image/color/palette"
+	"image/gif"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+var (
+	white = color.RGBA{0xFF, 0xFF, 0xFF, 0xFF}
+	gray  = color.RGBA{0xBB, 0xBB, 0xBB, 0xFF}
+	red   = color.RGBA{0xFF, 0, 0, 0xFF}
+	blue  = color.RGBA{0, 0, 0xFF, 0xFF}
+	green = color.RGBA{0, 0xFF, 0, 0xFF}
+)
+
+func gifFrame(r image.Rectangle, at func(x, y int) color.Color) *image.Paletted {
+	img := image.NewPaletted(r, palette.Plan9)
+	for y := r.Min.Y; y < r.Max.Y; y++ {
+		for x := r.Min.X; x < r.Max.X; x++ {
+			img.Set(x, y, at(x, y))
+		}
+	}
+	return img
+}
+
+// loadingGIF is a 40x30 animation: a blank white frame, a fine red/blue
+// checkerboard, a coarse green/white split over it, and a plain gray frame.
+func loadingGIF(t *testing.T) []byte {
+	t.Helper()
+	full := image.Rect(0, 0, 40, 30)
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			gifFrame(full, func(x, y int) color.Color { return white }),
+			gifFrame(image.Rect(0, 0, 40, 16), func(x, y int) color.Color {
+				if (x/4+y/4)%2 == 0 {
+					return red
+				}
+				return blue
+			}),
+			gifFrame(image.Rect(0, 16, 40, 30), func(x, y int) color.Color {
+				if y < 23 {
+					return green
+				}
+				return white
+			}),
+			gifFrame(full, func(x, y int) color.Color { return gray }),
+		},
+		Delay:    []int{10, 10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalNone, gif.DisposalNone, gif.DisposalNone},
+	}
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, g); err != nil {
+		t.Fatal(err)
+	}
+	return out.Bytes()
+}
+
+func framesPrefs(mode string) RenderOptions {
+	prefs := defaultRenderPrefs()
+	prefs.ScreenW = 100
+	prefs.Engine = &Options{ImageFrames: mode}
+	return prefs
+}
+
+func sameColor(c color.Color, want color.RGBA) bool {
+	r, g, b, a := c.RGBA()
+	return r>>8 == uint32(want.R) && g>>8 == uint32(want.G) && b>>8 == uint32(want.B) && a>>8 == uint32(want.A)
+}
+
+func TestAnimatedGIFFrameSelection(t *testing.T) {
+	raw := loadingGIF(t)
+	cases := []struct {
+		mode string
+		at   image.Point
+		want color.RGBA
+	}{
+		{framesAuto, image.Pt(1, 1), red},
+		{framesAuto, image.Pt(5, 1), blue},
+		{framesFirst, image.Pt(1, 1), white},
+		{framesLast, image.Pt(1, 1), gray},
+	}
+	for _, tc := range cases {
+		img, err := decodeImageBytes(raw, "image/gif", framesPrefs(tc.mode))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 40 || b.Dy() != 30 {
+			t.Fatalf("%s: size %v", tc.mode, b)
+		}
+		if c := img.At(tc.at.X, tc.at.Y); !sameColor(c, tc.want) {
+			t.Errorf("%s: pixel %v is %v, want %v", tc.mode, tc.at, c, tc.want)
+		}
+	}
+
+	// The strip skips the blank first and last frames: two 23x17 thumbnails.
+	img, err := decodeImageBytes(raw, "image/gif", framesPrefs(framesStrip))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 2*23+stripGap || b.Dy() != 17 {
+		t.Fatalf("strip size %v", b)
+	}
+	if c := img.At(23, 5); !sameColor(c, white) {
+		t.Fatalf("gap between thumbnails is %v", c)
+	}
+	if c := img.At(40, 12); !sameColor(c, green) {
+		t.Fatalf("second thumbnail should show the green frame, got %v", c)
+	}
+}
+
+func TestGIFAnimationLimits(t *testing.T) {
+	// Alternate palettes so every other frame carries a local colour table.
+	bw := color.Palette{color.Black, color.White}
+	g := &gif.GIF{}
+	for i := 0; i < maxAnimFrames+50; i++ {
+		fr := gifFrame(image.Rect(0, 0, 4, 4), func(x, y int) color.Color { return white })
+		if i%2 == 1 {
+			fr = image.NewPaletted(fr.Rect, bw)
+		}
+		g.Image = append(g.Image, fr)
+		g.Delay = append(g.Delay, 5)
+	}
+	var out bytes.Buffer
+	if err := gif.EncodeAll(&out, g); err != nil {
+		t.Fatal(err)
+	}
+	cut, err := gif.DecodeAll(bytes.NewReader(gifFramesPrefix(out.Bytes(), maxAnimFrames)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(cut.Image) != maxAnimFrames {
+		t.Fatalf("prefix kept %d frames, want %d", len(cut.Image), maxAnimFrames)
+	}
+	if a := gifAnimation(out.Bytes()); a == nil || len(a.frames) != maxAnimFrames {
+		t.Fatalf("animation should stop after %d frames", maxAnimFrames)
+	}
+
+	big := &gif.GIF{
+		Image:  g.Image[:2],
+		Delay:  g.Delay[:2],
+		Config: image.Config{ColorModel: color.Palette(palette.Plan9), Width: 2048, Height: 2048},
+	}
+	out.Reset()
+	if err := gif.EncodeAll(&out, big); err != nil {
+		t.Fatal(err)
+	}
+	if gifAnimation(out.Bytes()) != nil {
+		t.Fatalf("oversized canvas should not be decoded as an animation")
+	}
+}
+
+// apngFile assembles an APNG from frames placed at the given offsets.
+func apngFile(t *testing.T, w, h int, frames []image.Image, at []image.Point, dispose []byte) []byte {
+	t.Helper()
+	var out bytes.Buffer
+	out.WriteString(pngHeader)
+	seq := uint32(0)
+	for i, fr := range frames {
+		var enc bytes.Buffer
+		if err := png.Encode(&enc, fr); err != nil {
+			t.Fatal(err)
+		}
+		var ihdr, idat []byte
+		for p := enc.Bytes()[len(pngHeader):]; len(p) >= 12; {
+			n := binary.BigEndian.Uint32(p)
+			switch string(p[4:8]) {
+			case "IHDR":
+				ihdr = append([]byte(nil), p[8:8+n]...)
+			case "IDAT":
+				idat = append(idat, p[8:8+n]...)
+			}
+			p = p[12+n:]
+		}
+		if i == 0 {
+			binary.BigEndian.PutUint32(ihdr, uint32(w))
+			binary.BigEndian.PutUint32(ihdr[4:], uint32(h))
+			out.Write(pngChunk("IHDR", ihdr))
+			actl := binary.BigEndian.AppendUint32(nil, uint32(len(frames)))
+			out.Write(pngChunk("acTL", binary.BigEndian.AppendUint32(actl, 0)))
+		}
+		b := fr.Bounds()
+		fctl := binary.BigEndian.AppendUint32(nil, seq)
+		for _, v := range []int{b.Dx(), b.Dy(), at[i].X, at[i].Y} {
+			fctl = binary.BigEndian.AppendUint32(fctl, uint32(v))
+		}
+		fctl = append(fctl, 0, 10, 0, 100, dispose[i], 1)
+		out.Write(pngChunk("fcTL", fctl))
+		seq++
+		if i == 0 {
+			out.Write(pngChunk("IDAT", idat))
+		} else {
+			out.Write(pngChunk("fdAT", append(binary.BigEndian.AppendUint32(nil, seq), idat...)))
+			seq++
+		}
+	}
+	out.Write(pngChunk("IEND", nil))
+	return out.Bytes()
+}
+
+func TestAPNGFrameSelection(t *testing.T) {
+	checker := image.NewNRGBA(image.Rect(0, 0, 10, 10))
+	for y := 0; y < 10; y++ {
+		for x := 0; x < 10; x++ {
+			if (x+y)%2 == 0 {
+				checker.Set(x, y, color.Black)
+			}
+		}
+	}
+	redBox := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	for i := 0; i < len(redBox.Pix); i += 4 {
+		copy(redBox.Pix[i:], []byte{0xFF, 0, 0, 0xFF})
+	}
+	// Frames of an APNG share one colour type; keep every frame RGBA.
+	redBox.Pix[len(redBox.Pix)-1] = 0x80
+	frames := []image.Image{image.NewNRGBA(image.Rect(0, 0, 20, 20)), checker, redBox}
+	// The checkerboard is disposed to the background, so the last frame
+	// is a lone red square.
+	raw := apngFile(t, 20, 20, frames, []image.Point{{}, {5, 5}, {0, 0}}, []byte{1, 1, 0})
+
+	img, err := decodeImageBytes(raw, "image/png", framesPrefs(framesAuto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 20 {
+		t.Fatalf("size %v", b)
+	}
+	if c := img.At(5, 5); !sameColor(c, color.RGBA{0, 0, 0, 0xFF}) {
+		t.Fatalf("expected the checkerboard frame, got %v at 5,5", c)
+	}
+	if _, _, _, a := img.At(1, 1).RGBA(); a != 0 {
+		t.Fatalf("area outside the frame should stay transparent")
+	}
+
+	img, err = decodeImageBytes(raw, "image/png", framesPrefs(framesLast))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(1, 1); !sameColor(c, red) {
+		t.Fatalf("last frame pixel %v", c)
+	}
+	if _, _, _, a := img.At(8, 8).RGBA(); a != 0 {
+		t.Fatalf("disposed checkerboard still visible in the last frame")
+	}
+}
+
+func TestAPNGOversizedHeader(t *testing.T) {
+	small := image.NewNRGBA(image.Rect(0, 0, 2, 2))
+	frames := []image.Image{small, small}
+	at := []image.Point{{}, {}}
+	// 0xFFFFFFFF squared overflows int; the other canvases fit int but
+	// not the pixel budget.
+	for _, size := range [][2]int{{0xFFFFFFFF, 0xFFFFFFFF}, {1 << 30, 4}, {maxAnimPixels, 2}} {
+		raw := apngFile(t, size[0], size[1], frames, at, []byte{0, 0})
+		if decodeAnimation(raw) != nil {
+			t.Fatalf("%dx%d canvas decoded as an animation", size[0], size[1])
+		}
+	}
+	// The still decoder then rejects the header instead of panicking.
+	raw := apngFile(t, 0xFFFFFFFF, 0xFFFFFFFF, frames, at, []byte{0, 0})
+	if _, err := decodeImageBytes(raw, "image/png", framesPrefs(framesAuto)); err == nil {
+		t.Fatalf("oversized APNG decoded")
+	}
+}
+
+// vp8lSolid encodes a lossless WebP bitstream of one colour, using prefix
+// codes of a single symbol so pixels take no bits at all.
+func vp8lSolid(w, h int, c color.NRGBA) []byte {
+	var buf []byte
+	var acc uint64
+	var n uint
+	write := func(v uint64, bits uint) {
+		acc |= v << n
+		n += bits
+		for n >= 8 {
+			buf = append(buf, byte(acc))
+			acc >>= 8
+			n -= 8
+		}
+	}
+	buf = append(buf, 0x2f)
+	write(uint64(w-1), 14)
+	write(uint64(h-1), 14)
+	write(1, 1) // alpha is used
+	write(0, 3) // version
+	write(0, 1) // no transforms
+	write(0, 1) // no colour cache
+	write(0, 1) // no meta prefix codes
+	for _, sym := range []uint8{c.G, c.R, c.B, c.A, 0} {
+		write(1, 1) // simple code
+		write(0, 1) // one symbol
+		write(1, 1) // of eight bits
+		write(uint64(sym), 8)
+	}
+	write(0, 8)
+	return append(buf, 0, 0, 0, 0)
+}
+
+func riffChunk(typ string, data []byte) []byte {
+	out := binary.LittleEndian.AppendUint32([]byte(typ), uint32(len(data)))
+	out = append(out, data...)
+	if len(data)%2 == 1 {
+		out = append(out, 0)
+	}
+	return out
+}
+
+func TestAnimatedWebPFrameSelection(t *testing.T) {
+	u24 := func(b []byte, v int) []byte { return append(b, byte(v), byte(v>>8), byte(v>>16)) }
+	anmf := func(x, y, w, h int, flags byte, c color.NRGBA) []byte {
+		d := u24(u24(u24(u24(u24(nil, x/2), y/2), w-1), h-1), 100)
+		d = append(d, flags)
+		return riffChunk("ANMF", append(d, riffChunk("VP8L", vp8lSolid(w, h, c))...))
+	}
+	vp8x := u24(u24([]byte{0x12, 0, 0, 0}, 19), 9)
+	body := []byte("WEBP")
+	body = append(body, riffChunk("VP8X", vp8x)...)
+	body = append(body, riffChunk("ANIM", []byte{0, 0, 0, 0, 0, 0})...)
+	body = append(body, anmf(0, 0, 20, 10, 0, color.NRGBA{})...)
+	body = append(body, anmf(10, 0, 10, 10, 0, color.NRGBA{0xFF, 0, 0, 0xFF})...)
+	raw := append(binary.LittleEndian.AppendUint32([]byte("RIFF"), uint32(len(body))), body...)
+
+	img, err := decodeImageBytes(raw, "image/webp", framesPrefs(framesAuto))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 10 {
+		t.Fatalf("size %v", b)
+	}
+	if c := img.At(15, 5); !sameColor(c, red) {
+		t.Fatalf("second frame pixel %v", c)
+	}
+	if _, _, _, a := img.At(5, 5).RGBA(); a != 0 {
+		t.Fatalf("first frame area should stay transparent")
+	}
+}
+
+func TestRenderAnimatedGIFUsesSelectedFrame(t *testing.T) {
+	useTempDiskCache(t)
+	raw := loadingGIF(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "image/gif")
+		_, _ = w.Write(raw)
+	}))
+	defer origin.Close()
+
+	opts := framesPrefs(framesAuto)
+	opts.ScreenW = 240
+	opts.ImageMIME = "image/png"
+	res := renderFixture(t, obmlFixture{name: "anim-gif", url: origin.URL + "/", html: `<img src="/spinner.gif" alt="Loading">`, opts: &opts})
+	toks := res.tokensByTag('I')
+	if len(toks) != 1 {
+		t.Fatalf("expected the animation inline, got %d images", len(toks))
+	}
+	img, err := png.Decode(bytes.NewReader(toks[0].extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c := img.At(1, 1); !sameColor(c, red) {
+		t.Fatalf("expected the detailed frame, got %v", c)
+	}
+	if _, _, _, _, ok := imgCacheGet(cacheFormat("image/png", opts), 0, origin.URL+"/spinner.gif"); !ok {
+		t.Fatalf("image should be cached under its frame selection")
+	}
+	if f := cacheFormat("image/png", opts); f != "image/png" {
+		t.Fatalf("the default selection should keep the plain cache format, got %q", f)
+	}
+	for _, mode := range []string{framesFirst, framesLast, framesStrip} {
+		other := framesPrefs(mode)
+		if _, _, _, _, ok := imgCacheGet(cacheFormat("image/png", other), 0, origin.URL+"/spinner.gif"); ok {
+			t.Fatalf("%s: served the %s selection", mode, framesAuto)
+		}
+		found := false
+		for _, cand := range allCacheCandidates() {
+			found = found || cand == cacheCandidatesFor(other)[0]
+		}
+		if !found {
+			t.Fatalf("%s: purge candidates miss %+v", mode, cacheCandidatesFor(other)[0])
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package oms
+
+import (
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	defaultImageWorkers = 6
+	defaultImageBudget  = 6 * time.Second
+)
+
+// imageResult is one fetched and transcoded image.
+type imageResult struct {
+	data []byte
+	w, h int
+	ok   bool
+}
+
+// imageCall is a fetch in progress; res is valid once done is closed.
+type imageCall struct {
+	done chan struct{}
+	res  imageResult
+}
+
+// imageFlights deduplicates image fetches across concurrent renders, so
+// clients opening the same page at once fetch each image from the origin
+// only once.
+var imageFlights = struct {
+	sync.Mutex
+	calls map[string]*imageCall
+}{calls: map[string]*imageCall{}}
+
+// fetchImageShared runs fetchAndEncodeImage for absURL, or waits for the
+// identical fetch another render already started. Images are shared by URL,
+// output format and colour depth, as the image caches are, and by the
+// cookies the request would carry, so one client's session never answers
+// another's fetch.
+func fetchImageShared(absURL string, prefs RenderOptions) imageResult {
+	key := cacheFormat(prefs.ImageMIME, prefs) + "|" + strconv.FormatBool(prefs.HighQuality) + "|" + strconv.Itoa(prefs.ScreenW) +
+		"|" + imageCookieKey(absURL, prefs) + "|" + absURL
+	imageFlights.Lock()
+	if c, ok := imageFlights.calls[key]; ok {
+		imageFlights.Unlock()
+		imgCounters.shared.Add(1)
+		<-c.done
+		return c.res
+	}
+	c := &imageCall{done: make(chan struct{})}
+	imageFlights.calls[key] = c
+	imageFlights.Unlock()
+
+	data, w, h, ok := fetchAndEncodeImage(absURL, prefs)
+	c.res = imageResult{data: data, w: w, h: h, ok: ok}
+	imageFlights.Lock()
+	delete(imageFlights.calls, key)
+	imageFlights.Unlock()
+	close(c.done)
+	return c.res
+}
+
+// imageCookieKey lists the cookies fetchAndEncodeImage sends for absURL:
+// the client's Cookie header, the origin page's cookies and the jar's.
+func imageCookieKey(absURL string, prefs RenderOptions) string {
+	var parts []string
+	if prefs.ReqHeaders != nil {
+		if ck := prefs.ReqHeaders.Get("Cookie"); ck != "" {
+			parts = append(parts, ck)
+		}
+		if oc := prefs.OriginCookies; oc != "" {
+			parts = append(parts, oc)
+		}
+	}
+	if prefs.Jar != nil {
+		if u, err := url.Parse(absURL); err == nil {
+			for _, c := range prefs.Jar.Cookies(u) {
+				parts = append(parts, c.Name+"="+c.Value)
+			}
+		}
+	}
+	return strings.Join(parts, "; ")
+}
+
+// imagePrefetch holds the images of one render, fetched ahead of the walk.
+// The futures map is complete before any worker starts and is only read
+// afterwards.
+type imagePrefetch struct {
+	deadline time.Time
+	futures  map[string]*imageCall
+}
+
+// prefetchImages collects the images the walk under root will draw (<img>
+// with srcset and lazy-loading attributes, <picture> sources and inline CSS
+// backgrounds) and fetches them through a pool of Options.ImageWorkers
+// workers. The render waits for them until Options.ImageBudgetMS after this
+// call; fetches still running then finish in the background and only fill
+// the caches. It returns nil when images are off or the page has none.
+func prefetchImages(root *html.Node, base string, ss *Stylesheet, prefs RenderOptions) *imagePrefetch {
+	if root == nil || !prefs.ImagesOn {
+		return nil
+	}
+	urls := collectImageURLs(root, base, ss, prefs)
+	if len(urls) == 0 {
+		return nil
+	}
+	engine := prefs.engine()
+	ip := &imagePrefetch{
+		deadline: time.Now().Add(engine.imageBudget()),
+		futures:  make(map[string]*imageCall, len(urls)),
+	}
+	jobs := make(chan string, len(urls))
+	for _, u := range urls {
+		ip.futures[u] = &imageCall{done: make(chan struct{})}
+		jobs <- u
+	}
+	close(jobs)
+	for range min(engine.imageWorkers(), len(urls)) {
+		go func() {
+			for u := range jobs {
+				f := ip.futures[u]
+				if time.Now().Before(ip.deadline) {
+					f.res = fetchImageShared(u, prefs)
+				}
+				close(f.done)
+			}
+		}()
+	}
+	return ip
+}
+
+// wait returns the image for absURL, blocking until it arrives or the page
+// deadline passes. URLs the prefetch did not collect are fetched now under
+// the same deadline; a fetch that runs late only fills the caches.
+func (ip *imagePrefetch) wait(absURL string, prefs RenderOptions) imageResult {
+	f, ok := ip.futures[absURL]
+	if !ok {
+		if !time.Now().Before(ip.deadline) {
+			return imageResult{}
+		}
+		f = &imageCall{done: make(chan struct{})}
+		go func() {
+			f.res = fetchImageShared(absURL, prefs)
+			close(f.done)
+		}()
+	}
+	select {
+	case <-f.done:
+		return f.res
+	default:
+	}
+	timer := time.NewTimer(time.Until(ip.deadline))
+	defer timer.Stop()
+	select {
+	case <-f.done:
+		return f.res
+	case <-timer.C:
+		imgCounters.late.Add(1)
+		return imageResult{}
+	}
+}
+
+// fetchImage returns the encoded image at absURL for this render: through
+// the prefetch when there is one, else fetched directly.
+func (o RenderOptions) fetchImage(absURL string) ([]byte, int, int, bool) {
+	if o.images != nil {
+		res := o.images.wait(absURL, o)
+		return res.data, res.w, res.h, res.ok
+	}
+	return fetchAndEncodeImage(absURL, o)
+}
+
+// collectImageURLs lists, in document order and without repeats, the
+// absolute image URLs walkRich will ask for in root's subtree. Hidden
+// subtrees are skipped; only <picture>'s chosen source counts.
+func collectImageURLs(root *html.Node, base string, ss *Stylesheet, prefs RenderOptions) []string {
+	var urls []string
+	seen := map[string]bool{}
+	add := func(abs string) {
+		if abs != "" && !seen[abs] {
+			seen[abs] = true
+			urls = append(urls, abs)
+		}
+	}
+	var visit func(*html.Node)
+	visit = func(n *html.Node) {
+		for c := n; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if st := getAttr(c, "style"); st != "" && isDisplayNone(st) {
+				continue
+			}
+			var props map[string]string
+			if ss != nil {
+				props = computeStyleFor(c, ss)
+				if strings.Contains(strings.ToLower(props["display"]), "none") ||
+					strings.Contains(strings.ToLower(props["visibility"]), "hidden") {
+					continue
+				}
+			}
+			if abs, _, _ := inlineBackgroundURL(c, props, base, prefs); abs != "" {
+				add(abs)
+			}
+			switch strings.ToLower(c.Data) {
+			case "head", "script", "style", "noscript", "template":
+				continue
+			case "img":
+				add(imageLink(base, imgSource(c)))
+				continue
+			case "picture":
+				add(imageLink(base, pictureSource(c)))
+				continue
+			}
+			if c.FirstChild != nil {
+				visit(c.FirstChild)
+			}
+		}
+	}
+	visit(root.FirstChild)
+	return urls
+}
+
+// imageLink resolves an image src the way renderImageFromURL does.
+func imageLink(base, src string) string {
+	src = strings.TrimSpace(src)
+	if src == "" {
+		return ""
+	}
+	if abs := resolveLink(base, src); strings.HasPrefix(abs, "0/") {
+		return abs[2:]
+	}
+	return ""
+}
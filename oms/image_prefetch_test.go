@@ -0,0 +1,239 @@
+package oms
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/png"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// useTempDiskCache points the disk image cache at a temporary directory for
+// the duration of a test, including fetches it left running.
+func useTempDiskCache(t *testing.T) {
+	t.Helper()
+	diskCacheOnce.Do(initDiskCache)
+	oldDir, oldMax := diskCacheSettings()
+	configureDiskCache(Options{ImageCacheDir: t.TempDir(), ImageCacheMB: -1})
+	t.Cleanup(func() {
+		for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(5 * time.Millisecond) {
+			imageFlights.Lock()
+			n := len(imageFlights.calls)
+			imageFlights.Unlock()
+			if n == 0 {
+				break
+			}
+		}
+		diskCfgMu.Lock()
+		diskCacheDir, diskCacheMax = oldDir, oldMax
+		diskCfgMu.Unlock()
+	})
+}
+
+func testPNG(t *testing.T) []byte {
+	t.Helper()
+	img := image.NewRGBA(image.Rect(0, 0, 8, 8))
+	for i := range img.Pix {
+		img.Pix[i] = 0x80
+	}
+	img.Set(0, 0, color.RGBA{0xFF, 0, 0, 0xFF})
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, img); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// imageOrigin serves testPNG for every path after delay(path), counting
+// requests per path.
+type imageOrigin struct {
+	*httptest.Server
+	mu   sync.Mutex
+	hits map[string]int
+}
+
+func newImageOrigin(t *testing.T, delay func(path string)) *imageOrigin {
+	t.Helper()
+	body := testPNG(t)
+	o := &imageOrigin{hits: map[string]int{}}
+	o.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		o.mu.Lock()
+		o.hits[r.URL.Path]++
+		o.mu.Unlock()
+		delay(r.URL.Path)
+		w.Header().Set("Content-Type", "image/png")
+		_, _ = w.Write(body)
+	}))
+	t.Cleanup(o.Close)
+	return o
+}
+
+func (o *imageOrigin) hitCount(path string) int {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	return o.hits[path]
+}
+
+func TestPrefetchFetchesPageImagesInParallel(t *testing.T) {
+	useTempDiskCache(t)
+	var running, peak atomic.Int32
+	origin := newImageOrigin(t, func(string) {
+		n := running.Add(1)
+		for {
+			p := peak.Load()
+			if n <= p || peak.CompareAndSwap(p, n) {
+				break
+			}
+		}
+		time.Sleep(150 * time.Millisecond)
+		running.Add(-1)
+	})
+	var page strings.Builder
+	page.WriteString(`<style>.ico{width:8px;height:8px;background:url(/bg.png) no-repeat}</style><body>`)
+	for _, p := range []string{"/a.png", "/b.png", "/c.png", "/d.png", "/e.png", "/a.png"} {
+		page.WriteString(`<p>x<img src="` + p + `" alt="i"></p>`)
+	}
+	page.WriteString(`<img srcset="/f.png 1x, /g.png 2x"><picture><source srcset="/h.png"><img src="/fallback.png"></picture>`)
+	page.WriteString(`<span class="ico"></span><div style="display:none"><img src="/hidden.png"></div></body>`)
+
+	opts := defaultRenderPrefs()
+	opts.Engine = &Options{ImageWorkers: 4, ImageBudgetMS: 5000}
+	start := time.Now()
+	res := renderFixture(t, obmlFixture{name: "gallery", url: origin.URL + "/", html: page.String(), opts: &opts})
+	elapsed := time.Since(start)
+
+	if got := res.countTag('I'); got != 9 {
+		t.Fatalf("expected 9 inline images, got %d", got)
+	}
+	for _, p := range []string{"/a.png", "/b.png", "/c.png", "/d.png", "/e.png", "/f.png", "/h.png", "/bg.png"} {
+		if got := origin.hitCount(p); got != 1 {
+			t.Errorf("%s fetched %d times, want once", p, got)
+		}
+	}
+	for _, p := range []string{"/g.png", "/fallback.png", "/hidden.png"} {
+		if got := origin.hitCount(p); got != 0 {
+			t.Errorf("%s fetched %d times, want never", p, got)
+		}
+	}
+	if peak.Load() < 2 || peak.Load() > 4 {
+		t.Errorf("peak concurrency %d, want 2..4 workers", peak.Load())
+	}
+	if elapsed >= 8*150*time.Millisecond {
+		t.Errorf("render took %v, images were not fetched in parallel", elapsed)
+	}
+}
+
+func TestPrefetchDeadlineFallsBackToPlaceholder(t *testing.T) {
+	useTempDiskCache(t)
+	release := make(chan struct{})
+	origin := newImageOrigin(t, func(path string) {
+		if path == "/slow.png" {
+			<-release
+		}
+	})
+	defer close(release)
+
+	opts := defaultRenderPrefs()
+	opts.Engine = &Options{ImageBudgetMS: 200}
+	html := `<body><img src="/fast.png" alt="fast"><img src="/slow.png" alt="slow"></body>`
+	start := time.Now()
+	res := renderFixture(t, obmlFixture{name: "deadline", url: origin.URL + "/", html: html, opts: &opts})
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("render waited %v past the image budget", elapsed)
+	}
+	if got := res.countTag('I'); got != 1 {
+		t.Fatalf("expected the fast image inline, got %d I tags", got)
+	}
+	if got := res.countTag('J'); got != 1 {
+		t.Fatalf("expected a placeholder for the slow image, got %d J tags", got)
+	}
+	res.mustHaveLink(t, "0/"+origin.URL+"/slow.png")
+}
+
+func TestPrefetchMissIsBoundedByDeadline(t *testing.T) {
+	useTempDiskCache(t)
+	release := make(chan struct{})
+	origin := newImageOrigin(t, func(string) { <-release })
+	defer close(release)
+
+	ip := &imagePrefetch{deadline: time.Now().Add(200 * time.Millisecond), futures: map[string]*imageCall{}}
+	start := time.Now()
+	res := ip.wait(origin.URL+"/unlisted.png", defaultRenderPrefs())
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Fatalf("fetch of an image outside the prefetch waited %v past the budget", elapsed)
+	}
+	if res.ok {
+		t.Fatalf("expected no image once the deadline passed")
+	}
+}
+
+func TestFetchImageSharedDeduplicatesConcurrentRenders(t *testing.T) {
+	useTempDiskCache(t)
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 4)
+	origin := newImageOrigin(t, func(string) {
+		arrived <- struct{}{}
+		<-release
+	})
+	prefs := defaultRenderPrefs()
+	url := origin.URL + "/shared.png"
+
+	sharedBefore := imgCounters.shared.Load()
+	results := make(chan imageResult, 3)
+	go func() { results <- fetchImageShared(url, prefs) }()
+	<-arrived
+	for range 2 {
+		go func() { results <- fetchImageShared(url, prefs) }()
+	}
+	for imgCounters.shared.Load() < sharedBefore+2 {
+		time.Sleep(time.Millisecond)
+	}
+	close(release)
+	for range 3 {
+		if res := <-results; !res.ok || len(res.data) == 0 {
+			t.Fatalf("expected every caller to get the image, got %+v", res)
+		}
+	}
+	if got := origin.hitCount("/shared.png"); got != 1 {
+		t.Fatalf("origin saw %d requests, want 1", got)
+	}
+}
+
+func TestFetchImageSharedKeepsCookiesApart(t *testing.T) {
+	useTempDiskCache(t)
+	release := make(chan struct{})
+	arrived := make(chan struct{}, 2)
+	origin := newImageOrigin(t, func(string) {
+		arrived <- struct{}{}
+		<-release
+	})
+	url := origin.URL + "/private.png"
+	withCookie := func(ck string) RenderOptions {
+		prefs := defaultRenderPrefs()
+		prefs.ReqHeaders = http.Header{"Cookie": {ck}}
+		return prefs
+	}
+
+	results := make(chan imageResult, 2)
+	go func() { results <- fetchImageShared(url, withCookie("sid=alice")) }()
+	<-arrived
+	go func() { results <- fetchImageShared(url, withCookie("sid=bob")) }()
+	select {
+	case <-arrived:
+	case <-time.After(2 * time.Second):
+		t.Fatalf("a fetch with other cookies joined the first one")
+	}
+	close(release)
+	for range 2 {
+		<-results
+	}
+	if got := origin.hitCount("/private.png"); got != 2 {
+		t.Fatalf("origin saw %d requests, want one per cookie", got)
+	}
+}
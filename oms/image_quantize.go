@@ -0,0 +1,356 @@
+package oms
+
+import (
+	"image"
+	"image/color"
+	"math"
+	"math/bits"
+	"sort"
+	"strconv"
+	"sync"
+
+	"golang.org/x/image/draw"
+)
+
+// Dithering modes of Options.ImageDither.
+const (
+	ditherFloydSteinberg = "floyd-steinberg"
+	ditherOrdered        = "ordered"
+	ditherNone           = "none"
+)
+
+// colorDepth is what a handset screen can show, from the c: (colours) and
+// l: (alpha levels) fields of d=. Levels are powers of two.
+type colorDepth struct {
+	r, g, b int // levels per channel; 0 = 8-bit
+	gray    int // levels of a grayscale screen; 0 = colour
+	alpha   int // alpha levels; 0 = 8-bit, 1 = no transparency
+	dither  string
+}
+
+// depthFor returns the screen depth of prefs. Screens of 16 colours or
+// fewer are taken to be grayscale; colour bits are split 3-3-2, 4-4-4,
+// 5-6-5 and so on, with green getting the spare bit.
+func depthFor(prefs RenderOptions) colorDepth {
+	var d colorDepth
+	switch n := prefs.NumColors; {
+	case n <= 0 || n >= 1<<24:
+	case n <= 16:
+		d.gray = 1 << max(bits.Len(uint(n))-1, 1)
+	default:
+		c := bits.Len(uint(n)) - 1
+		g := (c + 2) / 3
+		r := (c - g + 1) / 2
+		d.r, d.g, d.b = 1<<r, 1<<g, 1<<(c-g-r)
+	}
+	if l := prefs.AlphaLevels; l > 0 && l < 256 {
+		d.alpha = 1 << (bits.Len(uint(l)) - 1)
+	}
+	d.dither = prefs.engine().imageDither()
+	return d
+}
+
+// full reports whether the screen shows 24-bit colour with 8-bit alpha, so
+// images need no reduction.
+func (d colorDepth) full() bool {
+	return d.r == 0 && d.gray == 0 && d.alpha == 0
+}
+
+// key is appended to the image cache format, so images reduced for one
+// depth are not served to another.
+func (d colorDepth) key() string {
+	if d.full() {
+		return ""
+	}
+	k := ";depth="
+	switch {
+	case d.gray > 0:
+		k += "g" + strconv.Itoa(d.gray)
+	case d.r > 0:
+		k += strconv.Itoa(d.r) + "." + strconv.Itoa(d.g) + "." + strconv.Itoa(d.b)
+	default:
+		k += "rgb"
+	}
+	return k + ";alpha=" + strconv.Itoa(d.alpha) + ";" + d.dither
+}
+
+// depthsInUse holds the depth keys cacheFormat has handed out since start-up.
+var depthsInUse sync.Map
+
+// cacheFormat is the image cache format of an image encoded as format for
+// prefs: the frame selection of animations, then the colour depth.
+func cacheFormat(format string, prefs RenderOptions) string {
+	k := depthFor(prefs).key()
+	if _, ok := depthsInUse.Load(k); !ok {
+		depthsInUse.Store(k, true)
+	}
+	return format + framesKey(prefs) + k
+}
+
+// depthKeys lists full depth and every depth cached since start-up, for
+// purging the variants of a cached image. Reduced variants written by an
+// earlier process are left to the disk cache's size limit.
+func depthKeys() []string {
+	keys := []string{""}
+	depthsInUse.Range(func(k, _ any) bool {
+		if k != "" {
+			keys = append(keys, k.(string))
+		}
+		return true
+	})
+	return keys
+}
+
+// bayer4 is the 4x4 ordered dithering threshold matrix.
+var bayer4 = [16]float32{0, 8, 2, 10, 12, 4, 14, 6, 3, 11, 1, 9, 15, 7, 13, 5}
+
+// quantizeImage reduces img to depth d, spreading the rounding error by
+// d.dither. Alpha is rounded without dithering, and fully transparent
+// pixels are made transparent black so they share one palette entry.
+func quantizeImage(img image.Image, d colorDepth) *image.NRGBA {
+	b := img.Bounds()
+	w, h := b.Dx(), b.Dy()
+	out := image.NewNRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(out, out.Bounds(), img, b.Min, draw.Src)
+
+	levels := []int{d.r, d.g, d.b}
+	if d.gray > 0 {
+		levels = []int{d.gray}
+	}
+	var cur, next []float32
+	if d.dither == ditherFloydSteinberg {
+		cur = make([]float32, (w+2)*3)
+		next = make([]float32, (w+2)*3)
+	}
+	for y := 0; y < h; y++ {
+		row := out.Pix[y*out.Stride:]
+		for x := 0; x < w; x++ {
+			p := row[x*4 : x*4+4]
+			switch {
+			case d.alpha == 1:
+				p[3] = 0xFF
+			case d.alpha > 1:
+				p[3] = quantizeLevel(float32(p[3]), d.alpha)
+			}
+			if p[3] == 0 {
+				p[0], p[1], p[2] = 0, 0, 0
+				continue
+			}
+			var v [3]float32
+			if d.gray > 0 {
+				v[0] = 0.299*float32(p[0]) + 0.587*float32(p[1]) + 0.114*float32(p[2])
+			} else {
+				v = [3]float32{float32(p[0]), float32(p[1]), float32(p[2])}
+			}
+			for c, n := range levels {
+				if n == 0 {
+					continue
+				}
+				step := 255 / float32(n-1)
+				switch d.dither {
+				case ditherFloydSteinberg:
+					v[c] += cur[(x+1)*3+c]
+				case ditherOrdered:
+					v[c] += ((bayer4[(y&3)*4+(x&3)]+0.5)/16 - 0.5) * step
+				}
+				q := quantizeLevel(v[c], n)
+				if cur != nil {
+					e := v[c] - float32(q)
+					cur[(x+2)*3+c] += e * 7 / 16
+					next[x*3+c] += e * 3 / 16
+					next[(x+1)*3+c] += e * 5 / 16
+					next[(x+2)*3+c] += e / 16
+				}
+				if d.gray > 0 {
+					p[0], p[1], p[2] = q, q, q
+				} else {
+					p[c] = q
+				}
+			}
+		}
+		if cur != nil {
+			cur, next = next, cur
+			clear(next)
+		}
+	}
+	return out
+}
+
+// quantizeLevel rounds v to the nearest of n levels spread over 0..255.
+func quantizeLevel(v float32, n int) uint8 {
+	step := 255 / float64(n-1)
+	q := math.Round(math.Min(math.Max(float64(v), 0), 255)/step) * step
+	return uint8(math.Round(q))
+}
+
+// flattenImage composites img onto white, for screens without alpha.
+func flattenImage(img image.Image) image.Image {
+	if !imageHasAlpha(img) {
+		return img
+	}
+	b := img.Bounds()
+	dst := image.NewRGBA(image.Rect(0, 0, b.Dx(), b.Dy()))
+	draw.Draw(dst, dst.Bounds(), image.White, image.Point{}, draw.Src)
+	draw.Draw(dst, dst.Bounds(), img, b.Min, draw.Over)
+	return dst
+}
+
+// exactPalette returns img as a paletted image when it has at most limit
+// (up to 256) colours.
+func exactPalette(img *image.NRGBA, limit int) (*image.Paletted, bool) {
+	b := img.Bounds()
+	out := image.NewPaletted(b, nil)
+	index := map[color.NRGBA]uint8{}
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			c := color.NRGBA{img.Pix[i], img.Pix[i+1], img.Pix[i+2], img.Pix[i+3]}
+			k, ok := index[c]
+			if !ok {
+				if len(out.Palette) == limit {
+					return nil, false
+				}
+				k = uint8(len(out.Palette))
+				index[c] = k
+				out.Palette = append(out.Palette, c)
+			}
+			out.Pix[out.PixOffset(x, y)] = k
+		}
+	}
+	return out, len(out.Palette) > 0
+}
+
+// palettize maps img onto a median-cut palette of at most n colours with
+// Floyd-Steinberg error diffusion. Pixels under half alpha become one
+// transparent entry.
+func palettize(img *image.NRGBA, n int) *image.Paletted {
+	out := image.NewPaletted(img.Bounds(), medianCutPalette(img, n))
+	draw.FloydSteinberg.Draw(out, out.Bounds(), img, img.Bounds().Min)
+	return out
+}
+
+// medianCutPalette picks up to n colours for img by repeatedly splitting
+// the colour box with the widest channel at its pixel median.
+func medianCutPalette(img *image.NRGBA, n int) color.Palette {
+	type entry struct {
+		c     [3]uint8
+		count int
+	}
+	counts := map[[3]uint8]int{}
+	transparent := false
+	b := img.Bounds()
+	for y := b.Min.Y; y < b.Max.Y; y++ {
+		for x := b.Min.X; x < b.Max.X; x++ {
+			i := img.PixOffset(x, y)
+			if img.Pix[i+3] < 0x80 {
+				transparent = true
+				continue
+			}
+			counts[[3]uint8{img.Pix[i], img.Pix[i+1], img.Pix[i+2]}]++
+		}
+	}
+	if transparent {
+		n--
+	}
+	all := make([]entry, 0, len(counts))
+	for c, k := range counts {
+		all = append(all, entry{c, k})
+	}
+	// Map order is random; sort so the palette is reproducible.
+	sort.Slice(all, func(i, j int) bool {
+		a, b := all[i].c, all[j].c
+		return a[0] < b[0] || a[0] == b[0] && (a[1] < b[1] || a[1] == b[1] && a[2] < b[2])
+	})
+	boxes := [][]entry{all}
+	for len(boxes) < n {
+		split, ch, span := -1, 0, 0
+		for i, box := range boxes {
+			for c := 0; c < 3; c++ {
+				lo, hi := 255, 0
+				for _, e := range box {
+					lo, hi = min(lo, int(e.c[c])), max(hi, int(e.c[c]))
+				}
+				if hi-lo > span {
+					split, ch, span = i, c, hi-lo
+				}
+			}
+		}
+		if split < 0 {
+			break
+		}
+		box := boxes[split]
+		sort.SliceStable(box, func(i, j int) bool { return box[i].c[ch] < box[j].c[ch] })
+		total := 0
+		for _, e := range box {
+			total += e.count
+		}
+		k, seen := 1, box[0].count
+		for k < len(box)-1 && seen*2 < total {
+			seen += box[k].count
+			k++
+		}
+		boxes[split] = box[:k]
+		boxes = append(boxes, box[k:])
+	}
+	pal := make(color.Palette, 0, len(boxes)+1)
+	for _, box := range boxes {
+		var sum [3]int
+		total := 0
+		for _, e := range box {
+			for c := range sum {
+				sum[c] += int(e.c[c]) * e.count
+			}
+			total += e.count
+		}
+		if total == 0 {
+			continue
+		}
+		pal = append(pal, color.NRGBA{uint8(sum[0] / total), uint8(sum[1] / total), uint8(sum[2] / total), 0xFF})
+	}
+	if transparent || len(pal) == 0 {
+		pal = append(pal, color.NRGBA{})
+	}
+	return pal
+}
+
+// encodeForDevice encodes img as want for the screen prefs describes. The
+// image is reduced to the screen's depth first, so palette formats need
+// fewer colours; a palette PNG replaces JPEG when it is no larger. JPEG
+// itself is encoded from the unreduced image, since dithering noise costs
+// JPEG bytes and the handset reduces it anyway.
+func encodeForDevice(img image.Image, want string, prefs RenderOptions, maxBytes int) ([]byte, string, int, error) {
+	d := depthFor(prefs)
+	if d.full() && want != "image/gif" {
+		data, quality, err := encodeImageAs(img, want, prefs, maxBytes)
+		return data, want, quality, err
+	}
+	if want == "image/gif" && d.alpha != 1 {
+		// GIF has a single transparent colour and no partial alpha.
+		d.alpha = 2
+	}
+	reduced := quantizeImage(img, d)
+	pal, exact := exactPalette(reduced, 256)
+	switch want {
+	case "image/gif":
+		if !exact {
+			pal = palettize(reduced, gifColors(prefs))
+		}
+		data, _, err := encodeImageAs(pal, want, prefs, 0)
+		return data, want, 0, err
+	case "image/png":
+		var src image.Image = reduced
+		if exact {
+			src = pal
+		}
+		data, _, err := encodeImageAs(src, want, prefs, 0)
+		return data, want, 0, err
+	}
+	data, quality, err := encodeImageAs(img, want, prefs, maxBytes)
+	if err != nil || !exact {
+		return data, want, quality, err
+	}
+	if p, _, err := encodeImageAs(pal, "image/png", prefs, 0); err == nil && len(p) <= len(data) {
+		return p, "image/png", 0, nil
+	}
+	return data, want, quality, nil
+}
@@ -0,0 +1,215 @@
+package oms
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/gif"
+	"image/png"
+	"strings"
+	"testing"
+)
+
+func TestDepthForHandsetColours(t *testing.T) {
+	cases := []struct {
+		colours, alpha int
+		want           colorDepth
+	}{
+		{0, 0, colorDepth{}},
+		{1 << 24, 256, colorDepth{}},
+		{256, 0, colorDepth{r: 8, g: 8, b: 4}},
+		{4096, 0, colorDepth{r: 16, g: 16, b: 16}},
+		{65536, 2, colorDepth{r: 32, g: 64, b: 32, alpha: 2}},
+		{262144, 1, colorDepth{r: 64, g: 64, b: 64, alpha: 1}},
+		{16, 0, colorDepth{gray: 16}},
+		{2, 3, colorDepth{gray: 2, alpha: 2}},
+	}
+	for _, tc := range cases {
+		got := depthFor(RenderOptions{NumColors: tc.colours, AlphaLevels: tc.alpha})
+		tc.want.dither = ditherFloydSteinberg
+		if got != tc.want {
+			t.Errorf("c=%d l=%d: got %+v, want %+v", tc.colours, tc.alpha, got, tc.want)
+		}
+	}
+	full := cacheCandidatesFor(defaultRenderPrefs())
+	prefs := defaultRenderPrefs()
+	prefs.NumColors = 4096
+	reduced := cacheCandidatesFor(prefs)
+	if reduced[0].format == full[0].format || !strings.HasPrefix(reduced[0].format, "image/jpeg;") {
+		t.Fatalf("reduced images should be cached apart: %q vs %q", reduced[0].format, full[0].format)
+	}
+	found := false
+	for _, cand := range allCacheCandidates() {
+		found = found || cand == reduced[0]
+	}
+	if !found {
+		t.Fatalf("purge candidates miss %+v", reduced[0])
+	}
+}
+
+// grayRamp is a horizontal ramp from black to white.
+func grayRamp(w, h int) *image.RGBA {
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			v := uint8(x * 255 / (w - 1))
+			img.Set(x, y, color.RGBA{v, v, v, 0xFF})
+		}
+	}
+	return img
+}
+
+func TestQuantizeImageDithersToDeviceLevels(t *testing.T) {
+	src := grayRamp(64, 16)
+	for _, dither := range []string{ditherFloydSteinberg, ditherOrdered, ditherNone} {
+		out := quantizeImage(src, colorDepth{gray: 4, dither: dither})
+		levels := map[uint8]bool{}
+		// Sum per column band, to compare local brightness with the source.
+		var srcSum, outSum [4]int
+		for y := 0; y < 16; y++ {
+			for x := 0; x < 64; x++ {
+				i := out.PixOffset(x, y)
+				levels[out.Pix[i]] = true
+				if out.Pix[i] != out.Pix[i+1] || out.Pix[i] != out.Pix[i+2] {
+					t.Fatalf("%s: pixel %d,%d is not gray", dither, x, y)
+				}
+				srcSum[x/16] += int(src.Pix[src.PixOffset(x, y)])
+				outSum[x/16] += int(out.Pix[i])
+			}
+		}
+		for v := range levels {
+			if v%85 != 0 {
+				t.Fatalf("%s: value %d is not one of 4 levels", dither, v)
+			}
+		}
+		if dither == ditherNone {
+			continue
+		}
+		if len(levels) != 4 {
+			t.Fatalf("%s: expected all 4 levels, got %v", dither, levels)
+		}
+		for band := range srcSum {
+			if diff := (outSum[band] - srcSum[band]) / (16 * 16); diff < -12 || diff > 12 {
+				t.Errorf("%s: band %d brightness off by %d", dither, band, diff)
+			}
+		}
+	}
+}
+
+// logoImage is a flat-colour graphic with a transparent border.
+func logoImage() *image.NRGBA {
+	img := image.NewNRGBA(image.Rect(0, 0, 120, 60))
+	for y := 8; y < 52; y++ {
+		for x := 8; x < 112; x++ {
+			c := color.NRGBA{0x20, 0x40, 0xC0, 0xFF}
+			if (x/12+y/12)%2 == 0 {
+				c = color.NRGBA{0xF0, 0xA0, 0x10, 0xFF}
+			}
+			img.SetNRGBA(x, y, c)
+		}
+	}
+	return img
+}
+
+func TestEncodeImageUsesPalettePNGWhenSmaller(t *testing.T) {
+	prefs := defaultRenderPrefs()
+	prefs.NumColors = 65536
+	prefs.AlphaLevels = 1
+
+	logo := flattenImage(logoImage())
+	data, _, _, format, _, err := encodeImage(logo, prefs)
+	if err != nil || format != "image/png" {
+		t.Fatalf("expected a palette PNG for a flat graphic, got %s (err %v)", format, err)
+	}
+	decoded, err := png.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pm, ok := decoded.(*image.Paletted)
+	if !ok || len(pm.Palette) > 32 {
+		t.Fatalf("expected a small palette image, got %T", decoded)
+	}
+	if r, g, b, _ := decoded.At(0, 0).RGBA(); r>>8 != 0xFF || g>>8 != 0xFF || b>>8 != 0xFF {
+		t.Fatalf("transparent border should be flattened onto white, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+
+	photo := noisyImage(120, 90)
+	if _, _, _, format, _, err := encodeImage(photo, prefs); err != nil || format != "image/jpeg" {
+		t.Fatalf("expected JPEG for a photo, got %s (err %v)", format, err)
+	}
+}
+
+func TestEncodeImageQuantizesPNGAndGIFToDevice(t *testing.T) {
+	prefs := defaultRenderPrefs()
+	prefs.ImageMIME = "image/png"
+	full, _, _, _, _, err := encodeImage(noisyImage(120, 90), prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefs.NumColors = 256
+	prefs.AlphaLevels = 2
+	data, _, _, _, _, err := encodeImage(noisyImage(120, 90), prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(data) >= len(full) {
+		t.Fatalf("256-colour PNG is %d bytes, full colour %d", len(data), len(full))
+	}
+	if img, err := png.Decode(bytes.NewReader(data)); err != nil {
+		t.Fatal(err)
+	} else if _, ok := img.(*image.Paletted); !ok {
+		t.Fatalf("expected a palette PNG, got %T", img)
+	}
+
+	soft := logoImage()
+	soft.SetNRGBA(10, 10, color.NRGBA{0x20, 0x40, 0xC0, 0x60})
+	data, _, _, _, _, err = encodeImage(soft, prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, _ := png.Decode(bytes.NewReader(data))
+	for _, p := range []image.Point{{0, 0}, {10, 10}, {20, 20}} {
+		if _, _, _, a := img.At(p.X, p.Y).RGBA(); a != 0 && a != 0xFFFF {
+			t.Fatalf("alpha at %v is %d, want 2 levels", p, a>>8)
+		}
+	}
+
+	prefs = defaultRenderPrefs()
+	prefs.ImageMIME = "image/gif"
+	data, _, _, _, _, err = encodeImage(noisyImage(120, 90), prefs)
+	if err != nil {
+		t.Fatal(err)
+	}
+	g, err := gif.Decode(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n := len(g.(*image.Paletted).Palette); n > gifColors(prefs) {
+		t.Fatalf("GIF palette has %d colours, want at most %d", n, gifColors(prefs))
+	}
+}
+
+func TestPurgeImageCacheRemovesVariantsInUse(t *testing.T) {
+	useTempDiskCache(t)
+	const url, other = "http://purge.test/a.png", "http://purge.test/b.png"
+	reduced := defaultRenderPrefs()
+	reduced.NumColors = 16
+	reduced.ImageMIME = "image/png"
+	var formats []string
+	for _, prefs := range []RenderOptions{defaultRenderPrefs(), reduced} {
+		for _, cand := range cacheCandidatesFor(prefs) {
+			formats = append(formats, cand.format)
+			imgCachePut(cand.format, cand.quality, url, []byte("x"), 1, 1, imgMeta{})
+			diskCachePut(cand.format, cand.quality, url, []byte("x"), 1, 1, imgMeta{})
+		}
+	}
+	imgCachePut(formats[0], 40, other, []byte("y"), 1, 1, imgMeta{})
+
+	memory, disk := PurgeImageCache(url)
+	if memory != len(formats) || disk != len(formats) {
+		t.Fatalf("purged %d memory entries and %d files, want %d of each", memory, disk, len(formats))
+	}
+	if _, _, _, _, ok := imgCacheGet(formats[0], 40, other); !ok {
+		t.Fatalf("purge dropped another URL")
+	}
+}
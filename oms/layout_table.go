@@ -0,0 +1,238 @@
+package oms
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// layoutTableThreshold is the score from which a table is treated as page
+	// layout rather than tabular data.
+	layoutTableThreshold = 2
+	// layoutLongCellRunes marks a cell holding running text, not a datum.
+	layoutLongCellRunes = 250
+	// layoutMainShare is the share of a table's non-link text a cell must hold
+	// to be moved to the front as the main content column.
+	layoutMainShare = 0.5
+)
+
+// layoutTableScore weighs the signals that tell layout tables from data
+// tables. Positive points lean towards layout, negative ones towards data.
+func layoutTableScore(table *html.Node, g *tableGrid) int {
+	switch strings.ToLower(strings.TrimSpace(getAttr(table, "role"))) {
+	case "presentation", "none":
+		return layoutTableThreshold
+	case "table", "grid", "treegrid":
+		return 0
+	}
+	score := 0
+	if strings.TrimSpace(getAttr(table, "summary")) != "" {
+		score -= 2
+	}
+	if findFirstChild(table, "caption") != nil {
+		score -= 2
+	}
+	if border, err := strconv.Atoi(strings.TrimSpace(getAttr(table, "border"))); err == nil && border > 0 {
+		score--
+	} else if strings.TrimSpace(getAttr(table, "cellspacing")) == "0" || strings.TrimSpace(getAttr(table, "cellpadding")) == "0" {
+		score++
+	}
+	if w := strings.TrimSpace(getAttr(table, "width")); w == "100%" {
+		score++
+	}
+	if hasNestedTable(table) {
+		score += 3
+	}
+	for a := table.Parent; a != nil; a = a.Parent {
+		if a.Type == html.ElementNode && strings.EqualFold(a.Data, "table") {
+			score++
+			break
+		}
+	}
+
+	cells, headers, long, block := 0, false, false, false
+	links, linkRunes, textRunes := 0, 0, 0
+	regular := len(g.slots) >= 2 && g.cols >= 2
+	for r := range g.slots {
+		perRow := 0
+		for c := 0; c < g.cols; c++ {
+			cell := g.origin(r, c)
+			if cell == nil {
+				continue
+			}
+			cells++
+			perRow++
+			if cell.colspan != 1 || cell.rowspan != 1 {
+				regular = false
+			}
+			headers = headers || cell.header
+			n := utf8.RuneCountInString(cellText(cell.node))
+			textRunes += n
+			long = long || n > layoutLongCellRunes
+			block = block || hasBlockContent(cell.node)
+			cl, cr := linkStats(cell.node)
+			links += cl
+			linkRunes += cr
+		}
+		if perRow != g.cols {
+			regular = false
+		}
+	}
+	if headers {
+		score -= 2
+	}
+	if regular {
+		score--
+	}
+	if cells <= 1 {
+		score += 3
+	}
+	if long {
+		score += 2
+	}
+	if block {
+		score++
+	}
+	if links >= 10 && linkRunes*10 > textRunes*7 {
+		score++
+	}
+	return score
+}
+
+func isLayoutTable(table *html.Node, g *tableGrid) bool {
+	return layoutTableScore(table, g) >= layoutTableThreshold
+}
+
+// hasBlockContent reports whether a cell holds block-level markup such as
+// paragraphs, lists or headings.
+func hasBlockContent(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		switch strings.ToLower(c.Data) {
+		case "div", "p", "ul", "ol", "dl", "table", "form", "blockquote", "pre",
+			"h1", "h2", "h3", "h4", "h5", "h6", "section", "article", "nav", "header", "footer":
+			return true
+		}
+		if hasBlockContent(c) {
+			return true
+		}
+	}
+	return false
+}
+
+// linkStats counts the links under n and the characters of their text.
+func linkStats(n *html.Node) (links, runes int) {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if strings.EqualFold(c.Data, "a") && strings.TrimSpace(getAttr(c, "href")) != "" {
+			links++
+			runes += utf8.RuneCountInString(cellText(c))
+			continue
+		}
+		l, r := linkStats(c)
+		links += l
+		runes += r
+	}
+	return links, runes
+}
+
+// mainContentCell picks the cell holding most of the table's non-link text,
+// or nil when no cell clearly dominates.
+func mainContentCell(cells []*tableCell) *tableCell {
+	var best *tableCell
+	bestWeight, total := 0, 0
+	for _, cell := range cells {
+		_, lr := linkStats(cell.node)
+		w := max(utf8.RuneCountInString(cellText(cell.node))-lr, 0)
+		total += w
+		if w > bestWeight {
+			best, bestWeight = cell, w
+		}
+	}
+	if best == nil || float64(bestWeight) < layoutMainShare*float64(total) {
+		return nil
+	}
+	return best
+}
+
+// formsStayInCells reports whether every cell with form controls also holds
+// the form they belong to, so cells can be reordered without moving inputs
+// away from their form header.
+func formsStayInCells(cells []*tableCell) bool {
+	for _, cell := range cells {
+		if hasFormControls(cell.node) && findFirstByTag(cell.node, "form") == nil {
+			return false
+		}
+	}
+	return true
+}
+
+// hasStrayForm reports whether a form element sits between table rows, where
+// the parser leaves it empty and only source order ties inputs to it.
+func hasStrayForm(table *html.Node) bool {
+	var rec func(*html.Node, int) bool
+	rec = func(n *html.Node, depth int) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "form":
+				return true
+			case "thead", "tbody", "tfoot", "tr":
+				if depth < 2 && rec(c, depth+1) {
+					return true
+				}
+			}
+		}
+		return false
+	}
+	return rec(table, 0)
+}
+
+// linearizeLayoutTable walks the cells of a layout table one after another in
+// reading order. The main content column goes first when one clearly
+// dominates, so articles are not buried under navigation; nested tables are
+// classified again as they are reached.
+func linearizeLayoutTable(table *html.Node, g *tableGrid, base string, p *Page, visited map[*html.Node]bool, st *walkState, prefs RenderOptions) {
+	var cells []*tableCell
+	for r := range g.slots {
+		for c := 0; c < g.cols; c++ {
+			if cell := g.origin(r, c); cell != nil && !cellEmpty(cell.node) {
+				cells = append(cells, cell)
+			}
+		}
+	}
+	if main := mainContentCell(cells); main != nil && main != cells[0] && formsStayInCells(cells) && !hasStrayForm(table) {
+		ordered := []*tableCell{main}
+		for _, cell := range cells {
+			if cell != main {
+				ordered = append(ordered, cell)
+			}
+		}
+		cells = ordered
+	}
+	forms := newTableForms(table, g)
+	prevCell := st.inTableCell
+	st.inTableCell = false
+	for _, cell := range cells {
+		forms.upTo(cell.row, base, p, visited, st)
+		before := p.tagCount
+		if cell.node.FirstChild != nil {
+			walkRich(cell.node.FirstChild, base, p, visited, st, prefs)
+		}
+		if p.tagCount != before {
+			p.AddBreak()
+		}
+	}
+	forms.upTo(len(g.slots), base, p, visited, st)
+	forms.close(st)
+	st.inTableCell = prevCell
+}
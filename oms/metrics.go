@@ -0,0 +1,95 @@
+package oms
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+)
+
+// ImageCacheCounters reports how image requests were satisfied since start-up.
+type ImageCacheCounters struct {
+	MemoryHits  uint64
+	DiskHits    uint64
+	Revalidated uint64 // stale entries confirmed by a 304
+	Misses      uint64 // fetched (or failed) from the origin
+	Shared      uint64 // waited for the same fetch by another render
+	Late        uint64 // missed the render's image budget
+}
+
+var imgCounters struct {
+	memory, disk, revalidated, misses, shared, late atomic.Uint64
+}
+
+// ImageCacheStats returns a snapshot of the image cache counters.
+func ImageCacheStats() ImageCacheCounters {
+	return ImageCacheCounters{
+		MemoryHits:  imgCounters.memory.Load(),
+		DiskHits:    imgCounters.disk.Load(),
+		Revalidated: imgCounters.revalidated.Load(),
+		Misses:      imgCounters.misses.Load(),
+		Shared:      imgCounters.shared.Load(),
+		Late:        imgCounters.late.Load(),
+	}
+}
+
+var (
+	upstreamErrMu sync.Mutex
+	upstreamErrs  = map[string]uint64{}
+)
+
+// UpstreamErrorCounts returns the number of failed page loads per error class:
+// timeout, dns, connect, tls, canceled, read, status_4xx, status_5xx, other.
+func UpstreamErrorCounts() map[string]uint64 {
+	upstreamErrMu.Lock()
+	defer upstreamErrMu.Unlock()
+	out := make(map[string]uint64, len(upstreamErrs))
+	for k, v := range upstreamErrs {
+		out[k] = v
+	}
+	return out
+}
+
+func recordUpstreamError(class string) {
+	upstreamErrMu.Lock()
+	upstreamErrs[class]++
+	upstreamErrMu.Unlock()
+}
+
+func recordUpstreamStatus(status int) {
+	switch {
+	case status >= 500:
+		recordUpstreamError("status_5xx")
+	case status >= 400:
+		recordUpstreamError("status_4xx")
+	}
+}
+
+// classifyUpstreamError maps a transport error onto a small set of classes.
+func classifyUpstreamError(err error) string {
+	var dnsErr *net.DNSError
+	var opErr *net.OpError
+	var netErr net.Error
+	var certErr *tls.CertificateVerificationError
+	var unknownAuth x509.UnknownAuthorityError
+	var hostErr x509.HostnameError
+	var recErr tls.RecordHeaderError
+	switch {
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.As(err, &dnsErr):
+		return "dns"
+	case errors.As(err, &certErr), errors.As(err, &unknownAuth), errors.As(err, &hostErr), errors.As(err, &recErr):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	case errors.As(err, &opErr) && opErr.Op == "dial":
+		return "connect"
+	}
+	return "other"
+}
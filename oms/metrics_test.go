@@ -0,0 +1,27 @@
+package oms
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"testing"
+)
+
+func TestClassifyUpstreamError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want string
+	}{
+		{context.Canceled, "canceled"},
+		{fmt.Errorf("get: %w", context.DeadlineExceeded), "timeout"},
+		{&net.DNSError{Err: "no such host", Name: "nope.invalid"}, "dns"},
+		{&net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, "connect"},
+		{errors.New("boom"), "other"},
+	}
+	for _, tc := range cases {
+		if got := classifyUpstreamError(tc.err); got != tc.want {
+			t.Errorf("classifyUpstreamError(%v) = %q, want %q", tc.err, got, tc.want)
+		}
+	}
+}
@@ -273,6 +273,10 @@ func SelectOMSPartFromPackedWithNav(data []byte, page, maxTags int, serverBase,
 		return data, 1, 1, nil
 	}
 	total := len(parts)
+	if total == 1 {
+		// Like the renderer, a page that fits one part gets no navigation.
+		return SelectOMSPartFromPacked(data, 1, maxTags)
+	}
 	if page > total {
 		page = total
 	}
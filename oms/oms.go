@@ -9,9 +9,6 @@ import (
 	"encoding/base64"
 	"encoding/binary"
 	"image"
-	"image/gif"
-	"image/jpeg"
-	"image/png"
 	"io"
 	"mime"
 	"net"
@@ -24,9 +21,8 @@ import (
 	_ "golang.org/x/image/webp"
 
 	"fmt"
-	"log"
+	"log/slog"
 	"math"
-	"os"
 	"strconv"
 	"sync"
 	"time"
@@ -35,10 +31,19 @@ import (
 	"golang.org/x/net/html"
 )
 
-var ProxyCookieJarStore interface {
+// CookieJarSource hands out the upstream cookie jar for a client key.
+type CookieJarSource interface {
 	Get(key string) http.CookieJar
-} = nil
+}
+
+// ProxyCookieJarStore and ProxyDeriveClientKey pick the jar LoadPageWithHeaders
+// uses when no jar is passed explicitly.
+//
+// Deprecated: a package-level store is shared by every server in the process.
+// Pass the jar through RenderOptions.Jar or LoadPageWithJar instead.
+var ProxyCookieJarStore CookieJarSource = nil
 
+// Deprecated: see ProxyCookieJarStore.
 var ProxyDeriveClientKey func(r *http.Request) string = nil
 
 const defaultUpstreamUA = "Mozilla/5.0 (Linux; Android 9; OMS Test) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/120 Safari/537.36"
@@ -117,25 +122,10 @@ func addTextWithColor(p *Page, st *walkState, n *html.Node, text string) {
 	p.AddStyle(style | (uint32(calcColor(current)) << 8))
 }
 
-// splitByTags splits a raw payload (without V2 header) into parts with at most
-// maxTags tags each. Each part starts with the original leading OMS string (URL).
-// maxBytesBudget returns the per-part byte budget used for pagination.
-// Default is 32KB, optionally overridden by OMS_PAGINATE_BYTES (min 1KB).
+// maxBytesBudget returns the default per-part byte budget used for pagination
+// (Options.PaginateBytes of DefaultOptions, 32KB unless configured).
 func maxBytesBudget() int {
-	maxBytes := defaultPaginationBytes
-	if s := strings.TrimSpace(os.Getenv("OMS_PAGINATE_BYTES")); s != "" {
-		if v, err := strconv.Atoi(s); err == nil {
-			if v <= 0 {
-				maxBytes = 0
-			} else {
-				maxBytes = v
-			}
-		}
-	}
-	if maxBytes > 0 && maxBytes < 1024 {
-		maxBytes = 1024
-	}
-	return maxBytes
+	return DefaultOptions().paginationBytes()
 }
 
 // shrinkPartToMaxBytes trims a single part (prefix + tagged body) so that its
@@ -283,11 +273,17 @@ func shrinkPartToMaxBytes(part []byte, limit int, styleDataLen int) []byte {
 	return append([]byte{}, part[:p]...)
 }
 
+// splitByTags splits a raw payload (without V2 header) into parts with at most
+// maxTags tags each. Each part starts with the original leading OMS string (URL).
 func splitByTags(b []byte, maxTags int, clientVersion ClientVersion) [][]byte {
+	return splitByTagsBudget(b, maxTags, maxBytesBudget(), clientVersion)
+}
+
+// splitByTagsBudget is splitByTags with an explicit per-part byte budget (0 = unlimited).
+func splitByTagsBudget(b []byte, maxTags, maxBytes int, clientVersion ClientVersion) [][]byte {
 	if maxTags <= 0 || len(b) < 2 {
 		return [][]byte{b}
 	}
-	maxBytes := maxBytesBudget()
 	styleDataLen := 4
 	if clientVersion == ClientVersion3 {
 		styleDataLen = 6
@@ -574,6 +570,7 @@ type imgEntry struct {
 	key        string
 	data       []byte
 	w, h       int
+	meta       imgMeta
 	prev, next *imgEntry
 }
 
@@ -614,20 +611,20 @@ func (c *imgLRU) moveFront(e *imgEntry) {
 	}
 }
 
-func (c *imgLRU) get(key string) ([]byte, int, int, bool) {
+func (c *imgLRU) get(key string) ([]byte, int, int, imgMeta, bool) {
 	if c == nil {
-		return nil, 0, 0, false
+		return nil, 0, 0, imgMeta{}, false
 	}
 	c.mu.Lock()
 	defer c.mu.Unlock()
 	if e, ok := c.m[key]; ok {
 		c.moveFront(e)
-		return append([]byte(nil), e.data...), e.w, e.h, true
+		return append([]byte(nil), e.data...), e.w, e.h, e.meta, true
 	}
-	return nil, 0, 0, false
+	return nil, 0, 0, imgMeta{}, false
 }
 
-func (c *imgLRU) put(key string, data []byte, w, h int) {
+func (c *imgLRU) put(key string, data []byte, w, h int, meta imgMeta) {
 	if c == nil || c.max <= 0 {
 		return
 	}
@@ -637,10 +634,11 @@ func (c *imgLRU) put(key string, data []byte, w, h int) {
 		c.size -= int64(len(e.data))
 		e.data = append([]byte(nil), data...)
 		e.w, e.h = w, h
+		e.meta = meta
 		c.size += int64(len(e.data))
 		c.moveFront(e)
 	} else {
-		e := &imgEntry{key: key, data: append([]byte(nil), data...), w: w, h: h}
+		e := &imgEntry{key: key, data: append([]byte(nil), data...), w: w, h: h, meta: meta}
 		e.next = c.head
 		if c.head != nil {
 			c.head.prev = e
@@ -652,6 +650,10 @@ func (c *imgLRU) put(key string, data []byte, w, h int) {
 		c.m[key] = e
 		c.size += int64(len(e.data))
 	}
+	c.evictLocked()
+}
+
+func (c *imgLRU) evictLocked() {
 	for c.size > c.max && c.tail != nil {
 		old := c.tail
 		delete(c.m, old.key)
@@ -665,35 +667,44 @@ func (c *imgLRU) put(key string, data []byte, w, h int) {
 	}
 }
 
-var globalImgCache = func() *imgLRU {
-	mb := 100
-	if s := os.Getenv("OMS_IMG_CACHE_MB"); s != "" {
-		if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && v >= 0 {
-			mb = v
-		}
-	}
-	if mb <= 0 {
-		return nil
-	}
-	return newImgLRU(int64(mb) * 1024 * 1024)
-}()
+// resize changes the byte budget; zero disables the cache and drops its entries.
+func (c *imgLRU) resize(max int64) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.max = max
+	c.evictLocked()
+}
+
+var (
+	imgCacheOnce   sync.Once
+	globalImgCache *imgLRU
+)
+
+// imageCache returns the shared in-memory image cache, sized from DefaultOptions
+// on first use.
+func imageCache() *imgLRU {
+	imgCacheOnce.Do(func() {
+		globalImgCache = newImgLRU(DefaultOptions().imageCacheBytes())
+	})
+	return globalImgCache
+}
+
+// configureImageCaches applies o to the memory and disk image caches.
+func configureImageCaches(o Options) {
+	imageCache().resize(o.imageCacheBytes())
+	configureDiskCache(o)
+}
 
 func imgCacheKey(format string, quality int, url string) string {
 	return format + "|q=" + strconv.Itoa(quality) + "|" + url
 }
 
-func imgCacheGet(format string, quality int, url string) ([]byte, int, int, bool) {
-	if globalImgCache == nil {
-		return nil, 0, 0, false
-	}
-	return globalImgCache.get(imgCacheKey(format, quality, url))
+func imgCacheGet(format string, quality int, url string) ([]byte, int, int, imgMeta, bool) {
+	return imageCache().get(imgCacheKey(format, quality, url))
 }
 
-func imgCachePut(format string, quality int, url string, data []byte, w, h int) {
-	if globalImgCache == nil {
-		return
-	}
-	globalImgCache.put(imgCacheKey(format, quality, url), data, w, h)
+func imgCachePut(format string, quality int, url string, data []byte, w, h int, meta imgMeta) {
+	imageCache().put(imgCacheKey(format, quality, url), data, w, h, meta)
 }
 
 func addHeader(p *Page) {
@@ -719,120 +730,15 @@ func LoadPage(oURL string) (*Page, error) {
 	return LoadPageWithHeaders(oURL, nil)
 }
 
-// ---------------------- Charset helpers ----------------------
-
-// decodeLegacyToUTF8 converts known legacy encodings to UTF-8 based on header or meta hints.
-// Currently supports windows-1251; others fall back to raw bytes.
-func decodeLegacyToUTF8(body []byte, contentType string) []byte {
-	cs := sniffCharset(body, contentType)
-	lcs := strings.ToLower(strings.TrimSpace(cs))
-	switch lcs {
-	case "windows-1251", "cp1251", "win-1251", "charset=windows-1251":
-		return cp1251ToUTF8(body)
-	case "koi8-r", "koi8r", "charset=koi8-r":
-		return koi8rToUTF8(body)
-	default:
-		return body
-	}
-}
-
-func sniffCharset(body []byte, contentType string) string {
-	s := strings.ToLower(contentType)
-	if i := strings.Index(s, "charset="); i != -1 {
-		v := s[i+8:]
-		// trim separators and quotes
-		for j, c := range v {
-			if c == ';' || c == ' ' || c == '"' || c == '\'' {
-				v = v[:j]
-				break
-			}
-		}
-		return strings.TrimSpace(v)
-	}
-	// Search first 2KB of body for meta charset
-	n := len(body)
-	if n > 2048 {
-		n = 2048
-	}
-	low := strings.ToLower(string(body[:n]))
-	if i := strings.Index(low, "charset="); i != -1 {
-		v := low[i+8:]
-		for j, c := range v {
-			if c == ';' || c == ' ' || c == '"' || c == '\'' || c == '>' {
-				v = v[:j]
-				break
-			}
-		}
-		return strings.TrimSpace(v)
-	}
-	return "utf-8"
-}
-
-// cp1251ToUTF8 decodes Windows-1251 bytes into UTF-8 (subset sufficient for Cyrillic text).
-func cp1251ToUTF8(b []byte) []byte {
-	var out bytes.Buffer
-	for _, c := range b {
-		switch {
-		case c < 0x80:
-			out.WriteByte(c)
-		case c >= 0xC0 && c <= 0xDF: // Рђ..РЇ
-			ci := int(c)
-			r := rune(0x0410 + (ci - 0xC0))
-			out.WriteRune(r)
-		case c >= 0xE0 && c <= 0xFF: // Р°..СЏ
-			ci := int(c)
-			r := rune(0x0430 + (ci - 0xE0))
-			out.WriteRune(r)
-		case c == 0xA8: // РЃ
-			out.WriteRune('\u0401')
-		case c == 0xB8: // С‘
-			out.WriteRune('\u0451')
-		case c == 0xA0: // NBSP -> space
-			out.WriteByte(' ')
-		default:
-			// Best-effort: replace with '?'
-			out.WriteByte('?')
-		}
-	}
-	return out.Bytes()
-}
-
-// koi8rToUTF8 decodes KOI8-R to UTF-8 covering common Cyrillic letters.
-func koi8rToUTF8(b []byte) []byte {
-	// Accurate KOI8-R mapping table for bytes 0x80..0xFF.
-	// See https://en.wikipedia.org/wiki/KOI8-R
-	var table = [128]rune{
-		0x2500, 0x2502, 0x250C, 0x2510, 0x2514, 0x2518, 0x251C, 0x2524, // 0x80..0x87
-		0x252C, 0x2534, 0x253C, 0x2580, 0x2584, 0x2588, 0x258C, 0x2590, // 0x88..0x8F
-		0x2591, 0x2592, 0x2593, 0x2320, 0x25A0, 0x2219, 0x221A, 0x2248, // 0x90..0x97
-		0x2264, 0x2265, 0x00A0, 0x2321, 0x00B0, 0x00B2, 0x00B7, 0x00F7, // 0x98..0x9F
-		0x2550, 0x2551, 0x2552, 0x0451, 0x2553, 0x2554, 0x2555, 0x2556, // 0xA0..0xA7
-		0x2557, 0x2558, 0x2559, 0x255A, 0x255B, 0x255C, 0x255D, 0x255E, // 0xA8..0xAF
-		0x255F, 0x2560, 0x2561, 0x0401, 0x2562, 0x2563, 0x2564, 0x2565, // 0xB0..0xB7
-		0x2566, 0x2567, 0x2568, 0x2569, 0x256A, 0x256B, 0x256C, 0x00A9, // 0xB8..0xBF
-		0x044E, 0x0430, 0x0431, 0x0446, 0x0434, 0x0435, 0x0444, 0x0433, // 0xC0..0xC7
-		0x0445, 0x0438, 0x0439, 0x043A, 0x043B, 0x043C, 0x043D, 0x043E, // 0xC8..0xCF
-		0x043F, 0x044F, 0x0440, 0x0441, 0x0442, 0x0443, 0x0436, 0x0432, // 0xD0..0xD7
-		0x044C, 0x044B, 0x0437, 0x0448, 0x044D, 0x0449, 0x0447, 0x044A, // 0xD8..0xDF
-		0x042E, 0x0410, 0x0411, 0x0426, 0x0414, 0x0415, 0x0424, 0x0413, // 0xE0..0xE7
-		0x0425, 0x0418, 0x0419, 0x041A, 0x041B, 0x041C, 0x041D, 0x041E, // 0xE8..0xEF
-		0x041F, 0x042F, 0x0420, 0x0421, 0x0422, 0x0423, 0x0416, 0x0412, // 0xF0..0xF7
-		0x042C, 0x042B, 0x0417, 0x0428, 0x042D, 0x0429, 0x0427, 0x042A, // 0xF8..0xFF
-	}
-	var out bytes.Buffer
-	for _, c := range b {
-		if c < 0x80 {
-			out.WriteByte(c)
-		} else {
-			out.WriteRune(table[int(c-0x80)])
-		}
-	}
-	return out.Bytes()
-}
-
 // LoadPageWithHeaders performs HTTP GET with optional headers and converts the HTML into OMS.
 // Unlike the legacy C code, non-200 statuses are still parsed when a body is present.
 func LoadPageWithHeaders(oURL string, hdr http.Header) (*Page, error) {
+	return LoadPageWithJar(oURL, hdr, nil)
+}
+
+// LoadPageWithJar is LoadPageWithHeaders sending and storing cookies in jar.
+// A nil jar falls back to the deprecated ProxyCookieJarStore.
+func LoadPageWithJar(oURL string, hdr http.Header, jar http.CookieJar) (*Page, error) {
 	req, err := http.NewRequest(http.MethodGet, oURL, nil)
 
 	// РџСЂРѕСЃС‚Р°РІРёРј РґРµС„РѕР»С‚РЅС‹Рµ Р·Р°РіРѕР»РѕРІРєРё, РµСЃР»Рё РЅРµ РїРµСЂРµРґР°Р»Рё
@@ -862,8 +768,7 @@ func LoadPageWithHeaders(oURL string, hdr http.Header) (*Page, error) {
 		}
 	}
 
-	jar := http.CookieJar(nil)
-	if ProxyCookieJarStore != nil && ProxyDeriveClientKey != nil {
+	if jar == nil && ProxyCookieJarStore != nil && ProxyDeriveClientKey != nil {
 		jar = ProxyCookieJarStore.Get(ProxyDeriveClientKey(req))
 	}
 
@@ -1030,9 +935,9 @@ func renderImageFromURL(p *Page, st *walkState, base, src, alt string, prefs Ren
 		return
 	}
 	abs := resolveLink(base, src)
-	if ib, w, h, ok := fetchAndEncodeImage(abs[2:], prefs); ok {
-		if len(ib) <= prefs.MaxInlineKB*1024 {
-			p.AddImageInline(w, h, ib)
+	if ib, w, h, ok := prefs.fetchImage(abs[2:]); ok {
+		if ib, fw, fh, fits := prefs.fitImage(ib, w, h, false); fits {
+			p.AddImageInline(fw, fh, ib)
 		} else {
 			if st != nil && st.inLink {
 				p.AddImagePlaceholder(w, h)
@@ -1064,6 +969,46 @@ func walk(n *html.Node, base string, p *Page) {
 	walkRich(n, base, p, visited, &st, prefs)
 }
 
+// imgSource returns the URL an <img> is rendered from: src, else the first
+// srcset candidate, else a common lazy-loading attribute.
+func imgSource(n *html.Node) string {
+	src := strings.TrimSpace(getAttr(n, "src"))
+	if src == "" {
+		if ss := strings.TrimSpace(getAttr(n, "srcset")); ss != "" {
+			src = pickSrcFromSrcset(ss)
+		}
+	}
+	for _, attr := range []string{"data-src", "data-original", "data-lazy-src"} {
+		if src != "" {
+			break
+		}
+		src = strings.TrimSpace(getAttr(n, attr))
+	}
+	return src
+}
+
+// pictureSource returns the URL a <picture> is rendered from: the first
+// <source> with a srcset or src, else its <img> src.
+func pictureSource(n *html.Node) string {
+	chosen := ""
+	for s := n.FirstChild; s != nil && chosen == ""; s = s.NextSibling {
+		if s.Type == html.ElementNode && strings.EqualFold(s.Data, "source") {
+			if ss := strings.TrimSpace(getAttr(s, "srcset")); ss != "" {
+				chosen = pickSrcFromSrcset(ss)
+			}
+			if chosen == "" {
+				chosen = strings.TrimSpace(getAttr(s, "src"))
+			}
+		}
+	}
+	if chosen == "" {
+		if img := findFirstChild(n, "img"); img != nil {
+			chosen = strings.TrimSpace(getAttr(img, "src"))
+		}
+	}
+	return chosen
+}
+
 // pickSrcFromSrcset returns the first URL from a srcset string.
 func pickSrcFromSrcset(srcset string) string {
 	s := strings.TrimSpace(srcset)
@@ -1138,6 +1083,10 @@ type walkState struct {
 	bgStack    []string
 	curBg      string
 	formStack  []string
+	forms      []*FormSpec
+	// inTableCell is set while renderTable writes cells so that inline
+	// content keeps each table row on one line.
+	inTableCell bool
 }
 
 // resolveFormActionURL resolves a form action reference against the base page URL and
@@ -1233,6 +1182,40 @@ type RenderOptions struct {
 	ClientVersion ClientVersion
 	// Optional JavaScript baking configuration (nil = auto/off).
 	JS *JSBakingOptions
+	// Engine overrides the process-wide renderer options (nil = DefaultOptions()).
+	Engine *Options
+	// Validators of a stale cached render; when set, plain GET loads become
+	// conditional and a 304 yields a Page with NotModified set.
+	IfNoneMatch     string
+	IfModifiedSince string
+	// Logger receives render and upstream events (nil = slog.Default()).
+	Logger *slog.Logger
+	// KeepLayoutTables walks layout tables in source order, cell by cell,
+	// instead of linearising them with the main content column first.
+	KeepLayoutTables bool
+	// Reader renders only the extracted main content (title, byline,
+	// headings, inline images and in-text links).
+	Reader bool
+	// Form is the registry entry of the form FormBody was submitted from. When
+	// set the submission is replayed from it; otherwise method and action are
+	// guessed from the payload.
+	Form *FormSpec
+	// FormFiles maps the file inputs of that form to the upload picked for
+	// them. A nil entry submits the input without a file.
+	FormFiles map[string]*FormUpload
+	// FormCharset is the charset remembered for the action FormBody posts
+	// to. It encodes submissions without a Form entry (empty = UTF-8).
+	FormCharset string
+	// UploadSlots are offered as choices for <input type=file> controls.
+	UploadSlots []UploadSlot
+	// DeviceCharset is the handset's preferred encoding (E= or its
+	// Accept-Charset). It breaks ties when a page declares no charset.
+	DeviceCharset string
+
+	// images are the page's images fetched ahead of the walk.
+	images *imagePrefetch
+	// imageBytes is what is left of the render's image byte budget.
+	imageBytes *imageBudget
 }
 
 // JSExecutionMode controls whether JS baking should be applied.
@@ -1282,6 +1265,19 @@ func cloneHeader(h http.Header) http.Header {
 	return out
 }
 
+// originCacheHeaders lists the response headers that affect render-cache freshness.
+var originCacheHeaders = []string{"Cache-Control", "Pragma", "Expires", "Date", "Age", "Vary", "Last-Modified", "ETag"}
+
+func cacheHeadersFrom(h http.Header) http.Header {
+	out := http.Header{}
+	for _, name := range originCacheHeaders {
+		if vs := h.Values(name); len(vs) > 0 {
+			out[http.CanonicalHeaderKey(name)] = append([]string(nil), vs...)
+		}
+	}
+	return out
+}
+
 func shouldOfferDownload(header http.Header) bool {
 	if header == nil {
 		return false
@@ -1434,6 +1430,9 @@ func BuildPaginationLink(target string, opts *RenderOptions, page, maxTags int)
 		clean = u.String()
 	}
 	if page <= 1 {
+		if opts != nil && opts.Reader {
+			return BuildReaderLink(clean)
+		}
 		return clean
 	}
 	frag := url.Values{}
@@ -1471,6 +1470,9 @@ func BuildPaginationLink(target string, opts *RenderOptions, page, maxTags int)
 		if opts.NumColors > 0 {
 			frag.Set("c", strconv.Itoa(opts.NumColors))
 		}
+		if opts.Reader {
+			frag.Set("reader", "1")
+		}
 	}
 	encoded := frag.Encode()
 	if encoded == "" {
@@ -1825,50 +1827,48 @@ func hasTextContent(n *html.Node) bool {
 	return false
 }
 
-func renderBackgroundImage(n *html.Node, props map[string]string, base string, p *Page, prefs RenderOptions) bool {
-	if n == nil || p == nil {
-		return false
-	}
-	// Never draw background sprites directly on form controls to avoid
-	// covering native widgets (search button/inputs etc.).
-	if n.Type == html.ElementNode && isFormControlTag(n.Data) {
-		return false
-	}
-	// Also avoid background images for containers that include form controls.
-	if containsFormControl(n) {
-		return false
-	}
+// backgroundImageValue returns the url() of n's background image, or "" when
+// it has none or is (or holds) a form control.
+func backgroundImageValue(n *html.Node, props map[string]string) string {
 	inlineStyle := getAttr(n, "style")
 	bgVal := cssPropValue(props, inlineStyle, "background-image")
 	if bgVal == "" {
 		bgVal = cssPropValue(props, inlineStyle, "background")
 	}
-	if bgVal == "" {
-		return false
-	}
 	urlVal := extractBackgroundImageURL(bgVal)
 	if urlVal == "" {
-		return false
+		return ""
 	}
-	if !prefs.ImagesOn {
-		if hasTextContent(n) {
-			return false
-		}
-		p.AddText("*")
-		return true
+	// Never draw background sprites directly on form controls to avoid
+	// covering native widgets (search button/inputs etc.).
+	if n.Type == html.ElementNode && isFormControlTag(n.Data) {
+		return ""
+	}
+	// Also avoid background images for containers that include form controls.
+	if containsFormControl(n) {
+		return ""
 	}
+	return urlVal
+}
+
+// inlineBackgroundURL returns the absolute URL of the background image n is
+// drawn with, and its box size hints. It is "" for boxes with text on top,
+// repeating backgrounds and boxes too large to be icons.
+func inlineBackgroundURL(n *html.Node, props map[string]string, base string, prefs RenderOptions) (string, int, int) {
+	urlVal := backgroundImageValue(n, props)
 	// No tag restriction: any element can carry a small decorative background
-	if hasTextContent(n) {
-		return false
+	if urlVal == "" || hasTextContent(n) {
+		return "", 0, 0
 	}
+	inlineStyle := getAttr(n, "style")
 	repeat := strings.ToLower(cssPropValue(props, inlineStyle, "background-repeat"))
 	if repeat != "" && repeat != "no-repeat" && repeat != "initial" {
-		return false
+		return "", 0, 0
 	}
 	widthHint := cssValueToPx(cssPropValue(props, inlineStyle, "width"), prefs.ScreenW)
 	heightHint := cssValueToPx(cssPropValue(props, inlineStyle, "height"), prefs.ScreenH)
 	if widthHint > maxInlineBackgroundSize || heightHint > maxInlineBackgroundSize {
-		return false
+		return "", 0, 0
 	}
 	abs := urlVal
 	if !strings.HasPrefix(urlVal, "data:") {
@@ -1878,13 +1878,32 @@ func renderBackgroundImage(n *html.Node, props map[string]string, base string, p
 			}
 		}
 		if !strings.Contains(abs, "://") && !strings.HasPrefix(abs, "data:") {
+			return "", 0, 0
+		}
+	}
+	return abs, widthHint, heightHint
+}
+
+func renderBackgroundImage(n *html.Node, props map[string]string, base string, p *Page, prefs RenderOptions) bool {
+	if n == nil || p == nil {
+		return false
+	}
+	if !prefs.ImagesOn {
+		if backgroundImageValue(n, props) == "" || hasTextContent(n) {
 			return false
 		}
+		p.AddText("*")
+		return true
+	}
+	abs, widthHint, heightHint := inlineBackgroundURL(n, props, base, prefs)
+	if abs == "" {
+		return false
 	}
+	inlineStyle := getAttr(n, "style")
 	// Parse background-position for sprite cropping if present
 	posX, posY, hasPos := parseBackgroundPosition(cssPropValue(props, inlineStyle, "background-position"))
 
-	data, w, h, ok := fetchAndEncodeImage(abs, prefs)
+	data, w, h, ok := prefs.fetchImage(abs)
 	if !ok {
 		return false
 	}
@@ -1900,22 +1919,23 @@ func renderBackgroundImage(n *html.Node, props map[string]string, base string, p
 	if widthHint > maxInlineBackgroundSize || heightHint > maxInlineBackgroundSize {
 		return false
 	}
-	if prefs.MaxInlineKB > 0 && len(data) > prefs.MaxInlineKB*1024 {
-		return false
-	}
 	if hasPos {
 		// CSS background-position offsets shift the image relative to the box.
 		// Negative values mean the sprite is shifted left/up, so visible region starts at -pos.
 		cropX := -posX
 		cropY := -posY
 		if cropped, ok := fetchAndEncodeImageRegion(abs, prefs, cropX, cropY, widthHint, heightHint); ok {
-			if prefs.MaxInlineKB <= 0 || len(cropped) <= prefs.MaxInlineKB*1024 {
+			if cropped, _, _, fits := prefs.fitImage(cropped, widthHint, heightHint, true); fits {
 				p.AddImageInline(widthHint, heightHint, cropped)
 				return true
 			}
 		}
 		// If cropping fails, fall back to full image rendering.
 	}
+	data, _, _, ok = prefs.fitImage(data, w, h, true)
+	if !ok {
+		return false
+	}
 	p.AddImageInline(widthHint, heightHint, data)
 	return true
 }
@@ -2136,11 +2156,11 @@ func fetchAndEncodeImageRegion(absURL string, prefs RenderOptions, x, y, w, h in
 	regionKey := absURL + "#rect=" + strconv.Itoa(x) + "," + strconv.Itoa(y) + "," + strconv.Itoa(w) + "," + strconv.Itoa(h)
 	candidates := cacheCandidatesFor(prefs)
 	for _, cand := range candidates {
-		if data, _, _, ok := imgCacheGet(cand.format, cand.quality, regionKey); ok {
+		if data, _, _, _, ok := imgCacheGet(cand.format, cand.quality, regionKey); ok {
 			return data, true
 		}
-		if data, _, _, ok := diskCacheGet(cand.format, cand.quality, regionKey); ok {
-			imgCachePut(cand.format, cand.quality, regionKey, data, w, h)
+		if data, _, _, meta, ok := diskCacheGet(cand.format, cand.quality, regionKey); ok {
+			imgCachePut(cand.format, cand.quality, regionKey, data, w, h, meta)
 			return data, true
 		}
 	}
@@ -2149,12 +2169,12 @@ func fetchAndEncodeImageRegion(absURL string, prefs RenderOptions, x, y, w, h in
 	var srcBytes []byte
 	var have bool
 	for _, cand := range candidates {
-		if data, _, _, ok := imgCacheGet(cand.format, cand.quality, absURL); ok {
+		if data, _, _, _, ok := imgCacheGet(cand.format, cand.quality, absURL); ok {
 			srcBytes = data
 			have = true
 			break
 		}
-		if data, _, _, ok := diskCacheGet(cand.format, cand.quality, absURL); ok {
+		if data, _, _, _, ok := diskCacheGet(cand.format, cand.quality, absURL); ok {
 			srcBytes = data
 			have = true
 			break
@@ -2224,7 +2244,7 @@ func fetchAndEncodeImageRegion(absURL string, prefs RenderOptions, x, y, w, h in
 	}
 
 	// Decode and crop
-	img, _, err := image.Decode(bytes.NewReader(srcBytes))
+	img, err := decodeImageBytes(srcBytes, "", prefs)
 	if err != nil {
 		return nil, false
 	}
@@ -2268,8 +2288,9 @@ func fetchAndEncodeImageRegion(absURL string, prefs RenderOptions, x, y, w, h in
 	if err != nil {
 		return nil, false
 	}
-	imgCachePut(format, quality, regionKey, data, w, h)
-	diskCachePut(format, quality, regionKey, data, w, h)
+	format = cacheFormat(format, prefs)
+	imgCachePut(format, quality, regionKey, data, w, h, imgMeta{})
+	diskCachePut(format, quality, regionKey, data, w, h, imgMeta{})
 	return data, true
 }
 
@@ -2319,63 +2340,8 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 					st.pushStyle(p, st.curStyle|styleRightBit)
 					alignedPushed = true
 				}
-				styleOverride := st.curStyle
-				styleChanged := false
-				if weight := strings.TrimSpace(cssEffectiveProp(c, st.css, props, "font-weight")); weight != "" {
-					lw := strings.ToLower(weight)
-					switch {
-					case strings.Contains(lw, "bold"), strings.Contains(lw, "bolder"):
-						if styleOverride&styleBoldBit == 0 {
-							styleOverride |= styleBoldBit
-							styleChanged = true
-						}
-					case strings.Contains(lw, "normal"), strings.Contains(lw, "lighter"):
-						if styleOverride&styleBoldBit != 0 {
-							styleOverride &^= styleBoldBit
-							styleChanged = true
-						}
-					default:
-						if n, err := strconv.Atoi(lw); err == nil {
-							if n >= 600 {
-								if styleOverride&styleBoldBit == 0 {
-									styleOverride |= styleBoldBit
-									styleChanged = true
-								}
-							} else if n > 0 && styleOverride&styleBoldBit != 0 {
-								styleOverride &^= styleBoldBit
-								styleChanged = true
-							}
-						}
-					}
-				}
-				if fs := strings.ToLower(strings.TrimSpace(cssEffectiveProp(c, st.css, props, "font-style"))); fs != "" {
-					if strings.Contains(fs, "italic") || strings.Contains(fs, "oblique") {
-						if styleOverride&styleItalicBit == 0 {
-							styleOverride |= styleItalicBit
-							styleChanged = true
-						}
-					} else if strings.Contains(fs, "normal") {
-						if styleOverride&styleItalicBit != 0 {
-							styleOverride &^= styleItalicBit
-							styleChanged = true
-						}
-					}
-				}
-				if td := strings.ToLower(strings.TrimSpace(cssEffectiveProp(c, st.css, props, "text-decoration"))); td != "" {
-					if strings.Contains(td, "underline") {
-						if styleOverride&styleUnderBit == 0 {
-							styleOverride |= styleUnderBit
-							styleChanged = true
-						}
-					} else if strings.Contains(td, "none") {
-						if styleOverride&styleUnderBit != 0 {
-							styleOverride &^= styleUnderBit
-							styleChanged = true
-						}
-					}
-				}
-				if styleChanged && styleOverride != st.curStyle {
-					st.pushStyle(p, styleOverride)
+				if style := cssTextStyle(c, st.css, props, st.curStyle); style != st.curStyle {
+					st.pushStyle(p, style)
 					stylePushed = true
 				}
 				if col := strings.TrimSpace(cssEffectiveProp(c, st.css, props, "color")); col != "" {
@@ -2791,6 +2757,9 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 					}
 				}
 			}
+			if st.inTableCell && !blockWrap {
+				shouldBreak = false
+			}
 			if !shouldBreak && iconOnly {
 				p.AddText(" ")
 			}
@@ -2800,22 +2769,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			recurse = false
 		case "img":
 			// Images handling based on client prefs
-			src := strings.TrimSpace(getAttr(c, "src"))
-			if src == "" {
-				if ss := strings.TrimSpace(getAttr(c, "srcset")); ss != "" {
-					src = pickSrcFromSrcset(ss)
-				}
-			}
-			if src == "" {
-				// Common lazy-loading attributes
-				src = strings.TrimSpace(getAttr(c, "data-src"))
-				if src == "" {
-					src = strings.TrimSpace(getAttr(c, "data-original"))
-				}
-				if src == "" {
-					src = strings.TrimSpace(getAttr(c, "data-lazy-src"))
-				}
-			}
+			src := imgSource(c)
 			alt := strings.TrimSpace(getAttr(c, "alt"))
 			if alt == "" {
 				if hasAncestorClass(c, "nl") {
@@ -2826,6 +2780,9 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			}
 			renderImageFromURL(p, st, base, src, alt, prefs)
 			recurse = false
+		case "svg":
+			renderInlineSVG(p, st, c, prefs)
+			recurse = false
 		case "caption":
 			if txt := strings.TrimSpace(collectText(c)); txt != "" {
 				markTextNodes(c, visited)
@@ -2970,58 +2927,19 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			p.AddText("+")
 			recurse = false
 		case "table":
-			if hasFormControls(c) || hasAnchorLinks(c) {
-				// let recursion process interactive content to preserve links
-			} else {
-				if cap := findFirstChild(c, "caption"); cap != nil {
-					if txt := strings.TrimSpace(collectText(cap)); txt != "" {
-						markTextNodes(cap, visited)
-						p.AddPlus()
-						p.AddText(txt)
-						p.AddBreak()
-					}
-				}
-				// Traverse sections and rows: thead/tbody/tfoot/tr
-				for sec := c.FirstChild; sec != nil; sec = sec.NextSibling {
-					if sec.Type != html.ElementNode {
-						continue
-					}
-					if strings.EqualFold(sec.Data, "tr") {
-						row := make([]string, 0, 8)
-						for cell := sec.FirstChild; cell != nil; cell = cell.NextSibling {
-							if cell.Type == html.ElementNode && (strings.EqualFold(cell.Data, "td") || strings.EqualFold(cell.Data, "th")) {
-								txt := strings.TrimSpace(collectText(cell))
-								if txt != "" {
-									row = append(row, txt)
-								}
-							}
-						}
-						if len(row) > 0 {
-							p.AddText(strings.Join(row, " | "))
-							p.AddBreak()
-						}
-						continue
-					}
-					if strings.EqualFold(sec.Data, "thead") || strings.EqualFold(sec.Data, "tbody") || strings.EqualFold(sec.Data, "tfoot") {
-						for r := sec.FirstChild; r != nil; r = r.NextSibling {
-							if r.Type == html.ElementNode && strings.EqualFold(r.Data, "tr") {
-								row := make([]string, 0, 8)
-								for cell := r.FirstChild; cell != nil; cell = cell.NextSibling {
-									if cell.Type == html.ElementNode && (strings.EqualFold(cell.Data, "td") || strings.EqualFold(cell.Data, "th")) {
-										txt := strings.TrimSpace(collectText(cell))
-										if txt != "" {
-											row = append(row, txt)
-										}
-									}
-								}
-								if len(row) > 0 {
-									p.AddText(strings.Join(row, " | "))
-									p.AddBreak()
-								}
-							}
-						}
-					}
+			g := buildTableGrid(c, st)
+			switch {
+			case isLayoutTable(c, g):
+				if !prefs.KeepLayoutTables {
+					linearizeLayoutTable(c, g, base, p, visited, st, prefs)
+					recurse = false
 				}
+				// kept layout tables are walked in source order like any
+				// other container
+			case hasNestedTable(c):
+				// inner tables are classified again as recursion reaches them
+			default:
+				renderTable(c, g, base, p, visited, st, prefs)
 				recurse = false
 			}
 		case "details":
@@ -3043,23 +2961,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			}
 			recurse = false
 		case "picture":
-			chosen := ""
-			for s := c.FirstChild; s != nil && chosen == ""; s = s.NextSibling {
-				if s.Type == html.ElementNode && strings.EqualFold(s.Data, "source") {
-					if ss := strings.TrimSpace(getAttr(s, "srcset")); ss != "" {
-						chosen = pickSrcFromSrcset(ss)
-					}
-					if chosen == "" {
-						chosen = strings.TrimSpace(getAttr(s, "src"))
-					}
-				}
-			}
-			if chosen == "" {
-				if img := findFirstChild(c, "img"); img != nil {
-					chosen = strings.TrimSpace(getAttr(img, "src"))
-				}
-			}
-			if chosen != "" {
+			if chosen := pictureSource(c); chosen != "" {
 				alt := "Image"
 				if img := findFirstChild(c, "img"); img != nil {
 					if a := strings.TrimSpace(getAttr(img, "alt")); a != "" {
@@ -3070,10 +2972,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			}
 			recurse = false
 		case "form":
-			action := getAttr(c, "action")
-			p.AddForm(action)
-			absAction := resolveFormActionURL(base, action)
-			st.formStack = append(st.formStack, absAction)
+			st.openForm(c, base, p)
 		case "button":
 			typ := strings.ToLower(getAttr(c, "type"))
 			if typ == "" {
@@ -3085,6 +2984,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			}
 			value := getAttr(c, "value")
 			label := strings.TrimSpace(collectText(c))
+			st.recordField(c, FormField{Name: getAttr(c, "name"), Type: typ, Value: value})
 			if value == "" {
 				value = label
 			}
@@ -3099,6 +2999,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			}
 			recurse = false
 		case "textarea":
+			st.recordField(c, FormField{Name: getAttr(c, "name"), Type: "textarea", Value: collectText(c)})
 			stl := getAttr(c, "style")
 			if stl == "" || !strings.Contains(stl, "display:none") {
 				name := getAttr(c, "name")
@@ -3118,6 +3019,15 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 				name = "dname"
 			}
 			value := getAttr(c, "value")
+			field := FormField{Name: getAttr(c, "name"), Type: typ, Value: value}
+			switch typ {
+			case "checkbox", "radio":
+				field.Checked = boolAttr(c, "checked")
+				if field.Value == "" {
+					field.Value = "on"
+				}
+			}
+			st.recordField(c, field)
 			switch typ {
 			case "text":
 				p.AddTextInput(name, value)
@@ -3139,22 +3049,17 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 				p.AddRadio(name, value, checked)
 			case "hidden":
 				p.AddHidden(name, value)
-				if len(st.formStack) > 0 {
-					actionKey := st.formStack[len(st.formStack)-1]
-					actionKey = strings.TrimSpace(actionKey)
-					if actionKey == "" {
-						actionKey = resolveFormActionURL(base, "")
+				if actionKey := st.formActionKey(base); actionKey != "" {
+					if p.FormHidden[actionKey] == nil {
+						p.FormHidden[actionKey] = make(map[string]string)
 					}
-					if actionKey != "" {
-						if p.FormHidden[actionKey] == nil {
-							p.FormHidden[actionKey] = make(map[string]string)
-						}
-						if _, exists := p.FormHidden[actionKey][name]; !exists {
-							p.FormHidden[actionKey][name] = value
-						}
-						ensureHiddenFieldOverrides(actionKey, p.FormHidden[actionKey])
+					if _, exists := p.FormHidden[actionKey][name]; !exists {
+						p.FormHidden[actionKey][name] = value
 					}
+					ensureHiddenFieldOverrides(actionKey, p.FormHidden[actionKey])
 				}
+			case "file":
+				addFileInput(p, name, prefs.UploadSlots)
 			case "button":
 				p.AddButton(name, value)
 			case "reset":
@@ -3166,6 +3071,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 				name = "dname"
 			}
 			multiple := boolAttr(c, "multiple")
+			st.recordSelect(c, getAttr(c, "name"), multiple)
 			type option struct {
 				label, value string
 				selected     bool
@@ -3208,18 +3114,14 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 					}
 				}
 				if !skip {
-					var txt string
-					if st.pre {
-						txt = c.Data
-					} else {
-						txt = condenseSpaces(c.Data)
+					mode := whiteSpaceFor(c.Parent, st.css, st.pre)
+					txt := collapseWhiteSpace(c.Data, mode)
+					if mode == whiteSpaceNormal && condenseSpaces(txt) == "" {
+						txt = ""
 					}
 					if txt != "" {
-						if !visited[c] {
-							visited[c] = true
-							txt := c.Data
-							addTextWithColor(p, st, c, txt)
-						}
+						visited[c] = true
+						addTextWithColor(p, st, c, txt)
 					}
 				}
 			}
@@ -3240,9 +3142,7 @@ func walkRich(cur *html.Node, base string, p *Page, visited map[*html.Node]bool,
 			st.popBgcolor(p)
 		}
 		if c.Type == html.ElementNode && strings.EqualFold(c.Data, "form") {
-			if len(st.formStack) > 0 {
-				st.formStack = st.formStack[:len(st.formStack)-1]
-			}
+			st.closeForm()
 		}
 		if c.Type == html.ElementNode {
 			switch strings.ToLower(c.Data) {
@@ -3321,24 +3221,6 @@ func hasFormControls(n *html.Node) bool {
 	return found
 }
 
-func hasAnchorLinks(n *html.Node) bool {
-	var rec func(*html.Node) bool
-	rec = func(x *html.Node) bool {
-		for c := x.FirstChild; c != nil; c = c.NextSibling {
-			if c.Type == html.ElementNode {
-				if strings.EqualFold(c.Data, "a") && strings.TrimSpace(getAttr(c, "href")) != "" {
-					return true
-				}
-				if rec(c) {
-					return true
-				}
-			}
-		}
-		return false
-	}
-	return rec(n)
-}
-
 // findFirstImgAlt returns alt text for first <img> under a node
 func findFirstImgAlt(n *html.Node) string {
 	var rec func(*html.Node) string
@@ -3618,13 +3500,13 @@ func cacheCandidatesFor(prefs RenderOptions) []cacheCandidate {
 	}
 	switch want {
 	case "image/png":
-		return []cacheCandidate{{format: "image/png", quality: 0}}
+		return []cacheCandidate{{format: cacheFormat("image/png", prefs), quality: 0}}
 	case "image/gif":
-		return []cacheCandidate{{format: "image/gif", quality: 0}}
+		return []cacheCandidate{{format: cacheFormat("image/gif", prefs), quality: 0}}
 	default:
 		return []cacheCandidate{
-			{format: "image/jpeg", quality: jpegQualityFor(prefs)},
-			{format: "image/png", quality: 0},
+			{format: cacheFormat("image/jpeg", prefs), quality: jpegQualityFor(prefs)},
+			{format: cacheFormat("image/png", prefs), quality: 0},
 		}
 	}
 }
@@ -3637,33 +3519,57 @@ func jpegQualityFor(prefs RenderOptions) int {
 }
 
 func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int, bool) {
-	debug := os.Getenv("OMS_IMG_DEBUG") == "1"
+	debug := prefs.engine().ImageDebug
+	lg := prefs.logger()
 	candidates := cacheCandidatesFor(prefs)
+	now := time.Now()
 
+	// A stale entry with validators is kept aside and revalidated below.
+	type staleImage struct {
+		cand cacheCandidate
+		data []byte
+		w, h int
+		meta imgMeta
+	}
+	var stale *staleImage
 	for _, cand := range candidates {
-		if data, w, h, ok := imgCacheGet(cand.format, cand.quality, absURL); ok {
-			if debug {
-				log.Printf("IMG cache hit mem fmt=%s q=%d url=%s", cand.format, cand.quality, absURL)
+		if data, w, h, meta, ok := imgCacheGet(cand.format, cand.quality, absURL); ok {
+			if !meta.stale(now) {
+				imgCounters.memory.Add(1)
+				if debug {
+					lg.Debug("image cache hit", "tier", "memory", "format", cand.format, "quality", cand.quality, "url", absURL)
+				}
+				return data, w, h, true
 			}
-			return data, w, h, true
+			if stale == nil && meta.hasValidators() {
+				stale = &staleImage{cand: cand, data: data, w: w, h: h, meta: meta}
+			}
+			continue
 		}
-		if data, w, h, ok := diskCacheGet(cand.format, cand.quality, absURL); ok {
-			imgCachePut(cand.format, cand.quality, absURL, data, w, h)
-			if debug {
-				log.Printf("IMG cache hit disk fmt=%s q=%d url=%s", cand.format, cand.quality, absURL)
+		if data, w, h, meta, ok := diskCacheGet(cand.format, cand.quality, absURL); ok {
+			if !meta.stale(now) {
+				imgCachePut(cand.format, cand.quality, absURL, data, w, h, meta)
+				imgCounters.disk.Add(1)
+				if debug {
+					lg.Debug("image cache hit", "tier", "disk", "format", cand.format, "quality", cand.quality, "url", absURL)
+				}
+				return data, w, h, true
+			}
+			if stale == nil && meta.hasValidators() {
+				stale = &staleImage{cand: cand, data: data, w: w, h: h, meta: meta}
 			}
-			return data, w, h, true
 		}
 	}
 
 	if strings.HasPrefix(absURL, "data:") {
 		if data, w, h, format, quality, ok := decodeDataURI(absURL, prefs); ok {
-			imgCachePut(format, quality, absURL, data, w, h)
-			diskCachePut(format, quality, absURL, data, w, h)
+			format = cacheFormat(format, prefs)
+			imgCachePut(format, quality, absURL, data, w, h, imgMeta{})
+			diskCachePut(format, quality, absURL, data, w, h, imgMeta{})
 			return data, w, h, true
 		}
 		if debug {
-			log.Printf("IMG decode data: failed url=%s", absURL)
+			lg.Debug("image data uri decode failed", "url", absURL)
 		}
 		return nil, 0, 0, false
 	}
@@ -3671,10 +3577,13 @@ func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int,
 	req, err := http.NewRequest(http.MethodGet, absURL, nil)
 	if err != nil {
 		if debug {
-			log.Printf("IMG newrequest: %v", err)
+			lg.Debug("image request failed", "url", absURL, "err", err)
 		}
 		return nil, 0, 0, false
 	}
+	if stale == nil {
+		imgCounters.misses.Add(1)
+	}
 	req.Header.Set("Accept", "image/*")
 	if prefs.ReqHeaders != nil {
 		if ua := prefs.ReqHeaders.Get("User-Agent"); ua != "" {
@@ -3700,6 +3609,9 @@ func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int,
 	if prefs.Referrer != "" {
 		req.Header.Set("Referer", prefs.Referrer)
 	}
+	if stale != nil {
+		setConditionalHeaders(req.Header, stale.meta.ETag, stale.meta.LastModified)
+	}
 	client := &http.Client{Timeout: 8 * time.Second}
 	if prefs.Jar != nil {
 		client.Jar = prefs.Jar
@@ -3707,12 +3619,30 @@ func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int,
 	resp, err := client.Do(req)
 	if err != nil {
 		if debug {
-			log.Printf("IMG fetch: %v", err)
+			lg.Debug("image fetch failed", "url", absURL, "err", err)
+		}
+		if stale != nil {
+			// Serving a stale image beats a broken placeholder on a flaky link.
+			return stale.data, stale.w, stale.h, true
 		}
 		return nil, 0, 0, false
 	}
 	defer resp.Body.Close()
 
+	if stale != nil && resp.StatusCode != http.StatusNotModified {
+		imgCounters.misses.Add(1)
+	}
+	if stale != nil && resp.StatusCode == http.StatusNotModified {
+		meta := imgMetaFromHeader(resp.Header, time.Now(), stale.meta)
+		imgCachePut(stale.cand.format, stale.cand.quality, absURL, stale.data, stale.w, stale.h, meta)
+		diskCachePut(stale.cand.format, stale.cand.quality, absURL, stale.data, stale.w, stale.h, meta)
+		imgCounters.revalidated.Add(1)
+		if debug {
+			lg.Debug("image revalidated", "format", stale.cand.format, "quality", stale.cand.quality, "url", absURL)
+		}
+		return stale.data, stale.w, stale.h, true
+	}
+
 	var rc io.ReadCloser = resp.Body
 	switch strings.ToLower(strings.TrimSpace(resp.Header.Get("Content-Encoding"))) {
 	case "gzip":
@@ -3733,15 +3663,15 @@ func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int,
 	raw, err := io.ReadAll(rc)
 	if err != nil || len(raw) == 0 {
 		if debug {
-			log.Printf("IMG read: err=%v len=%d", err, len(raw))
+			lg.Debug("image read failed", "url", absURL, "err", err, "len", len(raw))
 		}
 		return nil, 0, 0, false
 	}
 
-	img, _, err := image.Decode(bytes.NewReader(raw))
+	img, err := decodeImageBytes(raw, resp.Header.Get("Content-Type"), prefs)
 	if err != nil {
 		if debug {
-			log.Printf("IMG decode: %v (ct=%s)", err, resp.Header.Get("Content-Type"))
+			lg.Debug("image decode failed", "url", absURL, "err", err, "content_type", resp.Header.Get("Content-Type"))
 		}
 		return nil, 0, 0, false
 	}
@@ -3749,13 +3679,15 @@ func fetchAndEncodeImage(absURL string, prefs RenderOptions) ([]byte, int, int,
 	data, w, h, format, quality, err := encodeImage(img, prefs)
 	if err != nil {
 		if debug {
-			log.Printf("IMG encode %s: %v", format, err)
+			lg.Debug("image encode failed", "url", absURL, "format", format, "err", err)
 		}
 		return nil, 0, 0, false
 	}
 
-	imgCachePut(format, quality, absURL, data, w, h)
-	diskCachePut(format, quality, absURL, data, w, h)
+	meta := imgMetaFromHeader(resp.Header, time.Now(), imgMeta{})
+	format = cacheFormat(format, prefs)
+	imgCachePut(format, quality, absURL, data, w, h, meta)
+	diskCachePut(format, quality, absURL, data, w, h, meta)
 	return data, w, h, true
 }
 
@@ -3777,47 +3709,10 @@ func clampImageToScreenWidth(img image.Image, maxWidth int) (image.Image, int, i
 	return dst, maxWidth, scaledH
 }
 
+// encodeImage encodes img in the client's image format and quality, scaled
+// down to the screen width.
 func encodeImage(img image.Image, prefs RenderOptions) ([]byte, int, int, string, int, error) {
-	img, w, h := clampImageToScreenWidth(img, prefs.ScreenW)
-
-	want := strings.ToLower(strings.TrimSpace(prefs.ImageMIME))
-	if want == "" {
-		want = "image/jpeg"
-	}
-	if want == "image/jpeg" && imageHasAlpha(img) {
-		want = "image/png"
-	}
-
-	var out bytes.Buffer
-	quality := 0
-
-	switch want {
-	case "image/png":
-		enc := png.Encoder{CompressionLevel: png.DefaultCompression}
-		if prefs.HighQuality {
-			enc.CompressionLevel = png.BestCompression
-		}
-		if err := enc.Encode(&out, img); err != nil {
-			return nil, 0, 0, want, quality, err
-		}
-		return append([]byte(nil), out.Bytes()...), w, h, want, quality, nil
-	case "image/gif":
-		options := &gif.Options{NumColors: 128}
-		if prefs.HighQuality {
-			options.NumColors = 256
-		}
-		if err := gif.Encode(&out, img, options); err != nil {
-			return nil, 0, 0, want, quality, err
-		}
-		return append([]byte(nil), out.Bytes()...), w, h, want, quality, nil
-	default:
-		want = "image/jpeg"
-		quality = jpegQualityFor(prefs)
-		if err := jpeg.Encode(&out, img, &jpeg.Options{Quality: quality}); err != nil {
-			return nil, 0, 0, want, quality, err
-		}
-		return append([]byte(nil), out.Bytes()...), w, h, want, quality, nil
-	}
+	return encodeImageWithin(img, prefs, 0)
 }
 
 // imageHasAlpha returns true if any sampled pixel has alpha != 0xff.
@@ -3862,10 +3757,12 @@ func decodeDataURI(uri string, prefs RenderOptions) ([]byte, int, int, string, i
 			return nil, 0, 0, "", 0, false
 		}
 		raw = b
+	} else if unescaped, err := url.PathUnescape(data); err == nil {
+		raw = []byte(unescaped)
 	} else {
 		raw = []byte(data)
 	}
-	img, _, err := image.Decode(bytes.NewReader(raw))
+	img, err := decodeImageBytes(raw, meta, prefs)
 	if err != nil {
 		return nil, 0, 0, "", 0, false
 	}
@@ -3903,8 +3800,9 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 	}
 	if looksLikeOMS(body) {
 		page := &Page{
-			Data:       append([]byte(nil), body...),
-			SetCookies: append([]string(nil), doc.SetCookies...),
+			Data:         append([]byte(nil), body...),
+			SetCookies:   append([]string(nil), doc.SetCookies...),
+			OriginHeader: cacheHeadersFrom(doc.Header),
 			Stats: TrafficStats{
 				OriginTransferBytes: doc.TransferBytes,
 				OriginDecodedBytes:  len(body),
@@ -3913,7 +3811,12 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 		}
 		return page, nil
 	}
-	utf8Body := decodeLegacyToUTF8(body, doc.Header.Get("Content-Type"))
+	deviceCharset := ""
+	if opts != nil {
+		deviceCharset = opts.DeviceCharset
+	}
+	pageCharset := detectCharset(body, doc.Header.Get("Content-Type"), deviceCharset)
+	utf8Body := decodeToUTF8(body, pageCharset)
 	decodedLen := len(utf8Body)
 	parsed, err := html.Parse(bytes.NewReader(utf8Body))
 	if err != nil {
@@ -3927,6 +3830,7 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 	}
 	p := NewPage()
 	p.SetCookies = append([]string(nil), doc.SetCookies...)
+	p.OriginHeader = cacheHeadersFrom(doc.Header)
 	p.Stats.OriginTransferBytes = doc.TransferBytes
 	p.Stats.OriginDecodedBytes = decodedLen
 	p.AddString("1/" + effectiveURL)
@@ -3945,9 +3849,16 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 	rp.ReqHeaders = hdr
 	rp.Referrer = effectiveURL
 	rp.Styles = buildStylesheet(parsed, base, hdr, jar)
+	applyGeneratedContent(parsed, rp.Styles)
+	applyTextTransforms(parsed, rp.Styles)
+	var article *readerArticle
+	if rp.Reader {
+		article = extractArticle(parsed)
+	}
+	reader := article != nil
 	chosenCol := ""
 	chosenBg := ""
-	if bodyNode := findFirstByTag(parsed, "body"); bodyNode != nil {
+	if bodyNode := findFirstByTag(parsed, "body"); bodyNode != nil && !reader {
 		var bgHex, fgHex string
 		if rp.Styles != nil {
 			if props := computeStyleFor(bodyNode, rp.Styles); props != nil {
@@ -4005,7 +3916,18 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 	}
 	st.css = rp.Styles
 	p.AddStyle(styleDefault)
-	walkRich(parsed, base, p, visited, &st, rp)
+	rp.imageBytes = newImageBudget(rp)
+	if reader {
+		renderReader(article, base, effectiveURL, p, rp)
+	} else {
+		if !rp.Reader && decodedLen >= readerSuggestBytes && readerWorthy(parsed) {
+			p.AddLink("0/"+BuildReaderLink(effectiveURL), "[Reader view]")
+		}
+		linearizeCSSLayout(parsed, rp.Styles, rp.ScreenW)
+		rp.images = prefetchImages(parsed, base, rp.Styles, rp)
+		walkRich(parsed, base, p, visited, &st, rp)
+	}
+	setFormCharsets(p.Forms, pageCharset)
 	if len(p.SetCookies) > 0 {
 		var pairs []string
 		for _, sc := range p.SetCookies {
@@ -4033,32 +3955,25 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 			maxTags = opts.MaxTagsPerPage
 		}
 	}
+	eng := rp.engine()
+	p.engine = &eng
 	if maxTags == 0 {
-		if s := os.Getenv("OMS_PAGINATE_TAGS"); s != "" {
-			if v, err := strconv.Atoi(strings.TrimSpace(s)); err == nil && v > 0 {
-				maxTags = v
-			}
-		}
-		if maxTags == 0 {
-			if rp.ClientVersion == ClientVersion1 {
-				maxTags = 2400
-			} else {
-				maxTags = 1600
-			}
-		}
+		maxTags = eng.paginationTags(rp.ClientVersion)
 	}
 	if pageIdx < 1 {
 		pageIdx = 1
 	}
+	p.MaxTags = maxTags
 	{
 		fullRaw := append([]byte(nil), p.Data...)
 		packed := NewPage()
+		packed.engine = &eng
 		packed.Data = fullRaw
 		packed.SetTransport(rp.ClientVersion, rp.Compression)
 		packed.finalize()
 		p.CachePacked = append([]byte(nil), packed.Data...)
 	}
-	parts := splitByTags(p.Data, maxTags, rp.ClientVersion)
+	parts := splitByTagsBudget(p.Data, maxTags, eng.paginationBytes(), rp.ClientVersion)
 	if len(parts) == 0 {
 		p.finalize()
 		return p, nil
@@ -4133,7 +4048,7 @@ func RenderDocument(doc *UpstreamDocument, hdr http.Header, opts *RenderOptions)
 			lastShown = n
 		}
 		nav.AddBreak()
-		budget := maxBytesBudget()
+		budget := eng.paginationBytes()
 		allowed := budget - len(nav.Data)
 		if allowed < 1024 {
 			allowed = 1024
@@ -4159,7 +4074,8 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 	method := http.MethodGet
 	var bodyReader io.Reader
 	var contentTypeOverride string
-	debugHTTP := os.Getenv("OMS_HTTP_DEBUG") == "1"
+	debugHTTP := opts.engine().HTTPDebug
+	lg := opts.logger()
 
 	if hdr == nil {
 		hdr = http.Header{}
@@ -4181,13 +4097,13 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 					}
 					parts = append(parts, fmt.Sprintf("%s(len=%d)=%s", k, len(v), masked))
 				}
-				log.Printf("FORM payload keys: %s", strings.Join(parts, ", "))
+				lg.Debug("form payload", "fields", strings.Join(parts, ", "))
 			} else {
-				log.Printf("FORM payload raw len=%d", len(fb))
+				lg.Debug("form payload", "raw_len", len(fb))
 			}
 		}
-		if submission := prepareOperaMiniSubmission(oURL, opts.FormBody); submission != nil {
-			log.Printf("SUBMISSION plan method=%s url=%s body_len=%d ct=%s", submission.Method, submission.URL, len(submission.Body), submission.ContentType)
+		if submission := prepareOperaMiniSubmission(oURL, opts.FormBody, opts.Form, opts.FormFiles, opts.FormCharset, lg); submission != nil {
+			lg.Debug("form submission", "method", submission.Method, "url", submission.URL, "body_len", len(submission.Body), "content_type", submission.ContentType)
 			if submission.URL != "" {
 				effectiveURL = submission.URL
 			}
@@ -4227,6 +4143,11 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 			req.Header.Add(k, v)
 		}
 	}
+	conditional := false
+	if opts != nil && method == http.MethodGet && bodyReader == nil && (opts.IfNoneMatch != "" || opts.IfModifiedSince != "") {
+		setConditionalHeaders(req.Header, opts.IfNoneMatch, opts.IfModifiedSince)
+		conditional = true
+	}
 	if req.Method == http.MethodPost {
 		if req.Header.Get("Referer") == "" {
 			if u, err := url.Parse(effectiveURL); err == nil {
@@ -4234,7 +4155,7 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 				ref.RawQuery = ""
 				req.Header.Set("Referer", ref.String())
 				if debugHTTP {
-					log.Printf("UPSTREAM add Referer=%s", ref.String())
+					lg.Debug("upstream referer added", "referer", ref.String())
 				}
 			}
 		}
@@ -4243,7 +4164,7 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 				origin := u.Scheme + "://" + u.Host
 				req.Header.Set("Origin", origin)
 				if debugHTTP {
-					log.Printf("UPSTREAM add Origin=%s", origin)
+					lg.Debug("upstream origin added", "origin", origin)
 				}
 			}
 		}
@@ -4275,16 +4196,32 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 			jarInfo = "jar=nil"
 		}
 		ct := req.Header.Get("Content-Type")
-		log.Printf("UPSTREAM req url=%s method=%s xkey=%q cookie_hdr_len=%d jar=%s ct=%q body=%t", effectiveURL, req.Method, xk, len(ck), jarInfo, ct, bodyReader != nil)
+		lg.Debug("upstream request", "url", effectiveURL, "method", req.Method, "client_key", xk,
+			"cookie_len", len(ck), "jar", jarInfo, "content_type", ct, "body", bodyReader != nil)
 	}
 	resp, err := hc.Do(req)
 	if err != nil {
+		class := classifyUpstreamError(err)
+		recordUpstreamError(class)
+		lg.Warn("upstream request failed", "url", effectiveURL, "class", class, "err", err)
 		return errorPage(effectiveURL, "Timeout loading page"), nil
 	}
 	defer resp.Body.Close()
+	recordUpstreamStatus(resp.StatusCode)
+	if conditional && resp.StatusCode == http.StatusNotModified {
+		if debugHTTP {
+			lg.Debug("upstream not modified", "url", effectiveURL)
+		}
+		return &Page{
+			NotModified:  true,
+			OriginHeader: cacheHeadersFrom(resp.Header),
+			SetCookies:   append([]string(nil), resp.Header["Set-Cookie"]...),
+		}, nil
+	}
 
 	rawBody, err := io.ReadAll(resp.Body)
 	if err != nil {
+		recordUpstreamError("read")
 		return errorPage(effectiveURL, "Internal server error"), nil
 	}
 	transferBytes := len(rawBody)
@@ -4325,13 +4262,13 @@ func LoadPageWithHeadersAndOptionsCtx(ctx context.Context, oURL string, hdr http
 		if resp.Request != nil && resp.Request.URL != nil {
 			finalURL = resp.Request.URL.String()
 		}
-		log.Printf("UPSTREAM resp status=%d final=%s set-cookie=%d", resp.StatusCode, finalURL, nsc)
+		lg.Debug("upstream response", "status", resp.StatusCode, "final", finalURL, "set_cookies", nsc)
 		if nsc > 0 {
 			for i, v := range sc {
 				if i >= 3 {
 					break
 				}
-				log.Printf("UPSTREAM set-cookie[%d]=%s", i, v)
+				lg.Debug("upstream set-cookie", "index", i, "value", v)
 			}
 		}
 	}
@@ -4360,11 +4297,20 @@ type formSubmission struct {
 	ContentType string
 }
 
-func prepareOperaMiniSubmission(baseURL, payload string) *formSubmission {
+// prepareOperaMiniSubmission turns the Opera Mini form payload into an
+// origin request. A known form is replayed from its registry entry; without
+// one, method and action are guessed from the opf flag, action keys and
+// sensitive field names, and lg notes when a guess forces POST.
+func prepareOperaMiniSubmission(baseURL, payload string, form *FormSpec, files map[string]*FormUpload, charset string, lg *slog.Logger) *formSubmission {
 	payload = strings.TrimSpace(payload)
 	if payload == "" || payload == "0" {
 		return nil
 	}
+	if form != nil {
+		if sub := form.submission(payload, files); sub != nil {
+			return sub
+		}
+	}
 	if !strings.Contains(payload, "=") {
 		return nil
 	}
@@ -4428,15 +4374,14 @@ func prepareOperaMiniSubmission(baseURL, payload string) *formSubmission {
 		values.Add(normalizedKey, val)
 	}
 	if method == http.MethodGet && hasSensitive {
-		////if os.Getenv("OMS_HTTP_DEBUG") == "1" {
 		if seenOPF {
-			log.Printf("SUBMISSION heuristic: overriding OPF to POST (has sensitive fields)")
+			lg.Debug("form submission forced to POST", "reason", "sensitive fields override opf")
 		} else {
-			log.Printf("SUBMISSION heuristic: forcing POST (has sensitive fields, no opf)")
+			lg.Debug("form submission forced to POST", "reason", "sensitive fields")
 		}
-		////}
 		method = http.MethodPost
 	}
+	values = encodeFormValues(values, charset)
 	base, err := url.Parse(baseURL)
 	if err != nil {
 		base = nil
@@ -0,0 +1,274 @@
+package oms
+
+import (
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Options holds renderer settings that used to be looked up in the process
+// environment at call time. The zero value selects the built-in defaults.
+// Per-request values travel in RenderOptions.Engine; code paths without
+// render options (packed-cache pagination, error pages) use DefaultOptions.
+type Options struct {
+	// PaginateTags is the tag budget per page part when the client does not
+	// ask for one (0 = 2400 for OM1, 1600 otherwise).
+	PaginateTags int `json:"paginateTags,omitempty"`
+	// PaginateBytes is the byte budget per page part (0 = 32KB, negative
+	// disables the byte limit, values below 1KB are raised to 1KB).
+	PaginateBytes int `json:"paginateBytes,omitempty"`
+	// TagCountMode tweaks the tag count written to the OMS header for legacy
+	// clients: "" adds one tag, "exact", "exclude_q", "plus1", "plus2", or
+	// "delta" which adds TagCountDelta.
+	TagCountMode  string `json:"tagCountMode,omitempty"`
+	TagCountDelta int    `json:"tagCountDelta,omitempty"`
+	// ImageCacheDir and ImageCacheMB configure the process-wide image caches
+	// (defaults cache/img and 100MB, negative MB disables them). They are only
+	// applied through SetDefaultOptions.
+	ImageCacheDir string `json:"imageCacheDir,omitempty"`
+	ImageCacheMB  int    `json:"imageCacheMB,omitempty"`
+	// ImageWorkers bounds the concurrent image fetches of one render
+	// (0 = 6). ImageBudgetMS is how long a render waits for its images in
+	// total (0 = 6000); images that miss it become placeholders.
+	ImageWorkers  int `json:"imageWorkers,omitempty"`
+	ImageBudgetMS int `json:"imageBudgetMs,omitempty"`
+	// ImageDither is how images reduced to a handset's colour depth are
+	// dithered: "floyd-steinberg" (default), "ordered" or "none".
+	ImageDither string `json:"imageDither,omitempty"`
+	// ImageFrames is how animated GIF, APNG and WebP images are made
+	// static: "auto" (default, the most detailed frame), "first", "last",
+	// or "strip" for a contact sheet of a few frames.
+	ImageFrames string `json:"imageFrames,omitempty"`
+
+	ImageDebug bool `json:"imageDebug,omitempty"`
+	CSSDebug   bool `json:"cssDebug,omitempty"`
+	HTTPDebug  bool `json:"httpDebug,omitempty"`
+}
+
+const defaultImageCacheMB = 100
+
+// OptionsFromEnv returns base with the OMS_* environment variables applied on
+// top, so deployments can override individual values of a config file.
+func OptionsFromEnv(base Options) Options {
+	o := base
+	if v, ok := envInt("OMS_PAGINATE_TAGS"); ok && v > 0 {
+		o.PaginateTags = v
+	}
+	if v, ok := envInt("OMS_PAGINATE_BYTES"); ok {
+		if v <= 0 {
+			v = -1
+		}
+		o.PaginateBytes = v
+	}
+	mode := os.Getenv("OMS_TAGCOUNT_MODE")
+	delta, deltaOK := envInt("OMS_TAGCOUNT_DELTA")
+	switch mode {
+	case "exact", "exclude_q", "plus1", "plus2":
+		o.TagCountMode = mode
+	default:
+		if deltaOK && delta >= 0 {
+			o.TagCountMode = "delta"
+			o.TagCountDelta = delta
+		} else if mode != "" || os.Getenv("OMS_TAGCOUNT_DELTA") != "" {
+			o.TagCountMode = "exact"
+		}
+	}
+	if v := strings.TrimSpace(os.Getenv("OMS_IMG_CACHE_DIR")); v != "" {
+		o.ImageCacheDir = v
+	}
+	if v, ok := envInt("OMS_IMG_CACHE_MB"); ok && v >= 0 {
+		if v == 0 {
+			v = -1
+		}
+		o.ImageCacheMB = v
+	}
+	if v, ok := envInt("OMS_IMG_WORKERS"); ok && v > 0 {
+		o.ImageWorkers = v
+	}
+	if v, ok := envInt("OMS_IMG_BUDGET_MS"); ok && v > 0 {
+		o.ImageBudgetMS = v
+	}
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("OMS_IMG_DITHER"))); v {
+	case ditherFloydSteinberg, ditherOrdered, ditherNone:
+		o.ImageDither = v
+	}
+	switch v := strings.ToLower(strings.TrimSpace(os.Getenv("OMS_IMG_FRAMES"))); v {
+	case framesAuto, framesFirst, framesLast, framesStrip:
+		o.ImageFrames = v
+	}
+	if v, ok := envBool("OMS_IMG_DEBUG"); ok {
+		o.ImageDebug = v
+	}
+	if v, ok := envBool("OMS_CSS_DEBUG"); ok {
+		o.CSSDebug = v
+	}
+	if v, ok := envBool("OMS_HTTP_DEBUG"); ok {
+		o.HTTPDebug = v
+	}
+	return o
+}
+
+func envInt(name string) (int, bool) {
+	s := strings.TrimSpace(os.Getenv(name))
+	if s == "" {
+		return 0, false
+	}
+	v, err := strconv.Atoi(s)
+	return v, err == nil
+}
+
+func envBool(name string) (bool, bool) {
+	s := strings.TrimSpace(os.Getenv(name))
+	if s == "" {
+		return false, false
+	}
+	return s == "1", true
+}
+
+var (
+	defaultOptsMu   sync.RWMutex
+	defaultOpts     Options
+	defaultOptsInit bool
+)
+
+// DefaultOptions returns the process-wide renderer options. Until
+// SetDefaultOptions is called they are derived from the environment.
+func DefaultOptions() Options {
+	defaultOptsMu.RLock()
+	if defaultOptsInit {
+		o := defaultOpts
+		defaultOptsMu.RUnlock()
+		return o
+	}
+	defaultOptsMu.RUnlock()
+	defaultOptsMu.Lock()
+	defer defaultOptsMu.Unlock()
+	if !defaultOptsInit {
+		defaultOpts = OptionsFromEnv(Options{})
+		defaultOptsInit = true
+	}
+	return defaultOpts
+}
+
+// SetDefaultOptions replaces the process-wide renderer options and resizes the
+// shared image caches accordingly. Call it before serving requests; changing
+// ImageCacheDir later only affects images cached afterwards.
+func SetDefaultOptions(o Options) {
+	defaultOptsMu.Lock()
+	defaultOpts = o
+	defaultOptsInit = true
+	defaultOptsMu.Unlock()
+	configureImageCaches(o)
+}
+
+// engine returns the renderer options for a request.
+func (o *RenderOptions) engine() Options {
+	if o != nil && o.Engine != nil {
+		return *o.Engine
+	}
+	return DefaultOptions()
+}
+
+// logger returns the request-scoped logger, falling back to slog.Default().
+func (o *RenderOptions) logger() *slog.Logger {
+	if o != nil && o.Logger != nil {
+		return o.Logger
+	}
+	return slog.Default()
+}
+
+func (o Options) imageWorkers() int {
+	if o.ImageWorkers > 0 {
+		return o.ImageWorkers
+	}
+	return defaultImageWorkers
+}
+
+func (o Options) imageBudget() time.Duration {
+	if o.ImageBudgetMS > 0 {
+		return time.Duration(o.ImageBudgetMS) * time.Millisecond
+	}
+	return defaultImageBudget
+}
+
+func (o Options) imageDither() string {
+	switch o.ImageDither {
+	case ditherOrdered, ditherNone:
+		return o.ImageDither
+	}
+	return ditherFloydSteinberg
+}
+
+func (o Options) imageFrames() string {
+	switch o.ImageFrames {
+	case framesFirst, framesLast, framesStrip:
+		return o.ImageFrames
+	}
+	return framesAuto
+}
+
+func (o Options) paginationBytes() int {
+	switch {
+	case o.PaginateBytes < 0:
+		return 0
+	case o.PaginateBytes == 0:
+		return defaultPaginationBytes
+	case o.PaginateBytes < 1024:
+		return 1024
+	}
+	return o.PaginateBytes
+}
+
+func (o Options) paginationTags(version ClientVersion) int {
+	if o.PaginateTags > 0 {
+		return o.PaginateTags
+	}
+	if version == ClientVersion1 {
+		return 2400
+	}
+	return 1600
+}
+
+// headerTagCount applies TagCountMode to the scanned tag count.
+func (o Options) headerTagCount(base int) int {
+	switch o.TagCountMode {
+	case "":
+		// Bump by one to avoid OM2 AIOOBE on some pages.
+		return base + 1
+	case "exclude_q":
+		if base > 0 {
+			return base - 1
+		}
+	case "plus1":
+		return base + 1
+	case "plus2":
+		return base + 2
+	case "delta":
+		if o.TagCountDelta > 0 {
+			return base + o.TagCountDelta
+		}
+	}
+	return base
+}
+
+func (o Options) imageCacheDir() string {
+	if o.ImageCacheDir != "" {
+		return o.ImageCacheDir
+	}
+	return filepath.Join("cache", "img")
+}
+
+func (o Options) imageCacheBytes() int64 {
+	mb := o.ImageCacheMB
+	if mb == 0 {
+		mb = defaultImageCacheMB
+	}
+	if mb < 0 {
+		return 0
+	}
+	return int64(mb) * 1024 * 1024
+}
@@ -0,0 +1,65 @@
+package oms
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestOptionsFromEnv(t *testing.T) {
+	t.Setenv("OMS_PAGINATE_TAGS", "900")
+	t.Setenv("OMS_PAGINATE_BYTES", "0")
+	t.Setenv("OMS_TAGCOUNT_MODE", "")
+	t.Setenv("OMS_TAGCOUNT_DELTA", "3")
+	t.Setenv("OMS_IMG_CACHE_MB", "")
+	t.Setenv("OMS_CSS_DEBUG", "1")
+	o := OptionsFromEnv(Options{PaginateTags: 100, ImageCacheMB: 7})
+	if o.PaginateTags != 900 || o.ImageCacheMB != 7 || !o.CSSDebug {
+		t.Fatalf("unexpected options %+v", o)
+	}
+	if o.paginationBytes() != 0 {
+		t.Fatalf("OMS_PAGINATE_BYTES=0 must disable the byte budget, got %d", o.paginationBytes())
+	}
+	if got := o.headerTagCount(10); got != 13 {
+		t.Fatalf("delta mode: got %d", got)
+	}
+
+	t.Setenv("OMS_TAGCOUNT_DELTA", "")
+	if got := OptionsFromEnv(Options{}).headerTagCount(10); got != 11 {
+		t.Fatalf("default tag count should add one, got %d", got)
+	}
+	t.Setenv("OMS_TAGCOUNT_MODE", "bogus")
+	if got := OptionsFromEnv(Options{}).headerTagCount(10); got != 10 {
+		t.Fatalf("unknown mode should leave the count untouched, got %d", got)
+	}
+	if got := (Options{PaginateBytes: 10}).paginationBytes(); got != 1024 {
+		t.Fatalf("byte budget below 1KB should be raised, got %d", got)
+	}
+}
+
+func TestRenderOptionsEngineIsPerRequest(t *testing.T) {
+	body := "<html><body>" + strings.Repeat("<p>line</p>", 200) + "</body></html>"
+	render := func(eng *Options) *Page {
+		doc := &UpstreamDocument{
+			URL:    "http://example.com/",
+			Body:   []byte(body),
+			Header: http.Header{"Content-Type": {"text/html; charset=utf-8"}},
+			Status: http.StatusOK,
+		}
+		opts := defaultRenderPrefs()
+		opts.Engine = eng
+		p, err := RenderDocument(doc, nil, &opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return p
+	}
+	small := render(&Options{PaginateTags: 100})
+	large := render(&Options{PaginateTags: 5000})
+	if small.MaxTags != 100 || large.MaxTags != 5000 {
+		t.Fatalf("engine tag budgets not applied: %d/%d", small.MaxTags, large.MaxTags)
+	}
+	if small.partCnt <= 1 || large.partCnt != 1 {
+		t.Fatalf("expected only the small budget to paginate, got %d/%d parts", small.partCnt, large.partCnt)
+	}
+}
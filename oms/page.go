@@ -5,8 +5,7 @@ import (
 	"compress/flate"
 	"compress/gzip"
 	"encoding/binary"
-	"os"
-	"strconv"
+	"net/http"
 	"strings"
 )
 
@@ -35,10 +34,22 @@ type Page struct {
 	partCnt       int
 	clientVersion ClientVersion
 	compression   CompressionMethod
+	// engine carries the renderer options of the request (nil = DefaultOptions()).
+	engine *Options
 	// FormHidden records hidden input fields discovered on the page keyed by form action URL.
 	FormHidden map[string]map[string]string
+	// Forms is the form registry of the page in document order.
+	Forms []*FormSpec
 	// NoCache indicates that the page should not be persisted in the render cache.
 	NoCache bool
+	// OriginHeader carries the caching-related headers of the origin response
+	// (Cache-Control, Expires, Vary, Date, Age, ...) so callers can derive freshness.
+	OriginHeader http.Header
+	// NotModified is set when the origin answered a conditional request with 304;
+	// such a page carries no render and the caller reuses its cached copy.
+	NotModified bool
+	// MaxTags is the per-part tag budget the render was paginated with.
+	MaxTags int
 	// Stats carries size metrics for debug/telemetry (origin vs encoded OMS).
 	Stats TrafficStats
 }
@@ -383,11 +394,7 @@ func (p *Page) finalize() {
 	}
 	// Derive TagCount by scanning payload to avoid mismatches
 	baseTags, baseStrings := analyzePayloadCounts(p.Data, p.clientVersion)
-	cnt := adjustTagCount(baseTags)
-	// If no override set, bump by +1 to avoid OM2 AIOOBE on some pages
-	if os.Getenv("OMS_TAGCOUNT_MODE") == "" && os.Getenv("OMS_TAGCOUNT_DELTA") == "" {
-		cnt++
-	}
+	cnt := p.options().headerTagCount(baseTags)
 
 	// Derive string count and use swapped value for robust client handling
 	stag := baseStrings + 1
@@ -495,30 +502,11 @@ func (p *Page) Normalize() {
 	}
 }
 
-func adjustTagCount(base int) int {
-	// Strategy selection via env OMS_TAGCOUNT_MODE: exact|exclude_q|plus1|plus2
-	// Or numeric delta via OMS_TAGCOUNT_DELTA (>=0)
-	if m := os.Getenv("OMS_TAGCOUNT_MODE"); m != "" {
-		switch m {
-		case "exact":
-			return base
-		case "exclude_q":
-			if base > 0 {
-				return base - 1
-			}
-			return base
-		case "plus1":
-			return base + 1
-		case "plus2":
-			return base + 2
-		}
-	}
-	if s := os.Getenv("OMS_TAGCOUNT_DELTA"); s != "" {
-		if v, err := strconv.Atoi(s); err == nil && v >= 0 {
-			return base + v
-		}
+func (p *Page) options() Options {
+	if p.engine != nil {
+		return *p.engine
 	}
-	return base
+	return DefaultOptions()
 }
 
 func analyzePayloadCounts(b []byte, clientVersion ClientVersion) (int, int) {
@@ -663,6 +651,19 @@ func (p *Page) SetPart(cur, cnt int) {
 	p.partCnt = cnt
 }
 
+// Parts reports the selected part and the number of parts the render was split
+// into (1, 1 for unpaginated pages).
+func (p *Page) Parts() (int, int) {
+	cur, cnt := p.partCur, p.partCnt
+	if cur <= 0 {
+		cur = 1
+	}
+	if cnt <= 0 {
+		cnt = 1
+	}
+	return cur, cnt
+}
+
 // Finalize exposes page finalization for external callers.
 // It wraps the internal finalize to build the complete OMS payload.
 func (p *Page) Finalize() { p.finalize() }
@@ -0,0 +1,419 @@
+package oms
+
+import (
+	"net/url"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// readerSuggestBytes is the decoded HTML size from which a "Reader view"
+	// link is offered at the top of a full render.
+	readerSuggestBytes = 48 << 10
+	// readerMinTextRunes is the paragraph text needed before the reader link
+	// is offered; shorter pages are usually not articles.
+	readerMinTextRunes = 500
+	// readerMinParagraphRunes skips captions, buttons and other short blocks
+	// when scoring.
+	readerMinParagraphRunes = 25
+)
+
+var (
+	readerUnlikelyHints = []string{"banner", "breadcrumb", "combx", "comment", "community", "cookie", "disqus",
+		"footer", "header", "menu", "modal", "nav", "popup", "promo", "related", "remark", "rss", "share",
+		"shoutbox", "sidebar", "social", "sponsor", "advert", "widget", "subscribe"}
+	readerLikelyHints   = []string{"article", "body", "column", "content", "main", "post", "entry", "story", "text"}
+	readerPositiveHints = []string{"article", "body", "content", "entry", "hentry", "main", "page", "post", "text", "blog", "story"}
+	readerNegativeHints = []string{"hidden", "banner", "combx", "comment", "contact", "foot", "masthead", "meta",
+		"outbrain", "promo", "related", "scroll", "share", "shoutbox", "sidebar", "skyscraper", "sponsor",
+		"shopping", "tags", "tool", "widget", "nav", "menu"}
+	readerBylineHints = []string{"byline", "author", "dateline", "writtenby"}
+)
+
+// readerArticle is the main content extracted from a page for reader mode.
+type readerArticle struct {
+	title   string
+	byline  string
+	content []*html.Node // top-level content blocks in document order
+}
+
+// classHints returns the lower-cased class and id of n for hint matching.
+func classHints(n *html.Node) string {
+	return strings.ToLower(getAttr(n, "class") + " " + getAttr(n, "id"))
+}
+
+func containsAny(s string, hints []string) bool {
+	for _, h := range hints {
+		if strings.Contains(s, h) {
+			return true
+		}
+	}
+	return false
+}
+
+// readerClassWeight rewards class/id names that usually mark article bodies
+// and penalises those of comments, sidebars and navigation.
+func readerClassWeight(n *html.Node) float64 {
+	hints := classHints(n)
+	w := 0.0
+	if containsAny(hints, readerNegativeHints) {
+		w -= 25
+	}
+	if containsAny(hints, readerPositiveHints) {
+		w += 25
+	}
+	return w
+}
+
+func readerTagBias(tag string) float64 {
+	switch tag {
+	case "article", "main":
+		return 10
+	case "div":
+		return 5
+	case "pre", "td", "blockquote":
+		return 3
+	case "address", "ol", "ul", "dl", "dd", "dt", "li", "form":
+		return -3
+	case "h1", "h2", "h3", "h4", "h5", "h6", "th":
+		return -5
+	}
+	return 0
+}
+
+// readerSkipped reports whether n can never be part of the article.
+func readerSkipped(n *html.Node) bool {
+	switch strings.ToLower(n.Data) {
+	case "script", "style", "noscript", "nav", "aside", "footer", "form", "iframe", "select",
+		"button", "svg", "canvas", "object", "embed", "template":
+		return true
+	}
+	if isDisplayNone(getAttr(n, "style")) || boolAttr(n, "hidden") || strings.EqualFold(getAttr(n, "aria-hidden"), "true") {
+		return true
+	}
+	return false
+}
+
+// readerUnlikely reports whether the class/id of n suggests page chrome.
+func readerUnlikely(n *html.Node) bool {
+	switch strings.ToLower(n.Data) {
+	case "body", "article", "main":
+		return false
+	}
+	hints := classHints(n)
+	return containsAny(hints, readerUnlikelyHints) && !containsAny(hints, readerLikelyHints)
+}
+
+func linkDensity(n *html.Node) float64 {
+	text := utf8.RuneCountInString(cellText(n))
+	if text == 0 {
+		return 0
+	}
+	_, lr := linkStats(n)
+	return float64(lr) / float64(text)
+}
+
+// readerWorthy is the cheap check behind the "Reader view" link: it adds up
+// the text of long paragraphs outside page chrome and stops as soon as there
+// is enough for an article, without scoring the page like extractArticle.
+func readerWorthy(doc *html.Node) bool {
+	body := findFirstByTag(doc, "body")
+	if body == nil {
+		return false
+	}
+	total := 0
+	var rec func(*html.Node) bool
+	rec = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || readerSkipped(c) || readerUnlikely(c) {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "p", "pre", "blockquote":
+				if runes := utf8.RuneCountInString(cellText(c)); runes >= readerMinParagraphRunes {
+					total += runes
+				}
+				if total >= readerMinTextRunes {
+					return true
+				}
+				continue
+			}
+			if rec(c) {
+				return true
+			}
+		}
+		return false
+	}
+	return rec(body)
+}
+
+// extractArticle finds the main content of a parsed document, scoring text
+// blocks by length and commas and propagating the score to their parents the
+// way Readability does. It returns nil when no block stands out.
+func extractArticle(doc *html.Node) *readerArticle {
+	body := findFirstByTag(doc, "body")
+	if body == nil {
+		return nil
+	}
+	scores := map[*html.Node]float64{}
+	var order []*html.Node
+	addScore := func(n *html.Node, v float64) {
+		if n == nil || n.Type != html.ElementNode {
+			return
+		}
+		if _, ok := scores[n]; !ok {
+			scores[n] = readerTagBias(strings.ToLower(n.Data)) + readerClassWeight(n)
+			order = append(order, n)
+		}
+		scores[n] += v
+	}
+	var rec func(*html.Node)
+	rec = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode || readerSkipped(c) || readerUnlikely(c) {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "p", "pre", "td", "blockquote":
+				scoreParagraph(c, addScore)
+			case "div", "section":
+				if !hasBlockContent(c) {
+					scoreParagraph(c, addScore)
+				}
+			}
+			rec(c)
+		}
+	}
+	rec(body)
+
+	var best *html.Node
+	bestScore := 0.0
+	for _, n := range order {
+		scores[n] *= 1 - linkDensity(n)
+		if best == nil || scores[n] > bestScore {
+			best, bestScore = n, scores[n]
+		}
+	}
+	if best == nil || bestScore <= 0 {
+		return nil
+	}
+
+	art := &readerArticle{}
+	art.content = readerSiblings(best, bestScore, scores)
+	art.title = extractTitle(doc)
+	art.byline = findByline(doc)
+	return art
+}
+
+func scoreParagraph(n *html.Node, addScore func(*html.Node, float64)) {
+	text := cellText(n)
+	runes := utf8.RuneCountInString(text)
+	if runes < readerMinParagraphRunes {
+		return
+	}
+	score := 1 + float64(strings.Count(text, ",")+strings.Count(text, "，")) + float64(min(runes/100, 3))
+	addScore(n.Parent, score)
+	if n.Parent != nil {
+		addScore(n.Parent.Parent, score/2)
+	}
+}
+
+// readerSiblings returns best together with the siblings that look like the
+// same article: well-scored blocks and long, link-poor paragraphs.
+func readerSiblings(best *html.Node, bestScore float64, scores map[*html.Node]float64) []*html.Node {
+	if best.Parent == nil {
+		return []*html.Node{best}
+	}
+	threshold := max(10, bestScore*0.2)
+	bestClass := getAttr(best, "class")
+	var out []*html.Node
+	for s := best.Parent.FirstChild; s != nil; s = s.NextSibling {
+		if s == best {
+			out = append(out, s)
+			continue
+		}
+		if s.Type != html.ElementNode || readerSkipped(s) {
+			continue
+		}
+		score, scored := scores[s]
+		if scored && bestClass != "" && getAttr(s, "class") == bestClass {
+			score += bestScore * 0.2
+		}
+		if scored && score >= threshold {
+			out = append(out, s)
+			continue
+		}
+		if strings.EqualFold(s.Data, "p") {
+			text := cellText(s)
+			runes := utf8.RuneCountInString(text)
+			ld := linkDensity(s)
+			if (runes > 80 && ld < 0.25) || (runes > 0 && ld == 0 && strings.Contains(text, ". ")) {
+				out = append(out, s)
+			}
+		}
+	}
+	return out
+}
+
+// findByline looks for an author line marked by rel=author, common class
+// names or a <meta name="author">.
+func findByline(doc *html.Node) string {
+	var meta string
+	var found string
+	var rec func(*html.Node) bool
+	rec = func(n *html.Node) bool {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			if strings.EqualFold(c.Data, "meta") && strings.EqualFold(getAttr(c, "name"), "author") && meta == "" {
+				meta = strings.TrimSpace(getAttr(c, "content"))
+			}
+			if strings.EqualFold(getAttr(c, "rel"), "author") || containsAny(classHints(c), readerBylineHints) {
+				if text := cellText(c); text != "" && utf8.RuneCountInString(text) < 100 {
+					found = text
+					return true
+				}
+			}
+			if rec(c) {
+				return true
+			}
+		}
+		return false
+	}
+	rec(doc)
+	if found != "" {
+		return found
+	}
+	return meta
+}
+
+// cleanReaderContent strips everything reader mode does not keep from the
+// article blocks: page chrome, forms and embeds, link-heavy boxes, tracking
+// pixels and presentational attributes. A leading heading that repeats the
+// page title replaces it, so the title is not shown twice.
+func cleanReaderContent(art *readerArticle) {
+	var rec func(*html.Node)
+	rec = func(n *html.Node) {
+		for c := n.FirstChild; c != nil; {
+			next := c.NextSibling
+			if c.Type == html.CommentNode {
+				n.RemoveChild(c)
+			} else if c.Type == html.ElementNode {
+				if readerRemovable(c, art.byline) {
+					n.RemoveChild(c)
+				} else {
+					keepReaderAttrs(c)
+					rec(c)
+				}
+			}
+			c = next
+		}
+	}
+	for _, n := range art.content {
+		keepReaderAttrs(n)
+		rec(n)
+	}
+	for _, n := range art.content {
+		h := findFirstByTag(n, "h1")
+		if h == nil {
+			h = findFirstByTag(n, "h2")
+		}
+		if h == nil || h.Parent == nil {
+			continue
+		}
+		if text := cellText(h); text != "" && (art.title == "" || strings.Contains(art.title, text)) {
+			art.title = text
+			h.Parent.RemoveChild(h)
+		}
+		break
+	}
+}
+
+func readerRemovable(n *html.Node, byline string) bool {
+	tag := strings.ToLower(n.Data)
+	switch tag {
+	case "input", "textarea", "video", "audio":
+		return true
+	case "header":
+		return linkDensity(n) > 0.5
+	case "img":
+		w := cssValueToPx(getAttr(n, "width"), 0)
+		h := cssValueToPx(getAttr(n, "height"), 0)
+		return (w > 0 && w <= 2) || (h > 0 && h <= 2)
+	}
+	if readerSkipped(n) {
+		return true
+	}
+	hints := classHints(n)
+	if containsAny(hints, readerNegativeHints) && !containsAny(hints, readerPositiveHints) {
+		return true
+	}
+	if byline != "" && containsAny(hints, readerBylineHints) && cellText(n) == byline {
+		return true
+	}
+	switch tag {
+	case "div", "section", "ul", "ol", "table":
+		runes := utf8.RuneCountInString(cellText(n))
+		if runes < 200 && linkDensity(n) > 0.5 {
+			return true
+		}
+	}
+	return false
+}
+
+// keepReaderAttrs drops every attribute reader output does not need, so
+// site colours, backgrounds and inline styles do not leak into it.
+func keepReaderAttrs(n *html.Node) {
+	kept := n.Attr[:0]
+	for _, a := range n.Attr {
+		switch strings.ToLower(a.Key) {
+		case "href", "src", "srcset", "alt", "width", "height", "colspan", "rowspan":
+			kept = append(kept, a)
+		}
+	}
+	n.Attr = kept
+}
+
+// renderReader writes the reader view of art: a link back to the full page,
+// the title and byline, then the cleaned article blocks.
+func renderReader(art *readerArticle, base, pageURL string, p *Page, prefs RenderOptions) {
+	cleanReaderContent(art)
+	p.AddLink("0/"+pageURL, "[Full page]")
+	st := walkState{curStyle: styleDefault}
+	if art.title != "" {
+		p.AddPlus()
+		st.pushStyle(p, st.curStyle|styleBoldBit)
+		p.AddText(art.title)
+		st.popStyle(p)
+		p.AddBreak()
+	}
+	if art.byline != "" {
+		st.pushStyle(p, st.curStyle|styleItalicBit)
+		p.AddText(art.byline)
+		st.popStyle(p)
+		p.AddBreak()
+	}
+	// Move the blocks under one container so walkRich sees only them.
+	root := &html.Node{Type: html.ElementNode, Data: "div"}
+	for _, n := range art.content {
+		if n.Parent != nil {
+			n.Parent.RemoveChild(n)
+		}
+		root.AppendChild(n)
+	}
+	prefs.images = prefetchImages(root, base, nil, prefs)
+	walkRich(root.FirstChild, base, p, map[*html.Node]bool{}, &st, prefs)
+}
+
+// BuildReaderLink returns target with the pseudo-anchor that asks for the
+// reader view of the page.
+func BuildReaderLink(target string) string {
+	if u, err := url.Parse(target); err == nil {
+		u.Fragment = ""
+		target = u.String()
+	}
+	return target + "#__om=reader=1"
+}
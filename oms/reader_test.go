@@ -0,0 +1,87 @@
+package oms
+
+import (
+	"strings"
+	"testing"
+)
+
+func readerFixtureHTML(padding int) string {
+	var b strings.Builder
+	b.WriteString(`<html><head><title>Rail strike ends - Daily Courier</title><meta name="author" content="Courier staff"></head><body>`)
+	b.WriteString(`<div id="nav"><a href="/">Home</a> <a href="/world">World</a> <a href="/sport">Sport</a></div>`)
+	b.WriteString(`<div class="sidebar"><h3>Most read</h3><a href="/x">Celebrity gossip</a></div>`)
+	b.WriteString(`<div class="article-body"><h1>Rail strike ends</h1><p class="byline">By Jane Roe</p>`)
+	for i := 0; i < 5; i++ {
+		b.WriteString(`<p>Trains resumed on Monday, after unions, operators and the ministry agreed on pay, rosters and safety checks for the coming year.</p>`)
+	}
+	b.WriteString(`<p>Details are in the <a href="/deal">full agreement</a>, which runs to forty pages.</p>`)
+	b.WriteString(`<p><img src="data:image/png;base64,` + tinyPNGBase64 + `" alt="Station"></p>`)
+	b.WriteString(`<form action="/newsletter"><input name="email"></form></div>`)
+	b.WriteString(`<div class="comments"><p>First! This comment is long enough to be scored, but it is not the article.</p></div>`)
+	if padding > 0 {
+		b.WriteString(`<script>` + strings.Repeat("var x=1;", padding/8) + `</script>`)
+	}
+	b.WriteString(`</body></html>`)
+	return b.String()
+}
+
+func TestReaderModeKeepsArticleOnly(t *testing.T) {
+	useTempDiskCache(t)
+	res := renderFixture(t, obmlFixture{
+		name: "reader",
+		url:  "http://news.test/story",
+		html: readerFixtureHTML(0),
+		opts: &RenderOptions{Reader: true, ImagesOn: true, ImageMIME: "image/png", MaxInlineKB: 96},
+	})
+	res.mustHaveLink(t, "0/http://news.test/story")
+	res.mustContainText(t, "Rail strike ends")
+	res.mustContainText(t, "By Jane Roe")
+	res.mustContainText(t, "Trains resumed on Monday")
+	res.mustHaveLink(t, "0/http://news.test/deal")
+	res.mustNotContainText(t, "Celebrity gossip")
+	res.mustNotContainText(t, "First!")
+	res.mustNotContainText(t, "Daily Courier")
+	for _, link := range res.linkURLs() {
+		if strings.HasSuffix(link, "/world") {
+			t.Fatalf("navigation link leaked into reader view: %v", res.linkURLs())
+		}
+	}
+	if res.countTag('I') == 0 {
+		t.Fatalf("expected the inline article image to be kept")
+	}
+	if res.countTag('x') != 0 {
+		t.Fatalf("expected form inputs to be dropped")
+	}
+}
+
+func TestHeavyPageOffersReaderLink(t *testing.T) {
+	useTempDiskCache(t)
+	heavy := renderFixture(t, obmlFixture{name: "heavy", url: "http://news.test/story", html: readerFixtureHTML(readerSuggestBytes)})
+	links := heavy.linkURLs()
+	if len(links) == 0 || links[0] != "0/http://news.test/story#__om=reader=1" {
+		t.Fatalf("expected reader link first, got %v", links)
+	}
+	heavy.mustContainText(t, "Celebrity gossip")
+
+	light := renderFixture(t, obmlFixture{name: "light", url: "http://news.test/story", html: readerFixtureHTML(0)})
+	for _, link := range light.linkURLs() {
+		if strings.Contains(link, "reader=1") {
+			t.Fatalf("light pages should not offer reader view, got %v", light.linkURLs())
+		}
+	}
+}
+
+func TestHeavyPageWithoutArticleHasNoReaderLink(t *testing.T) {
+	var b strings.Builder
+	b.WriteString(`<html><body><div class="article-list">`)
+	for i := 0; i < 40; i++ {
+		b.WriteString(`<p><a href="/story">Short headline</a></p>`)
+	}
+	b.WriteString(`</div><script>` + strings.Repeat("var x=1;", readerSuggestBytes/8) + `</script></body></html>`)
+	res := renderFixture(t, obmlFixture{name: "heavy_index", url: "http://news.test/", html: b.String()})
+	for _, link := range res.linkURLs() {
+		if strings.Contains(link, "reader=1") {
+			t.Fatalf("index pages should not offer reader view, got %v", res.linkURLs())
+		}
+	}
+}
@@ -49,7 +49,7 @@ type fixtureResult struct {
 }
 
 func TestFetchAndEncodeImageDataURI(t *testing.T) {
-	t.Parallel()
+	useTempDiskCache(t)
 	if _, err := base64.StdEncoding.DecodeString(tinyPNGBase64); err != nil {
 		t.Fatalf("base64 decode tiny png: %v", err)
 	}
@@ -447,6 +447,25 @@ func (fr *fixtureResult) mustHaveBackgroundColor(t *testing.T, want uint16) {
 	t.Fatalf("expected background color 0x%04x, got %v", want, fr.backgroundColors())
 }
 
+// mustHaveStyle checks the style bits in effect for the text run equal to
+// text: every bit of want set and every bit of ban clear.
+func (fr *fixtureResult) mustHaveStyle(t *testing.T, text string, want, ban uint32) {
+	t.Helper()
+	var style uint32
+	for _, tok := range fr.tokens {
+		switch {
+		case tok.tag == 'S' && len(tok.data) > 0:
+			style = uint32(tok.data[0])
+		case tok.tag == 'T' && len(tok.strings) > 0 && strings.TrimSpace(tok.strings[0]) == text:
+			if style&want != want || style&ban != 0 {
+				t.Fatalf("text %q has style %#x, want bits %#x set and %#x clear", text, style, want, ban)
+			}
+			return
+		}
+	}
+	t.Fatalf("no text run %q in %v", text, fr.textStrings())
+}
+
 func (fr *fixtureResult) formHiddenValue(action, name string) (string, bool) {
 	if fr.page == nil || fr.page.FormHidden == nil {
 		return "", false
@@ -460,6 +479,7 @@ func (fr *fixtureResult) formHiddenValue(action, name string) (string, bool) {
 }
 
 func TestRenderDocumentSyntheticSites(t *testing.T) {
+	useTempDiskCache(t)
 	fixtures := []obmlFixture{
 		{
 			name: "basic_structure",
@@ -756,3 +776,76 @@ func TestRenderDocumentSyntheticSites(t *testing.T) {
 		})
 	}
 }
+
+func TestRenderDocumentCSSTextStyles(t *testing.T) {
+	fixtures := []obmlFixture{
+		{
+			name: "font_weight_style_decoration",
+			html: `<style>.b{font-weight:700}.i{font-style:oblique}.u{text-decoration:underline}.s{text-decoration-line:line-through}.n{font-weight:normal}</style>` +
+				`<p>x <span class="b">heavy</span> <span class="i">slanted</span> <span class="u">lined</span> <span class="s">struck</span> <b>x <span class="n">plain</span></b></p>`,
+			assert: func(t *testing.T, res *fixtureResult) {
+				res.mustHaveStyle(t, "heavy", styleBoldBit, styleItalicBit)
+				res.mustHaveStyle(t, "slanted", styleItalicBit, styleBoldBit)
+				res.mustHaveStyle(t, "lined", styleUnderBit, 0)
+				res.mustHaveStyle(t, "struck", styleUnderBit, 0)
+				res.mustHaveStyle(t, "plain", 0, styleBoldBit)
+			},
+		},
+		{
+			name: "font_size_emphasis",
+			html: `<style>.lead{font-size:1.5em}.kw{font-size:x-large}.fine{font-size:11px}.wrap{font-size:12px}.wrap .x{font-size:2em}.h{font-size:24pt}.h .r{font-size:16px}.body{font-size:100%}</style>` +
+				`<p>x <span class="lead">lead</span> <span class="kw">keyword</span> <span class="fine">fine print</span> <span class="body">body</span></p>` +
+				`<div class="wrap">small <span class="x">doubled</span></div><div class="h">title <span class="r">regular</span></div>`,
+			assert: func(t *testing.T, res *fixtureResult) {
+				res.mustHaveStyle(t, "lead", styleBoldBit, 0)
+				res.mustHaveStyle(t, "keyword", styleBoldBit, 0)
+				res.mustHaveStyle(t, "fine print", styleItalicBit, styleBoldBit)
+				res.mustHaveStyle(t, "body", 0, styleBoldBit|styleItalicBit)
+				res.mustHaveStyle(t, "small", styleItalicBit, 0)
+				res.mustHaveStyle(t, "doubled", styleBoldBit, styleItalicBit)
+				res.mustHaveStyle(t, "title", styleBoldBit, 0)
+				res.mustHaveStyle(t, "regular", 0, styleBoldBit)
+			},
+		},
+		{
+			name: "text_transform",
+			html: `<style>.up{text-transform:uppercase}.low{text-transform:lowercase}.cap{text-transform:capitalize}.sc{font-variant:small-caps}.none{text-transform:none}</style>` +
+				`<p class="up">shout <span class="none">quiet</span></p><p class="low">WHISPER</p>` +
+				`<p class="cap">don't <em>stop</em> me-now</p><p class="sc">caps</p>` +
+				`<p class="up" lang="tr">istanbul</p><p class="up" lang="de">straße</p>` +
+				`<form class="up"><textarea name="t">keep</textarea></form>`,
+			assert: func(t *testing.T, res *fixtureResult) {
+				res.mustContainText(t, "SHOUT")
+				res.mustContainText(t, "quiet")
+				res.mustContainText(t, "whisper")
+				res.mustContainText(t, "Don't ")
+				res.mustContainText(t, "Stop")
+				res.mustContainText(t, "Me-Now")
+				res.mustContainText(t, "CAPS")
+				res.mustContainText(t, "İSTANBUL")
+				res.mustContainText(t, "STRASSE")
+				res.mustNotContainText(t, "KEEP")
+			},
+		},
+		{
+			name: "white_space",
+			html: `<style>.pw{white-space:pre-wrap}.pl{white-space:pre-line}pre.flat{white-space:normal}</style>` +
+				"<p>one   two\n  three</p><p class=\"pw\">four   five\n  six</p><p class=\"pl\">seven   eight\n  nine</p><pre class=\"flat\">ten\n   eleven</pre>",
+			assert: func(t *testing.T, res *fixtureResult) {
+				res.mustContainText(t, "one two three")
+				res.mustContainText(t, "four   five\n  six")
+				res.mustContainText(t, "seven eight\nnine")
+				res.mustContainText(t, "ten eleven")
+			},
+		},
+	}
+	for _, fx := range fixtures {
+		fx := fx
+		t.Run(fx.name, func(t *testing.T) {
+			res := renderFixture(t, fx)
+			if fx.assert != nil {
+				fx.assert(t, res)
+			}
+		})
+	}
+}
@@ -0,0 +1,134 @@
+package oms
+
+import (
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// defaultImageTTL is the freshness lifetime of transcoded images whose origin
+// response carries no Cache-Control/Expires information.
+const defaultImageTTL = 24 * time.Hour
+
+// imgMeta carries origin validators and freshness for a cached image so that a
+// stale entry can be revalidated with a conditional request instead of refetched.
+// A zero Expires marks entries that never go stale (data: URIs, legacy cache files).
+type imgMeta struct {
+	ETag         string
+	LastModified string
+	Expires      time.Time
+}
+
+func (m imgMeta) stale(now time.Time) bool {
+	return !m.Expires.IsZero() && now.After(m.Expires)
+}
+
+func (m imgMeta) hasValidators() bool {
+	return m.ETag != "" || m.LastModified != ""
+}
+
+// imgMetaFromHeader derives validators and freshness from an image response.
+// A 304 may omit validators, in which case the previous ones are kept.
+func imgMetaFromHeader(h http.Header, now time.Time, prev imgMeta) imgMeta {
+	meta := imgMeta{
+		ETag:         strings.TrimSpace(h.Get("ETag")),
+		LastModified: strings.TrimSpace(h.Get("Last-Modified")),
+	}
+	if meta.ETag == "" {
+		meta.ETag = prev.ETag
+	}
+	if meta.LastModified == "" {
+		meta.LastModified = prev.LastModified
+	}
+	meta.Expires = now.Add(freshnessLifetime(h, now, defaultImageTTL))
+	return meta
+}
+
+// CacheControl holds the Cache-Control response directives that decide how
+// long a response may be reused. MaxAge and SMaxAge are -1 when absent.
+type CacheControl struct {
+	NoStore bool
+	NoCache bool
+	Private bool
+	MaxAge  int
+	SMaxAge int
+}
+
+// ParseCacheControl reads the directives of every Cache-Control header in h.
+// Unknown directives and malformed delta-seconds are ignored.
+func ParseCacheControl(h http.Header) CacheControl {
+	cc := CacheControl{MaxAge: -1, SMaxAge: -1}
+	for _, raw := range h.Values("Cache-Control") {
+		for _, dir := range strings.Split(raw, ",") {
+			name, val, _ := strings.Cut(strings.ToLower(strings.TrimSpace(dir)), "=")
+			val = strings.Trim(strings.TrimSpace(val), `"`)
+			switch strings.TrimSpace(name) {
+			case "no-store":
+				cc.NoStore = true
+			case "no-cache":
+				cc.NoCache = true
+			case "private":
+				cc.Private = true
+			case "max-age":
+				if n, err := strconv.Atoi(val); err == nil {
+					cc.MaxAge = n
+				}
+			case "s-maxage":
+				if n, err := strconv.Atoi(val); err == nil {
+					cc.SMaxAge = n
+				}
+			}
+		}
+	}
+	return cc
+}
+
+// freshnessLifetime returns how long a response stays fresh according to its
+// Cache-Control max-age (minus Age) or Expires headers, or fallback otherwise.
+// no-cache and no-store yield zero so the next use revalidates.
+func freshnessLifetime(h http.Header, now time.Time, fallback time.Duration) time.Duration {
+	if h == nil {
+		return fallback
+	}
+	cc := ParseCacheControl(h)
+	if cc.NoCache || cc.NoStore {
+		return 0
+	}
+	maxAge := cc.MaxAge
+	if maxAge >= 0 {
+		ttl := time.Duration(maxAge) * time.Second
+		if n, err := strconv.Atoi(strings.TrimSpace(h.Get("Age"))); err == nil && n > 0 {
+			ttl -= time.Duration(n) * time.Second
+		}
+		if ttl < 0 {
+			ttl = 0
+		}
+		return ttl
+	}
+	if raw := h.Get("Expires"); raw != "" {
+		exp, err := http.ParseTime(raw)
+		if err != nil {
+			return 0
+		}
+		date := now
+		if d, err := http.ParseTime(h.Get("Date")); err == nil {
+			date = d
+		}
+		if ttl := exp.Sub(date); ttl > 0 {
+			return ttl
+		}
+		return 0
+	}
+	return fallback
+}
+
+// setConditionalHeaders adds If-None-Match / If-Modified-Since for the given validators.
+func setConditionalHeaders(h http.Header, etag, lastModified string) {
+	if etag != "" {
+		h.Set("If-None-Match", etag)
+	}
+	if lastModified != "" {
+		h.Set("If-Modified-Since", lastModified)
+	}
+}
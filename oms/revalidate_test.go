@@ -0,0 +1,94 @@
+package oms
+
+import (
+	"encoding/binary"
+	"net/http"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestImgMetaFromHeaderFreshness(t *testing.T) {
+	now := time.Date(2024, 5, 1, 12, 0, 0, 0, time.UTC)
+	cases := []struct {
+		name string
+		h    http.Header
+		ttl  time.Duration
+	}{
+		{"default", http.Header{}, defaultImageTTL},
+		{"max-age minus age", http.Header{"Cache-Control": {"public, max-age=600"}, "Age": {"100"}}, 500 * time.Second},
+		{"no-cache", http.Header{"Cache-Control": {"no-cache"}}, 0},
+		{"expires", http.Header{
+			"Date":    {now.Format(http.TimeFormat)},
+			"Expires": {now.Add(time.Hour).Format(http.TimeFormat)},
+		}, time.Hour},
+	}
+	for _, tc := range cases {
+		meta := imgMetaFromHeader(tc.h, now, imgMeta{})
+		if got := meta.Expires.Sub(now); got != tc.ttl {
+			t.Errorf("%s: ttl=%v want %v", tc.name, got, tc.ttl)
+		}
+	}
+
+	prev := imgMeta{ETag: `"v1"`, LastModified: "Wed, 01 May 2024 10:00:00 GMT"}
+	meta := imgMetaFromHeader(http.Header{"Cache-Control": {"max-age=60"}}, now, prev)
+	if meta.ETag != prev.ETag || meta.LastModified != prev.LastModified {
+		t.Fatalf("expected 304 without validators to keep previous ones, got %+v", meta)
+	}
+	if meta.stale(now) || !meta.stale(now.Add(2*time.Minute)) {
+		t.Fatalf("unexpected staleness for %+v", meta)
+	}
+	if (imgMeta{}).stale(now.Add(365 * 24 * time.Hour)) {
+		t.Fatalf("zero meta must never go stale")
+	}
+}
+
+func TestParseCacheControl(t *testing.T) {
+	h := http.Header{"Cache-Control": {`Private, max-age="120"`, "s-maxage=30, no-cache, bogus=1"}}
+	want := CacheControl{NoCache: true, Private: true, MaxAge: 120, SMaxAge: 30}
+	if got := ParseCacheControl(h); got != want {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	if got := ParseCacheControl(http.Header{"Cache-Control": {"max-age=soon"}}); got != (CacheControl{MaxAge: -1, SMaxAge: -1}) {
+		t.Fatalf("malformed max-age: %+v", got)
+	}
+}
+
+func TestDiskCacheKeepsValidators(t *testing.T) {
+	diskCacheOnce.Do(initDiskCache)
+	oldDir, oldMax := diskCacheSettings()
+	configureDiskCache(Options{ImageCacheDir: t.TempDir(), ImageCacheMB: -1})
+	defer func() {
+		diskCfgMu.Lock()
+		diskCacheDir, diskCacheMax = oldDir, oldMax
+		diskCfgMu.Unlock()
+	}()
+
+	exp := time.Unix(1714564800, 0)
+	meta := imgMeta{ETag: `"abc"`, LastModified: "Wed, 01 May 2024 10:00:00 GMT", Expires: exp}
+	diskCachePut("jpeg", 50, "http://example.com/a.png", []byte("payload"), 12, 34, meta)
+	data, w, h, got, ok := diskCacheGet("jpeg", 50, "http://example.com/a.png")
+	if !ok || string(data) != "payload" || w != 12 || h != 34 {
+		t.Fatalf("round trip failed: ok=%v data=%q w=%d h=%d", ok, data, w, h)
+	}
+	if got.ETag != meta.ETag || got.LastModified != meta.LastModified || !got.Expires.Equal(exp) {
+		t.Fatalf("meta mismatch: got %+v want %+v", got, meta)
+	}
+
+	// Entries written before validators were stored have no magic prefix.
+	dir, path := diskKey("jpeg", 50, "http://example.com/legacy.png")
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		t.Fatal(err)
+	}
+	legacy := make([]byte, 4, 8)
+	binary.BigEndian.PutUint16(legacy[0:2], 7)
+	binary.BigEndian.PutUint16(legacy[2:4], 9)
+	legacy = append(legacy, "old"...)
+	if err := os.WriteFile(path, legacy, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	data, w, h, got, ok = diskCacheGet("jpeg", 50, "http://example.com/legacy.png")
+	if !ok || string(data) != "old" || w != 7 || h != 9 || got != (imgMeta{}) {
+		t.Fatalf("legacy entry mismatch: ok=%v data=%q w=%d h=%d meta=%+v", ok, data, w, h, got)
+	}
+}
@@ -0,0 +1,1653 @@
+package oms
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/xml"
+	"errors"
+	"image"
+	"image/color"
+	"io"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+
+	"golang.org/x/image/colornames"
+	"golang.org/x/image/draw"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"golang.org/x/image/vector"
+	"golang.org/x/net/html"
+)
+
+const (
+	// Size of an SVG that gives neither width, height nor viewBox.
+	svgDefaultW = 300
+	svgDefaultH = 150
+	// maxSVGPixels bounds the bitmap an SVG is drawn into.
+	maxSVGPixels = 1 << 20
+	// maxSVGDepth stops runaway nesting and <use> cycles.
+	maxSVGDepth = 32
+	// maxSVGElements bounds the elements drawn, counting every copy a <use>
+	// makes, so nested fan-out cannot multiply without limit.
+	maxSVGElements = 10000
+	// maxSVGWork bounds the mask pixels rasterised for one drawing; every
+	// fill and stroke covers the whole bitmap.
+	maxSVGWork = 64 * maxSVGPixels
+)
+
+var (
+	errNotSVG   = errors.New("svg: no <svg> root element")
+	errSVGEmpty = errors.New("svg: nothing to draw")
+)
+
+// svgNode is an element of an SVG document, from inline markup or an
+// image/svg+xml file. Tag and attribute names are lower case, and style
+// attributes and <style> rules are merged into attrs. Text nodes have an
+// empty tag.
+type svgNode struct {
+	tag      string
+	attrs    map[string]string
+	text     string
+	children []*svgNode
+}
+
+// svgStyleProps are the CSS properties of the page stylesheet that apply
+// to inline SVG elements.
+var svgStyleProps = []string{
+	"display", "visibility", "color", "fill", "fill-opacity", "fill-rule",
+	"stroke", "stroke-width", "stroke-opacity", "stroke-linecap", "opacity",
+	"font-size", "text-anchor", "stop-color", "stop-opacity",
+}
+
+// isSVG reports whether a fetched image is an SVG document.
+func isSVG(raw []byte, contentType string) bool {
+	if strings.Contains(strings.ToLower(contentType), "svg") {
+		return true
+	}
+	head := raw[:min(len(raw), 1024)]
+	head = bytes.ToLower(bytes.TrimSpace(bytes.TrimPrefix(head, []byte("\xef\xbb\xbf"))))
+	if bytes.HasPrefix(head, []byte("<svg")) {
+		return true
+	}
+	return (bytes.HasPrefix(head, []byte("<?xml")) || bytes.HasPrefix(head, []byte("<!"))) && bytes.Contains(head, []byte("<svg"))
+}
+
+// parseSVG reads an SVG document leniently, as browsers do with markup
+// served as SVG.
+func parseSVG(data []byte) (*svgNode, error) {
+	dec := xml.NewDecoder(bytes.NewReader(data))
+	dec.Strict = false
+	dec.AutoClose = xml.HTMLAutoClose
+	dec.Entity = xml.HTMLEntity
+	dec.CharsetReader = func(_ string, r io.Reader) (io.Reader, error) { return r, nil }
+	var root *svgNode
+	var stack []*svgNode
+	for {
+		tok, err := dec.Token()
+		if err != nil {
+			if err == io.EOF || root != nil {
+				break
+			}
+			return nil, err
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			n := &svgNode{tag: strings.ToLower(t.Name.Local), attrs: make(map[string]string, len(t.Attr))}
+			for _, a := range t.Attr {
+				n.attrs[strings.ToLower(a.Name.Local)] = a.Value
+			}
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, n)
+			} else if root == nil && n.tag == "svg" {
+				root = n
+			} else {
+				return nil, errNotSVG
+			}
+			stack = append(stack, n)
+		case xml.EndElement:
+			if len(stack) > 0 {
+				stack = stack[:len(stack)-1]
+			}
+		case xml.CharData:
+			if len(stack) > 0 {
+				parent := stack[len(stack)-1]
+				parent.children = append(parent.children, &svgNode{text: string(t)})
+			}
+		}
+	}
+	if root == nil {
+		return nil, errNotSVG
+	}
+	applySVGStyles(root)
+	return root, nil
+}
+
+// svgFromHTML converts an inline <svg> subtree. Properties the page's CSS
+// sets on its elements are merged in, and <use> references missing from
+// the subtree (icon sprites) are copied from elsewhere in the document.
+func svgFromHTML(n *html.Node, ss *Stylesheet) *svgNode {
+	var conv func(*html.Node) *svgNode
+	conv = func(h *html.Node) *svgNode {
+		s := &svgNode{tag: strings.ToLower(h.Data), attrs: make(map[string]string, len(h.Attr))}
+		for _, a := range h.Attr {
+			s.attrs[strings.ToLower(a.Key)] = a.Val
+		}
+		if props := computeStyleFor(h, ss); props != nil {
+			for _, k := range svgStyleProps {
+				if v, ok := props[k]; ok {
+					s.attrs[k] = v
+				}
+			}
+		}
+		for c := h.FirstChild; c != nil; c = c.NextSibling {
+			switch c.Type {
+			case html.ElementNode:
+				s.children = append(s.children, conv(c))
+			case html.TextNode:
+				s.children = append(s.children, &svgNode{text: c.Data})
+			}
+		}
+		return s
+	}
+	root := conv(n)
+
+	doc := n
+	for doc.Parent != nil {
+		doc = doc.Parent
+	}
+	ids := root.ids()
+	var defs *svgNode
+	var resolve func(*svgNode)
+	resolve = func(s *svgNode) {
+		for _, c := range s.children {
+			resolve(c)
+		}
+		if s.tag != "use" {
+			return
+		}
+		id, ok := strings.CutPrefix(strings.TrimSpace(s.attrs["href"]), "#")
+		if !ok || id == "" || ids[id] != nil {
+			return
+		}
+		if ref := findElementByID(doc, id); ref != nil {
+			copied := conv(ref)
+			for k, v := range copied.ids() {
+				ids[k] = v
+			}
+			if defs == nil {
+				defs = &svgNode{tag: "defs", attrs: map[string]string{}}
+				root.children = append(root.children, defs)
+			}
+			defs.children = append(defs.children, copied)
+			resolve(copied)
+		}
+	}
+	resolve(root)
+	applySVGStyles(root)
+	return root
+}
+
+// findElementByID returns the first element under n with the given id.
+func findElementByID(n *html.Node, id string) *html.Node {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type != html.ElementNode {
+			continue
+		}
+		if getAttr(c, "id") == id {
+			return c
+		}
+		if found := findElementByID(c, id); found != nil {
+			return found
+		}
+	}
+	return nil
+}
+
+// ids indexes the elements of the tree by id.
+func (n *svgNode) ids() map[string]*svgNode {
+	ids := map[string]*svgNode{}
+	var visit func(*svgNode)
+	visit = func(s *svgNode) {
+		if id := s.attrs["id"]; id != "" && ids[id] == nil {
+			ids[id] = s
+		}
+		for _, c := range s.children {
+			visit(c)
+		}
+	}
+	visit(n)
+	return ids
+}
+
+// textContent returns the concatenated text of n's subtree.
+func (n *svgNode) textContent() string {
+	var sb strings.Builder
+	var visit func(*svgNode)
+	visit = func(s *svgNode) {
+		sb.WriteString(s.text)
+		for _, c := range s.children {
+			visit(c)
+		}
+	}
+	visit(n)
+	return sb.String()
+}
+
+// digest identifies the drawing for the image cache.
+func (n *svgNode) digest() string {
+	h := sha1.New()
+	var visit func(*svgNode)
+	visit = func(s *svgNode) {
+		io.WriteString(h, "<"+s.tag)
+		keys := make([]string, 0, len(s.attrs))
+		for k := range s.attrs {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			io.WriteString(h, " "+k+"="+strconv.Quote(s.attrs[k]))
+		}
+		io.WriteString(h, ">"+s.text)
+		for _, c := range s.children {
+			visit(c)
+		}
+		io.WriteString(h, "/>")
+	}
+	visit(n)
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// svgRule is a rule of an SVG <style> element. Only compound selectors of
+// a tag, classes and an id are supported.
+type svgRule struct {
+	tag, id     string
+	classes     []string
+	specificity int
+	decls       [][2]string
+}
+
+func (r svgRule) matches(n *svgNode) bool {
+	if r.tag != "" && r.tag != "*" && r.tag != n.tag {
+		return false
+	}
+	if r.id != "" && n.attrs["id"] != r.id {
+		return false
+	}
+	have := strings.Fields(n.attrs["class"])
+	for _, c := range r.classes {
+		found := false
+		for _, h := range have {
+			found = found || h == c
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// applySVGStyles merges <style> rules and style attributes into the
+// presentation attributes of the tree.
+func applySVGStyles(root *svgNode) {
+	var rules []svgRule
+	var collect func(*svgNode)
+	collect = func(n *svgNode) {
+		if n.tag == "style" {
+			rules = append(rules, parseSVGRules(n.textContent())...)
+			return
+		}
+		for _, c := range n.children {
+			collect(c)
+		}
+	}
+	collect(root)
+	sort.SliceStable(rules, func(i, j int) bool { return rules[i].specificity < rules[j].specificity })
+
+	var apply func(*svgNode)
+	apply = func(n *svgNode) {
+		if n.tag == "" {
+			return
+		}
+		for _, r := range rules {
+			if r.matches(n) {
+				for _, d := range r.decls {
+					n.attrs[d[0]] = d[1]
+				}
+			}
+		}
+		for _, d := range parseSVGDecls(n.attrs["style"]) {
+			n.attrs[d[0]] = d[1]
+		}
+		for _, c := range n.children {
+			apply(c)
+		}
+	}
+	apply(root)
+}
+
+// parseSVGRules parses the rules of a style sheet, skipping at-rules and
+// selectors with combinators, pseudo-classes or attributes.
+func parseSVGRules(css string) []svgRule {
+	for {
+		start := strings.Index(css, "/*")
+		if start < 0 {
+			break
+		}
+		end := strings.Index(css[start+2:], "*/")
+		if end < 0 {
+			css = css[:start]
+			break
+		}
+		css = css[:start] + css[start+2+end+2:]
+	}
+	var rules []svgRule
+	for _, block := range strings.Split(css, "}") {
+		sel, body, ok := strings.Cut(block, "{")
+		if !ok || strings.Contains(sel, "@") {
+			continue
+		}
+		decls := parseSVGDecls(body)
+		for _, s := range strings.Split(sel, ",") {
+			s = strings.TrimSpace(s)
+			if s == "" || strings.ContainsAny(s, " >+~:[") {
+				continue
+			}
+			r := svgRule{decls: decls}
+			for i := 0; i < len(s); {
+				j := i + 1
+				for j < len(s) && s[j] != '.' && s[j] != '#' {
+					j++
+				}
+				switch part := s[i:j]; part[0] {
+				case '.':
+					r.classes = append(r.classes, part[1:])
+					r.specificity += 10
+				case '#':
+					r.id = part[1:]
+					r.specificity += 100
+				default:
+					r.tag = strings.ToLower(part)
+					r.specificity++
+				}
+				i = j
+			}
+			rules = append(rules, r)
+		}
+	}
+	return rules
+}
+
+// parseSVGDecls splits "prop: value; ..." into lower-case properties and
+// values, dropping !important.
+func parseSVGDecls(s string) [][2]string {
+	var out [][2]string
+	for _, part := range strings.Split(s, ";") {
+		k, v, ok := strings.Cut(part, ":")
+		if !ok {
+			continue
+		}
+		k = strings.ToLower(strings.TrimSpace(k))
+		v = strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(v), "!important"))
+		if k != "" && v != "" {
+			out = append(out, [2]string{k, v})
+		}
+	}
+	return out
+}
+
+// ---------------------- Geometry ----------------------
+
+type svgPoint struct{ x, y float64 }
+
+// svgMatrix is the affine transform x' = a*x + c*y + e, y' = b*x + d*y + f.
+type svgMatrix struct{ a, b, c, d, e, f float64 }
+
+var svgIdentity = svgMatrix{a: 1, d: 1}
+
+// mul returns m applied after n.
+func (m svgMatrix) mul(n svgMatrix) svgMatrix {
+	return svgMatrix{
+		a: m.a*n.a + m.c*n.b,
+		b: m.b*n.a + m.d*n.b,
+		c: m.a*n.c + m.c*n.d,
+		d: m.b*n.c + m.d*n.d,
+		e: m.a*n.e + m.c*n.f + m.e,
+		f: m.b*n.e + m.d*n.f + m.f,
+	}
+}
+
+func (m svgMatrix) apply(p svgPoint) svgPoint {
+	return svgPoint{m.a*p.x + m.c*p.y + m.e, m.b*p.x + m.d*p.y + m.f}
+}
+
+// scale is the factor m scales lengths by, on average.
+func (m svgMatrix) scale() float64 {
+	return math.Sqrt(math.Abs(m.a*m.d - m.b*m.c))
+}
+
+func svgTranslate(x, y float64) svgMatrix { return svgMatrix{a: 1, d: 1, e: x, f: y} }
+func svgScale(x, y float64) svgMatrix     { return svgMatrix{a: x, d: y} }
+
+// parseSVGTransform parses a transform list such as
+// "translate(10 20) rotate(45) scale(2)".
+func parseSVGTransform(s string) svgMatrix {
+	m := svgIdentity
+	for {
+		open := strings.IndexByte(s, '(')
+		end := strings.IndexByte(s, ')')
+		if open < 0 || end < open {
+			return m
+		}
+		name := strings.ToLower(strings.Trim(s[:open], " \t\r\n,"))
+		args := svgNumbers(s[open+1 : end])
+		s = s[end+1:]
+		arg := func(i int, def float64) float64 {
+			if i < len(args) {
+				return args[i]
+			}
+			return def
+		}
+		var t svgMatrix
+		switch name {
+		case "matrix":
+			if len(args) < 6 {
+				continue
+			}
+			t = svgMatrix{args[0], args[1], args[2], args[3], args[4], args[5]}
+		case "translate":
+			t = svgTranslate(arg(0, 0), arg(1, 0))
+		case "scale":
+			sx := arg(0, 1)
+			t = svgScale(sx, arg(1, sx))
+		case "rotate":
+			rad := arg(0, 0) * math.Pi / 180
+			cx, cy := arg(1, 0), arg(2, 0)
+			sin, cos := math.Sincos(rad)
+			t = svgTranslate(cx, cy).mul(svgMatrix{a: cos, b: sin, c: -sin, d: cos}).mul(svgTranslate(-cx, -cy))
+		case "skewx":
+			t = svgMatrix{a: 1, c: math.Tan(arg(0, 0) * math.Pi / 180), d: 1}
+		case "skewy":
+			t = svgMatrix{a: 1, b: math.Tan(arg(0, 0) * math.Pi / 180), d: 1}
+		default:
+			continue
+		}
+		m = m.mul(t)
+	}
+}
+
+// svgNumbers parses a list of numbers separated by spaces or commas.
+func svgNumbers(s string) []float64 {
+	sc := svgScanner{s: s}
+	var out []float64
+	for {
+		v, ok := sc.number()
+		if !ok {
+			return out
+		}
+		out = append(out, v)
+	}
+}
+
+// svgScanner reads the numbers of path data and attribute lists.
+type svgScanner struct {
+	s string
+	i int
+}
+
+func (sc *svgScanner) skipSeparators() {
+	for sc.i < len(sc.s) {
+		switch sc.s[sc.i] {
+		case ' ', '\t', '\r', '\n', ',':
+			sc.i++
+		default:
+			return
+		}
+	}
+}
+
+func (sc *svgScanner) number() (float64, bool) {
+	sc.skipSeparators()
+	start, i := sc.i, sc.i
+	if i < len(sc.s) && (sc.s[i] == '+' || sc.s[i] == '-') {
+		i++
+	}
+	digits, dot := false, false
+	for ; i < len(sc.s); i++ {
+		c := sc.s[i]
+		if c >= '0' && c <= '9' {
+			digits = true
+		} else if c == '.' && !dot {
+			dot = true
+		} else {
+			break
+		}
+	}
+	if !digits {
+		return 0, false
+	}
+	if i < len(sc.s) && (sc.s[i] == 'e' || sc.s[i] == 'E') {
+		j := i + 1
+		if j < len(sc.s) && (sc.s[j] == '+' || sc.s[j] == '-') {
+			j++
+		}
+		if j < len(sc.s) && sc.s[j] >= '0' && sc.s[j] <= '9' {
+			for j < len(sc.s) && sc.s[j] >= '0' && sc.s[j] <= '9' {
+				j++
+			}
+			i = j
+		}
+	}
+	v, err := strconv.ParseFloat(sc.s[start:i], 64)
+	if err != nil {
+		return 0, false
+	}
+	sc.i = i
+	return v, true
+}
+
+// flag reads an arc flag, which may be written without a separator.
+func (sc *svgScanner) flag() (bool, bool) {
+	sc.skipSeparators()
+	if sc.i < len(sc.s) && (sc.s[sc.i] == '0' || sc.s[sc.i] == '1') {
+		sc.i++
+		return sc.s[sc.i-1] == '1', true
+	}
+	return false, false
+}
+
+// svgSeg is a path segment: 'M' and 'L' use p[0], 'C' uses all three
+// points, 'Z' none.
+type svgSeg struct {
+	op byte
+	p  [3]svgPoint
+}
+
+type svgPath []svgSeg
+
+func (p *svgPath) moveTo(a svgPoint) { *p = append(*p, svgSeg{op: 'M', p: [3]svgPoint{a}}) }
+func (p *svgPath) lineTo(a svgPoint) { *p = append(*p, svgSeg{op: 'L', p: [3]svgPoint{a}}) }
+func (p *svgPath) cubicTo(a, b, c svgPoint) {
+	*p = append(*p, svgSeg{op: 'C', p: [3]svgPoint{a, b, c}})
+}
+func (p *svgPath) close() { *p = append(*p, svgSeg{op: 'Z'}) }
+
+// arcTo appends the elliptical arc from cur to end as cubic curves,
+// following the endpoint parameterisation of SVG 1.1 appendix F.6.
+func (p *svgPath) arcTo(cur svgPoint, rx, ry, angle float64, large, sweep bool, end svgPoint) {
+	if cur == end {
+		return
+	}
+	rx, ry = math.Abs(rx), math.Abs(ry)
+	if rx == 0 || ry == 0 {
+		p.lineTo(end)
+		return
+	}
+	sin, cos := math.Sincos(angle * math.Pi / 180)
+	dx, dy := (cur.x-end.x)/2, (cur.y-end.y)/2
+	x1 := cos*dx + sin*dy
+	y1 := -sin*dx + cos*dy
+	if l := x1*x1/(rx*rx) + y1*y1/(ry*ry); l > 1 {
+		rx, ry = rx*math.Sqrt(l), ry*math.Sqrt(l)
+	}
+	num := rx*rx*ry*ry - rx*rx*y1*y1 - ry*ry*x1*x1
+	den := rx*rx*y1*y1 + ry*ry*x1*x1
+	coef := math.Sqrt(math.Max(0, num/den))
+	if large == sweep {
+		coef = -coef
+	}
+	cxp, cyp := coef*rx*y1/ry, -coef*ry*x1/rx
+	cx := cos*cxp - sin*cyp + (cur.x+end.x)/2
+	cy := sin*cxp + cos*cyp + (cur.y+end.y)/2
+	vecAngle := func(ux, uy, vx, vy float64) float64 {
+		return math.Atan2(ux*vy-uy*vx, ux*vx+uy*vy)
+	}
+	ux, uy := (x1-cxp)/rx, (y1-cyp)/ry
+	theta := vecAngle(1, 0, ux, uy)
+	delta := vecAngle(ux, uy, (-x1-cxp)/rx, (-y1-cyp)/ry)
+	if !sweep && delta > 0 {
+		delta -= 2 * math.Pi
+	} else if sweep && delta < 0 {
+		delta += 2 * math.Pi
+	}
+	n := int(math.Ceil(math.Abs(delta) / (math.Pi / 2)))
+	step := delta / float64(n)
+	k := 4.0 / 3 * math.Tan(step/4)
+	at := func(t float64) (svgPoint, svgPoint) {
+		st, ct := math.Sincos(t)
+		x, y := rx*ct, ry*st
+		tx, ty := -rx*st, ry*ct
+		return svgPoint{cos*x - sin*y + cx, sin*x + cos*y + cy}, svgPoint{cos*tx - sin*ty, sin*tx + cos*ty}
+	}
+	for i := 0; i < n; i++ {
+		p0, d0 := at(theta + float64(i)*step)
+		p1, d1 := at(theta + float64(i+1)*step)
+		if i == n-1 {
+			p1 = end
+		}
+		p.cubicTo(svgPoint{p0.x + k*d0.x, p0.y + k*d0.y}, svgPoint{p1.x - k*d1.x, p1.y - k*d1.y}, p1)
+	}
+}
+
+// parsePathData parses the d attribute of <path>. Like browsers it draws
+// everything up to the first error.
+func parsePathData(d string) svgPath {
+	var p svgPath
+	sc := svgScanner{s: d}
+	var cur, start, ctrl svgPoint
+	var cmd, prev byte
+	needMove := false
+	for {
+		sc.skipSeparators()
+		if sc.i >= len(sc.s) {
+			return p
+		}
+		if c := sc.s[sc.i]; (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			cmd = c
+			sc.i++
+		} else if cmd == 0 || cmd == 'z' || cmd == 'Z' {
+			return p
+		}
+		rel := cmd >= 'a'
+		abs := func(x, y float64) svgPoint {
+			if rel {
+				return svgPoint{cur.x + x, cur.y + y}
+			}
+			return svgPoint{x, y}
+		}
+		point := func() (svgPoint, bool) {
+			x, ok1 := sc.number()
+			y, ok2 := sc.number()
+			return abs(x, y), ok1 && ok2
+		}
+		lower := cmd | 0x20
+		if needMove && lower != 'm' && lower != 'z' {
+			p.moveTo(start)
+			needMove = false
+		}
+		switch lower {
+		case 'm':
+			a, ok := point()
+			if !ok {
+				return p
+			}
+			p.moveTo(a)
+			cur, start, needMove = a, a, false
+			// Further coordinate pairs are implicit lineto commands.
+			cmd = 'L' | (cmd & 0x20)
+		case 'l':
+			a, ok := point()
+			if !ok {
+				return p
+			}
+			p.lineTo(a)
+			cur = a
+		case 'h':
+			x, ok := sc.number()
+			if !ok {
+				return p
+			}
+			if rel {
+				x += cur.x
+			}
+			cur = svgPoint{x, cur.y}
+			p.lineTo(cur)
+		case 'v':
+			y, ok := sc.number()
+			if !ok {
+				return p
+			}
+			if rel {
+				y += cur.y
+			}
+			cur = svgPoint{cur.x, y}
+			p.lineTo(cur)
+		case 'c', 's':
+			var c1 svgPoint
+			ok := true
+			if lower == 'c' {
+				c1, ok = point()
+			} else if prev == 'c' || prev == 's' {
+				c1 = svgPoint{2*cur.x - ctrl.x, 2*cur.y - ctrl.y}
+			} else {
+				c1 = cur
+			}
+			c2, ok2 := point()
+			end, ok3 := point()
+			if !ok || !ok2 || !ok3 {
+				return p
+			}
+			p.cubicTo(c1, c2, end)
+			ctrl, cur = c2, end
+		case 'q', 't':
+			var q svgPoint
+			ok := true
+			if lower == 'q' {
+				q, ok = point()
+			} else if prev == 'q' || prev == 't' {
+				q = svgPoint{2*cur.x - ctrl.x, 2*cur.y - ctrl.y}
+			} else {
+				q = cur
+			}
+			end, ok2 := point()
+			if !ok || !ok2 {
+				return p
+			}
+			p.cubicTo(svgPoint{cur.x + 2*(q.x-cur.x)/3, cur.y + 2*(q.y-cur.y)/3},
+				svgPoint{end.x + 2*(q.x-end.x)/3, end.y + 2*(q.y-end.y)/3}, end)
+			ctrl, cur = q, end
+		case 'a':
+			rx, ok1 := sc.number()
+			ry, ok2 := sc.number()
+			angle, ok3 := sc.number()
+			large, ok4 := sc.flag()
+			sweep, ok5 := sc.flag()
+			end, ok6 := point()
+			if !ok1 || !ok2 || !ok3 || !ok4 || !ok5 || !ok6 {
+				return p
+			}
+			p.arcTo(cur, rx, ry, angle, large, sweep, end)
+			cur = end
+		case 'z':
+			p.close()
+			cur, needMove = start, true
+		default:
+			return p
+		}
+		prev = lower
+	}
+}
+
+// flatten transforms p by m and approximates its curves with lines. The
+// result is one polyline per subpath; closed marks those ended by Z.
+func (p svgPath) flatten(m svgMatrix) (subs [][]svgPoint, closed []bool) {
+	var cur []svgPoint
+	flush := func(isClosed bool) {
+		if len(cur) > 0 {
+			subs = append(subs, cur)
+			closed = append(closed, isClosed)
+		}
+		cur = nil
+	}
+	for _, seg := range p {
+		switch seg.op {
+		case 'M':
+			flush(false)
+			cur = []svgPoint{m.apply(seg.p[0])}
+		case 'L':
+			if cur != nil {
+				cur = append(cur, m.apply(seg.p[0]))
+			}
+		case 'C':
+			if cur == nil {
+				continue
+			}
+			p0 := cur[len(cur)-1]
+			p1, p2, p3 := m.apply(seg.p[0]), m.apply(seg.p[1]), m.apply(seg.p[2])
+			length := math.Hypot(p1.x-p0.x, p1.y-p0.y) + math.Hypot(p2.x-p1.x, p2.y-p1.y) + math.Hypot(p3.x-p2.x, p3.y-p2.y)
+			n := min(max(int(length/2), 1), 64)
+			for i := 1; i <= n; i++ {
+				t := float64(i) / float64(n)
+				u := 1 - t
+				cur = append(cur, svgPoint{
+					u*u*u*p0.x + 3*u*u*t*p1.x + 3*u*t*t*p2.x + t*t*t*p3.x,
+					u*u*u*p0.y + 3*u*u*t*p1.y + 3*u*t*t*p2.y + t*t*t*p3.y,
+				})
+			}
+		case 'Z':
+			flush(true)
+		}
+	}
+	flush(false)
+	return subs, closed
+}
+
+// ---------------------- Painting ----------------------
+
+// svgState is the inherited drawing state of an element.
+type svgState struct {
+	m                          svgMatrix
+	vw, vh                     float64 // viewport size in user units, for percentages
+	color                      color.NRGBA
+	fill, stroke               *color.NRGBA // nil = none
+	fillOpacity, strokeOpacity float64
+	opacity                    float64
+	strokeWidth                float64
+	evenOdd                    bool
+	lineCap                    string
+	fontSize                   float64
+	anchor                     string
+}
+
+// svgRaster draws an SVG tree into an RGBA bitmap. Drawing stops once the
+// element or pixel budget is spent.
+type svgRaster struct {
+	dst      *image.RGBA
+	z        *vector.Rasterizer
+	ids      map[string]*svgNode
+	active   map[*svgNode]bool // elements being drawn, to refuse <use> of an ancestor
+	elements int
+	work     int
+}
+
+// rasterizeSVG draws root into a bitmap of its own size, or w x h when
+// given (one of them keeps the aspect ratio), scaled down to maxW pixels
+// wide. fg is the currentColor of the document.
+func rasterizeSVG(root *svgNode, w, h float64, maxW int, fg color.NRGBA) (*image.RGBA, error) {
+	vb, hasVB := parseViewBox(root.attrs["viewbox"])
+	iw, okW := svgLength(root.attrs["width"], 0)
+	ih, okH := svgLength(root.attrs["height"], 0)
+	switch {
+	case okW && okH:
+	case okW && hasVB:
+		ih = iw * vb[3] / vb[2]
+	case okH && hasVB:
+		iw = ih * vb[2] / vb[3]
+	case hasVB && !okW && !okH:
+		iw, ih = vb[2], vb[3]
+	default:
+		if !okW {
+			iw = svgDefaultW
+		}
+		if !okH {
+			ih = svgDefaultH
+		}
+	}
+	switch {
+	case w > 0 && h > 0:
+		iw, ih = w, h
+	case w > 0 && iw > 0:
+		iw, ih = w, ih*w/iw
+	case h > 0 && ih > 0:
+		iw, ih = iw*h/ih, h
+	}
+	if !(iw >= 0.5 && ih >= 0.5) || math.IsInf(iw, 0) || math.IsInf(ih, 0) {
+		return nil, errSVGEmpty
+	}
+	scale := 1.0
+	if maxW > 0 && iw > float64(maxW) {
+		scale = float64(maxW) / iw
+	}
+	if px := iw * ih * scale * scale; px > maxSVGPixels {
+		scale *= math.Sqrt(maxSVGPixels / px)
+	}
+	W, H := max(int(math.Round(iw*scale)), 1), max(int(math.Round(ih*scale)), 1)
+
+	st := svgState{
+		m:             svgScale(float64(W)/iw, float64(H)/ih),
+		vw:            iw,
+		vh:            ih,
+		color:         fg,
+		fill:          &fg,
+		fillOpacity:   1,
+		strokeOpacity: 1,
+		opacity:       1,
+		strokeWidth:   1,
+		lineCap:       "butt",
+		fontSize:      16,
+	}
+	if hasVB {
+		st.m = viewBoxMatrix(vb, root.attrs["preserveaspectratio"], 0, 0, float64(W), float64(H))
+		st.vw, st.vh = vb[2], vb[3]
+	}
+	r := &svgRaster{
+		dst:      image.NewRGBA(image.Rect(0, 0, W, H)),
+		z:        vector.NewRasterizer(W, H),
+		ids:      root.ids(),
+		active:   map[*svgNode]bool{root: true},
+		elements: maxSVGElements,
+		work:     maxSVGWork,
+	}
+	if strings.TrimSpace(root.attrs["display"]) != "none" {
+		r.children(root, r.inherit(st, root), 0)
+	}
+	for i := 3; i < len(r.dst.Pix); i += 4 {
+		if r.dst.Pix[i] != 0 {
+			return r.dst, nil
+		}
+	}
+	return nil, errSVGEmpty
+}
+
+// parseViewBox returns min-x, min-y, width and height.
+func parseViewBox(s string) ([4]float64, bool) {
+	v := svgNumbers(s)
+	if len(v) != 4 || v[2] <= 0 || v[3] <= 0 {
+		return [4]float64{}, false
+	}
+	return [4]float64{v[0], v[1], v[2], v[3]}, true
+}
+
+// viewBoxMatrix maps viewBox vb onto the viewport x, y, w, h as
+// preserveAspectRatio par asks (default xMidYMid meet).
+func viewBoxMatrix(vb [4]float64, par string, x, y, w, h float64) svgMatrix {
+	sx, sy := w/vb[2], h/vb[3]
+	fields := strings.Fields(strings.ToLower(par))
+	align := "xmidymid"
+	if len(fields) > 0 {
+		align = fields[0]
+	}
+	if align != "none" {
+		s := min(sx, sy)
+		if len(fields) > 1 && fields[1] == "slice" {
+			s = max(sx, sy)
+		}
+		sx, sy = s, s
+		switch {
+		case strings.Contains(align, "xmid"):
+			x += (w - vb[2]*s) / 2
+		case strings.Contains(align, "xmax"):
+			x += w - vb[2]*s
+		}
+		switch {
+		case strings.Contains(align, "ymid"):
+			y += (h - vb[3]*s) / 2
+		case strings.Contains(align, "ymax"):
+			y += h - vb[3]*s
+		}
+	}
+	return svgTranslate(x, y).mul(svgScale(sx, sy)).mul(svgTranslate(-vb[0], -vb[1]))
+}
+
+// svgLength parses a length in user units; percentages are of ref. ok is
+// false when s is empty, invalid, or a percentage without a reference.
+func svgLength(s string, ref float64) (float64, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	unit := 1.0
+	for _, u := range []struct {
+		suffix string
+		px     float64
+	}{{"px", 1}, {"pt", 4.0 / 3}, {"pc", 16}, {"em", 16}, {"ex", 8}, {"in", 96}, {"cm", 96 / 2.54}, {"mm", 96 / 25.4}, {"%", -1}} {
+		if strings.HasSuffix(s, u.suffix) {
+			s = strings.TrimSpace(strings.TrimSuffix(s, u.suffix))
+			unit = u.px
+			break
+		}
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) || math.IsInf(v, 0) {
+		return 0, false
+	}
+	if unit < 0 {
+		if ref <= 0 {
+			return 0, false
+		}
+		return v * ref / 100, true
+	}
+	return v * unit, true
+}
+
+// length reads attribute name of n as a length, 0 when absent.
+func (st svgState) length(n *svgNode, name string, ref float64) float64 {
+	v, _ := svgLength(n.attrs[name], ref)
+	return v
+}
+
+// parseSVGColor parses a CSS colour, including the SVG colour keywords.
+func parseSVGColor(s string) (color.NRGBA, bool) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if s == "transparent" {
+		return color.NRGBA{}, true
+	}
+	if c, ok := colornames.Map[s]; ok {
+		return color.NRGBA{c.R, c.G, c.B, 0xFF}, true
+	}
+	if strings.HasPrefix(s, "#") && (len(s) == 5 || len(s) == 9) {
+		digits := s[1:]
+		if len(digits) == 4 {
+			digits = string([]byte{digits[0], digits[0], digits[1], digits[1], digits[2], digits[2], digits[3], digits[3]})
+		}
+		if v, err := strconv.ParseUint(digits, 16, 32); err == nil {
+			return color.NRGBA{uint8(v >> 24), uint8(v >> 16), uint8(v >> 8), uint8(v)}, true
+		}
+		return color.NRGBA{}, false
+	}
+	c, ok := parseCSSColor(s)
+	if !ok {
+		return color.NRGBA{}, false
+	}
+	out := color.NRGBA{c.R, c.G, c.B, 0xFF}
+	if strings.HasPrefix(s, "rgba(") {
+		if parts := strings.Split(strings.TrimSuffix(s[5:], ")"), ","); len(parts) == 4 {
+			if a, ok := svgOpacity(parts[3]); ok {
+				out.A = uint8(math.Round(a * 255))
+			}
+		}
+	}
+	return out, true
+}
+
+// svgOpacity parses an opacity as a number or percentage, clamped to 0..1.
+func svgOpacity(s string) (float64, bool) {
+	s = strings.TrimSpace(s)
+	div := 1.0
+	if strings.HasSuffix(s, "%") {
+		s, div = strings.TrimSuffix(s, "%"), 100
+	}
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil || math.IsNaN(v) {
+		return 0, false
+	}
+	return min(max(v/div, 0), 1), true
+}
+
+// paint resolves a fill or stroke value. Gradients and patterns are drawn
+// in the average colour of their stops, or their fallback colour.
+func (r *svgRaster) paint(v string, st svgState, inherited *color.NRGBA) *color.NRGBA {
+	v = strings.TrimSpace(v)
+	switch strings.ToLower(v) {
+	case "none":
+		return nil
+	case "currentcolor":
+		c := st.color
+		return &c
+	case "inherit", "":
+		return inherited
+	}
+	if rest, ok := strings.CutPrefix(v, "url("); ok {
+		ref, fallback, _ := strings.Cut(rest, ")")
+		id := strings.TrimPrefix(strings.Trim(strings.TrimSpace(ref), `"'`), "#")
+		if c, ok := r.gradientColor(r.ids[id], 0); ok {
+			return &c
+		}
+		if fallback = strings.TrimSpace(fallback); fallback != "" {
+			return r.paint(fallback, st, nil)
+		}
+		return nil
+	}
+	if c, ok := parseSVGColor(v); ok {
+		return &c
+	}
+	return inherited
+}
+
+// gradientColor averages the stops of a gradient, following href to the
+// gradient that holds them.
+func (r *svgRaster) gradientColor(g *svgNode, depth int) (color.NRGBA, bool) {
+	if g == nil || depth > 4 || (g.tag != "lineargradient" && g.tag != "radialgradient") {
+		return color.NRGBA{}, false
+	}
+	var sum [4]float64
+	n := 0
+	for _, stop := range g.children {
+		if stop.tag != "stop" {
+			continue
+		}
+		c, ok := parseSVGColor(stop.attrs["stop-color"])
+		if !ok {
+			c = color.NRGBA{A: 0xFF}
+		}
+		a := float64(c.A) / 255
+		if o, ok := svgOpacity(stop.attrs["stop-opacity"]); ok {
+			a *= o
+		}
+		sum[0] += float64(c.R)
+		sum[1] += float64(c.G)
+		sum[2] += float64(c.B)
+		sum[3] += a
+		n++
+	}
+	if n == 0 {
+		id := strings.TrimPrefix(strings.TrimSpace(g.attrs["href"]), "#")
+		return r.gradientColor(r.ids[id], depth+1)
+	}
+	f := float64(n)
+	return color.NRGBA{uint8(sum[0] / f), uint8(sum[1] / f), uint8(sum[2] / f), uint8(math.Round(sum[3] / f * 255))}, true
+}
+
+// inherit applies the presentation attributes of n to st.
+func (r *svgRaster) inherit(st svgState, n *svgNode) svgState {
+	a := n.attrs
+	if v, ok := a["color"]; ok {
+		if c, ok := parseSVGColor(v); ok {
+			st.color = c
+		}
+	}
+	if v, ok := a["fill"]; ok {
+		st.fill = r.paint(v, st, st.fill)
+	}
+	if v, ok := a["stroke"]; ok {
+		st.stroke = r.paint(v, st, st.stroke)
+	}
+	if v, ok := svgOpacity(a["fill-opacity"]); ok {
+		st.fillOpacity = v
+	}
+	if v, ok := svgOpacity(a["stroke-opacity"]); ok {
+		st.strokeOpacity = v
+	}
+	if v, ok := svgOpacity(a["opacity"]); ok {
+		// Group opacity is approximated by fading each descendant.
+		st.opacity *= v
+	}
+	if v, ok := svgLength(a["stroke-width"], math.Hypot(st.vw, st.vh)/math.Sqrt2); ok && v >= 0 {
+		st.strokeWidth = v
+	}
+	switch strings.TrimSpace(a["fill-rule"]) {
+	case "evenodd":
+		st.evenOdd = true
+	case "nonzero":
+		st.evenOdd = false
+	}
+	if v := strings.TrimSpace(a["stroke-linecap"]); v == "butt" || v == "round" || v == "square" {
+		st.lineCap = v
+	}
+	if v, ok := a["font-size"]; ok {
+		if px, ok := svgLength(v, st.fontSize*100); ok && px > 0 {
+			st.fontSize = px
+		}
+	}
+	if v := strings.TrimSpace(a["text-anchor"]); v == "start" || v == "middle" || v == "end" {
+		st.anchor = v
+	}
+	return st
+}
+
+// svgSkipped are elements that are not drawn where they stand.
+var svgSkipped = map[string]bool{
+	"defs": true, "symbol": true, "clippath": true, "mask": true, "pattern": true,
+	"marker": true, "lineargradient": true, "radialgradient": true, "filter": true,
+	"title": true, "desc": true, "metadata": true, "style": true, "script": true,
+	"foreignobject": true, "image": true, "": true,
+}
+
+func (r *svgRaster) children(n *svgNode, st svgState, depth int) {
+	for _, c := range n.children {
+		r.render(c, st, depth+1)
+	}
+}
+
+func (r *svgRaster) render(n *svgNode, st svgState, depth int) {
+	if depth > maxSVGDepth || svgSkipped[n.tag] || r.elements <= 0 || r.work <= 0 {
+		return
+	}
+	if strings.TrimSpace(n.attrs["display"]) == "none" {
+		return
+	}
+	r.elements--
+	r.active[n] = true
+	defer delete(r.active, n)
+	st = r.inherit(st, n)
+	if tr := n.attrs["transform"]; tr != "" {
+		st.m = st.m.mul(parseSVGTransform(tr))
+	}
+	hidden := strings.TrimSpace(n.attrs["visibility"]) == "hidden"
+	switch n.tag {
+	case "g", "a":
+		r.children(n, st, depth)
+	case "switch":
+		// Draw the first child that is not a foreign object.
+		for _, c := range n.children {
+			if !svgSkipped[c.tag] {
+				r.render(c, st, depth+1)
+				break
+			}
+		}
+	case "svg":
+		r.viewport(n, n, st, st.length(n, "x", st.vw), st.length(n, "y", st.vh), depth)
+	case "use":
+		id := strings.TrimPrefix(strings.TrimSpace(n.attrs["href"]), "#")
+		ref := r.ids[id]
+		if ref == nil || r.active[ref] {
+			return
+		}
+		x, y := st.length(n, "x", st.vw), st.length(n, "y", st.vh)
+		if ref.tag == "symbol" || ref.tag == "svg" {
+			r.viewport(ref, n, r.inherit(st, ref), x, y, depth)
+			return
+		}
+		st.m = st.m.mul(svgTranslate(x, y))
+		r.render(ref, st, depth+1)
+	case "text":
+		if !hidden {
+			r.drawText(n, st)
+		}
+	default:
+		if path := r.shape(n, st); len(path) > 0 && !hidden {
+			r.drawPath(path, st)
+		}
+	}
+}
+
+// viewport draws the children of a nested <svg> or a <symbol> placed by
+// sized, which gives width and height (default 100%).
+func (r *svgRaster) viewport(n, sized *svgNode, st svgState, x, y float64, depth int) {
+	w, okW := svgLength(sized.attrs["width"], st.vw)
+	h, okH := svgLength(sized.attrs["height"], st.vh)
+	if !okW {
+		w = st.vw
+	}
+	if !okH {
+		h = st.vh
+	}
+	if w <= 0 || h <= 0 {
+		return
+	}
+	r.active[n] = true
+	defer delete(r.active, n)
+	if vb, ok := parseViewBox(n.attrs["viewbox"]); ok {
+		st.m = st.m.mul(viewBoxMatrix(vb, n.attrs["preserveaspectratio"], x, y, w, h))
+		st.vw, st.vh = vb[2], vb[3]
+	} else {
+		st.m = st.m.mul(svgTranslate(x, y))
+		st.vw, st.vh = w, h
+	}
+	r.children(n, st, depth)
+}
+
+// shape returns the outline of a basic shape or path in user units.
+func (r *svgRaster) shape(n *svgNode, st svgState) svgPath {
+	length := func(name string, ref float64) float64 { return st.length(n, name, ref) }
+	var p svgPath
+	switch n.tag {
+	case "path":
+		return parsePathData(n.attrs["d"])
+	case "rect":
+		x, y := length("x", st.vw), length("y", st.vh)
+		w, h := length("width", st.vw), length("height", st.vh)
+		if w <= 0 || h <= 0 {
+			return nil
+		}
+		rx, okX := svgLength(n.attrs["rx"], st.vw)
+		ry, okY := svgLength(n.attrs["ry"], st.vh)
+		if !okX {
+			rx = ry
+		}
+		if !okY {
+			ry = rx
+		}
+		rx, ry = min(max(rx, 0), w/2), min(max(ry, 0), h/2)
+		if rx == 0 || ry == 0 {
+			p.moveTo(svgPoint{x, y})
+			p.lineTo(svgPoint{x + w, y})
+			p.lineTo(svgPoint{x + w, y + h})
+			p.lineTo(svgPoint{x, y + h})
+			p.close()
+			return p
+		}
+		corners := []struct{ from, to svgPoint }{
+			{svgPoint{x + w - rx, y}, svgPoint{x + w, y + ry}},
+			{svgPoint{x + w, y + h - ry}, svgPoint{x + w - rx, y + h}},
+			{svgPoint{x + rx, y + h}, svgPoint{x, y + h - ry}},
+			{svgPoint{x, y + ry}, svgPoint{x + rx, y}},
+		}
+		p.moveTo(svgPoint{x + rx, y})
+		for _, c := range corners {
+			p.lineTo(c.from)
+			p.arcTo(c.from, rx, ry, 0, false, true, c.to)
+		}
+		p.close()
+	case "circle", "ellipse":
+		cx, cy := length("cx", st.vw), length("cy", st.vh)
+		var rx, ry float64
+		if n.tag == "circle" {
+			rx = length("r", math.Hypot(st.vw, st.vh)/math.Sqrt2)
+			ry = rx
+		} else {
+			rx, ry = length("rx", st.vw), length("ry", st.vh)
+		}
+		if rx <= 0 || ry <= 0 {
+			return nil
+		}
+		start := svgPoint{cx + rx, cy}
+		mid := svgPoint{cx - rx, cy}
+		p.moveTo(start)
+		p.arcTo(start, rx, ry, 0, false, true, mid)
+		p.arcTo(mid, rx, ry, 0, false, true, start)
+		p.close()
+	case "line":
+		p.moveTo(svgPoint{length("x1", st.vw), length("y1", st.vh)})
+		p.lineTo(svgPoint{length("x2", st.vw), length("y2", st.vh)})
+	case "polyline", "polygon":
+		v := svgNumbers(n.attrs["points"])
+		for i := 0; i+1 < len(v); i += 2 {
+			if i == 0 {
+				p.moveTo(svgPoint{v[0], v[1]})
+			} else {
+				p.lineTo(svgPoint{v[i], v[i+1]})
+			}
+		}
+		if n.tag == "polygon" && len(p) > 0 {
+			p.close()
+		}
+	}
+	return p
+}
+
+// drawPath fills and strokes path. Strokes always use round joins and
+// ignore dash patterns.
+func (r *svgRaster) drawPath(path svgPath, st svgState) {
+	subs, closed := path.flatten(st.m)
+	if len(subs) == 0 {
+		return
+	}
+	if st.fill != nil {
+		r.fill(r.fillMask(subs, st.evenOdd), *st.fill, st.fillOpacity*st.opacity)
+	}
+	if st.stroke != nil && st.strokeWidth > 0 {
+		hw := st.strokeWidth * st.m.scale() / 2
+		r.fill(r.strokeMask(subs, closed, hw, st.lineCap), *st.stroke, st.strokeOpacity*st.opacity)
+	}
+}
+
+// fill paints c through mask.
+func (r *svgRaster) fill(mask *image.Alpha, c color.NRGBA, opacity float64) {
+	c.A = uint8(math.Round(float64(c.A) * opacity))
+	if mask == nil || c.A == 0 {
+		return
+	}
+	draw.DrawMask(r.dst, r.dst.Bounds(), image.NewUniform(c), image.Point{}, mask, image.Point{}, draw.Over)
+}
+
+func (r *svgRaster) newMask() *image.Alpha {
+	b := r.dst.Bounds()
+	r.work -= b.Dx() * b.Dy()
+	r.z.Reset(b.Dx(), b.Dy())
+	return image.NewAlpha(b)
+}
+
+// polygon adds the closed polygon pts to the rasterizer.
+func (r *svgRaster) polygon(pts []svgPoint) {
+	r.z.MoveTo(float32(pts[0].x), float32(pts[0].y))
+	for _, p := range pts[1:] {
+		r.z.LineTo(float32(p.x), float32(p.y))
+	}
+	r.z.ClosePath()
+}
+
+// fillMask rasterises the interior of subs. The rasterizer implements the
+// nonzero rule; for evenodd each subpath is drawn alone and the coverages
+// are combined with exclusive or.
+func (r *svgRaster) fillMask(subs [][]svgPoint, evenOdd bool) *image.Alpha {
+	if !evenOdd || len(subs) == 1 {
+		mask := r.newMask()
+		for _, pts := range subs {
+			if len(pts) > 2 {
+				r.polygon(pts)
+			}
+		}
+		r.z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+		return mask
+	}
+	var acc *image.Alpha
+	for _, pts := range subs {
+		if len(pts) <= 2 || r.work <= 0 {
+			continue
+		}
+		mask := r.newMask()
+		r.polygon(pts)
+		r.z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+		if acc == nil {
+			acc = mask
+			continue
+		}
+		for i, b := range mask.Pix {
+			a := int(acc.Pix[i])
+			acc.Pix[i] = uint8(a + int(b) - 2*a*int(b)/255)
+		}
+	}
+	return acc
+}
+
+// strokeMask rasterises the outline of the polylines subs at half width
+// hw. Every piece is wound the same way so overlaps merge.
+func (r *svgRaster) strokeMask(subs [][]svgPoint, closed []bool, hw float64, lineCap string) *image.Alpha {
+	mask := r.newMask()
+	dot := func(c svgPoint) {
+		n := min(max(int(hw*2), 8), 48)
+		pts := make([]svgPoint, n)
+		for i := range pts {
+			// Clockwise, like the segment quads.
+			sin, cos := math.Sincos(-2 * math.Pi * float64(i) / float64(n))
+			pts[i] = svgPoint{c.x + hw*cos, c.y + hw*sin}
+		}
+		r.polygon(pts)
+	}
+	for i, pts := range subs {
+		// Drop repeated points, which have no direction.
+		clean := pts[:1:1]
+		for _, p := range pts[1:] {
+			if last := clean[len(clean)-1]; math.Hypot(p.x-last.x, p.y-last.y) > 1e-6 {
+				clean = append(clean, p)
+			}
+		}
+		if closed[i] && len(clean) > 2 {
+			clean = append(clean, clean[0])
+		}
+		if len(clean) == 1 {
+			if lineCap == "round" {
+				dot(clean[0])
+			} else if lineCap == "square" {
+				c := clean[0]
+				r.polygon([]svgPoint{{c.x - hw, c.y + hw}, {c.x + hw, c.y + hw}, {c.x + hw, c.y - hw}, {c.x - hw, c.y - hw}})
+			}
+			continue
+		}
+		last := len(clean) - 2
+		for j := 0; j <= last; j++ {
+			a, b := clean[j], clean[j+1]
+			l := math.Hypot(b.x-a.x, b.y-a.y)
+			dx, dy := (b.x-a.x)/l, (b.y-a.y)/l
+			if !closed[i] && lineCap == "square" {
+				if j == 0 {
+					a = svgPoint{a.x - dx*hw, a.y - dy*hw}
+				}
+				if j == last {
+					b = svgPoint{b.x + dx*hw, b.y + dy*hw}
+				}
+			}
+			nx, ny := -dy*hw, dx*hw
+			r.polygon([]svgPoint{{a.x + nx, a.y + ny}, {b.x + nx, b.y + ny}, {b.x - nx, b.y - ny}, {a.x - nx, a.y - ny}})
+			if j > 0 || closed[i] {
+				dot(a)
+			}
+		}
+		if !closed[i] && lineCap == "round" {
+			dot(clean[0])
+			dot(clean[len(clean)-1])
+		}
+	}
+	r.z.Draw(mask, mask.Bounds(), image.Opaque, image.Point{})
+	return mask
+}
+
+// svgTextRun is a piece of text with its own style and optional position.
+type svgTextRun struct {
+	text       string
+	st         svgState
+	x, y       float64
+	hasX, hasY bool
+	dx, dy     float64
+}
+
+// drawText draws <text> and its <tspan>s with the built-in bitmap font,
+// scaled to font-size. Text is not rotated or skewed with its transform.
+func (r *svgRaster) drawText(n *svgNode, st svgState) {
+	var runs []svgTextRun
+	var collect func(*svgNode, svgState, bool)
+	collect = func(e *svgNode, st svgState, top bool) {
+		run := svgTextRun{st: st}
+		if v := svgNumbers(e.attrs["x"]); len(v) > 0 {
+			run.x, run.hasX = v[0], true
+		}
+		if v := svgNumbers(e.attrs["y"]); len(v) > 0 {
+			run.y, run.hasY = v[0], true
+		}
+		if v := svgNumbers(e.attrs["dx"]); len(v) > 0 {
+			run.dx = v[0]
+		}
+		if v := svgNumbers(e.attrs["dy"]); len(v) > 0 {
+			run.dy = v[0]
+		}
+		first := true
+		for _, c := range e.children {
+			switch {
+			case c.tag == "" && strings.TrimSpace(c.text) != "":
+				if first {
+					run.text = c.text
+					runs = append(runs, run)
+					first = false
+				} else {
+					runs = append(runs, svgTextRun{text: c.text, st: st})
+				}
+			case c.tag == "tspan" && strings.TrimSpace(c.attrs["display"]) != "none":
+				collect(c, r.inherit(st, c), false)
+				first = false
+			}
+		}
+		if first && !top && (run.hasX || run.hasY) {
+			runs = append(runs, run)
+		}
+	}
+	collect(n, st, true)
+
+	face := basicfont.Face7x13
+	advance := func(run svgTextRun) float64 {
+		return float64(len([]rune(run.text))) * float64(face.Advance) * run.st.fontSize / float64(face.Height)
+	}
+	var x, y float64
+	for i := 0; i < len(runs); {
+		// A chunk starts at an absolute position and is anchored as a whole.
+		j := i + 1
+		for j < len(runs) && !runs[j].hasX && !runs[j].hasY {
+			j++
+		}
+		if runs[i].hasX {
+			x = runs[i].x
+		}
+		if runs[i].hasY {
+			y = runs[i].y
+		}
+		total := 0.0
+		for k := i; k < j; k++ {
+			runs[k].text = strings.Join(strings.Fields(runs[k].text), " ")
+			if k > i && strings.TrimSpace(runs[k].text) != "" {
+				runs[k].text = " " + runs[k].text
+			}
+			total += advance(runs[k]) + runs[k].dx
+		}
+		switch runs[i].st.anchor {
+		case "middle":
+			x -= total / 2
+		case "end":
+			x -= total
+		}
+		for k := i; k < j; k++ {
+			x += runs[k].dx
+			y += runs[k].dy
+			r.drawRun(runs[k], x, y)
+			x += advance(runs[k])
+		}
+		i = j
+	}
+}
+
+// drawRun draws one run with its baseline starting at x, y (user units).
+func (r *svgRaster) drawRun(run svgTextRun, x, y float64) {
+	st := run.st
+	if st.fill == nil || run.text == "" {
+		return
+	}
+	face := basicfont.Face7x13
+	src := image.NewAlpha(image.Rect(0, 0, len([]rune(run.text))*face.Advance, face.Height))
+	d := font.Drawer{Dst: src, Src: image.Opaque, Face: face, Dot: fixed.P(0, face.Ascent)}
+	d.DrawString(run.text)
+
+	scale := st.fontSize * st.m.scale() / float64(face.Height)
+	w, h := int(math.Round(float64(src.Rect.Dx())*scale)), int(math.Round(float64(face.Height)*scale))
+	if w <= 0 || h <= 0 {
+		return
+	}
+	origin := st.m.apply(svgPoint{x, y})
+	top := image.Pt(int(math.Round(origin.x)), int(math.Round(origin.y-float64(face.Ascent)*scale)))
+	glyphs := image.NewAlpha(image.Rectangle{Min: top, Max: top.Add(image.Pt(w, h))})
+	draw.ApproxBiLinear.Scale(glyphs, glyphs.Rect, src, src.Rect, draw.Src, nil)
+	c := *st.fill
+	c.A = uint8(math.Round(float64(c.A) * st.fillOpacity * st.opacity))
+	if c.A == 0 {
+		return
+	}
+	draw.DrawMask(r.dst, glyphs.Rect, image.NewUniform(c), image.Point{}, glyphs, glyphs.Rect.Min, draw.Over)
+}
+
+// ---------------------- Inline SVG in pages ----------------------
+
+// svgLabel is the accessible name of an inline <svg>: aria-label, else its
+// <title>.
+func svgLabel(n *html.Node) string {
+	if v := strings.TrimSpace(getAttr(n, "aria-label")); v != "" {
+		return v
+	}
+	if t := findFirstChild(n, "title"); t != nil {
+		return strings.Join(strings.Fields(collectText(t)), " ")
+	}
+	return ""
+}
+
+// inlineSVGImage rasterises an inline <svg> at the size its attributes or
+// the page CSS give and encodes it for the client. Drawings are cached in
+// memory by content, size and text colour.
+func inlineSVGImage(n *html.Node, st *walkState, prefs RenderOptions) ([]byte, int, int, bool) {
+	var ss *Stylesheet
+	fg := color.NRGBA{A: 0xFF}
+	if st != nil {
+		ss = st.css
+		if c, ok := parseSVGColor(effectiveTextColor(n, st)); ok {
+			fg = c
+		}
+	}
+	var w, h float64
+	if props := computeStyleFor(n, ss); props != nil {
+		if px, ok := cssLengthToPx(props["width"], prefs.ScreenW); ok {
+			w = float64(px)
+		}
+		if px, ok := cssLengthToPx(props["height"], 0); ok {
+			h = float64(px)
+		}
+		if (w == 0 && props["width"] != "" && !strings.Contains(props["width"], "auto")) ||
+			(h == 0 && props["height"] != "" && !strings.Contains(props["height"], "auto")) {
+			// Sized to nothing, like icon sprite containers.
+			return nil, 0, 0, false
+		}
+	}
+	root := svgFromHTML(n, ss)
+	key := "svg:" + root.digest() + ";" + strconv.FormatFloat(w, 'f', -1, 64) + "x" + strconv.FormatFloat(h, 'f', -1, 64) +
+		";" + strconv.Itoa(prefs.ScreenW) + ";" + rgbColor{fg.R, fg.G, fg.B}.hex()
+	for _, cand := range cacheCandidatesFor(prefs) {
+		if data, iw, ih, _, ok := imgCacheGet(cand.format, cand.quality, key); ok {
+			return data, iw, ih, true
+		}
+	}
+	img, err := rasterizeSVG(root, w, h, prefs.ScreenW, fg)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	data, iw, ih, format, quality, err := encodeImage(img, prefs)
+	if err != nil {
+		return nil, 0, 0, false
+	}
+	imgCachePut(cacheFormat(format, prefs), quality, key, data, iw, ih, imgMeta{})
+	return data, iw, ih, true
+}
+
+// renderInlineSVG draws an inline <svg> as an image. Its label stands in
+// when images are off; drawings that come out empty are left out.
+func renderInlineSVG(p *Page, st *walkState, n *html.Node, prefs RenderOptions) {
+	label := svgLabel(n)
+	if prefs.ImagesOn {
+		if data, w, h, ok := inlineSVGImage(n, st, prefs); ok {
+			if data, fw, fh, fits := prefs.fitImage(data, w, h, false); fits {
+				p.AddImageInline(fw, fh, data)
+			} else {
+				p.AddImagePlaceholder(w, h)
+			}
+			return
+		}
+	}
+	if label != "" {
+		p.AddText("[" + label + "]")
+	}
+}
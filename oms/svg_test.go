@@ -0,0 +1,278 @@
+package oms
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"image"
+	"image/color"
+	"image/png"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func mustRasterize(t *testing.T, svg string, w, h float64, maxW int) *image.RGBA {
+	t.Helper()
+	root, err := parseSVG([]byte(svg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	img, err := rasterizeSVG(root, w, h, maxW, color.NRGBA{A: 0xFF})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return img
+}
+
+func rgbaAt(img *image.RGBA, x, y int) color.RGBA {
+	return img.RGBAAt(x, y)
+}
+
+func TestParsePathData(t *testing.T) {
+	p := parsePathData("M10 10h20v20H10z m5,5 l1-1 a5 5 0 1010 0 Q 1 2 3 4 T5 6")
+	var ops []byte
+	for _, seg := range p {
+		ops = append(ops, seg.op)
+	}
+	if got := string(ops); !strings.HasPrefix(got, "MLLLZMLC") || !strings.HasSuffix(got, "CC") {
+		t.Fatalf("ops %q", got)
+	}
+	if p[5].p[0] != (svgPoint{15, 15}) || p[6].p[0] != (svgPoint{16, 14}) {
+		t.Fatalf("relative moveto after Z should start from the subpath start: %+v %+v", p[5], p[6])
+	}
+	last := p[len(p)-1].p[2]
+	if last != (svgPoint{5, 6}) {
+		t.Fatalf("path ends at %+v", last)
+	}
+	if bad := parsePathData("M0 0 L10 10 L20 oops L30 30"); len(bad) != 2 {
+		t.Fatalf("drawing should stop at the first error, got %d segments", len(bad))
+	}
+}
+
+func TestRasterizeSVGShapes(t *testing.T) {
+	img := mustRasterize(t, `<svg xmlns="http://www.w3.org/2000/svg" width="100" height="50">
+		<rect width="50" height="50" fill="red"/>
+		<circle cx="75" cy="25" r="20" fill="#00f" fill-opacity="0.5"/>
+		<line x1="0" y1="45" x2="100" y2="45" stroke="lime" stroke-width="4"/>
+		<path d="M60 0 h40 v10 h-40 z M70 2 h20 v6 h-20 z" fill="black" fill-rule="evenodd"/>
+	</svg>`, 0, 0, 0)
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 50 {
+		t.Fatalf("size %v", b)
+	}
+	if c := rgbaAt(img, 10, 10); c != (color.RGBA{0xFF, 0, 0, 0xFF}) {
+		t.Fatalf("rect pixel %v", c)
+	}
+	if c := rgbaAt(img, 75, 25); c.B < 0x70 || c.B > 0x90 || c.A < 0x70 || c.A > 0x90 {
+		t.Fatalf("half transparent circle pixel %v", c)
+	}
+	if c := rgbaAt(img, 53, 5); c.A != 0 {
+		t.Fatalf("outside the circle %v", c)
+	}
+	if c := rgbaAt(img, 10, 45); c.G != 0xFF || c.R != 0 {
+		t.Fatalf("stroke pixel %v", c)
+	}
+	if c := rgbaAt(img, 10, 40); c.R != 0xFF || c.G != 0 {
+		t.Fatalf("stroke should be 4px wide, pixel above it %v", c)
+	}
+	if c := rgbaAt(img, 62, 5); c != (color.RGBA{0, 0, 0, 0xFF}) {
+		t.Fatalf("evenodd outer ring %v", c)
+	}
+	if c := rgbaAt(img, 88, 4); c.A != 0 {
+		t.Fatalf("evenodd hole %v", c)
+	}
+}
+
+func TestRasterizeSVGViewBoxAndStyles(t *testing.T) {
+	// A 24-unit icon shown at 480px, scaled down to a 240px screen.
+	img := mustRasterize(t, `<svg viewBox="0 0 24 12" width="480">
+		<style>.a { fill: #0f0 } #b { fill: blue }</style>
+		<g transform="translate(12 0)"><rect class="a" width="12" height="12"/></g>
+		<rect id="b" class="a" width="6" height="12"/>
+		<rect width="6" height="12" x="6" style="fill:yellow;stroke:none"/>
+	</svg>`, 0, 0, 240)
+	if b := img.Bounds(); b.Dx() != 240 || b.Dy() != 120 {
+		t.Fatalf("size %v", b)
+	}
+	if c := rgbaAt(img, 200, 60); c != (color.RGBA{0, 0xFF, 0, 0xFF}) {
+		t.Fatalf("translated group %v", c)
+	}
+	if c := rgbaAt(img, 30, 60); c != (color.RGBA{0, 0, 0xFF, 0xFF}) {
+		t.Fatalf("id rule should beat class rule, got %v", c)
+	}
+	if c := rgbaAt(img, 90, 60); c != (color.RGBA{0xFF, 0xFF, 0, 0xFF}) {
+		t.Fatalf("style attribute %v", c)
+	}
+
+	// preserveAspectRatio centres a square drawing in a wide viewport.
+	img = mustRasterize(t, `<svg viewBox="0 0 10 10"><rect width="10" height="10" fill="red"/></svg>`, 100, 50, 0)
+	if c := rgbaAt(img, 10, 25); c.A != 0 {
+		t.Fatalf("letterbox %v", c)
+	}
+	if c := rgbaAt(img, 50, 25); c.R != 0xFF {
+		t.Fatalf("centre %v", c)
+	}
+}
+
+func TestRasterizeSVGUseAndText(t *testing.T) {
+	img := mustRasterize(t, `<svg xmlns:xlink="http://www.w3.org/1999/xlink" width="100" height="40">
+		<defs><symbol id="sq" viewBox="0 0 1 1"><rect width="1" height="1"/></symbol>
+		<linearGradient id="g"><stop offset="0" stop-color="#f00"/><stop offset="1" stop-color="#00f"/></linearGradient></defs>
+		<use xlink:href="#sq" x="80" y="0" width="20" height="20" fill="url(#g)"/>
+		<text x="0" y="30" font-size="26" fill="black">Hi</text>
+	</svg>`, 0, 0, 0)
+	if c := rgbaAt(img, 90, 10); c.R < 0x70 || c.B < 0x70 || c.G != 0 || c.A != 0xFF {
+		t.Fatalf("symbol drawn with the gradient's average colour, got %v", c)
+	}
+	if c := rgbaAt(img, 90, 30); c.A != 0 {
+		t.Fatalf("symbol should be 20px, got %v below it", c)
+	}
+	ink := 0
+	for y := 0; y < 40; y++ {
+		for x := 0; x < 40; x++ {
+			if rgbaAt(img, x, y).A > 0x80 {
+				ink++
+			}
+		}
+	}
+	if ink < 40 {
+		t.Fatalf("text drew only %d pixels", ink)
+	}
+}
+
+func TestRasterizeSVGUseLimits(t *testing.T) {
+	// A <use> of its own ancestor is refused instead of repeating the group.
+	img := mustRasterize(t, `<svg width="100" height="10">
+		<g id="row"><rect width="10" height="10"/><use href="#row" x="20"/></g>
+	</svg>`, 0, 0, 0)
+	if c := rgbaAt(img, 5, 5); c.A != 0xFF {
+		t.Fatalf("group not drawn: %v", c)
+	}
+	if c := rgbaAt(img, 25, 5); c.A != 0 {
+		t.Fatalf("self-referencing use was drawn: %v", c)
+	}
+
+	// Ten uses of ten uses of ... would be 10^7 shapes.
+	var doc strings.Builder
+	doc.WriteString(`<svg width="100" height="100"><defs><rect id="l0" width="1" height="1"/>`)
+	for level := 1; level <= 7; level++ {
+		fmt.Fprintf(&doc, `<g id="l%d">`, level)
+		for i := 0; i < 10; i++ {
+			fmt.Fprintf(&doc, `<use href="#l%d" x="%d"/>`, level-1, i)
+		}
+		doc.WriteString(`</g>`)
+	}
+	doc.WriteString(`</defs><use href="#l7"/></svg>`)
+	start := time.Now()
+	mustRasterize(t, doc.String(), 0, 0, 0)
+	if d := time.Since(start); d > 5*time.Second {
+		t.Fatalf("fan-out took %v", d)
+	}
+}
+
+func TestRasterizeSVGEmpty(t *testing.T) {
+	for _, svg := range []string{
+		`<svg width="0" height="0"><rect width="10" height="10"/></svg>`,
+		`<svg width="10" height="10"><rect width="10" height="10" fill="none"/></svg>`,
+		`<svg width="10" height="10"><defs><rect id="r" width="10" height="10"/></defs></svg>`,
+	} {
+		root, err := parseSVG([]byte(svg))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := rasterizeSVG(root, 0, 0, 0, color.NRGBA{A: 0xFF}); err != errSVGEmpty {
+			t.Errorf("%s: err %v, want errSVGEmpty", svg, err)
+		}
+	}
+	if _, err := parseSVG([]byte(`<html><body></body></html>`)); err != errNotSVG {
+		t.Fatalf("non-SVG document: err %v", err)
+	}
+}
+
+func TestRenderExternalSVGImage(t *testing.T) {
+	useTempDiskCache(t)
+	icon := `<?xml version="1.0"?><svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 200 100"><rect width="200" height="100" fill="#c00"/></svg>`
+	var zipped bytes.Buffer
+	zw := gzip.NewWriter(&zipped)
+	_, _ = zw.Write([]byte(icon))
+	_ = zw.Close()
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasSuffix(r.URL.Path, ".svgz") {
+			_, _ = w.Write(zipped.Bytes())
+			return
+		}
+		w.Header().Set("Content-Type", "image/svg+xml")
+		_, _ = w.Write([]byte(icon))
+	}))
+	defer origin.Close()
+
+	opts := defaultRenderPrefs()
+	opts.ScreenW = 120
+	opts.ImageMIME = "image/png"
+	res := renderFixture(t, obmlFixture{
+		name: "svg-external",
+		url:  origin.URL + "/",
+		html: `<p>logo</p><img src="/logo.svg" alt="Logo"><img src="/logo.svgz" alt="Zipped">`,
+		opts: &opts,
+	})
+	toks := res.tokensByTag('I')
+	if len(toks) != 2 {
+		t.Fatalf("expected both SVGs inline, got %d images", len(toks))
+	}
+	for _, tok := range toks {
+		img, err := png.Decode(bytes.NewReader(tok.extra))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b := img.Bounds(); b.Dx() != 120 || b.Dy() != 60 {
+			t.Fatalf("SVG should be drawn to the screen width, got %v", b)
+		}
+		if r, g, _, _ := img.At(60, 30).RGBA(); r>>8 != 0xCC || g != 0 {
+			t.Fatalf("unexpected colour %d,%d", r>>8, g>>8)
+		}
+	}
+}
+
+func TestRenderInlineSVG(t *testing.T) {
+	html := `<style>.icon { width: 32px; height: 32px; color: #0a0 }</style>
+		<svg style="display:none"><symbol id="star" viewBox="0 0 10 10"><path d="M0 0h10v10H0z" fill="currentColor"/></symbol></svg>
+		<p>Rated <svg class="icon" aria-label="Star"><use href="#star"/></svg> five</p>
+		<svg width="20" height="20"><title>Dot</title><circle cx="10" cy="10" r="8" fill="navy"/></svg>`
+	opts := defaultRenderPrefs()
+	opts.ImageMIME = "image/png"
+	res := renderFixture(t, obmlFixture{name: "svg-inline", html: html, opts: &opts})
+	toks := res.tokensByTag('I')
+	if len(toks) != 2 {
+		t.Fatalf("expected 2 inline SVG images, got %d", len(toks))
+	}
+	img, err := png.Decode(bytes.NewReader(toks[0].extra))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b := img.Bounds(); b.Dx() != 32 || b.Dy() != 32 {
+		t.Fatalf("icon should take its CSS size, got %v", b)
+	}
+	if r, g, b, _ := img.At(16, 16).RGBA(); r != 0 || g>>8 != 0xAA || b != 0 {
+		t.Fatalf("currentColor should follow CSS color, got %d,%d,%d", r>>8, g>>8, b>>8)
+	}
+	res.mustContainText(t, "Rated")
+
+	opts.ImagesOn = false
+	res = renderFixture(t, obmlFixture{name: "svg-inline-off", html: html, opts: &opts})
+	if n := res.countTag('I'); n != 0 {
+		t.Fatalf("images off: got %d images", n)
+	}
+	res.mustContainText(t, "[Star]")
+	res.mustContainText(t, "[Dot]")
+}
+
+func TestParseSVGTransform(t *testing.T) {
+	m := parseSVGTransform("translate(10,20) rotate(90) scale(2)")
+	p := m.apply(svgPoint{1, 0})
+	if math.Abs(p.x-10) > 1e-9 || math.Abs(p.y-22) > 1e-9 {
+		t.Fatalf("got %+v", p)
+	}
+}
@@ -0,0 +1,551 @@
+package oms
+
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/net/html"
+)
+
+const (
+	// tableCharPx approximates one character of the client's default font when
+	// estimating column widths.
+	tableCharPx = 6
+	// tableSepPx is the width of the " | " separator between columns.
+	tableSepPx = 3 * tableCharPx
+	// tableImgPx is assumed for images that do not declare a width.
+	tableImgPx = 16
+	// tableInputPx is assumed for text fields, selects and text areas.
+	tableInputPx = 80
+	// tableMaxCols bounds the grid so broken colspan values cannot blow it up.
+	tableMaxCols = 64
+	// defaultTableScreenW matches the width assumed for media queries.
+	defaultTableScreenW = 240
+)
+
+// tableCell is a td/th placed on the table grid. Every slot it spans points
+// back to the same cell; row and col are its top-left slot.
+type tableCell struct {
+	node    *html.Node
+	header  bool
+	row     int
+	col     int
+	rowspan int
+	colspan int
+}
+
+// tableGrid is the slot matrix of a table after colspan/rowspan expansion.
+type tableGrid struct {
+	slots    [][]*tableCell
+	rows     []*html.Node // the tr of each grid row
+	cols     int
+	headRows int // leading rows made of header cells (thead or all-th rows)
+}
+
+func (g *tableGrid) at(r, c int) *tableCell {
+	if r < len(g.slots) && c < len(g.slots[r]) {
+		return g.slots[r][c]
+	}
+	return nil
+}
+
+func (g *tableGrid) set(r, c int, cell *tableCell) {
+	for len(g.slots) <= r {
+		g.slots = append(g.slots, nil)
+	}
+	for len(g.slots[r]) <= c {
+		g.slots[r] = append(g.slots[r], nil)
+	}
+	g.slots[r][c] = cell
+	if c+1 > g.cols {
+		g.cols = c + 1
+	}
+}
+
+// origin returns the cell whose top-left slot is (r, c), if any.
+func (g *tableGrid) origin(r, c int) *tableCell {
+	if cell := g.at(r, c); cell != nil && cell.row == r && cell.col == c {
+		return cell
+	}
+	return nil
+}
+
+// buildTableGrid places the visible rows and cells of table on a grid,
+// honouring colspan and rowspan the way browsers do.
+func buildTableGrid(table *html.Node, st *walkState) *tableGrid {
+	var rows []*html.Node
+	var inHead []bool
+	for sec := table.FirstChild; sec != nil; sec = sec.NextSibling {
+		if sec.Type != html.ElementNode || tableNodeHidden(sec, st) {
+			continue
+		}
+		switch strings.ToLower(sec.Data) {
+		case "tr":
+			rows = append(rows, sec)
+			inHead = append(inHead, false)
+		case "thead", "tbody", "tfoot":
+			for tr := sec.FirstChild; tr != nil; tr = tr.NextSibling {
+				if tr.Type == html.ElementNode && strings.EqualFold(tr.Data, "tr") && !tableNodeHidden(tr, st) {
+					rows = append(rows, tr)
+					inHead = append(inHead, strings.EqualFold(sec.Data, "thead"))
+				}
+			}
+		}
+	}
+
+	g := &tableGrid{rows: rows}
+	for r, tr := range rows {
+		col := 0
+		for td := tr.FirstChild; td != nil; td = td.NextSibling {
+			if td.Type != html.ElementNode || tableNodeHidden(td, st) {
+				continue
+			}
+			tag := strings.ToLower(td.Data)
+			if tag != "td" && tag != "th" {
+				continue
+			}
+			for col < tableMaxCols && g.at(r, col) != nil {
+				col++
+			}
+			if col >= tableMaxCols {
+				break
+			}
+			colspan := min(spanAttr(td, "colspan", 1), tableMaxCols-col)
+			rowspan := spanAttr(td, "rowspan", 1)
+			if rowspan == 0 || rowspan > len(rows)-r {
+				// rowspan="0" extends to the end of the table
+				rowspan = len(rows) - r
+			}
+			cell := &tableCell{node: td, header: tag == "th", row: r, col: col, rowspan: rowspan, colspan: colspan}
+			for dr := 0; dr < rowspan; dr++ {
+				for dc := 0; dc < colspan; dc++ {
+					g.set(r+dr, col+dc, cell)
+				}
+			}
+			col += colspan
+		}
+		if len(g.slots) <= r {
+			g.slots = append(g.slots, nil)
+		}
+	}
+
+	for r := range g.slots {
+		if !inHead[r] && !g.headerRow(r) {
+			break
+		}
+		g.headRows++
+	}
+	if g.headRows == len(g.slots) {
+		// a table made only of th cells has no separate header
+		g.headRows = 0
+	}
+	return g
+}
+
+func spanAttr(n *html.Node, name string, def int) int {
+	v, err := strconv.Atoi(strings.TrimSpace(getAttr(n, name)))
+	if err != nil || v < 0 {
+		return def
+	}
+	if v == 0 && name == "colspan" {
+		return 1
+	}
+	return v
+}
+
+func tableNodeHidden(n *html.Node, st *walkState) bool {
+	if isDisplayNone(getAttr(n, "style")) {
+		return true
+	}
+	if st != nil && st.css != nil {
+		if props := computeStyleFor(n, st.css); props != nil && strings.Contains(strings.ToLower(props["display"]), "none") {
+			return true
+		}
+	}
+	return false
+}
+
+// headerRow reports whether every cell starting in row r is a th.
+func (g *tableGrid) headerRow(r int) bool {
+	seen := false
+	for c := 0; c < g.cols; c++ {
+		if cell := g.origin(r, c); cell != nil {
+			if !cell.header {
+				return false
+			}
+			seen = true
+		}
+	}
+	return seen
+}
+
+// spanningCell returns the only cell of row r when it covers every column,
+// which tables use for section headings.
+func (g *tableGrid) spanningCell(r int) *tableCell {
+	if g.cols < 2 {
+		return nil
+	}
+	cell := g.origin(r, 0)
+	if cell == nil || cell.colspan < g.cols {
+		return nil
+	}
+	return cell
+}
+
+// rowEmpty reports whether no cell starting in row r has visible content.
+func (g *tableGrid) rowEmpty(r int) bool {
+	for c := 0; c < g.cols; c++ {
+		if cell := g.origin(r, c); cell != nil && !cellEmpty(cell.node) {
+			return false
+		}
+	}
+	return true
+}
+
+// columnLabels joins the header rows above each column, e.g. "Score / Home".
+func (g *tableGrid) columnLabels() []string {
+	labels := make([]string, g.cols)
+	for c := range labels {
+		var parts []string
+		var last *tableCell
+		for r := 0; r < g.headRows; r++ {
+			cell := g.at(r, c)
+			if cell == nil || cell == last {
+				continue
+			}
+			last = cell
+			if txt := cellText(cell.node); txt != "" {
+				parts = append(parts, txt)
+			}
+		}
+		labels[c] = strings.Join(parts, " / ")
+	}
+	return labels
+}
+
+// columnar reports whether the table fits screenW laid out as rows of
+// "cell | cell" lines. Column widths come from the widest single-column cell,
+// either its estimated content width or its declared width.
+func (g *tableGrid) columnar(screenW int) bool {
+	if g.cols <= 1 {
+		return true
+	}
+	widths := make([]int, g.cols)
+	for r := range g.slots {
+		for c := 0; c < g.cols; c++ {
+			if cell := g.origin(r, c); cell != nil && cell.colspan == 1 {
+				widths[c] = max(widths[c], cellWidthPx(cell.node, screenW))
+			}
+		}
+	}
+	total := (g.cols - 1) * tableSepPx
+	for _, w := range widths {
+		total += w
+	}
+	return total <= screenW
+}
+
+func cellWidthPx(n *html.Node, screenW int) int {
+	w := utf8.RuneCountInString(cellText(n)) * tableCharPx
+	var imgs func(*html.Node)
+	imgs = func(x *html.Node) {
+		for c := x.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "img":
+				iw := cssValueToPx(getAttr(c, "width"), screenW)
+				if iw == 0 {
+					iw = tableImgPx
+				}
+				w += min(iw, screenW)
+			case "input":
+				switch strings.ToLower(getAttr(c, "type")) {
+				case "hidden":
+				case "checkbox", "radio":
+					w += tableCharPx * 2
+				case "submit", "reset", "button":
+					w += (utf8.RuneCountInString(getAttr(c, "value")) + 2) * tableCharPx
+				default:
+					w += min(tableInputPx, screenW)
+				}
+			case "select", "textarea":
+				w += min(tableInputPx, screenW)
+			}
+			imgs(c)
+		}
+	}
+	imgs(n)
+	declared := getAttr(n, "width")
+	if v := parseCssValue(getAttr(n, "style"), "width"); v != "" {
+		declared = v
+	}
+	return max(w, cssValueToPx(declared, screenW))
+}
+
+// hasNestedTable reports whether a table contains another table, which marks
+// it as a layout table rather than tabular data.
+func hasNestedTable(table *html.Node) bool {
+	for c := table.FirstChild; c != nil; c = c.NextSibling {
+		if findFirstByTag(c, "table") != nil {
+			return true
+		}
+	}
+	return false
+}
+
+func cellText(n *html.Node) string {
+	return strings.Join(strings.Fields(collectText(n)), " ")
+}
+
+func cellEmpty(n *html.Node) bool {
+	return cellText(n) == "" && findFirstByTag(n, "img") == nil && !hasFormControls(n)
+}
+
+// hasElementChildren reports whether n has element children; cells without
+// any can be written as plain text and merged with their neighbours.
+func hasElementChildren(n *html.Node) bool {
+	for c := n.FirstChild; c != nil; c = c.NextSibling {
+		if c.Type == html.ElementNode {
+			return true
+		}
+	}
+	return false
+}
+
+// tableForms opens the forms the parser leaves empty between table rows as
+// the rows after them are written. Such forms own their inputs only through
+// source order, so each stays open until the next one starts.
+type tableForms struct {
+	byRow [][]*html.Node // forms that precede each grid row; the last entry trails the table
+	next  int
+	open  bool
+}
+
+func newTableForms(table *html.Node, g *tableGrid) *tableForms {
+	f := &tableForms{byRow: make([][]*html.Node, len(g.rows)+1)}
+	index := make(map[*html.Node]int, len(g.rows))
+	for i, tr := range g.rows {
+		index[tr] = i
+	}
+	var pending []*html.Node
+	var rec func(*html.Node, int)
+	rec = func(n *html.Node, depth int) {
+		for c := n.FirstChild; c != nil; c = c.NextSibling {
+			if c.Type != html.ElementNode {
+				continue
+			}
+			switch strings.ToLower(c.Data) {
+			case "form":
+				pending = append(pending, c)
+			case "thead", "tbody", "tfoot":
+				if depth < 2 {
+					rec(c, depth+1)
+				}
+			case "tr":
+				if depth < 2 {
+					rec(c, depth+1)
+				}
+				if i, ok := index[c]; ok {
+					f.byRow[i] = append(f.byRow[i], pending...)
+					pending = nil
+				}
+			}
+		}
+	}
+	rec(table, 0)
+	f.byRow[len(g.rows)] = pending
+	return f
+}
+
+// upTo opens the forms that precede row and every row before it.
+func (f *tableForms) upTo(row int, base string, p *Page, visited map[*html.Node]bool, st *walkState) {
+	for ; f.next <= row && f.next < len(f.byRow); f.next++ {
+		for _, form := range f.byRow[f.next] {
+			f.close(st)
+			visited[form] = true
+			st.openForm(form, base, p)
+			f.open = true
+		}
+	}
+}
+
+// close ends the stray form left open by upTo, if any.
+func (f *tableForms) close(st *walkState) {
+	if f.open {
+		st.closeForm()
+		f.open = false
+	}
+}
+
+// tableRenderer writes a table grid into the page. Plain-text cells are
+// buffered so a row of them becomes a single text tag.
+type tableRenderer struct {
+	base    string
+	p       *Page
+	visited map[*html.Node]bool
+	st      *walkState
+	prefs   RenderOptions
+	forms   *tableForms
+	pending strings.Builder
+}
+
+func (r *tableRenderer) text(s string) { r.pending.WriteString(s) }
+
+func (r *tableRenderer) flush() {
+	if r.pending.Len() > 0 {
+		r.p.AddText(r.pending.String())
+		r.pending.Reset()
+	}
+}
+
+// row opens any stray forms that start before grid row n.
+func (r *tableRenderer) row(n int) {
+	r.flush()
+	r.forms.upTo(n, r.base, r.p, r.visited, r.st)
+}
+
+func (r *tableRenderer) line() {
+	r.flush()
+	r.p.AddBreak()
+}
+
+func (r *tableRenderer) bold(fn func()) {
+	r.flush()
+	r.st.pushStyle(r.p, r.st.curStyle|styleBoldBit)
+	fn()
+	r.flush()
+	r.st.popStyle(r.p)
+}
+
+// cell writes the content of a table cell, keeping links, images, colours and
+// inline formatting for anything that is not plain text.
+func (r *tableRenderer) cell(n *html.Node) {
+	if !hasElementChildren(n) {
+		r.text(cellText(n))
+		markTextNodes(n, r.visited)
+		return
+	}
+	r.flush()
+	if n.FirstChild != nil {
+		walkRich(n.FirstChild, r.base, r.p, r.visited, r.st, r.prefs)
+	}
+}
+
+// renderTable lays out a data table. Tables that fit the screen keep their
+// columns ("cell | cell" per row); wider ones are linearised into one card
+// per row with "header: value" lines.
+func renderTable(table *html.Node, g *tableGrid, base string, p *Page, visited map[*html.Node]bool, st *walkState, prefs RenderOptions) {
+	if cap := findFirstChild(table, "caption"); cap != nil {
+		if txt := strings.TrimSpace(collectText(cap)); txt != "" {
+			markTextNodes(cap, visited)
+			p.AddPlus()
+			p.AddText(txt)
+			p.AddBreak()
+		}
+	}
+	if g.cols == 0 {
+		return
+	}
+	screenW := prefs.ScreenW
+	if screenW <= 0 {
+		screenW = defaultTableScreenW
+	}
+	r := &tableRenderer{base: base, p: p, visited: visited, st: st, prefs: prefs, forms: newTableForms(table, g)}
+	prevCell := st.inTableCell
+	st.inTableCell = true
+	if g.columnar(screenW) {
+		r.columns(g)
+	} else {
+		r.cards(g)
+	}
+	r.row(len(g.slots))
+	r.forms.close(st)
+	st.inTableCell = prevCell
+}
+
+func (r *tableRenderer) columns(g *tableGrid) {
+	for row := range g.slots {
+		r.row(row)
+		if g.rowEmpty(row) {
+			continue
+		}
+		if span := g.spanningCell(row); span != nil {
+			r.bold(func() { r.cell(span.node) })
+			r.line()
+			continue
+		}
+		last := -1
+		for c := 0; c < g.cols; c++ {
+			if cell := g.origin(row, c); cell != nil && !cellEmpty(cell.node) {
+				last = c
+			}
+		}
+		write := func() {
+			for c := 0; c <= last; c++ {
+				cell := g.at(row, c)
+				if cell != nil && cell.col != c {
+					continue // covered by a colspan
+				}
+				if c > 0 {
+					r.text(" | ")
+				}
+				if cell == nil || cell.row != row {
+					continue // empty slot or covered by a rowspan
+				}
+				if cell.header && row >= g.headRows {
+					r.bold(func() { r.cell(cell.node) })
+				} else {
+					r.cell(cell.node)
+				}
+			}
+		}
+		if row < g.headRows {
+			r.bold(write)
+		} else {
+			write()
+		}
+		r.line()
+	}
+}
+
+func (r *tableRenderer) cards(g *tableGrid) {
+	labels := g.columnLabels()
+	for row := g.headRows; row < len(g.slots); row++ {
+		r.row(row)
+		if g.rowEmpty(row) {
+			continue
+		}
+		if span := g.spanningCell(row); span != nil {
+			r.p.AddPlus()
+			r.bold(func() { r.cell(span.node) })
+			r.line()
+			continue
+		}
+		var title *tableCell
+		if cell := g.origin(row, 0); cell != nil && cell.header {
+			title = cell
+			r.bold(func() { r.cell(cell.node) })
+			r.line()
+		}
+		for c := 0; c < g.cols; c++ {
+			cell := g.at(row, c)
+			if cell == nil || cell.col != c || cell == title || cellEmpty(cell.node) {
+				continue
+			}
+			if label := labels[c]; label != "" {
+				r.bold(func() { r.text(label + ": ") })
+			}
+			if cell.row != row {
+				// repeat rowspan values so every card stands on its own
+				r.text(cellText(cell.node))
+			} else {
+				r.cell(cell.node)
+			}
+			r.line()
+		}
+		r.p.AddParagraph()
+	}
+}
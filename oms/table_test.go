@@ -2,6 +2,7 @@ package oms
 
 import (
 	"bytes"
+	"fmt"
 	"strings"
 	"testing"
 
@@ -24,3 +25,178 @@ func TestTableWithAnchorsKeepsLinks(t *testing.T) {
 		t.Fatalf("table anchors should stay clickable, data=%q", page.Data)
 	}
 }
+
+func TestTableLayoutColumnsKeepRichCells(t *testing.T) {
+	res := renderFixture(t, obmlFixture{
+		name: "table_columns",
+		html: `<table><tr><th>Day</th><th>Time</th><th>Event</th></tr><tr><td colspan="3">Week 1</td></tr><tr><td rowspan="2">Mon</td><td>10:00</td><td><a href="/e1">Opening</a> <b>live</b></td></tr><tr><td>12:00</td><td>Lunch</td></tr></table>`,
+		opts: &RenderOptions{ScreenW: 176},
+	})
+	res.mustContainText(t, "Day | Time | Event")
+	res.mustContainText(t, "Mon | 10:00 | ")
+	res.mustContainText(t, " | 12:00 | Lunch")
+	res.mustHaveLink(t, "0/http://fixture.test/e1")
+	var seq []string
+	for _, tok := range res.tokens {
+		switch tok.tag {
+		case 'T', 'L':
+			seq = append(seq, tok.strings...)
+		case 'B':
+			seq = append(seq, "<br>")
+		}
+	}
+	got := strings.Join(seq, "")
+	want := "Day | Time | Event<br>Week 1<br>Mon | 10:00 | 0/http://fixture.test/e1Openinglive<br> | 12:00 | Lunch<br>"
+	if got != want {
+		t.Fatalf("unexpected row layout:\n got %q\nwant %q", got, want)
+	}
+}
+
+func TestTableLayoutWideTableBecomesCards(t *testing.T) {
+	const src = `<table><thead><tr><th>Team</th><th>Played</th><th>Won</th><th>Drawn</th><th>Lost</th><th>Points</th></tr></thead>` +
+		`<tbody><tr><th>Barcelona</th><td>10</td><td>8</td><td>1</td><td>1</td><td><a href="/p">25</a></td></tr>` +
+		`<tr><th>Girona</th><td>10</td><td>7</td><td>2</td><td>1</td><td>23</td></tr></tbody></table>`
+	wide := renderFixture(t, obmlFixture{name: "table_wide", html: src, opts: &RenderOptions{ScreenW: 480}})
+	wide.mustContainText(t, "Team | Played | Won | Drawn | Lost | Points")
+
+	res := renderFixture(t, obmlFixture{name: "table_cards", html: src, opts: &RenderOptions{ScreenW: 176}})
+	res.mustNotContainText(t, " | ")
+	res.mustContainText(t, "Barcelona")
+	res.mustContainText(t, "Played: ")
+	res.mustContainText(t, "Points: ")
+	res.mustHaveLink(t, "0/http://fixture.test/p")
+	if n := res.countTag('V'); n < 2 {
+		t.Fatalf("expected one card per row, got %d paragraph breaks", n)
+	}
+}
+
+func TestLayoutTableLinearisedMainContentFirst(t *testing.T) {
+	var nav strings.Builder
+	for i := 0; i < 12; i++ {
+		fmt.Fprintf(&nav, `<a href="/section/%d">Section %d</a><br>`, i, i)
+	}
+	article := strings.Repeat("The council approved the new timetable for the winter season. ", 6)
+	src := `<table width="100%" cellspacing="0"><tr><td colspan="2">Daily Courier</td></tr>` +
+		`<tr><td width="150">` + nav.String() + `</td><td><h2>Main story</h2><p>` + article + `</p></td></tr></table>`
+
+	order := func(res *fixtureResult) (story, section int) {
+		story, section = -1, -1
+		for i, tok := range res.tokens {
+			for _, s := range tok.strings {
+				if story < 0 && strings.Contains(s, "Main story") {
+					story = i
+				}
+				if section < 0 && strings.Contains(s, "Section 0") {
+					section = i
+				}
+			}
+		}
+		return story, section
+	}
+
+	res := renderFixture(t, obmlFixture{name: "layout_table", html: src})
+	res.mustNotContainText(t, " | ")
+	res.mustHaveLink(t, "0/http://fixture.test/section/11")
+	if story, section := order(res); story < 0 || section < 0 || story > section {
+		t.Fatalf("expected main story before navigation, got story=%d section=%d", story, section)
+	}
+
+	kept := renderFixture(t, obmlFixture{name: "layout_table_source", html: src, opts: &RenderOptions{KeepLayoutTables: true}})
+	if story, section := order(kept); story < 0 || section < 0 || story < section {
+		t.Fatalf("expected source order with KeepLayoutTables, got story=%d section=%d", story, section)
+	}
+}
+
+func TestKeptLayoutTableIsNotLaidOutAsData(t *testing.T) {
+	src := `<table role="presentation"><tr><td>Headlines</td><td>Weather today</td></tr></table>`
+	res := renderFixture(t, obmlFixture{name: "layout_table_kept", html: src, opts: &RenderOptions{KeepLayoutTables: true}})
+	res.mustContainText(t, "Headlines")
+	res.mustContainText(t, "Weather today")
+	res.mustNotContainText(t, " | ")
+}
+
+func TestLayoutTableScoreSeparatesDataTables(t *testing.T) {
+	cases := []struct {
+		name   string
+		src    string
+		layout bool
+	}{
+		{"headers", `<table><tr><th>Name</th><th>Price</th></tr><tr><td>Tea</td><td>2</td></tr></table>`, false},
+		{"bordered_grid", `<table border="1"><tr><td>06.10</td><td><a href="/a">Release</a></td></tr><tr><td>07.10</td><td><a href="/b">Patch</a></td></tr></table>`, false},
+		{"presentation", `<table role="presentation"><tr><td>a</td><td>b</td></tr></table>`, true},
+		{"single_wrapper", `<table width="100%"><tr><td><div>Everything</div></td></tr></table>`, true},
+		{"nested", `<table><tr><td><table><tr><td>x</td></tr></table></td><td>y</td></tr></table>`, true},
+	}
+	for _, tc := range cases {
+		doc, err := html.Parse(strings.NewReader(tc.src))
+		if err != nil {
+			t.Fatalf("%s: parse: %v", tc.name, err)
+		}
+		table := findFirstByTag(doc, "table")
+		g := buildTableGrid(table, nil)
+		if got := isLayoutTable(table, g); got != tc.layout {
+			t.Errorf("%s: isLayoutTable = %v (score %d), want %v", tc.name, got, layoutTableScore(table, g), tc.layout)
+		}
+	}
+}
+
+func TestTableLayoutKeepsFormControls(t *testing.T) {
+	layout := func(res *fixtureResult) string {
+		var seq []string
+		for _, tok := range res.tokens {
+			switch tok.tag {
+			case 'T':
+				seq = append(seq, tok.strings...)
+			case 'B':
+				seq = append(seq, "<br>")
+			case 'h', 'x', 'p', 'u':
+				seq = append(seq, fmt.Sprintf("<%c:%s>", tok.tag, tok.strings[0]))
+			}
+		}
+		return strings.Join(seq, "")
+	}
+	fieldNames := func(spec *FormSpec) []string {
+		var names []string
+		for _, f := range spec.Fields {
+			names = append(names, f.Name)
+		}
+		return names
+	}
+
+	login := renderFixture(t, obmlFixture{
+		name: "table_form",
+		html: `<form action="/login"><table><tr><th>User</th><td><input name="u"></td></tr>` +
+			`<tr><th>Password</th><td><input type="password" name="p"></td></tr>` +
+			`<tr><td colspan="2"><input type="submit" name="go" value="Log in"></td></tr></table></form>`,
+	})
+	if got, want := layout(login), "<h:/login>User | <x:u><br>Password | <p:p><br><u:go><br>"; got != want {
+		t.Fatalf("unexpected form table layout:\n got %q\nwant %q", got, want)
+	}
+	if len(login.page.Forms) != 1 {
+		t.Fatalf("expected one form, got %d", len(login.page.Forms))
+	}
+	if got := strings.Join(fieldNames(login.page.Forms[0]), ","); got != "u,p,go" {
+		t.Fatalf("login fields %q", got)
+	}
+
+	// Forms between rows are left empty by the parser and own the inputs of
+	// the rows after them.
+	cart := renderFixture(t, obmlFixture{
+		name: "table_stray_forms",
+		html: `<table><tr><th>Item</th><th>Qty</th></tr>` +
+			`<form action="/cart/1"><tr><td>Tea</td><td><input name="q1" value="1"><input type="submit" name="buy" value="Buy"></td></tr></form>` +
+			`<form action="/cart/2"><tr><td>Cake</td><td><input name="q2" value="2"></td></tr></form></table>`,
+	})
+	if got, want := layout(cart), "Item | Qty<br><h:/cart/1>Tea | <x:q1><u:buy><br><h:/cart/2>Cake | <x:q2><br>"; got != want {
+		t.Fatalf("unexpected stray form layout:\n got %q\nwant %q", got, want)
+	}
+	if len(cart.page.Forms) != 2 {
+		t.Fatalf("expected two forms, got %d", len(cart.page.Forms))
+	}
+	for i, want := range []string{"q1,buy", "q2"} {
+		spec := cart.page.Forms[i]
+		if got := strings.Join(fieldNames(spec), ","); got != want || !strings.HasSuffix(spec.Action, fmt.Sprintf("/cart/%d", i+1)) {
+			t.Errorf("form %d: action %q fields %q, want %q", i, spec.Action, got, want)
+		}
+	}
+}